@@ -1,15 +1,30 @@
 package main
 
 import (
+	"bufio"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 
 	"github.com/crusttech/permit/internal/api"
+	"github.com/crusttech/permit/internal/audit"
+	"github.com/crusttech/permit/internal/backup"
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/internal/env"
+	"github.com/crusttech/permit/internal/envelope"
+	"github.com/crusttech/permit/internal/guard"
+	"github.com/crusttech/permit/internal/metrics"
+	"github.com/crusttech/permit/internal/migrate"
 	"github.com/crusttech/permit/internal/rand"
+	"github.com/crusttech/permit/internal/store"
+	"github.com/crusttech/permit/internal/store/dsn"
+	"github.com/crusttech/permit/internal/sweep"
+	"github.com/crusttech/permit/internal/users"
 	"github.com/crusttech/permit/pkg/permit"
 )
 
@@ -19,13 +34,40 @@ type (
 	}
 
 	keeper interface {
-		List(query string) ([]*permit.Permit, error)
+		List(q store.Query) ([]*permit.Permit, string, error)
 		Get(key string) (*permit.Permit, error)
-		Create(permit.Permit) error
-		Revoke(key string) error
-		Enable(key string) error
-		Extend(key string, time *time.Time) error
-		Delete(key string) error
+		FindByDomain(domain string) ([]*permit.Permit, error)
+		Create(ctx context.Context, p permit.Permit) error
+		Update(ctx context.Context, key string, p store.Patch) error
+		Revoke(ctx context.Context, key string) error
+		Enable(ctx context.Context, key string) error
+		Extend(ctx context.Context, key string, time *time.Time) error
+		Delete(ctx context.Context, key string) error
+		History(key string) ([]store.Revision, error)
+		Rollback(ctx context.Context, key string, number int) error
+		Trash() ([]store.Trashed, error)
+		Restore(ctx context.Context, key string) error
+		Purge(ctx context.Context, before time.Time) ([]string, error)
+		Snapshot(fn func() error) error
+		Import(ctx context.Context, r store.Record) error
+		Reencrypt(keyID string) (int, error)
+		Check(ctx context.Context, opt store.CheckOptions) ([]store.Problem, error)
+		Events(since uint64, limit int) ([]store.Event, uint64, error)
+	}
+
+	userKeeper interface {
+		List() ([]users.User, error)
+		Add(name, password string, roles []string) error
+		Passwd(name, password string) error
+		SetDisabled(name string, disabled bool) error
+		Login(name, password string, ttl time.Duration) (*users.User, string, error)
+		Refresh(token string, ttl time.Duration) (*users.User, string, error)
+	}
+
+	auditLog interface {
+		Query(f audit.Filter) ([]audit.Record, error)
+		Verify() (uint64, error)
+		Reencrypt(keyID string) (int, error)
 	}
 )
 
@@ -42,6 +84,8 @@ func printPermit(cmd *cobra.Command, p permit.Permit) {
 	cmd.Printf("Domain:  %s\n", p.Domain)
 	cmd.Printf("Contact: %s\n", p.Contact)
 	cmd.Printf("Entity:  %s\n", p.Entity)
+	cmd.Printf("Plan:    %s\n", p.Plan)
+	cmd.Printf("Rev.:    %d\n", p.Revision)
 	cmd.Println("---------------------------------------------")
 	cmd.Printf("Issued:  %s\n", p.Issued)
 	cmd.Printf("Valid:   %v\n", p.Valid)
@@ -54,33 +98,178 @@ func printPermit(cmd *cobra.Command, p permit.Permit) {
 	}
 }
 
-func commands(storage keeper) []*cobra.Command {
+// conditional makes mutation fail when permit is not at the revision given with --if-revision
+func conditional(ctx context.Context, cmd *cobra.Command) context.Context {
+	if !cmd.Flags().Changed("if-revision") {
+		return ctx
+	}
+
+	rev, err := cmd.Flags().GetUint64("if-revision")
+	must(cmd, err)
+
+	return context.WithIfRevision(ctx, rev)
+}
+
+// uniqueDomain makes store refuse mutation that would give domain a second active permit, see --unique-domain
+func uniqueDomain(ctx context.Context, cmd *cobra.Command) context.Context {
+	if unique, _ := cmd.Flags().GetBool("unique-domain"); !unique {
+		return ctx
+	}
+
+	return context.WithUniqueDomain(ctx)
+}
+
+func printList(cmd *cobra.Command, ll []*permit.Permit) {
+	for _, l := range ll {
+		cmd.Printf(
+			"%-64s\t%-50s\t%v\t%v\n",
+			l.Key,
+			l.Domain,
+			l.Valid,
+			l.Expires,
+		)
+	}
+}
+
+// readPassword reads single line from standard input
+func readPassword(cmd *cobra.Command) string {
+	cmd.Print("Password: ")
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		must(cmd, errors.Wrap(err, "could not read password"))
+	}
+
+	return strings.TrimRight(line, "\r\n")
+}
+
+func printManifest(cmd *cobra.Command, path string, m *backup.Manifest) {
+	cmd.Printf("Archive:   %s\n", path)
+	cmd.Printf("Created:   %s\n", m.Created)
+	cmd.Printf("Permits:   %d\n", m.Counts.Permits)
+	cmd.Printf("Trashed:   %d\n", m.Counts.Trashed)
+	cmd.Printf("Revisions: %d\n", m.Counts.Revisions)
+	if m.KeyID != "" {
+		cmd.Printf("Key ID:    %s\n", m.KeyID)
+	}
+	for name, sum := range m.Checksums {
+		cmd.Printf("SHA-256:   %s  %s\n", sum, name)
+	}
+}
+
+// listQuery assembles store query from list command flags
+func listQuery(cmd *cobra.Command) (q store.Query, err error) {
+	var (
+		f = cmd.Flags()
+
+		dateFlag = func(name string) (*time.Time, error) {
+			var v, _ = f.GetString(name)
+			t, err := parseDate(v)
+			return t, errors.Wrapf(err, "--%s", name)
+		}
+	)
+
+	q.KeyPrefix, _ = f.GetString("key-prefix")
+	q.Domain, _ = f.GetString("domain")
+	q.Entity, _ = f.GetString("entity")
+	q.Contact, _ = f.GetString("contact")
+	q.Plan, _ = f.GetString("plan")
+	q.Sort, _ = f.GetString("sort")
+	q.Limit, _ = f.GetInt("limit")
+	q.Cursor, _ = f.GetString("cursor")
+
+	valid, _ := f.GetBool("valid")
+	revoked, _ := f.GetBool("revoked")
+	if valid && revoked {
+		return q, errors.New("--valid and --revoked can not be used together")
+	} else if valid || revoked {
+		q.Valid = &valid
+	}
+
+	if q.ExpiresBefore, err = dateFlag("expires-before"); err != nil {
+		return
+	}
+
+	if q.ExpiresAfter, err = dateFlag("expires-after"); err != nil {
+		return
+	}
+
+	return q, q.Validate()
+}
+
+func parseDate(v string) (*time.Time, error) {
+	if v == "" {
+		return nil, nil
+	}
+
+	if t, err := time.ParseInLocation("2006-01-02", v, time.Local); err == nil {
+		return &t, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return &t, nil
+	}
+
+	return nil, errors.Errorf("invalid date format %q, expecting YYYY-MM-DD or RFC3339", v)
+}
+
+func commands(ctx context.Context, storage keeper, auditLog auditLog, keyring *envelope.Keyring, userStore userKeeper, bans *guard.Store, registry *metrics.Registry) []*cobra.Command {
 	listCmd := &cobra.Command{
-		Use:   "list [query]",
-		Short: "List all permits",
-		Long:  `pass query string to search by key`,
-		Args:  cobra.MinimumNArgs(0),
+		Use:   "list [key prefix]",
+		Short: "List permits",
+		Long:  `pass key prefix or use flags to filter, sort and paginate permits`,
+		Args:  cobra.MaximumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			var q string
+			q, err := listQuery(cmd)
+			must(cmd, err)
+
 			if len(args) > 0 {
-				q = args[0]
+				q.KeyPrefix = args[0]
 			}
 
-			ll, err := storage.List(q)
+			ll, next, err := storage.List(q)
 			must(cmd, err)
 
-			for _, l := range ll {
-				cmd.Printf(
-					"%-64s\t%-50s\t%v\t%v\n",
-					l.Key,
-					l.Domain,
-					l.Valid,
-					l.Expires,
-				)
+			printList(cmd, ll)
+
+			if next != "" {
+				cmd.Printf("Next page: --cursor %s\n", next)
 			}
 		},
 	}
 
+	listCmd.Flags().String("key-prefix", "", "Permit key starts with")
+	listCmd.Flags().String("domain", "", "Domain glob pattern (*.example.tld)")
+	listCmd.Flags().String("entity", "", "Entity contains")
+	listCmd.Flags().String("contact", "", "Contact contains")
+	listCmd.Flags().Bool("valid", false, "Only permits that are not revoked")
+	listCmd.Flags().Bool("revoked", false, "Only revoked permits")
+	listCmd.Flags().String("expires-before", "", "Expires before date (YYYY-MM-DD or RFC3339)")
+	listCmd.Flags().String("expires-after", "", "Expires after date (YYYY-MM-DD or RFC3339)")
+	listCmd.Flags().String("plan", "", "Permit plan (trial, standard, unlimited)")
+	listCmd.Flags().String("sort", "key", "Sort by ("+strings.Join(store.SortFields, ", ")+"), prefix with - for descending order")
+	listCmd.Flags().Int("limit", 0, "Max number of permits to list, 0 for all")
+	listCmd.Flags().String("cursor", "", "Continue listing from cursor of the previous page")
+
+	findCmd := &cobra.Command{
+		Use:   "find",
+		Short: "Find permits",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			domain, _ := cmd.Flags().GetString("domain")
+			if domain == "" {
+				must(cmd, errors.New("nothing to search by, use --domain"))
+			}
+
+			ll, err := storage.FindByDomain(domain)
+			must(cmd, err)
+
+			printList(cmd, ll)
+		},
+	}
+
+	findCmd.Flags().String("domain", "", "Find permits issued for domain")
+
 	getCmd := &cobra.Command{
 		Use:   "get [permit key]",
 		Short: "Show single permit",
@@ -99,13 +288,16 @@ func commands(storage keeper) []*cobra.Command {
 		Run: func(cmd *cobra.Command, args []string) {
 			var now = time.Now().Truncate(time.Second)
 			var exp = &now
+			var plan = permit.PlanStandard
 
 			if trial, _ := cmd.Flags().GetBool("trial"); trial {
 				*exp = exp.AddDate(0, 0, 14)
+				plan = permit.PlanTrial
 			} else if inf, _ := cmd.Flags().GetBool("infinite"); !inf {
 				*exp = exp.AddDate(1, 0, 0)
 			} else {
 				exp = nil
+				plan = permit.PlanUnlimited
 			}
 
 			var key, _ = cmd.Flags().GetString("force-key")
@@ -125,12 +317,13 @@ func commands(storage keeper) []*cobra.Command {
 				Domain:     args[0],
 				Valid:      true,
 				Attributes: permit.DefaultAttributes,
+				Plan:       plan,
 			}
 
 			p.Contact, _ = cmd.Flags().GetString("contact")
 			p.Entity, _ = cmd.Flags().GetString("entity")
 
-			must(cmd, storage.Create(p))
+			must(cmd, storage.Create(uniqueDomain(ctx, cmd), p))
 
 			printPermit(cmd, p)
 		},
@@ -141,13 +334,73 @@ func commands(storage keeper) []*cobra.Command {
 	createCmd.Flags().String("force-key", "", "use this key instead of generated string")
 	createCmd.Flags().String("contact", "", "Contact (email)")
 	createCmd.Flags().String("entity", "", "Entity (company, organisation) name, info")
+	createCmd.Flags().Bool("unique-domain", env.GetBoolEnv("PERMIT_UNIQUE_DOMAIN"), "Refuse to create permit for domain that already has an active one")
+
+	updateCmd := &cobra.Command{
+		Use:   "update [permit key]",
+		Short: "Change permit's domain, contact, entity, plan or attributes",
+		Long:  "Only given flags are changed. Attributes are set with repeated --attribute name=value",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			var (
+				patch = store.Patch{}
+				f     = cmd.Flags()
+				str   = func(name string) *string {
+					if !f.Changed(name) {
+						return nil
+					}
+
+					v, _ := f.GetString(name)
+					return &v
+				}
+			)
+
+			patch.Domain = str("domain")
+			patch.Contact = str("contact")
+			patch.Entity = str("entity")
+			patch.Plan = str("plan")
+
+			aa, _ := f.GetStringSlice("attribute")
+			for _, a := range aa {
+				kv := strings.SplitN(a, "=", 2)
+				if len(kv) != 2 {
+					must(cmd, errors.Errorf("invalid attribute %q, expecting name=value", a))
+				}
+
+				value, err := strconv.Atoi(kv[1])
+				must(cmd, errors.Wrapf(err, "invalid value of attribute %s", kv[0]))
+
+				if patch.Attributes == nil {
+					patch.Attributes = map[string]int{}
+				}
+
+				patch.Attributes[kv[0]] = value
+			}
+
+			must(cmd, patch.Validate())
+
+			must(cmd, storage.Update(uniqueDomain(conditional(ctx, cmd), cmd), args[0], patch))
+
+			p, err := storage.Get(args[0])
+			must(cmd, err)
+
+			printPermit(cmd, *p)
+		},
+	}
+
+	updateCmd.Flags().String("domain", "", "Domain")
+	updateCmd.Flags().String("contact", "", "Contact (email)")
+	updateCmd.Flags().String("entity", "", "Entity (company, organisation) name, info")
+	updateCmd.Flags().String("plan", "", "Permit plan (trial, standard, unlimited)")
+	updateCmd.Flags().StringSlice("attribute", nil, "Attribute as name=value, can be repeated")
+	updateCmd.Flags().Bool("unique-domain", env.GetBoolEnv("PERMIT_UNIQUE_DOMAIN"), "Refuse to move permit to domain that already has an active one")
 
 	revokeCmd := &cobra.Command{
 		Use:   "revoke [permit key]",
 		Short: "Revokes (disables) permit",
 		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			must(cmd, storage.Revoke(args[0]))
+			must(cmd, storage.Revoke(conditional(ctx, cmd), args[0]))
 		},
 	}
 
@@ -156,7 +409,7 @@ func commands(storage keeper) []*cobra.Command {
 		Short: "Enable permit",
 		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			must(cmd, storage.Enable(args[0]))
+			must(cmd, storage.Enable(uniqueDomain(conditional(ctx, cmd), cmd), args[0]))
 		},
 	}
 
@@ -169,35 +422,589 @@ func commands(storage keeper) []*cobra.Command {
 			must(cmd, err)
 			e := time.Now().AddDate(0, months, 0)
 			cmd.Printf("Extending permit to %v", e)
-			must(cmd, storage.Extend(args[0], &e))
+			must(cmd, storage.Extend(uniqueDomain(conditional(ctx, cmd), cmd), args[0], &e))
 		},
 	}
 
 	deleteCmd := &cobra.Command{
 		Use:   "delete [permit key]",
-		Short: "Removes permit",
+		Short: "Moves permit to trash",
 		Args:  cobra.MinimumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			must(cmd, storage.Delete(args[0]))
+			must(cmd, storage.Delete(conditional(ctx, cmd), args[0]))
+		},
+	}
+
+	trashCmd := &cobra.Command{
+		Use:   "trash",
+		Short: "Manage deleted permits",
+	}
+
+	trashListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List deleted permits",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			tt, err := storage.Trash()
+			must(cmd, err)
+
+			for _, t := range tt {
+				cmd.Printf(
+					"%-64s\t%-50s\t%v\t%s\n",
+					t.Permit.Key,
+					t.Permit.Domain,
+					t.Deleted,
+					t.Actor,
+				)
+			}
+		},
+	}
+
+	trashCmd.AddCommand(trashListCmd)
+
+	restoreCmd := &cobra.Command{
+		Use:   "restore [permit key]",
+		Short: "Restores deleted permit from trash",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			must(cmd, storage.Restore(uniqueDomain(conditional(ctx, cmd), cmd), args[0]))
+
+			p, err := storage.Get(args[0])
+			must(cmd, err)
+
+			printPermit(cmd, *p)
+		},
+	}
+
+	purgeCmd := &cobra.Command{
+		Use:   "purge",
+		Short: "Permanently removes permits that were in trash longer than retention period",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			var before = time.Now()
+
+			if all, _ := cmd.Flags().GetBool("all"); !all {
+				days, _ := cmd.Flags().GetInt("older-than")
+				before = before.AddDate(0, 0, -days)
+			}
+
+			kk, err := storage.Purge(ctx, before)
+			for _, k := range kk {
+				cmd.Printf("Purged %s\n", k)
+			}
+
+			must(cmd, err)
+		},
+	}
+
+	purgeCmd.Flags().Int("older-than", env.GetIntEnv("TRASH_RETENTION_DAYS", 30), "Purge permits deleted more than this many days ago")
+	purgeCmd.Flags().Bool("all", false, "Empty the whole trash")
+
+	historyCmd := &cobra.Command{
+		Use:   "history [permit key]",
+		Short: "Show permit revisions and changes between them",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			rr, err := storage.History(args[0])
+			must(cmd, err)
+
+			var prev *permit.Permit
+			for _, r := range rr {
+				cmd.Printf("#%-4d %s  %-8s  %s\n", r.Number, r.Time, r.Action, r.Actor)
+				for _, c := range store.Diff(prev, r.Permit) {
+					cmd.Printf("      %-32s %s -> %s\n", c.Field, c.Old, c.New)
+				}
+
+				prev = r.Permit
+			}
+		},
+	}
+
+	rollbackCmd := &cobra.Command{
+		Use:   "rollback [permit key] [revision]",
+		Short: "Restore permit to the state of an earlier revision",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			number, err := strconv.Atoi(args[1])
+			must(cmd, err)
+			must(cmd, storage.Rollback(uniqueDomain(conditional(ctx, cmd), cmd), args[0], number))
+
+			p, err := storage.Get(args[0])
+			must(cmd, err)
+
+			printPermit(cmd, *p)
+		},
+	}
+
+	for _, c := range []*cobra.Command{updateCmd, revokeCmd, enableCmd, extendCmd, deleteCmd, restoreCmd, rollbackCmd} {
+		c.Flags().Uint64("if-revision", 0, "Fail if permit was modified and is no longer at this revision")
+	}
+
+	for _, c := range []*cobra.Command{enableCmd, extendCmd, restoreCmd, rollbackCmd} {
+		c.Flags().Bool("unique-domain", env.GetBoolEnv("PERMIT_UNIQUE_DOMAIN"), "Refuse to reactivate permit for domain that already has an active one")
+	}
+
+	backupCmd := &cobra.Command{
+		Use:   "backup [archive file]",
+		Short: "Write consistent compressed snapshot of all permits, trash and history",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			var path = "permit-backup-" + time.Now().Format("20060102T150405") + ".tar.gz"
+			if len(args) > 0 {
+				path = args[0]
+			}
+
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			must(cmd, err)
+
+			m, err := backup.Create(storage, f, keyring)
+			if err == nil {
+				err = f.Close()
+			}
+
+			if err != nil {
+				f.Close()
+				os.Remove(path)
+			}
+
+			must(cmd, err)
+			printManifest(cmd, path, m)
+		},
+	}
+
+	backupVerifyCmd := &cobra.Command{
+		Use:   "verify [archive file]",
+		Short: "Check backup archive against its manifest",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			m, err := backup.Verify(args[0], keyring)
+			must(cmd, err)
+			printManifest(cmd, args[0], m)
+		},
+	}
+
+	backupRestoreCmd := &cobra.Command{
+		Use:   "restore [archive file]",
+		Short: "Validate backup archive and load it into the store",
+		Long:  "Permits from the archive replace existing permits with the same key, other permits are kept",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+			rpt, err := backup.Restore(ctx, storage, args[0], keyring, dryRun)
+			if rpt != nil {
+				for _, k := range rpt.Created {
+					cmd.Printf("created   %s\n", k)
+				}
+
+				for _, k := range rpt.Replaced {
+					cmd.Printf("replaced  %s\n", k)
+				}
+
+				cmd.Printf(
+					"%d created, %d replaced, %d unchanged\n",
+					len(rpt.Created),
+					len(rpt.Replaced),
+					len(rpt.Unchanged),
+				)
+
+				if dryRun {
+					cmd.Println("Dry run, nothing was changed")
+				}
+			}
+
+			must(cmd, err)
+		},
+	}
+
+	backupRestoreCmd.Flags().Bool("dry-run", false, "Only validate the archive and report what would change")
+
+	backupCmd.AddCommand(backupVerifyCmd, backupRestoreCmd)
+
+	reencryptCmd := &cobra.Command{
+		Use:   "reencrypt [backup archive...]",
+		Short: "Re-encrypt all stored records, the audit log, sweep archive and backup archives with a master key",
+		Long: "Add the new key to STORAGE_ENCRYPTION_KEYS or the key file, re-encrypt and then make it active with STORAGE_ENCRYPTION_KEY_ID. " +
+			"Sweep archive (SWEEP_ARCHIVE_PATH) is re-encrypted when it exists; stop the sweeper first. " +
+			"Backup archives that are given as arguments are re-encrypted in place; the old key can be removed once all archives sealed with it are re-encrypted (see keyId in their manifest).",
+		Run: func(cmd *cobra.Command, args []string) {
+			keyID, _ := cmd.Flags().GetString("key-id")
+
+			n, err := storage.Reencrypt(keyID)
+			must(cmd, err)
+
+			cmd.Printf("Re-encrypted %d records\n", n)
+
+			n, err = auditLog.Reencrypt(keyID)
+			must(cmd, err)
+
+			cmd.Printf("Re-encrypted %d audit records\n", n)
+
+			archive := env.GetStringEnv("SWEEP_ARCHIVE_PATH", filepath.Join(env.GetStringEnv("STORAGE_FS_PATH", "/tmp"), "sweep", "archive.jsonl"))
+			if _, err = os.Stat(archive); err == nil {
+				n, err = sweep.Reencrypt(archive, keyring, keyID)
+				must(cmd, err)
+
+				cmd.Printf("Re-encrypted %d records in %s\n", n, archive)
+			}
+
+			for _, path := range args {
+				n, err = backup.Reencrypt(path, keyring, keyID)
+				must(cmd, err)
+
+				cmd.Printf("Re-encrypted %d records in %s\n", n, path)
+			}
 		},
 	}
 
+	reencryptCmd.Flags().String("key-id", "", "Master key ID, defaults to the active key")
+
+	fsckCmd := &cobra.Command{
+		Use:   "fsck",
+		Short: "Check stored files for damage and inconsistencies",
+		Long: "Reports undecodable and misnamed files, leftovers of interrupted writes, wrong key lengths, invalid " +
+			"domains and, with --unique-domain, domains with several active permits. With --repair, damaged files " +
+			"are moved to lost+found, duplicate active permits (all but the paid or longest valid one) are revoked " +
+			"and domain index is rebuilt. Repairs are audited",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			var opt store.CheckOptions
+			opt.Repair, _ = cmd.Flags().GetBool("repair")
+			opt.UniqueDomain, _ = cmd.Flags().GetBool("unique-domain")
+
+			pp, err := storage.Check(ctx, opt)
+
+			var repaired int
+			for _, p := range pp {
+				var status = "found"
+				if p.Repaired {
+					status = "repaired"
+					repaired++
+				}
+
+				cmd.Printf("%-8s  %-17s  %s\n", status, p.Kind, p.Path)
+				cmd.Printf("          %s\n", p.Message)
+			}
+
+			must(cmd, err)
+
+			cmd.Printf("%d problems found, %d repaired\n", len(pp), repaired)
+			if len(pp) > repaired {
+				os.Exit(1)
+			}
+		},
+	}
+
+	fsckCmd.Flags().Bool("repair", false, "Fix problems that can be fixed automatically")
+	fsckCmd.Flags().Bool("unique-domain", env.GetBoolEnv("PERMIT_UNIQUE_DOMAIN"), "Report (and repair) domains with several active permits")
+
+	sweepCmd := &cobra.Command{
+		Use:   "sweep",
+		Short: "Archive or delete long expired trials and flag long expired paid permits",
+		Long: "Trials expired for more than --trial-days are archived (appended to --archive and moved to trash) " +
+			"or deleted, depending on --trial-action. Paid permits expired for more than --paid-days are only " +
+			"reported. Permits in trash for more than --trash-days are purged. Report is printed and saved into --report-dir",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			var (
+				policy       sweep.Policy
+				dryRun, _    = cmd.Flags().GetBool("dry-run")
+				reportDir, _ = cmd.Flags().GetString("report-dir")
+			)
+
+			policy.TrialAction, _ = cmd.Flags().GetString("trial-action")
+			policy.TrialDays, _ = cmd.Flags().GetInt("trial-days")
+			policy.PaidDays, _ = cmd.Flags().GetInt("paid-days")
+			policy.TrashDays, _ = cmd.Flags().GetInt("trash-days")
+			policy.ArchivePath, _ = cmd.Flags().GetString("archive")
+			policy.Keyring = keyring
+
+			rpt, err := sweep.Run(ctx, storage, policy, time.Now(), dryRun)
+			must(cmd, err)
+
+			for _, l := range []struct {
+				status string
+				items  []sweep.Item
+			}{{"archived", rpt.Archived}, {"deleted", rpt.Deleted}, {"flagged", rpt.Flagged}} {
+				for _, i := range l.items {
+					cmd.Printf("%-8s  %s  %-10s  %s  %s\n", l.status, i.Key, i.Plan, i.Expired.Format("2006-01-02"), i.Domain)
+				}
+			}
+
+			for _, k := range rpt.Purged {
+				cmd.Printf("purged    %s\n", k)
+			}
+
+			for _, e := range rpt.Errors {
+				cmd.Printf("error     %s\n", e)
+			}
+
+			if !dryRun && reportDir != "" {
+				path, err := rpt.Save(reportDir)
+				must(cmd, err)
+				cmd.Printf("Report saved to %s\n", path)
+			}
+
+			cmd.Printf("%d archived, %d deleted, %d flagged, %d purged, %d errors\n", len(rpt.Archived), len(rpt.Deleted), len(rpt.Flagged), len(rpt.Purged), len(rpt.Errors))
+			if len(rpt.Errors) > 0 {
+				os.Exit(1)
+			}
+		},
+	}
+
+	sweepCmd.Flags().Bool("dry-run", false, "Only report what would be archived, deleted, flagged and purged")
+	sweepCmd.Flags().String("trial-action", env.GetStringEnv("SWEEP_TRIAL_ACTION", sweep.ActionArchive), "What to do with expired trials (archive, delete, none)")
+	sweepCmd.Flags().Int("trial-days", env.GetIntEnv("SWEEP_TRIAL_DAYS", 30), "Sweep trials expired more than this many days ago")
+	sweepCmd.Flags().Int("paid-days", env.GetIntEnv("SWEEP_PAID_DAYS", 60), "Flag paid permits expired more than this many days ago (0 disables)")
+	sweepCmd.Flags().Int("trash-days", env.GetIntEnv("TRASH_RETENTION_DAYS", 30), "Purge permits deleted more than this many days ago (0 disables)")
+	sweepCmd.Flags().String("archive", env.GetStringEnv("SWEEP_ARCHIVE_PATH", filepath.Join(env.GetStringEnv("STORAGE_FS_PATH", "/tmp"), "sweep", "archive.jsonl")), "File archived trials are appended to")
+	sweepCmd.Flags().String("report-dir", env.GetStringEnv("SWEEP_REPORT_DIR", filepath.Join(env.GetStringEnv("STORAGE_FS_PATH", "/tmp"), "sweep")), "Directory reports are saved into (empty disables)")
+
+	migrateCmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Copy all permits, trash and history to another storage backend and verify the copy",
+		Long: "Source can stay in use during migration. With --state, records copied by previous runs are skipped " +
+			"unless they changed, so migration can be resumed and repeated until nothing is left to copy",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			var (
+				fromDSN, _   = cmd.Flags().GetString("from")
+				toDSN, _     = cmd.Flags().GetString("to")
+				statePath, _ = cmd.Flags().GetString("state")
+			)
+
+			if toDSN == "" {
+				must(cmd, errors.New("target storage DSN (--to) is required"))
+			}
+
+			from, err := dsn.Open(fromDSN, keyring)
+			must(cmd, err)
+
+			to, err := dsn.Open(toDSN, keyring)
+			must(cmd, err)
+
+			sum, err := migrate.Run(ctx, from, to, statePath, func(r migrate.Result) {
+				if r.Error != "" {
+					cmd.Printf("%-8s  %-64s  %s\n", r.Status, r.Key, r.Error)
+				} else {
+					cmd.Printf("%-8s  %-64s  %s\n", r.Status, r.Key, r.Checksum)
+				}
+			})
+
+			if sum != nil {
+				cmd.Printf(
+					"%d copied, %d skipped, %d failed, %d verified, %d mismatched\n",
+					sum.Copied,
+					sum.Skipped,
+					sum.Failed,
+					sum.Verified,
+					sum.Mismatch,
+				)
+
+				cmd.Printf("Source: %d permits, %d trashed, %d revisions\n", sum.Source.Permits, sum.Source.Trashed, sum.Source.Revisions)
+				cmd.Printf("Target: %d permits, %d trashed, %d revisions\n", sum.Target.Permits, sum.Target.Trashed, sum.Target.Revisions)
+			}
+
+			must(cmd, err)
+		},
+	}
+
+	migrateCmd.Flags().String("from", env.GetStringEnv("STORAGE_DSN", "fs:"+env.GetStringEnv("STORAGE_FS_PATH", "/tmp")), "Source storage DSN")
+	migrateCmd.Flags().String("to", "", "Target storage DSN (e.g. fs:/new/storage)")
+	migrateCmd.Flags().String("state", "", "State file for resuming interrupted migration")
+
+	auditCmd := &cobra.Command{
+		Use:   "audit",
+		Short: "Query and verify audit log",
+	}
+
+	auditListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List audit records",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			var (
+				f   = audit.Filter{}
+				err error
+			)
+
+			f.Key, _ = cmd.Flags().GetString("key")
+			f.Actor, _ = cmd.Flags().GetString("actor")
+			f.Action, _ = cmd.Flags().GetString("action")
+
+			since, _ := cmd.Flags().GetString("since")
+			f.Since, err = parseDate(since)
+			must(cmd, err)
+
+			until, _ := cmd.Flags().GetString("until")
+			f.Until, err = parseDate(until)
+			must(cmd, err)
+
+			rr, err := auditLog.Query(f)
+			must(cmd, err)
+
+			for _, r := range rr {
+				cmd.Printf("#%-6d %s  %-8s  %-64s  %s %s\n", r.Seq, r.Time, r.Action, r.Key, r.Actor, r.IP)
+				for _, c := range store.Diff(r.Before, r.After) {
+					cmd.Printf("        %-32s %s -> %s\n", c.Field, c.Old, c.New)
+				}
+			}
+		},
+	}
+
+	auditListCmd.Flags().String("key", "", "Permit key")
+	auditListCmd.Flags().String("actor", "", "Actor (OS user or token subject)")
+	auditListCmd.Flags().String("action", "", "Action (create, revoke, enable, extend, delete, rollback)")
+	auditListCmd.Flags().String("since", "", "Records on or after date (YYYY-MM-DD or RFC3339)")
+	auditListCmd.Flags().String("until", "", "Records before date (YYYY-MM-DD or RFC3339)")
+
+	auditVerifyCmd := &cobra.Command{
+		Use:   "verify",
+		Short: "Verify audit log hash chain",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			n, err := auditLog.Verify()
+			if err != nil {
+				cmd.Printf("Audit log verification failed after %d records\n", n)
+			}
+
+			must(cmd, err)
+			cmd.Printf("Audit log OK, %d records verified\n", n)
+		},
+	}
+
+	auditCmd.AddCommand(auditListCmd, auditVerifyCmd)
+
+	userCmd := &cobra.Command{
+		Use:   "user",
+		Short: "Manage admin users that log in to the API",
+	}
+
+	userAddCmd := &cobra.Command{
+		Use:   "add [user name]",
+		Short: "Add user, password is read from standard input",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			roles, _ := cmd.Flags().GetStringSlice("role")
+			must(cmd, userStore.Add(args[0], readPassword(cmd), roles))
+		},
+	}
+
+	userAddCmd.Flags().StringSlice("role", []string{"reader"}, "Role (admin, issuer, reader), can be repeated")
+
+	userListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List users",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			uu, err := userStore.List()
+			must(cmd, err)
+
+			for _, u := range uu {
+				var status = "active"
+				if u.Disabled {
+					status = "disabled"
+				}
+
+				cmd.Printf("%-32s\t%-8s\t%s\t%s\n", u.Name, status, u.Created.Format("2006-01-02"), strings.Join(u.Roles, ","))
+			}
+		},
+	}
+
+	userDisableCmd := &cobra.Command{
+		Use:   "disable [user name]",
+		Short: "Disable user and revoke refresh tokens",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			must(cmd, userStore.SetDisabled(args[0], true))
+		},
+	}
+
+	userEnableCmd := &cobra.Command{
+		Use:   "enable [user name]",
+		Short: "Enable disabled user",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			must(cmd, userStore.SetDisabled(args[0], false))
+		},
+	}
+
+	userPasswdCmd := &cobra.Command{
+		Use:   "passwd [user name]",
+		Short: "Change password (read from standard input) and revoke refresh tokens",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			must(cmd, userStore.Passwd(args[0], readPassword(cmd)))
+		},
+	}
+
+	userCmd.AddCommand(userAddCmd, userListCmd, userDisableCmd, userEnableCmd, userPasswdCmd)
+
+	banCmd := &cobra.Command{
+		Use:   "ban",
+		Short: "Manage client IPs banned for repeated failed permit checks",
+	}
+
+	banListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List active bans",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			all, _ := cmd.Flags().GetBool("all")
+
+			bb, err := bans.List(time.Now(), all)
+			must(cmd, err)
+
+			for _, b := range bb {
+				cmd.Printf("%-39s\t%d\t%s\t%s\t%s\n", b.IP, b.Level, b.Since.Format(time.RFC3339), b.Until.Format(time.RFC3339), b.Reason)
+			}
+		},
+	}
+
+	banListCmd.Flags().Bool("all", false, "Include expired bans, kept to escalate repeated bans")
+
+	banLiftCmd := &cobra.Command{
+		Use:   "lift [ip]",
+		Short: "Lift ban and forget previous offences of the IP",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			must(cmd, bans.Lift(args[0]))
+		},
+	}
+
+	banCmd.AddCommand(banListCmd, banLiftCmd)
+
 	apiCmd := &cobra.Command{
 		Use:   "api",
 		Short: "Removes permit",
 		Run: func(cmd *cobra.Command, args []string) {
-			api.Serve(storage)
+			api.Serve(storage, auditLog, keyring, userStore, bans, registry)
 		},
 	}
 
 	return []*cobra.Command{
 		listCmd,
+		findCmd,
 		getCmd,
 		createCmd,
+		updateCmd,
 		revokeCmd,
 		enableCmd,
 		extendCmd,
 		deleteCmd,
+		trashCmd,
+		restoreCmd,
+		purgeCmd,
+		sweepCmd,
+		historyCmd,
+		rollbackCmd,
+		backupCmd,
+		reencryptCmd,
+		fsckCmd,
+		migrateCmd,
+		auditCmd,
+		userCmd,
+		banCmd,
 		apiCmd,
 	}
 }
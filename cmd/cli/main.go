@@ -1,18 +1,83 @@
 package main
 
 import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+
 	"github.com/spf13/cobra"
 
+	"github.com/crusttech/permit/internal/audit"
+	"github.com/crusttech/permit/internal/context"
 	"github.com/crusttech/permit/internal/env"
-	"github.com/crusttech/permit/internal/store/fs"
+	"github.com/crusttech/permit/internal/envelope"
+	"github.com/crusttech/permit/internal/guard"
+	"github.com/crusttech/permit/internal/metrics"
+	"github.com/crusttech/permit/internal/store/cache"
+	"github.com/crusttech/permit/internal/store/dsn"
+	"github.com/crusttech/permit/internal/users"
 )
 
 func main() {
-	storage, err := fs.NewPermitStorage(env.GetStringEnv("STORAGE_FS_PATH", "/tmp"))
+	var path = env.GetStringEnv("STORAGE_FS_PATH", "/tmp")
+
+	keyring, err := envelope.LoadKeyring(
+		env.GetStringEnv("STORAGE_ENCRYPTION_KEY_ID", ""),
+		env.GetStringEnv("STORAGE_ENCRYPTION_KEYS", ""),
+		env.GetStringEnv("STORAGE_ENCRYPTION_KEY_FILE", ""),
+	)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	backend, err := dsn.Open(env.GetStringEnv("STORAGE_DSN", "fs:"+path), keyring)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	auditLog, err := audit.NewLog(
+		env.GetStringEnv("AUDIT_LOG_PATH", filepath.Join(path, "audit", "audit.log")),
+		env.GetStringEnv("AUDIT_ANCHOR_PATH", ""),
+		keyring,
+	)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	userStore, err := users.NewStore(env.GetStringEnv("USERS_PATH", filepath.Join(path, "users")))
 	if err != nil {
 		panic(err.Error())
 	}
+
+	bans, err := guard.NewStore(env.GetStringEnv("BANS_PATH", filepath.Join(path, "bans")))
+	if err != nil {
+		panic(err.Error())
+	}
+
+	// Metrics are exposed by the API server only, backend is measured below the cache
+	registry := metrics.NewRegistry()
+
+	// Cache is shared by API handlers; CLI commands are short-lived and barely use it
+	storage := cache.Storage(
+		audit.Storage(metrics.Storage(backend, registry), auditLog),
+		env.GetIntEnv("STORAGE_CACHE_SIZE", 10000),
+		time.Duration(env.GetIntEnv("STORAGE_CACHE_TTL", 60))*time.Second,
+		time.Duration(env.GetIntEnv("STORAGE_CACHE_REFRESH_MS", 250))*time.Millisecond,
+	)
+
+	// Mutations from the CLI are recorded under the OS user
+	ctx := context.WithActor(context.Background(), osUser())
+
 	var rootCmd = &cobra.Command{Use: "app"}
-	rootCmd.AddCommand(commands(storage)...)
+	rootCmd.AddCommand(commands(ctx, storage, auditLog, keyring, userStore, bans, registry)...)
 	rootCmd.Execute()
 }
+
+func osUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+
+	return os.Getenv("USER")
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/crusttech/permit/internal/audit"
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+func endpointAuditList(log auditLog) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var (
+			err error
+			f   = audit.Filter{
+				Key:    ctx.Query("key"),
+				Actor:  ctx.Query("actor"),
+				Action: ctx.Query("action"),
+			}
+		)
+
+		if f.Since, err = queryTime(ctx, "since"); err != nil {
+			ctx.JSON(http.StatusBadRequest, newJsonError(ctx, permit.CodeInvalidRequest, err))
+			return
+		}
+
+		if f.Until, err = queryTime(ctx, "until"); err != nil {
+			ctx.JSON(http.StatusBadRequest, newJsonError(ctx, permit.CodeInvalidRequest, err))
+			return
+		}
+
+		rr, err := log.Query(f)
+		if err != nil {
+			context.Log(ctx.Request.Context()).With(zap.Error(err)).Error("could not query audit log")
+			ctx.JSON(http.StatusInternalServerError, newJsonError(ctx, permit.CodeServerError, errors.Wrap(err, "could not query audit log")))
+			return
+		}
+
+		ctx.JSON(http.StatusOK, rr)
+	}
+}
+
+func endpointAuditVerify(log auditLog) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var rsp = struct {
+			Valid    bool   `json:"valid"`
+			Verified uint64 `json:"verified"`
+			Error    string `json:"error,omitempty"`
+		}{}
+
+		n, err := log.Verify()
+		rsp.Valid, rsp.Verified = err == nil, n
+
+		if err != nil {
+			context.Log(ctx.Request.Context()).With(zap.Error(err)).Warn("audit log verification failed")
+			rsp.Error = err.Error()
+		}
+
+		ctx.JSON(http.StatusOK, rsp)
+	}
+}
+
+// queryTime parses optional RFC3339 query parameter
+func queryTime(ctx *gin.Context, name string) (*time.Time, error) {
+	v := ctx.Query(name)
+	if v == "" {
+		return nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return nil, errors.Errorf("invalid %s parameter, expecting RFC3339 time", name)
+	}
+
+	return &t, nil
+}
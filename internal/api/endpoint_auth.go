@@ -0,0 +1,154 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/crusttech/permit/internal/auth"
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/internal/guard"
+	"github.com/crusttech/permit/internal/ratelimit"
+	"github.com/crusttech/permit/internal/users"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+type (
+	tokenResponse struct {
+		AccessToken  string   `json:"accessToken"`
+		TokenType    string   `json:"tokenType"`
+		ExpiresIn    int      `json:"expiresIn"`
+		RefreshToken string   `json:"refreshToken"`
+		Roles        []string `json:"roles"`
+	}
+)
+
+// endpointAuthLogin issues tokens for user's name and password
+//
+// Failed logins are counted per client IP by the guard and per user name by
+// the lockout limiter; locked out user names are refused before their
+// password is compared.
+func endpointAuthLogin(uu userKeeper, signer *auth.Signer, refreshTTL time.Duration, lockout *ratelimit.Limiter, g *guard.Guard) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req = struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}{}
+
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, newJsonError(ctx, permit.CodeInvalidRequest, errors.Wrap(err, "could not decode request")))
+			return
+		}
+
+		var (
+			log     = context.Log(ctx.Request.Context()).With(zap.String("username", req.Username))
+			userKey = "user:" + strings.ToLower(req.Username)
+		)
+
+		if lockedOut(ctx, lockout, userKey) {
+			log.Warn("user locked out after failed logins")
+			return
+		}
+
+		u, refresh, err := uu.Login(req.Username, req.Password, refreshTTL)
+		if err != nil {
+			if authError(ctx, log, err) {
+				if lockout != nil {
+					lockout.Allow(userKey, time.Now())
+				}
+
+				checkFailed(ctx, g, "")
+			}
+
+			return
+		}
+
+		log.Info("user logged in")
+		respondTokens(ctx, signer, u, refresh)
+	}
+}
+
+// endpointAuthRefresh exchanges refresh token for new tokens, failures are counted by the guard
+func endpointAuthRefresh(uu userKeeper, signer *auth.Signer, refreshTTL time.Duration, g *guard.Guard) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req = struct {
+			RefreshToken string `json:"refreshToken"`
+		}{}
+
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, newJsonError(ctx, permit.CodeInvalidRequest, errors.Wrap(err, "could not decode request")))
+			return
+		}
+
+		u, refresh, err := uu.Refresh(req.RefreshToken, refreshTTL)
+		if err != nil {
+			if authError(ctx, context.Log(ctx.Request.Context()), err) {
+				checkFailed(ctx, g, "")
+			}
+
+			return
+		}
+
+		respondTokens(ctx, signer, u, refresh)
+	}
+}
+
+// authError hides the reason of failed login or refresh from the client, returns true when credentials were refused
+func authError(ctx *gin.Context, log *zap.Logger, err error) bool {
+	switch err {
+	case users.InvalidCredentials, users.InvalidRefresh, users.UserDisabled:
+		log.Warn("authentication failed", zap.Error(err))
+		ctx.JSON(http.StatusUnauthorized, newJsonError(ctx, permit.CodeUnauthorized, "authentication failed"))
+		return true
+	default:
+		log.With(zap.Error(err)).Error("could not authenticate user")
+		ctx.JSON(http.StatusInternalServerError, newJsonError(ctx, permit.CodeServerError, errors.Wrap(err, "could not authenticate user")))
+		return false
+	}
+}
+
+// lockedOut responds with 429 Too Many Requests when the user name had too many failed logins
+func lockedOut(ctx *gin.Context, l *ratelimit.Limiter, key string) bool {
+	if l == nil || ctx.GetBool(rateLimitExemptKey) {
+		return false
+	}
+
+	var (
+		now = time.Now()
+		st  = l.Peek(key, now)
+	)
+
+	if st.Allowed {
+		return false
+	}
+
+	countThrottled(ctx, "user")
+
+	ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(st.RetryAfter(now).Seconds()))))
+	ctx.AbortWithStatusJSON(http.StatusTooManyRequests, newJsonError(ctx, permit.CodeRateLimited, "too many failed logins, try again later"))
+	return true
+}
+
+func respondTokens(ctx *gin.Context, signer *auth.Signer, u *users.User, refresh string) {
+	token, exp, err := signer.Sign(u.Name, u.Scopes(), map[string]interface{}{"roles": u.Roles})
+	if err != nil {
+		context.Log(ctx.Request.Context()).With(zap.Error(err)).Error("could not issue token")
+		ctx.JSON(http.StatusInternalServerError, newJsonError(ctx, permit.CodeServerError, errors.Wrap(err, "could not issue token")))
+		return
+	}
+
+	ctx.Header("Cache-Control", "no-store")
+	ctx.JSON(http.StatusOK, tokenResponse{
+		AccessToken:  token,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(time.Until(exp).Seconds()),
+		RefreshToken: refresh,
+		Roles:        u.Roles,
+	})
+}
@@ -9,13 +9,31 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/internal/guard"
+	"github.com/crusttech/permit/internal/ratelimit"
 	"github.com/crusttech/permit/pkg/permit"
 )
 
 const minKeyLen = 4
 const maxKeyLen = 100
 
-func endpointKeyCheck(storage permitKeeper) gin.HandlerFunc {
+var (
+	// Response to unknown key or domain mismatch, with permit.CodeKeyNotFound
+	checkFailure = errors.New("permit not found for domain")
+
+	badCheckRequest = errors.New("could not decode request")
+)
+
+// endpointKeyCheck verifies permit for the domain
+//
+// Requests are limited per permit key with keyLimiter (nil for no limit).
+// Unknown keys and domain mismatch get the same response, so guessed keys
+// can not be told apart, and are counted by the guard. Deleted keys get
+// 410 KEY_DELETED, but only when checked with the domain they were issued for.
+//
+// Version 1 responds with the permit or an error, version 2 with the
+// check envelope (see permit.CheckResponse); HTTP statuses are the same.
+func endpointKeyCheck(storage permitKeeper, keyLimiter *ratelimit.Limiter, g *guard.Guard, version int) gin.HandlerFunc {
 	if storage == nil {
 		return func(ctx *gin.Context) {
 			ctx.AbortWithStatus(http.StatusBadRequest)
@@ -25,54 +43,177 @@ func endpointKeyCheck(storage permitKeeper) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		var (
 			err error
-			p   *permit.Permit
 			req = permit.Permit{}
 			log = context.Log(ctx.Request.Context())
 		)
 
-		if err = ctx.BindJSON(&req); err != nil {
+		if version == 2 {
+			err = ctx.ShouldBindJSON(&req)
+		} else {
+			err = ctx.BindJSON(&req)
+		}
+
+		if err != nil {
 			log.With(zap.Error(err)).Error("could not decode request")
-			ctx.JSON(http.StatusInternalServerError, newJsonError(errors.Wrap(err, "could not decode request")))
+			countCheck(ctx, permit.CodeInvalidRequest)
+
+			if version == 2 {
+				respondCheck(ctx, http.StatusBadRequest, nil, badCheckRequest)
+			} else {
+				ctx.JSON(http.StatusInternalServerError, newJsonError(ctx, permit.CodeInvalidRequest, errors.Wrap(err, "could not decode request")))
+			}
+
 			return
 		}
 
 		log = log.With(zap.String("key", req.Key), zap.String("domain", req.Domain))
 
-		if !permit.ValidateDomain(req.Domain) {
-			ctx.JSON(http.StatusBadRequest, newJsonError("invalid domain"))
+		if rateLimited(ctx, keyLimiter, "key:"+req.Key) {
+			log.Warn("permit key rate limit exceeded")
 			return
 		}
 
-		if p, err = storage.Get(req.Key); err != nil || p == nil {
-			if err == permit.PermitNotFound {
-				ctx.AbortWithStatus(http.StatusNotFound)
-			} else {
-				log.With(zap.Error(err)).Error("could not fetch permit")
-				ctx.JSON(http.StatusInternalServerError, newJsonError(errors.Wrap(err, "could not fetch permit")))
+		status, p, err := checkPermit(storage, req.Key, req.Domain, log)
+		if err == checkFailure {
+			checkFailed(ctx, g, req.Domain)
+		}
+
+		if err != nil {
+			countCheck(ctx, checkErrorCode(err))
+		} else {
+			countCheck(ctx, checkOK)
+
+			fields := []zap.Field{}
+			for k, v := range req.Attributes {
+				fields = append(fields, zap.Int("attributes."+k, v))
 			}
-			return
 
-		} else if p.Domain != req.Domain {
-			log.Warn("domain mismatch")
-			ctx.JSON(http.StatusUnauthorized, newJsonError("domain mismatch"))
-			return
+			log.Info("permit check ok", fields...)
 
-		} else if !p.IsValid() {
-			log.Warn("permit not valid")
-			ctx.JSON(http.StatusUnauthorized, newJsonError("permit not valid"))
-			return
+			if p.Expires != nil {
+				ctx.Header("Expires", p.Expires.Format(time.RFC1123))
+			}
+		}
 
-		} else if p.Expires != nil {
-			ctx.Header("Expires", p.Expires.Format(time.RFC1123))
+		if version == 2 {
+			respondCheck(ctx, status, p, err)
+		} else if err != nil {
+			ctx.JSON(status, newJsonError(ctx, checkErrorCode(err), err))
+		} else {
+			ctx.JSON(http.StatusOK, p)
 		}
+	}
+}
+
+// respondCheck sends v2 check envelope
+func respondCheck(ctx *gin.Context, status int, p *permit.Permit, err error) {
+	ctx.Header(permit.VersionHeader, "2")
+	ctx.JSON(status, checkResponse(p, err, time.Now()))
+}
 
-		fields := []zap.Field{}
-		for k, v := range req.Attributes {
-			fields = append(fields, zap.Int("attributes."+k, v))
+// checkResponse wraps result of checkPermit into v2 envelope
+func checkResponse(p *permit.Permit, err error, now time.Time) permit.CheckResponse {
+	rsp := permit.CheckResponse{
+		Status:     permit.CheckValid,
+		Warnings:   []string{},
+		ServerTime: now.UTC(),
+		Permit:     p,
+	}
+
+	if err == nil {
+		rsp.Warnings = p.Warnings(now)
+		return rsp
+	}
+
+	rsp.Status, rsp.Code, rsp.Message = permit.CheckInvalid, checkErrorCode(err), err.Error()
+
+	switch err {
+	case checkFailure, permit.PermitDeleted:
+		rsp.Reason = permit.ReasonNotFound
+	case permit.PermitExpired, permit.PermitRevoked:
+		rsp.Reason = permit.ReasonNotValid
+	case permit.InvalidDomain:
+		rsp.Reason = permit.ReasonInvalidDomain
+	case badCheckRequest:
+		rsp.Reason = permit.ReasonInvalidRequest
+	default:
+		rsp.Status, rsp.Reason = permit.CheckError, permit.ReasonServerError
+	}
+
+	return rsp
+}
+
+// checkErrorCode returns error code for checkPermit errors
+func checkErrorCode(err error) string {
+	switch err {
+	case checkFailure:
+		return permit.CodeKeyNotFound
+	case badCheckRequest:
+		return permit.CodeInvalidRequest
+	case permit.PermitExpired, permit.PermitRevoked, permit.PermitDeleted, permit.InvalidDomain:
+		return permit.ErrorCode(err)
+	default:
+		return permit.CodeServerError
+	}
+}
+
+// checkPermit verifies that key is valid for the domain
+//
+// Returns HTTP status and valid permit or error to respond with.
+func checkPermit(storage permitKeeper, key, domain string, log *zap.Logger) (int, *permit.Permit, error) {
+	if !permit.ValidateDomain(domain) {
+		return http.StatusBadRequest, nil, permit.InvalidDomain
+	}
+
+	p, err := storage.Get(key)
+	if err == permit.PermitDeleted {
+		// Deleted permit is only revealed to those who know its domain
+		if deleted, tErr := trashedPermit(storage, key); tErr != nil {
+			err = tErr
+		} else if deleted != nil && deleted.Domain == domain {
+			log.Warn("permit deleted")
+			return http.StatusGone, nil, permit.PermitDeleted
+		}
+	}
+
+	if err != nil && err != permit.PermitNotFound && err != permit.PermitDeleted {
+		log.With(zap.Error(err)).Error("could not fetch permit")
+		return http.StatusInternalServerError, nil, errors.Wrap(err, "could not fetch permit")
+	}
+
+	if p == nil || p.Domain != domain {
+		if err != nil {
+			log.Warn("check failed", zap.Error(err))
+		} else {
+			log.Warn("check failed, domain mismatch")
 		}
 
-		log.Info("permit check ok", fields...)
+		return http.StatusUnauthorized, nil, checkFailure
+	}
+
+	if !p.Valid {
+		log.Warn("permit revoked")
+		return http.StatusUnauthorized, nil, permit.PermitRevoked
+	} else if p.Expired() {
+		log.Warn("permit expired")
+		return http.StatusUnauthorized, nil, permit.PermitExpired
+	}
+
+	return http.StatusOK, p, nil
+}
+
+// trashedPermit returns deleted permit from trash, nil when it is not there
+func trashedPermit(storage permitKeeper, key string) (*permit.Permit, error) {
+	tt, err := storage.Trash()
+	if err != nil {
+		return nil, err
+	}
 
-		ctx.JSON(http.StatusOK, p)
+	for i := range tt {
+		if tt[i].Permit.Key == key {
+			return &tt[i].Permit, nil
+		}
 	}
+
+	return nil, nil
 }
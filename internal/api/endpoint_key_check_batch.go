@@ -0,0 +1,114 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/internal/ratelimit"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+type (
+	batchCheckItem struct {
+		Key    string `json:"key"`
+		Domain string `json:"domain"`
+	}
+
+	batchCheckResult struct {
+		Key    string         `json:"key"`
+		Domain string         `json:"domain"`
+		Status int            `json:"status"`
+		Error  string         `json:"error,omitempty"`
+		Code   string         `json:"code,omitempty"`
+		Permit *permit.Permit `json:"permit,omitempty"`
+	}
+
+	// batchCheckResultV2 is v2 check envelope of one item
+	batchCheckResultV2 struct {
+		Key    string `json:"key"`
+		Domain string `json:"domain"`
+		permit.CheckResponse
+	}
+)
+
+// endpointKeyCheckBatch checks many key and domain pairs in one request
+//
+// Each result has the status and error (or permit) that the single check
+// would respond with. Requests (not items) are limited per authenticated
+// caller; failures are not counted by the guard as callers are known.
+//
+// Version 2 results are check envelopes instead of status and error.
+func endpointKeyCheckBatch(storage permitKeeper, callerLimiter *ratelimit.Limiter, maxItems, version int) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var (
+			req = struct {
+				Checks []batchCheckItem `json:"checks"`
+			}{}
+
+			caller = context.Actor(ctx.Request.Context())
+			log    = context.Log(ctx.Request.Context()).With(zap.String("caller", caller))
+		)
+
+		if rateLimited(ctx, callerLimiter, "caller:"+caller) {
+			log.Warn("batch check rate limit exceeded")
+			return
+		}
+
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, newJsonError(ctx, permit.CodeInvalidRequest, errors.Wrap(err, "could not decode request")))
+			return
+		}
+
+		if len(req.Checks) == 0 {
+			ctx.JSON(http.StatusBadRequest, newJsonError(ctx, permit.CodeInvalidRequest, "no checks in request"))
+			return
+		} else if len(req.Checks) > maxItems {
+			ctx.JSON(http.StatusRequestEntityTooLarge, newJsonError(ctx, permit.CodeRequestTooLarge, errors.Errorf("too many checks, at most %d allowed", maxItems)))
+			return
+		}
+
+		var (
+			results   = make([]batchCheckResult, len(req.Checks))
+			resultsV2 = make([]batchCheckResultV2, len(req.Checks))
+
+			now   = time.Now()
+			valid int
+		)
+
+		for i, c := range req.Checks {
+			r := batchCheckResult{Key: c.Key, Domain: c.Domain}
+
+			status, p, err := checkPermit(storage, c.Key, c.Domain, log.With(zap.String("key", c.Key), zap.String("domain", c.Domain)))
+			r.Status, r.Permit = status, p
+
+			if err != nil {
+				r.Error, r.Code = err.Error(), checkErrorCode(err)
+				countCheck(ctx, r.Code)
+			} else {
+				valid++
+				countCheck(ctx, checkOK)
+			}
+
+			results[i] = r
+			resultsV2[i] = batchCheckResultV2{Key: c.Key, Domain: c.Domain, CheckResponse: checkResponse(p, err, now)}
+		}
+
+		log.Info("batch check done", zap.Int("checks", len(req.Checks)), zap.Int("valid", valid))
+
+		rsp := struct {
+			Results interface{} `json:"results"`
+		}{Results: results}
+
+		if version == 2 {
+			ctx.Header(permit.VersionHeader, "2")
+			rsp.Results = resultsV2
+		}
+
+		ctx.JSON(http.StatusOK, rsp)
+	}
+}
@@ -34,12 +34,12 @@ func endpointKeyCreate(storage permitKeeper) gin.HandlerFunc {
 
 		if err = ctx.BindJSON(&req); err != nil {
 			log.With(zap.Error(err)).Error("could not decode request")
-			ctx.JSON(http.StatusInternalServerError, newJsonError(errors.Wrap(err, "could not decode request")))
+			ctx.JSON(http.StatusInternalServerError, newJsonError(ctx, permit.CodeInvalidRequest, errors.Wrap(err, "could not decode request")))
 			return
 		}
 
 		if !permit.ValidateDomain(req.Domain) {
-			ctx.JSON(http.StatusBadRequest, newJsonError("invalid domain"))
+			ctx.JSON(http.StatusBadRequest, newJsonError(ctx, permit.CodeInvalidDomain, "invalid domain"))
 			return
 		}
 
@@ -52,14 +52,16 @@ func endpointKeyCreate(storage permitKeeper) gin.HandlerFunc {
 			p.Expires = &time.Time{}
 
 			switch req.Type {
-			case "trial":
+			case permit.PlanTrial:
 				// Trial keys, 14 days.
 				*p.Expires = tomorrow.AddDate(0, 0, 14)
+				p.Plan = permit.PlanTrial
 			// case "unlimited":
 			// 	p.Expires = nil
 			default:
 				// By default, offset expiration date by 1 year
 				*p.Expires = tomorrow.AddDate(1, 0, 0)
+				p.Plan = permit.PlanStandard
 			}
 
 			log = log.With(zap.Time("expires", *p.Expires))
@@ -71,6 +73,7 @@ func endpointKeyCreate(storage permitKeeper) gin.HandlerFunc {
 		p.Key = string(rand.RandBytesMaskImprSrc(permit.KeyLength))
 		p.Valid = true
 		p.Version = 1
+		p.Revision = 1
 		p.Issued = time.Now().Truncate(time.Second)
 
 		log = log.With(
@@ -87,6 +90,7 @@ func endpointKeyCreate(storage permitKeeper) gin.HandlerFunc {
 			// Iterate over default attributes and make sure only predefined keys
 			// from DefaultAttributes are copied. Ignore the rest and set defaults
 			// where keys are missing
+			p.Attributes = make(map[string]int, len(permit.DefaultAttributes))
 			for defKey, defValue := range permit.DefaultAttributes {
 				if reqAttribVal, has := req.Attributes[defKey]; !has {
 					p.Attributes[defKey] = defValue
@@ -96,9 +100,14 @@ func endpointKeyCreate(storage permitKeeper) gin.HandlerFunc {
 			}
 		}
 
-		if err = storage.Create(p); err != nil {
+		if err = storage.Create(ctx.Request.Context(), p); err == permit.DomainTaken {
+			log.Warn("domain already has an active permit")
+			storeError(ctx, err, "could not store permit")
+			return
+		} else if err != nil {
 			log.With(zap.Error(err)).Error("could not store permit")
-			ctx.JSON(http.StatusInternalServerError, newJsonError(errors.Wrap(err, "could not store permit")))
+			ctx.JSON(http.StatusInternalServerError, newJsonError(ctx, permit.CodeServerError, errors.Wrap(err, "could not store permit")))
+			return
 		}
 
 		fields := []zap.Field{}
@@ -107,7 +116,9 @@ func endpointKeyCreate(storage permitKeeper) gin.HandlerFunc {
 		}
 
 		log.Info("permit created", fields...)
+		countIssued(ctx, p.Plan)
 
+		ctx.Header("ETag", etag(&p))
 		ctx.JSON(http.StatusOK, p)
 	}
 }
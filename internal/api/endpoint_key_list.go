@@ -0,0 +1,81 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/internal/store"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+// endpointKeyList filters, sorts and paginates permits, same as the list command
+func endpointKeyList(storage permitKeeper) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var (
+			err error
+			rsp = struct {
+				Permits []*permit.Permit `json:"permits"`
+				Next    string           `json:"next,omitempty"`
+			}{}
+
+			q = store.Query{
+				KeyPrefix: ctx.Query("keyPrefix"),
+				Domain:    ctx.Query("domain"),
+				Entity:    ctx.Query("entity"),
+				Contact:   ctx.Query("contact"),
+				Plan:      ctx.Query("plan"),
+				Sort:      ctx.DefaultQuery("sort", "key"),
+				Cursor:    ctx.Query("cursor"),
+			}
+		)
+
+		if v := ctx.Query("valid"); v != "" {
+			valid, err := strconv.ParseBool(v)
+			if err != nil {
+				ctx.JSON(http.StatusBadRequest, newJsonError(ctx, permit.CodeInvalidRequest, "invalid valid parameter, expecting true or false"))
+				return
+			}
+
+			q.Valid = &valid
+		}
+
+		if v := ctx.Query("limit"); v != "" {
+			if q.Limit, err = strconv.Atoi(v); err != nil {
+				ctx.JSON(http.StatusBadRequest, newJsonError(ctx, permit.CodeInvalidRequest, "invalid limit parameter"))
+				return
+			}
+		}
+
+		if q.ExpiresBefore, err = queryTime(ctx, "expiresBefore"); err != nil {
+			ctx.JSON(http.StatusBadRequest, newJsonError(ctx, permit.CodeInvalidRequest, err))
+			return
+		}
+
+		if q.ExpiresAfter, err = queryTime(ctx, "expiresAfter"); err != nil {
+			ctx.JSON(http.StatusBadRequest, newJsonError(ctx, permit.CodeInvalidRequest, err))
+			return
+		}
+
+		if err = q.Validate(); err != nil {
+			ctx.JSON(http.StatusBadRequest, newJsonError(ctx, permit.CodeInvalidRequest, err))
+			return
+		}
+
+		if rsp.Permits, rsp.Next, err = storage.List(q); err != nil {
+			context.Log(ctx.Request.Context()).With(zap.Error(err)).Error("could not list permits")
+			ctx.JSON(http.StatusInternalServerError, newJsonError(ctx, permit.CodeServerError, errors.Wrap(err, "could not list permits")))
+			return
+		}
+
+		if rsp.Permits == nil {
+			rsp.Permits = []*permit.Permit{}
+		}
+
+		ctx.JSON(http.StatusOK, rsp)
+	}
+}
@@ -0,0 +1,26 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func endpointKeyRead(storage permitKeeper) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		p, err := storage.Get(ctx.Param("key"))
+		if err != nil {
+			storeError(ctx, err, "could not fetch permit")
+			return
+		}
+
+		ctx.Header("ETag", etag(p))
+
+		if ctx.GetHeader("If-None-Match") == etag(p) {
+			ctx.Status(http.StatusNotModified)
+			return
+		}
+
+		ctx.JSON(http.StatusOK, p)
+	}
+}
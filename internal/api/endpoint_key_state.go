@@ -0,0 +1,98 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+func endpointKeyRevoke(storage permitKeeper) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if err := storage.Revoke(ctx.Request.Context(), ctx.Param("key")); err != nil {
+			storeError(ctx, err, "could not revoke permit")
+			return
+		}
+
+		context.Log(ctx.Request.Context()).Info("permit revoked", zap.String("key", ctx.Param("key")))
+		respondPermit(ctx, storage, ctx.Param("key"))
+	}
+}
+
+func endpointKeyEnable(storage permitKeeper) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if err := storage.Enable(ctx.Request.Context(), ctx.Param("key")); err != nil {
+			storeError(ctx, err, "could not enable permit")
+			return
+		}
+
+		context.Log(ctx.Request.Context()).Info("permit enabled", zap.String("key", ctx.Param("key")))
+		respondPermit(ctx, storage, ctx.Param("key"))
+	}
+}
+
+// endpointKeyExtend sets new expiration date
+//
+// Request sets either exact expiration time or number of months from now
+// (same as the extend command).
+func endpointKeyExtend(storage permitKeeper) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var (
+			req = struct {
+				Expires *time.Time `json:"expires"`
+				Months  int        `json:"months"`
+			}{}
+		)
+
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, newJsonError(ctx, permit.CodeInvalidRequest, errors.Wrap(err, "could not decode request")))
+			return
+		}
+
+		if req.Expires == nil && req.Months == 0 {
+			ctx.JSON(http.StatusBadRequest, newJsonError(ctx, permit.CodeInvalidRequest, "expires or months required"))
+			return
+		} else if req.Expires == nil {
+			e := time.Now().Truncate(time.Second).AddDate(0, req.Months, 0)
+			req.Expires = &e
+		}
+
+		if err := storage.Extend(ctx.Request.Context(), ctx.Param("key"), req.Expires); err != nil {
+			storeError(ctx, err, "could not extend permit")
+			return
+		}
+
+		context.Log(ctx.Request.Context()).Info("permit extended", zap.String("key", ctx.Param("key")), zap.Time("expires", *req.Expires))
+		respondPermit(ctx, storage, ctx.Param("key"))
+	}
+}
+
+// endpointKeyDelete moves permit to trash
+func endpointKeyDelete(storage permitKeeper) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if err := storage.Delete(ctx.Request.Context(), ctx.Param("key")); err != nil {
+			storeError(ctx, err, "could not delete permit")
+			return
+		}
+
+		context.Log(ctx.Request.Context()).Info("permit deleted", zap.String("key", ctx.Param("key")))
+		ctx.Status(http.StatusNoContent)
+	}
+}
+
+// respondPermit sends permit's current state after a mutation
+func respondPermit(ctx *gin.Context, storage permitKeeper, key string) {
+	p, err := storage.Get(key)
+	if err != nil {
+		storeError(ctx, err, "could not fetch permit")
+		return
+	}
+
+	ctx.Header("ETag", etag(p))
+	ctx.JSON(http.StatusOK, p)
+}
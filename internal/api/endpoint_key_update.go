@@ -0,0 +1,51 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/internal/store"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+// endpointKeyUpdate changes permit's domain, contact, entity, plan or attributes
+//
+// Only fields present in the request are changed, attributes are merged.
+func endpointKeyUpdate(storage permitKeeper) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var (
+			key   = ctx.Param("key")
+			patch = store.Patch{}
+			log   = context.Log(ctx.Request.Context()).With(zap.String("key", key))
+		)
+
+		if err := ctx.ShouldBindJSON(&patch); err != nil {
+			ctx.JSON(http.StatusBadRequest, newJsonError(ctx, permit.CodeInvalidRequest, errors.Wrap(err, "could not decode request")))
+			return
+		}
+
+		if err := patch.Validate(); err != nil {
+			ctx.JSON(http.StatusBadRequest, newJsonError(ctx, permit.CodeInvalidRequest, err))
+			return
+		}
+
+		for name := range patch.Attributes {
+			if _, has := permit.DefaultAttributes[name]; !has {
+				ctx.JSON(http.StatusBadRequest, newJsonError(ctx, permit.CodeInvalidRequest, errors.Errorf("unknown attribute %q", name)))
+				return
+			}
+		}
+
+		if err := storage.Update(ctx.Request.Context(), key, patch); err != nil {
+			storeError(ctx, err, "could not update permit")
+			return
+		}
+
+		log.Info("permit updated")
+		respondPermit(ctx, storage, key)
+	}
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/internal/replica"
+	"github.com/crusttech/permit/internal/store"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+const maxReplicationBatch = 1000
+
+func endpointReplicationChanges(storage permitKeeper) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		since, err := strconv.ParseUint(ctx.DefaultQuery("since", "0"), 10, 64)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, newJsonError(ctx, permit.CodeInvalidRequest, "invalid since parameter"))
+			return
+		}
+
+		limit, err := strconv.Atoi(ctx.DefaultQuery("limit", strconv.Itoa(maxReplicationBatch)))
+		if err != nil || limit <= 0 || limit > maxReplicationBatch {
+			limit = maxReplicationBatch
+		}
+
+		cc, err := replica.ChangesSince(storage, since, limit)
+		if errors.Cause(err) == store.EventsCompacted {
+			// Replica has to load the snapshot again
+			ctx.JSON(http.StatusGone, newJsonError(ctx, permit.CodeCursorExpired, err))
+			return
+		} else if err != nil {
+			context.Log(ctx.Request.Context()).With(zap.Error(err)).Error("could not collect changes")
+			ctx.JSON(http.StatusInternalServerError, newJsonError(ctx, permit.CodeServerError, errors.Wrap(err, "could not collect changes")))
+			return
+		}
+
+		ctx.JSON(http.StatusOK, cc)
+	}
+}
+
+func endpointReplicationSnapshot(storage permitKeeper) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.Header("Content-Type", "application/x-ndjson")
+		ctx.Status(http.StatusOK)
+
+		if err := replica.WriteSnapshot(storage, ctx.Writer); err != nil {
+			// Too late to change the status, replica sees truncated stream
+			context.Log(ctx.Request.Context()).With(zap.Error(err)).Error("could not write snapshot")
+		}
+	}
+}
+
+func endpointReplicationStatus(r *replica.Replica) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, r.Status())
+	}
+}
+
+// readOnlyMiddleware refuses all writes on replicas
+func readOnlyMiddleware(primary string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusMethodNotAllowed, newJsonError(c, permit.CodeReadOnly, "read-only replica, send changes to "+primary))
+	}
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/internal/guard"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+// banMiddleware refuses requests from banned client IPs
+func banMiddleware(g *guard.Guard) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if g == nil || c.GetBool(rateLimitExemptKey) {
+			return
+		}
+
+		now := time.Now()
+		if b, banned := g.Banned(context.ClientIP(c.Request.Context()), now); banned {
+			countThrottled(c, "ban")
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(b.Until.Sub(now).Seconds()))))
+			c.AbortWithStatusJSON(http.StatusForbidden, newJsonError(c, permit.CodeClientBanned, "too many failed attempts, client is temporarily banned"))
+		}
+	}
+}
+
+// checkFailed counts failed check (or login) and logs bans and domain alerts it triggers
+func checkFailed(c *gin.Context, g *guard.Guard, domain string) {
+	if g == nil || c.GetBool(rateLimitExemptKey) {
+		return
+	}
+
+	var (
+		ip  = context.ClientIP(c.Request.Context())
+		log = context.Log(c.Request.Context())
+	)
+
+	e, err := g.Fail(ip, domain, time.Now())
+	if err != nil {
+		log.With(zap.Error(err)).Error("could not ban client")
+	}
+
+	if e.Ban != nil {
+		log.Warn("client banned",
+			zap.String("event", "ban"),
+			zap.String("ip", ip),
+			zap.Int("level", e.Ban.Level),
+			zap.Time("until", e.Ban.Until),
+			zap.String("reason", e.Ban.Reason),
+		)
+	}
+
+	if e.DomainAlert {
+		log.Warn("many failed checks for domain", zap.String("event", "domain-alert"), zap.String("domain", domain))
+	}
+}
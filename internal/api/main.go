@@ -2,34 +2,70 @@ package api
 
 import (
 	"net/http"
+	"path/filepath"
 	"time"
 
 	"github.com/SentimensRG/sigctx"
-	"github.com/cnjack/throttle"
-	"github.com/gin-gonic/contrib/jwt"
 	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 
+	"github.com/crusttech/permit/internal/audit"
+	"github.com/crusttech/permit/internal/auth"
+	"github.com/crusttech/permit/internal/context"
 	"github.com/crusttech/permit/internal/env"
+	"github.com/crusttech/permit/internal/envelope"
+	"github.com/crusttech/permit/internal/guard"
+	"github.com/crusttech/permit/internal/metrics"
+	"github.com/crusttech/permit/internal/ratelimit"
+	"github.com/crusttech/permit/internal/realip"
+	"github.com/crusttech/permit/internal/replica"
+	"github.com/crusttech/permit/internal/store"
+	"github.com/crusttech/permit/internal/sweep"
+	"github.com/crusttech/permit/internal/users"
 	"github.com/crusttech/permit/pkg/permit"
 )
 
 type (
 	permitKeeper interface {
+		List(q store.Query) ([]*permit.Permit, string, error)
 		Get(key string) (*permit.Permit, error)
-		Create(p permit.Permit) error
+		Create(ctx context.Context, p permit.Permit) error
+		Update(ctx context.Context, key string, p store.Patch) error
+		Revoke(ctx context.Context, key string) error
+		Enable(ctx context.Context, key string) error
+		Extend(ctx context.Context, key string, t *time.Time) error
+		Delete(ctx context.Context, key string) error
+		Trash() ([]store.Trashed, error)
+		Purge(ctx context.Context, before time.Time) ([]string, error)
+		History(key string) ([]store.Revision, error)
+		Events(since uint64, limit int) ([]store.Event, uint64, error)
+		Import(ctx context.Context, r store.Record) error
 	}
 
+	userKeeper interface {
+		Login(name, password string, ttl time.Duration) (*users.User, string, error)
+		Refresh(token string, ttl time.Duration) (*users.User, string, error)
+	}
+
+	auditLog interface {
+		Query(f audit.Filter) ([]audit.Record, error)
+		Verify() (uint64, error)
+	}
+
+	// jsonError is error response body, see permit.Error for codes
 	jsonError struct {
-		Error string `json:"error"`
+		// Same as message, kept for clients that do not know error codes
+		Text string `json:"error"`
+
+		permit.Error
 	}
 )
 
-const maxRequestsPerHour = 60
-
-func Serve(storage permitKeeper) {
-	var jwtSecret string
-	var g *gin.RouterGroup
+// Serve runs the API server until the process is signaled to stop
+//
+// Metrics are served on a separate listener (METRICS_LISTEN), when set.
+func Serve(storage permitKeeper, auditLog auditLog, keyring *envelope.Keyring, userStore userKeeper, bans *guard.Store, registry *metrics.Registry) {
 	log, err := setupLogger(env.GetBoolEnv("LOG_PRETTY"), "debug")
 	if err != nil {
 		panic("Unable to setup logging")
@@ -39,39 +75,131 @@ func Serve(storage permitKeeper) {
 		panic("Missing storage")
 	}
 
-	if jwtSecret = env.GetStringEnv("JWT_SECRET", ""); jwtSecret == "" {
-		panic("JWT_SECRET missing")
+	if auditLog == nil {
+		panic("Missing audit log")
+	}
+
+	if registry == nil {
+		registry = metrics.NewRegistry()
+	}
+
+	verifier, err := tokenVerifier()
+	if err != nil {
+		panic("Unable to setup token verification: " + err.Error())
 	}
 
 	ctx := sigctx.New()
 
 	gin.SetMode(env.GetStringEnv("GIN_MODE", gin.DebugMode))
+	trustedProxies, err := realip.ParseNetworks(env.GetStringEnv("TRUSTED_PROXIES", ""))
+	if err != nil {
+		panic("Invalid TRUSTED_PROXIES: " + err.Error())
+	}
+
+	rateLimitAllow, err := realip.ParseNetworks(env.GetStringEnv("CHECK_RATE_LIMIT_ALLOW", ""))
+	if err != nil {
+		panic("Invalid CHECK_RATE_LIMIT_ALLOW: " + err.Error())
+	}
+
 	router := gin.New()
 
-	router.Use(requestLogMiddleware(log))
-
-	g = router.Group("/key")
-	g.Use(jwt.Auth(jwtSecret))
-	g.POST("", endpointKeyCreate(storage))
-	// router.GET("/key/:key", endpointKeyRead(storage))
-
-	// Key check with throttling
-	g = router.Group("/check")
-	g.Use(throttle.Policy(&throttle.Quota{
-		Limit:  maxRequestsPerHour,
-		Within: time.Hour,
-	}))
-	g.POST("", endpointKeyCheck(storage))
-
-	// Catch all path
-	router.Any("/", func(ctx *gin.Context) {
-		ctx.Header("Content-Type", "text/html; charset=utf-8")
-		ctx.String(
-			http.StatusOK,
-			`<html><body style="text-align: center; margin: 50px;"><h1>Crust subscription server</h1></body></html>`,
+	// Client IP is resolved by request log middleware, behind trusted proxies only
+	router.ForwardedByClientIP = false
+	router.Use(requestLogMiddleware(log, trustedProxies), metricsMiddleware(newAPIMetrics(registry)))
+
+	primary := env.GetStringEnv("REPLICA_OF", "")
+
+	var (
+		rateLimitWindow = time.Duration(env.GetIntEnv("CHECK_RATE_LIMIT_WINDOW", 3600)) * time.Second
+
+		rr = routes{
+			storage:       storage,
+			auditLog:      auditLog,
+			authenticated: authMiddleware(verifier),
+			uniqueDomain:  env.GetBoolEnv("PERMIT_UNIQUE_DOMAIN"),
+			primary:       primary,
+			keyLimiter:    ratelimit.New(env.GetIntEnv("CHECK_RATE_LIMIT_KEY", 600), rateLimitWindow),
+			callerLimiter: ratelimit.New(env.GetIntEnv("CHECK_BATCH_RATE_LIMIT", 60), rateLimitWindow),
+			batchMax:      env.GetIntEnv("CHECK_BATCH_MAX", 500),
+		}
+	)
+
+	// Key check with rate limits per client IP and per permit key and bans for repeated failures
+	rr.checkGuard = guard.New(bans, banPolicy(env.GetIntEnv("CHECK_BAN_THRESHOLD", 20)))
+
+	var authGuard *guard.Guard
+
+	if signer, err := tokenSigner(); err != nil {
+		panic("Unable to setup token signing: " + err.Error())
+	} else if signer != nil {
+		// Login with rate limits per client IP, bans for repeated failures and lockout of user names
+		var (
+			refreshTTL    = time.Duration(env.GetIntEnv("AUTH_REFRESH_TTL", 24*60)) * time.Minute
+			authWindow    = time.Duration(env.GetIntEnv("AUTH_RATE_LIMIT_WINDOW", 900)) * time.Second
+			lockout       = ratelimit.New(env.GetIntEnv("AUTH_LOCKOUT_THRESHOLD", 5), authWindow)
+			authIPLimiter = ratelimit.New(env.GetIntEnv("AUTH_RATE_LIMIT_IP", 30), authWindow)
 		)
+
+		authGuard = guard.New(bans, banPolicy(env.GetIntEnv("AUTH_BAN_THRESHOLD", 10)))
+
+		rr.authLogin = endpointAuthLogin(userStore, signer, refreshTTL, lockout, authGuard)
+		rr.authRefresh = endpointAuthRefresh(userStore, signer, refreshTTL, authGuard)
+		rr.authLimits = []gin.HandlerFunc{rateLimitMiddleware(authIPLimiter, rateLimitAllow), banMiddleware(authGuard)}
+	}
+
+	if primary != "" {
+		// Replica pulls changes from primary and serves checks from its local store
+		r := replica.New(
+			primary,
+			env.GetStringEnv("REPLICA_TOKEN", ""),
+			storage,
+			env.GetStringEnv("REPLICA_STATE_PATH", filepath.Join(env.GetStringEnv("STORAGE_FS_PATH", "/tmp"), "replica.json")),
+			time.Duration(env.GetIntEnv("REPLICA_INTERVAL", 5))*time.Second,
+		)
+
+		go r.Run(context.WithLogger(ctx, log.Named("replica")))
+
+		rr.replicaStatus = endpointReplicationStatus(r)
+
+		registry.GaugeFunc("permit_replica_lag", "Changes on primary not yet applied by the replica.", func() []metrics.Sample {
+			return []metrics.Sample{{Value: float64(r.Status().Lag)}}
+		})
+	}
+
+	if primary == "" && env.GetBoolEnv("SWEEP_ENABLED") {
+		// Replicas get sweeper's changes from primary
+		policy := sweepPolicy(keyring)
+		if err := policy.Validate(); err != nil {
+			panic("Invalid sweep policy: " + err.Error())
+		}
+
+		go sweep.Schedule(
+			context.WithLogger(ctx, log.Named("sweep")),
+			storage,
+			policy,
+			time.Duration(env.GetIntEnv("SWEEP_INTERVAL", 24))*time.Hour,
+			env.GetStringEnv("SWEEP_REPORT_DIR", filepath.Join(env.GetStringEnv("STORAGE_FS_PATH", "/tmp"), "sweep")),
+		)
+	}
+
+	registry.CounterFunc("permit_bans_triggered_total", "Client IP bans triggered by failed checks and logins.", func() float64 {
+		n := rr.checkGuard.Triggered()
+		if authGuard != nil {
+			n += authGuard.Triggered()
+		}
+
+		return float64(n)
 	})
 
+	metrics.Permits(registry, storage)
+
+	rr.checkLimits = []gin.HandlerFunc{
+		rateLimitMiddleware(ratelimit.New(env.GetIntEnv("CHECK_RATE_LIMIT_IP", 60), rateLimitWindow), rateLimitAllow),
+		banMiddleware(rr.checkGuard),
+	}
+
+	rr.register(router)
+
 	srv := &http.Server{
 		Addr:    env.GetStringEnv("API_LISTEN", "localhost:80"),
 		Handler: router,
@@ -92,19 +220,130 @@ func Serve(storage permitKeeper) {
 
 	}()
 
+	if addr := env.GetStringEnv("METRICS_LISTEN", ""); addr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", registry.Handler())
+
+		msrv := &http.Server{Addr: addr, Handler: mux}
+
+		defer func() {
+			log.Info("Shutting down metrics server")
+			msrv.Shutdown(ctx)
+		}()
+
+		go func() {
+			log.Info("Starting metrics server", zap.String("addr", msrv.Addr))
+
+			if err := msrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.With(zap.Error(err)).
+					Fatal("Could not start metrics server")
+			}
+		}()
+	}
+
 	select {
 	case <-ctx.Done():
 		break
 	}
 }
 
-func newJsonError(err interface{}) jsonError {
+func newJsonError(ctx *gin.Context, code string, err interface{}) jsonError {
+	e := permit.Error{Code: code, RequestID: ctx.GetString(HTTP_HEADER_REQUEST_ID)}
+
 	switch val := err.(type) {
 	case string:
-		return jsonError{val}
+		e.Message = val
 	case error:
-		return jsonError{val.Error()}
+		e.Message = val.Error()
 	default:
-		return jsonError{"unexpected error type"}
+		e.Message = "unexpected error type"
+	}
+
+	return jsonError{Text: e.Message, Error: e}
+}
+
+// tokenVerifier reads token verification keys and required claims from environment
+func tokenVerifier() (*auth.Verifier, error) {
+	secrets, err := hmacSecrets()
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := auth.NewVerifier(secrets, env.GetStringEnv("JWT_JWKS_FILE", ""))
+	if err != nil {
+		return nil, err
+	}
+
+	v.Audience = env.GetStringEnv("JWT_AUDIENCE", "")
+	v.Issuer = env.GetStringEnv("JWT_ISSUER", "")
+	if v.Audience == "" || v.Issuer == "" {
+		return nil, errors.New("JWT_AUDIENCE and JWT_ISSUER are required")
+	}
+
+	v.Leeway = time.Duration(env.GetIntEnv("JWT_LEEWAY", 30)) * time.Second
+
+	return v, nil
+}
+
+// hmacSecrets reads HMAC secrets from environment
+//
+// JWT_SECRET is kept with "default" key ID.
+func hmacSecrets() (map[string][]byte, error) {
+	secrets := map[string][]byte{}
+
+	if secret := env.GetStringEnv("JWT_SECRET", ""); secret != "" {
+		secrets["default"] = []byte(secret)
+	}
+
+	return secrets, auth.ParseSecrets(env.GetStringEnv("JWT_SECRETS", ""), secrets)
+}
+
+// tokenSigner creates signer for tokens issued on login, nil when login is disabled
+//
+// Tokens are signed with one of the HMAC secrets, selected by AUTH_SIGNING_KEY_ID.
+func tokenSigner() (*auth.Signer, error) {
+	keyID := env.GetStringEnv("AUTH_SIGNING_KEY_ID", "")
+	if keyID == "" {
+		return nil, nil
+	}
+
+	secrets, err := hmacSecrets()
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := auth.NewSigner(keyID, secrets[keyID])
+	if err != nil {
+		return nil, err
+	}
+
+	s.Audience = env.GetStringEnv("JWT_AUDIENCE", "")
+	s.Issuer = env.GetStringEnv("JWT_ISSUER", "")
+	s.TTL = time.Duration(env.GetIntEnv("AUTH_TOKEN_TTL", 15)) * time.Minute
+
+	return s, nil
+}
+
+// banPolicy reads ban durations from environment, failures within CHECK_BAN_WINDOW over threshold trigger a ban
+func banPolicy(threshold int) guard.Policy {
+	return guard.Policy{
+		Threshold:       threshold,
+		Window:          time.Duration(env.GetIntEnv("CHECK_BAN_WINDOW", 600)) * time.Second,
+		BanDuration:     time.Duration(env.GetIntEnv("CHECK_BAN_DURATION", 900)) * time.Second,
+		MaxDuration:     time.Duration(env.GetIntEnv("CHECK_BAN_MAX_DURATION", 7*24*3600)) * time.Second,
+		Forget:          time.Duration(env.GetIntEnv("CHECK_BAN_FORGET", 7*24*3600)) * time.Second,
+		DomainThreshold: env.GetIntEnv("CHECK_DOMAIN_ALERT_THRESHOLD", 100),
+	}
+}
+
+// sweepPolicy reads expiry sweeper policy from environment
+func sweepPolicy(keyring *envelope.Keyring) sweep.Policy {
+	return sweep.Policy{
+		TrialAction: env.GetStringEnv("SWEEP_TRIAL_ACTION", sweep.ActionArchive),
+		TrialDays:   env.GetIntEnv("SWEEP_TRIAL_DAYS", 30),
+		PaidDays:    env.GetIntEnv("SWEEP_PAID_DAYS", 60),
+		TrashDays:   env.GetIntEnv("TRASH_RETENTION_DAYS", 30),
+		ArchivePath: env.GetStringEnv("SWEEP_ARCHIVE_PATH", filepath.Join(env.GetStringEnv("STORAGE_FS_PATH", "/tmp"), "sweep", "archive.jsonl")),
+		Keyring:     keyring,
 	}
 }
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/crusttech/permit/internal/metrics"
+)
+
+type (
+	// apiMetrics are collected by handlers, see metricsMiddleware
+	apiMetrics struct {
+		requests  *metrics.Histogram
+		checks    *metrics.Counter
+		throttled *metrics.Counter
+		issued    *metrics.Counter
+	}
+)
+
+const (
+	// Gin context keys
+	metricsKey   = "metrics"
+	unmatchedKey = "unmatched"
+
+	// Check outcome of valid permits, failed checks are counted by error code
+	checkOK = "OK"
+)
+
+func newAPIMetrics(r *metrics.Registry) *apiMetrics {
+	return &apiMetrics{
+		requests: r.Histogram(
+			"permit_http_request_duration_seconds",
+			"Duration of HTTP requests by route and status.",
+			metrics.DefaultBuckets,
+			"method", "route", "status",
+		),
+		checks: r.Counter(
+			"permit_checks_total",
+			"Permit checks by result code, batch checks are counted per item.",
+			"code",
+		),
+		throttled: r.Counter(
+			"permit_throttled_requests_total",
+			"Requests refused by rate limits (ip, key, caller), user lockouts or bans.",
+			"reason",
+		),
+		issued: r.Counter(
+			"permit_permits_issued_total",
+			"Permits issued through the API by plan.",
+			"plan",
+		),
+	}
+}
+
+// metricsMiddleware measures request latency and makes metrics available to handlers
+//
+// Requests are labeled with route (path with parameter names instead of their values)
+// so that the number of series does not grow with the number of keys.
+func metricsMiddleware(m *apiMetrics) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if m == nil {
+			return
+		}
+
+		start := time.Now()
+		c.Set(metricsKey, m)
+
+		c.Next()
+
+		route := "unmatched"
+		if !c.GetBool(unmatchedKey) {
+			route = routeOf(c.Request.URL.Path, c.Params)
+		}
+
+		m.requests.ObserveSince(start, c.Request.Method, route, strconv.Itoa(c.Writer.Status()))
+	}
+}
+
+// routeOf replaces path segments with names of the parameters they were matched to
+func routeOf(path string, params gin.Params) string {
+	if len(params) == 0 {
+		return path
+	}
+
+	ss := strings.Split(path, "/")
+	for i, p := 0, 0; i < len(ss) && p < len(params); i++ {
+		if ss[i] == params[p].Value {
+			ss[i] = ":" + params[p].Key
+			p++
+		}
+	}
+
+	return strings.Join(ss, "/")
+}
+
+// countCheck counts check outcome, code is checkOK for valid permits
+func countCheck(c *gin.Context, code string) {
+	if m := requestMetrics(c); m != nil {
+		m.checks.Inc(code)
+	}
+}
+
+// countThrottled counts refused request, reason is ip, key, caller, user or ban
+func countThrottled(c *gin.Context, reason string) {
+	if m := requestMetrics(c); m != nil {
+		m.throttled.Inc(reason)
+	}
+}
+
+func countIssued(c *gin.Context, plan string) {
+	if m := requestMetrics(c); m != nil {
+		m.issued.Inc(plan)
+	}
+}
+
+func requestMetrics(c *gin.Context) *apiMetrics {
+	if m, ok := c.Get(metricsKey); ok {
+		return m.(*apiMetrics)
+	}
+
+	return nil
+}
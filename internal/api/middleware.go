@@ -4,20 +4,29 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/dgrijalva/jwt-go/request"
 	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 
+	"github.com/crusttech/permit/internal/auth"
 	"github.com/crusttech/permit/internal/context"
 	"github.com/crusttech/permit/internal/rand"
+	"github.com/crusttech/permit/internal/realip"
+	"github.com/crusttech/permit/pkg/permit"
 )
 
 const (
 	HTTP_HEADER_REQUEST_ID = "request-id"
+
+	// Gin context key of verified token claims
+	claimsKey = "claims"
 )
 
-func requestLogMiddleware(logger *zap.Logger) gin.HandlerFunc {
+func requestLogMiddleware(logger *zap.Logger, trustedProxies realip.Networks) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var requestId string
+		var clientIP = realip.ClientIP(c.Request, trustedProxies)
 
 		ctx := c.Request.Context()
 
@@ -27,6 +36,7 @@ func requestLogMiddleware(logger *zap.Logger) gin.HandlerFunc {
 		}
 
 		ctx = context.WithRequestId(ctx, requestId)
+		ctx = context.WithClientIP(ctx, clientIP)
 
 		// Benchmark the requrst
 		start := time.Now()
@@ -67,7 +77,7 @@ func requestLogMiddleware(logger *zap.Logger) gin.HandlerFunc {
 			zap.String("path", c.Request.URL.Path),
 			zap.Int64("requestContentLength", c.Request.ContentLength),
 			zap.Int("responseContentLength", c.Writer.Size()),
-			zap.String("ip", c.ClientIP()),
+			zap.String("ip", clientIP),
 			zap.Float64("latency", latency),
 		)
 
@@ -92,3 +102,47 @@ func requestLogMiddleware(logger *zap.Logger) gin.HandlerFunc {
 		}
 	}
 }
+
+// authMiddleware verifies bearer token and puts its subject to the request context as actor
+func authMiddleware(v *auth.Verifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokenString, err := request.OAuth2Extractor.ExtractToken(c.Request)
+		if err != nil {
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, newJsonError(c, permit.CodeUnauthorized, "missing bearer token"))
+			return
+		}
+
+		claims, err := v.Verify(tokenString)
+		if err != nil {
+			context.Log(c.Request.Context()).With(zap.Error(err)).Warn("token rejected")
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, newJsonError(c, permit.CodeUnauthorized, err))
+			return
+		}
+
+		c.Set(claimsKey, claims)
+		c.Request = c.Request.WithContext(context.WithActor(c.Request.Context(), claims.Subject))
+	}
+}
+
+// requireScope refuses requests with tokens that do not grant the scope
+//
+// Expects token to be verified by the preceding auth middleware.
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if claims, ok := c.Get(claimsKey); !ok || !claims.(*auth.Claims).HasScope(scope) {
+			c.Header("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+			c.AbortWithStatusJSON(http.StatusForbidden, newJsonError(c, permit.CodeForbidden, errors.Wrap(auth.MissingScope, scope)))
+		}
+	}
+}
+
+// uniqueDomainMiddleware makes store refuse mutations that would give domain a second valid permit
+//
+// Check is done by the store under its lock, handlers report it as 409 DOMAIN_TAKEN.
+func uniqueDomainMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request = c.Request.WithContext(context.WithUniqueDomain(c.Request.Context()))
+	}
+}
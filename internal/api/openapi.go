@@ -0,0 +1,20 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:generate go run openapi_gen.go
+
+// endpointOpenAPI serves OpenAPI document of the API
+//
+// Document is kept in openapi.json and compiled in as openAPIDocument with
+// go generate. It is checked against responses of the handlers by contract
+// tests, update it together with the handlers.
+func endpointOpenAPI() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.Data(http.StatusOK, "application/json; charset=utf-8", []byte(openAPIDocument))
+	}
+}
@@ -0,0 +1,2282 @@
+// Code generated by openapi_gen.go from openapi.json; DO NOT EDIT.
+
+package api
+
+const openAPIDocument = `{
+  "openapi": "3.0.2",
+  "info": {
+    "title": "Crust permit API",
+    "version": "2",
+    "description": "All paths are also served under /v1 and /v2. Version 2 differs in check responses only, see /v2/check and /v2/check/batch; unversioned paths are aliases of version 1. Errors carry a code, message and request ID."
+  },
+  "servers": [
+    {
+      "url": "https://permit.crust.tech"
+    }
+  ],
+  "tags": [
+    {
+      "name": "check"
+    },
+    {
+      "name": "key"
+    },
+    {
+      "name": "auth"
+    },
+    {
+      "name": "audit"
+    },
+    {
+      "name": "replication"
+    },
+    {
+      "name": "meta"
+    }
+  ],
+  "paths": {
+    "/": {
+      "get": {
+        "summary": "Landing page",
+        "tags": [
+          "meta"
+        ],
+        "responses": {
+          "200": {
+            "description": "HTML page",
+            "content": {
+              "text/html": {
+                "schema": {
+                  "type": "string"
+                }
+              }
+            }
+          }
+        }
+      }
+    },
+    "/openapi.json": {
+      "get": {
+        "summary": "This document",
+        "tags": [
+          "meta"
+        ],
+        "responses": {
+          "200": {
+            "description": "OpenAPI document",
+            "content": {
+              "application/json": {}
+            }
+          }
+        }
+      }
+    },
+    "/check": {
+      "post": {
+        "summary": "Check permit for the domain",
+        "description": "Unknown keys and keys issued for other domains get the same response; deleted keys get 410 only with their own domain. Failed checks are counted per client IP, clients with too many failures are temporarily banned.",
+        "tags": [
+          "check"
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/CheckRequest"
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "Valid permit",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Permit"
+                }
+              }
+            },
+            "headers": {
+              "Expires": {
+                "description": "Permit expiration",
+                "schema": {
+                  "type": "string"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "401": {
+            "description": "Permit not found for the domain, revoked or expired",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Error"
+                }
+              }
+            }
+          },
+          "403": {
+            "description": "Client is temporarily banned",
+            "headers": {
+              "Retry-After": {
+                "description": "Seconds until the ban is lifted",
+                "schema": {
+                  "type": "integer"
+                }
+              }
+            },
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Error"
+                }
+              }
+            }
+          },
+          "410": {
+            "description": "Permit was deleted, sent only for the domain it was issued for",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Error"
+                }
+              }
+            }
+          },
+          "429": {
+            "$ref": "#/components/responses/TooManyRequests"
+          },
+          "500": {
+            "$ref": "#/components/responses/ServerError"
+          }
+        }
+      }
+    },
+    "/v2/check": {
+      "post": {
+        "summary": "Check permit for the domain, with result envelope",
+        "description": "Unknown keys and keys issued for other domains get the same response; deleted keys get 410 only with their own domain. Failed checks are counted per client IP, clients with too many failures are temporarily banned. Responses carry Permit-Api-Version: 2 header.",
+        "tags": [
+          "check"
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/CheckRequest"
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "Valid permit",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/CheckResponse"
+                }
+              }
+            }
+          },
+          "400": {
+            "description": "Invalid request",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/CheckResponse"
+                }
+              }
+            }
+          },
+          "401": {
+            "description": "Permit not found for the domain, revoked or expired",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/CheckResponse"
+                }
+              }
+            }
+          },
+          "403": {
+            "description": "Client is temporarily banned",
+            "headers": {
+              "Retry-After": {
+                "description": "Seconds until the ban is lifted",
+                "schema": {
+                  "type": "integer"
+                }
+              }
+            },
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Error"
+                }
+              }
+            }
+          },
+          "410": {
+            "description": "Permit was deleted, sent only for the domain it was issued for",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/CheckResponse"
+                }
+              }
+            }
+          },
+          "429": {
+            "$ref": "#/components/responses/TooManyRequests"
+          },
+          "500": {
+            "description": "Unexpected error",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/CheckResponse"
+                }
+              }
+            }
+          }
+        }
+      }
+    },
+    "/check/batch": {
+      "post": {
+        "summary": "Check many permits",
+        "description": "Requires permit:check scope, rate limited per caller.",
+        "tags": [
+          "check"
+        ],
+        "security": [
+          {
+            "bearer": []
+          }
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/BatchCheckRequest"
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "Result of every check",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/BatchCheckResponse"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          },
+          "413": {
+            "description": "Too many checks in request",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Error"
+                }
+              }
+            }
+          },
+          "429": {
+            "$ref": "#/components/responses/TooManyRequests"
+          }
+        }
+      }
+    },
+    "/v2/check/batch": {
+      "post": {
+        "summary": "Check many permits, with result envelopes",
+        "description": "Requires permit:check scope, rate limited per caller.",
+        "tags": [
+          "check"
+        ],
+        "security": [
+          {
+            "bearer": []
+          }
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/BatchCheckRequest"
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "Result of every check",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/BatchCheckResponseV2"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          },
+          "413": {
+            "description": "Too many checks in request",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Error"
+                }
+              }
+            }
+          },
+          "429": {
+            "$ref": "#/components/responses/TooManyRequests"
+          }
+        }
+      }
+    },
+    "/key": {
+      "get": {
+        "summary": "List permits",
+        "description": "Requires permit:read scope.",
+        "tags": [
+          "key"
+        ],
+        "security": [
+          {
+            "bearer": []
+          }
+        ],
+        "parameters": [
+          {
+            "name": "keyPrefix",
+            "in": "query",
+            "required": false,
+            "description": "Keys starting with",
+            "schema": {
+              "type": "string"
+            }
+          },
+          {
+            "name": "domain",
+            "in": "query",
+            "required": false,
+            "description": "Exact domain",
+            "schema": {
+              "type": "string"
+            }
+          },
+          {
+            "name": "entity",
+            "in": "query",
+            "required": false,
+            "description": "Exact entity",
+            "schema": {
+              "type": "string"
+            }
+          },
+          {
+            "name": "contact",
+            "in": "query",
+            "required": false,
+            "description": "Exact contact",
+            "schema": {
+              "type": "string"
+            }
+          },
+          {
+            "name": "plan",
+            "in": "query",
+            "required": false,
+            "description": "Exact plan",
+            "schema": {
+              "type": "string"
+            }
+          },
+          {
+            "name": "valid",
+            "in": "query",
+            "required": false,
+            "description": "Only valid (true) or invalid (false) permits",
+            "schema": {
+              "type": "boolean"
+            }
+          },
+          {
+            "name": "expiresBefore",
+            "in": "query",
+            "required": false,
+            "description": "Permits expiring before, RFC3339",
+            "schema": {
+              "type": "string",
+              "format": "date-time"
+            }
+          },
+          {
+            "name": "expiresAfter",
+            "in": "query",
+            "required": false,
+            "description": "Permits expiring after, RFC3339",
+            "schema": {
+              "type": "string",
+              "format": "date-time"
+            }
+          },
+          {
+            "name": "sort",
+            "in": "query",
+            "required": false,
+            "description": "Sort field: key, domain, expires or issued, prefix with - for descending",
+            "schema": {
+              "type": "string"
+            }
+          },
+          {
+            "name": "cursor",
+            "in": "query",
+            "required": false,
+            "description": "Cursor from previous page",
+            "schema": {
+              "type": "string"
+            }
+          },
+          {
+            "name": "limit",
+            "in": "query",
+            "required": false,
+            "description": "Page size",
+            "schema": {
+              "type": "integer"
+            }
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "Page of permits",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/PermitList"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          },
+          "500": {
+            "$ref": "#/components/responses/ServerError"
+          }
+        }
+      },
+      "post": {
+        "summary": "Issue permit",
+        "description": "Requires permit:issue scope.",
+        "tags": [
+          "key"
+        ],
+        "security": [
+          {
+            "bearer": []
+          }
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/PermitCreate"
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "Permit",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Permit"
+                }
+              }
+            },
+            "headers": {
+              "ETag": {
+                "description": "Permit revision, send it back in If-Match to make changes conditional",
+                "schema": {
+                  "type": "string"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          },
+          "405": {
+            "$ref": "#/components/responses/ReadOnly"
+          },
+          "409": {
+            "$ref": "#/components/responses/Conflict"
+          },
+          "500": {
+            "$ref": "#/components/responses/ServerError"
+          }
+        }
+      }
+    },
+    "/key/{key}": {
+      "parameters": [
+        {
+          "name": "key",
+          "in": "path",
+          "required": true,
+          "description": "Permit key",
+          "schema": {
+            "type": "string"
+          }
+        }
+      ],
+      "get": {
+        "summary": "Read permit",
+        "description": "Requires permit:read scope.",
+        "tags": [
+          "key"
+        ],
+        "security": [
+          {
+            "bearer": []
+          }
+        ],
+        "parameters": [
+          {
+            "name": "If-None-Match",
+            "in": "header",
+            "required": false,
+            "schema": {
+              "type": "string"
+            }
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "Permit",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Permit"
+                }
+              }
+            },
+            "headers": {
+              "ETag": {
+                "description": "Permit revision, send it back in If-Match to make changes conditional",
+                "schema": {
+                  "type": "string"
+                }
+              }
+            }
+          },
+          "304": {
+            "description": "Not modified since revision in If-None-Match"
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          },
+          "410": {
+            "$ref": "#/components/responses/Gone"
+          },
+          "500": {
+            "$ref": "#/components/responses/ServerError"
+          }
+        }
+      },
+      "patch": {
+        "summary": "Update permit",
+        "description": "Requires permit:admin scope.",
+        "tags": [
+          "key"
+        ],
+        "security": [
+          {
+            "bearer": []
+          }
+        ],
+        "parameters": [
+          {
+            "name": "If-Match",
+            "in": "header",
+            "required": false,
+            "description": "Permit revision from ETag, changes fail with 412 when permit was modified since",
+            "schema": {
+              "type": "string"
+            }
+          }
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/PermitPatch"
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "Permit",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Permit"
+                }
+              }
+            },
+            "headers": {
+              "ETag": {
+                "description": "Permit revision, send it back in If-Match to make changes conditional",
+                "schema": {
+                  "type": "string"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          },
+          "409": {
+            "$ref": "#/components/responses/Conflict"
+          },
+          "405": {
+            "$ref": "#/components/responses/ReadOnly"
+          },
+          "412": {
+            "$ref": "#/components/responses/PreconditionFailed"
+          },
+          "500": {
+            "$ref": "#/components/responses/ServerError"
+          }
+        }
+      },
+      "delete": {
+        "summary": "Delete permit",
+        "description": "Requires permit:admin scope.",
+        "tags": [
+          "key"
+        ],
+        "security": [
+          {
+            "bearer": []
+          }
+        ],
+        "parameters": [
+          {
+            "name": "If-Match",
+            "in": "header",
+            "required": false,
+            "description": "Permit revision from ETag, changes fail with 412 when permit was modified since",
+            "schema": {
+              "type": "string"
+            }
+          }
+        ],
+        "responses": {
+          "204": {
+            "description": "Permit moved to trash"
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          },
+          "405": {
+            "$ref": "#/components/responses/ReadOnly"
+          },
+          "412": {
+            "$ref": "#/components/responses/PreconditionFailed"
+          },
+          "500": {
+            "$ref": "#/components/responses/ServerError"
+          }
+        }
+      }
+    },
+    "/key/{key}/revoke": {
+      "parameters": [
+        {
+          "name": "key",
+          "in": "path",
+          "required": true,
+          "description": "Permit key",
+          "schema": {
+            "type": "string"
+          }
+        }
+      ],
+      "post": {
+        "summary": "Revoke permit",
+        "description": "Requires permit:admin scope.",
+        "tags": [
+          "key"
+        ],
+        "security": [
+          {
+            "bearer": []
+          }
+        ],
+        "parameters": [
+          {
+            "name": "If-Match",
+            "in": "header",
+            "required": false,
+            "description": "Permit revision from ETag, changes fail with 412 when permit was modified since",
+            "schema": {
+              "type": "string"
+            }
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "Permit",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Permit"
+                }
+              }
+            },
+            "headers": {
+              "ETag": {
+                "description": "Permit revision, send it back in If-Match to make changes conditional",
+                "schema": {
+                  "type": "string"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          },
+          "405": {
+            "$ref": "#/components/responses/ReadOnly"
+          },
+          "412": {
+            "$ref": "#/components/responses/PreconditionFailed"
+          },
+          "500": {
+            "$ref": "#/components/responses/ServerError"
+          }
+        }
+      }
+    },
+    "/key/{key}/enable": {
+      "parameters": [
+        {
+          "name": "key",
+          "in": "path",
+          "required": true,
+          "description": "Permit key",
+          "schema": {
+            "type": "string"
+          }
+        }
+      ],
+      "post": {
+        "summary": "Enable revoked permit",
+        "description": "Fails with 409 when the unique domain rule is on and another active permit holds the domain. Requires permit:admin scope.",
+        "tags": [
+          "key"
+        ],
+        "security": [
+          {
+            "bearer": []
+          }
+        ],
+        "parameters": [
+          {
+            "name": "If-Match",
+            "in": "header",
+            "required": false,
+            "description": "Permit revision from ETag, changes fail with 412 when permit was modified since",
+            "schema": {
+              "type": "string"
+            }
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "Permit",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Permit"
+                }
+              }
+            },
+            "headers": {
+              "ETag": {
+                "description": "Permit revision, send it back in If-Match to make changes conditional",
+                "schema": {
+                  "type": "string"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          },
+          "409": {
+            "$ref": "#/components/responses/Conflict"
+          },
+          "405": {
+            "$ref": "#/components/responses/ReadOnly"
+          },
+          "412": {
+            "$ref": "#/components/responses/PreconditionFailed"
+          },
+          "500": {
+            "$ref": "#/components/responses/ServerError"
+          }
+        }
+      }
+    },
+    "/key/{key}/extend": {
+      "parameters": [
+        {
+          "name": "key",
+          "in": "path",
+          "required": true,
+          "description": "Permit key",
+          "schema": {
+            "type": "string"
+          }
+        }
+      ],
+      "post": {
+        "summary": "Change permit expiration",
+        "description": "Fails with 409 when the unique domain rule is on and another active permit holds the domain. Requires permit:admin scope.",
+        "tags": [
+          "key"
+        ],
+        "security": [
+          {
+            "bearer": []
+          }
+        ],
+        "parameters": [
+          {
+            "name": "If-Match",
+            "in": "header",
+            "required": false,
+            "description": "Permit revision from ETag, changes fail with 412 when permit was modified since",
+            "schema": {
+              "type": "string"
+            }
+          }
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/PermitExtend"
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "Permit",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Permit"
+                }
+              }
+            },
+            "headers": {
+              "ETag": {
+                "description": "Permit revision, send it back in If-Match to make changes conditional",
+                "schema": {
+                  "type": "string"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          },
+          "409": {
+            "$ref": "#/components/responses/Conflict"
+          },
+          "405": {
+            "$ref": "#/components/responses/ReadOnly"
+          },
+          "412": {
+            "$ref": "#/components/responses/PreconditionFailed"
+          },
+          "500": {
+            "$ref": "#/components/responses/ServerError"
+          }
+        }
+      }
+    },
+    "/auth/login": {
+      "post": {
+        "summary": "Log in with username and password",
+        "description": "Available when token signing is configured. Failed logins are counted per client IP (see 403) and per user name; user name with too many failed logins gets 429 until the window ends.",
+        "tags": [
+          "auth"
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/LoginRequest"
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "Access and refresh tokens",
+            "headers": {
+              "Cache-Control": {
+                "schema": {
+                  "type": "string"
+                }
+              }
+            },
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/TokenResponse"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "401": {
+            "description": "Authentication failed",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Error"
+                }
+              }
+            }
+          },
+          "403": {
+            "description": "Client is temporarily banned",
+            "headers": {
+              "Retry-After": {
+                "description": "Seconds until the ban is lifted",
+                "schema": {
+                  "type": "integer"
+                }
+              }
+            },
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Error"
+                }
+              }
+            }
+          },
+          "429": {
+            "$ref": "#/components/responses/TooManyRequests"
+          },
+          "500": {
+            "$ref": "#/components/responses/ServerError"
+          }
+        }
+      }
+    },
+    "/auth/refresh": {
+      "post": {
+        "summary": "Exchange refresh token for new tokens",
+        "description": "Available when token signing is configured.",
+        "tags": [
+          "auth"
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/RefreshRequest"
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "Access and refresh tokens",
+            "headers": {
+              "Cache-Control": {
+                "schema": {
+                  "type": "string"
+                }
+              }
+            },
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/TokenResponse"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "401": {
+            "description": "Authentication failed",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Error"
+                }
+              }
+            }
+          },
+          "403": {
+            "description": "Client is temporarily banned",
+            "headers": {
+              "Retry-After": {
+                "description": "Seconds until the ban is lifted",
+                "schema": {
+                  "type": "integer"
+                }
+              }
+            },
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Error"
+                }
+              }
+            }
+          },
+          "429": {
+            "$ref": "#/components/responses/TooManyRequests"
+          },
+          "500": {
+            "$ref": "#/components/responses/ServerError"
+          }
+        }
+      }
+    },
+    "/audit": {
+      "get": {
+        "summary": "Query audit log",
+        "description": "Requires permit:admin scope.",
+        "tags": [
+          "audit"
+        ],
+        "security": [
+          {
+            "bearer": []
+          }
+        ],
+        "parameters": [
+          {
+            "name": "key",
+            "in": "query",
+            "required": false,
+            "description": "Permit key",
+            "schema": {
+              "type": "string"
+            }
+          },
+          {
+            "name": "actor",
+            "in": "query",
+            "required": false,
+            "description": "Actor",
+            "schema": {
+              "type": "string"
+            }
+          },
+          {
+            "name": "action",
+            "in": "query",
+            "required": false,
+            "description": "Action",
+            "schema": {
+              "type": "string"
+            }
+          },
+          {
+            "name": "since",
+            "in": "query",
+            "required": false,
+            "description": "Records since, RFC3339",
+            "schema": {
+              "type": "string",
+              "format": "date-time"
+            }
+          },
+          {
+            "name": "until",
+            "in": "query",
+            "required": false,
+            "description": "Records until, RFC3339",
+            "schema": {
+              "type": "string",
+              "format": "date-time"
+            }
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "Matching records",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "array",
+                  "items": {
+                    "$ref": "#/components/schemas/AuditRecord"
+                  }
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          },
+          "500": {
+            "$ref": "#/components/responses/ServerError"
+          }
+        }
+      }
+    },
+    "/audit/verify": {
+      "get": {
+        "summary": "Verify audit log hash chain",
+        "description": "Checks the hash chain and that the log reaches the head recorded in the anchor file, so records removed from the end are reported. Requires permit:admin scope.",
+        "tags": [
+          "audit"
+        ],
+        "security": [
+          {
+            "bearer": []
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "Verification result",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/AuditVerification"
+                }
+              }
+            }
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          }
+        }
+      }
+    },
+    "/replication/changes": {
+      "get": {
+        "summary": "Changes since sequence",
+        "description": "Primary only, requires permit:replicate scope.",
+        "tags": [
+          "replication"
+        ],
+        "security": [
+          {
+            "bearer": []
+          }
+        ],
+        "parameters": [
+          {
+            "name": "since",
+            "in": "query",
+            "required": false,
+            "description": "Sequence of the last applied change",
+            "schema": {
+              "type": "integer"
+            }
+          },
+          {
+            "name": "limit",
+            "in": "query",
+            "required": false,
+            "description": "At most this many changes, up to 1000",
+            "schema": {
+              "type": "integer"
+            }
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "Changed records",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Changes"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          },
+          "410": {
+            "description": "Changes after since were compacted away, load the snapshot again",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Error"
+                }
+              }
+            }
+          },
+          "500": {
+            "$ref": "#/components/responses/ServerError"
+          }
+        }
+      }
+    },
+    "/replication/snapshot": {
+      "get": {
+        "summary": "Snapshot of all records",
+        "description": "Primary only, requires permit:replicate scope.",
+        "tags": [
+          "replication"
+        ],
+        "security": [
+          {
+            "bearer": []
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "Head sequence followed by one record per line and a trailer with the record count, {\"end\":true,\"count\":N}; stream without the trailer was cut short",
+            "content": {
+              "application/x-ndjson": {
+                "schema": {
+                  "type": "string"
+                }
+              }
+            }
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          }
+        }
+      }
+    },
+    "/replication/status": {
+      "get": {
+        "summary": "Replication status",
+        "description": "Replicas only, requires permit:read scope.",
+        "tags": [
+          "replication"
+        ],
+        "security": [
+          {
+            "bearer": []
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "Status",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/ReplicaStatus"
+                }
+              }
+            }
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          }
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "bearer": {
+        "type": "http",
+        "scheme": "bearer",
+        "bearerFormat": "JWT"
+      }
+    },
+    "schemas": {
+      "Permit": {
+        "type": "object",
+        "required": [
+          "version",
+          "key",
+          "domain",
+          "valid",
+          "attributes",
+          "contact",
+          "entity",
+          "issued",
+          "revision"
+        ],
+        "properties": {
+          "version": {
+            "type": "integer"
+          },
+          "key": {
+            "type": "string"
+          },
+          "domain": {
+            "type": "string"
+          },
+          "expires": {
+            "type": "string",
+            "format": "date-time",
+            "description": "Permit is not valid after this time, no expiration when missing"
+          },
+          "valid": {
+            "type": "boolean",
+            "description": "False when permit is revoked"
+          },
+          "attributes": {
+            "type": "object",
+            "nullable": true,
+            "description": "Limits and features, -1 for unlimited",
+            "additionalProperties": {
+              "type": "integer"
+            }
+          },
+          "contact": {
+            "type": "string"
+          },
+          "entity": {
+            "type": "string"
+          },
+          "issued": {
+            "type": "string",
+            "format": "date-time"
+          },
+          "plan": {
+            "type": "string",
+            "description": "Plan the permit was issued under: trial, standard or unlimited"
+          },
+          "revision": {
+            "type": "integer",
+            "description": "Incremented on every change, same as ETag"
+          }
+        }
+      },
+      "Error": {
+        "type": "object",
+        "required": [
+          "error",
+          "code",
+          "message"
+        ],
+        "properties": {
+          "error": {
+            "type": "string",
+            "description": "Same as message, kept for clients that do not know error codes"
+          },
+          "code": {
+            "type": "string",
+            "enum": [
+              "KEY_NOT_FOUND",
+              "KEY_DELETED",
+              "DOMAIN_MISMATCH",
+              "DOMAIN_TAKEN",
+              "PERMIT_EXPIRED",
+              "PERMIT_REVOKED",
+              "INVALID_DOMAIN",
+              "INVALID_REQUEST",
+              "REQUEST_TOO_LARGE",
+              "UNAUTHORIZED",
+              "FORBIDDEN",
+              "RATE_LIMITED",
+              "CLIENT_BANNED",
+              "NOT_FOUND",
+              "REVISION_MISMATCH",
+              "READ_ONLY",
+              "CURSOR_EXPIRED",
+              "SERVER_ERROR"
+            ]
+          },
+          "message": {
+            "type": "string"
+          },
+          "requestId": {
+            "type": "string"
+          }
+        }
+      },
+      "CheckRequest": {
+        "type": "object",
+        "required": [
+          "key",
+          "domain"
+        ],
+        "properties": {
+          "key": {
+            "type": "string"
+          },
+          "domain": {
+            "type": "string"
+          },
+          "attributes": {
+            "type": "object",
+            "description": "Current usage, logged only",
+            "additionalProperties": {
+              "type": "integer"
+            }
+          }
+        }
+      },
+      "CheckResponse": {
+        "type": "object",
+        "description": "Check result envelope, API version 2",
+        "required": [
+          "status",
+          "warnings",
+          "serverTime"
+        ],
+        "properties": {
+          "status": {
+            "type": "string",
+            "enum": [
+              "valid",
+              "invalid",
+              "error"
+            ]
+          },
+          "reason": {
+            "type": "string",
+            "enum": [
+              "permit-not-found",
+              "permit-not-valid",
+              "invalid-domain",
+              "invalid-request",
+              "server-error"
+            ]
+          },
+          "code": {
+            "type": "string",
+            "enum": [
+              "KEY_NOT_FOUND",
+              "KEY_DELETED",
+              "DOMAIN_MISMATCH",
+              "DOMAIN_TAKEN",
+              "PERMIT_EXPIRED",
+              "PERMIT_REVOKED",
+              "INVALID_DOMAIN",
+              "INVALID_REQUEST",
+              "REQUEST_TOO_LARGE",
+              "UNAUTHORIZED",
+              "FORBIDDEN",
+              "RATE_LIMITED",
+              "CLIENT_BANNED",
+              "NOT_FOUND",
+              "REVISION_MISMATCH",
+              "READ_ONLY",
+              "SERVER_ERROR"
+            ]
+          },
+          "message": {
+            "type": "string"
+          },
+          "warnings": {
+            "type": "array",
+            "items": {
+              "type": "string",
+              "enum": [
+                "expires-soon",
+                "trial"
+              ]
+            }
+          },
+          "serverTime": {
+            "type": "string",
+            "format": "date-time"
+          },
+          "permit": {
+            "$ref": "#/components/schemas/Permit"
+          }
+        }
+      },
+      "BatchCheckRequest": {
+        "type": "object",
+        "required": [
+          "checks"
+        ],
+        "properties": {
+          "checks": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "required": [
+                "key",
+                "domain"
+              ],
+              "properties": {
+                "key": {
+                  "type": "string"
+                },
+                "domain": {
+                  "type": "string"
+                }
+              }
+            }
+          }
+        }
+      },
+      "BatchCheckResult": {
+        "type": "object",
+        "required": [
+          "key",
+          "domain",
+          "status"
+        ],
+        "properties": {
+          "key": {
+            "type": "string"
+          },
+          "domain": {
+            "type": "string"
+          },
+          "status": {
+            "type": "integer",
+            "description": "HTTP status the single check would respond with"
+          },
+          "error": {
+            "type": "string"
+          },
+          "code": {
+            "type": "string",
+            "enum": [
+              "KEY_NOT_FOUND",
+              "KEY_DELETED",
+              "DOMAIN_MISMATCH",
+              "DOMAIN_TAKEN",
+              "PERMIT_EXPIRED",
+              "PERMIT_REVOKED",
+              "INVALID_DOMAIN",
+              "INVALID_REQUEST",
+              "REQUEST_TOO_LARGE",
+              "UNAUTHORIZED",
+              "FORBIDDEN",
+              "RATE_LIMITED",
+              "CLIENT_BANNED",
+              "NOT_FOUND",
+              "REVISION_MISMATCH",
+              "READ_ONLY",
+              "SERVER_ERROR"
+            ]
+          },
+          "permit": {
+            "$ref": "#/components/schemas/Permit"
+          }
+        }
+      },
+      "BatchCheckResponse": {
+        "type": "object",
+        "required": [
+          "results"
+        ],
+        "properties": {
+          "results": {
+            "type": "array",
+            "items": {
+              "$ref": "#/components/schemas/BatchCheckResult"
+            }
+          }
+        }
+      },
+      "BatchCheckResultV2": {
+        "type": "object",
+        "required": [
+          "key",
+          "domain",
+          "status",
+          "warnings",
+          "serverTime"
+        ],
+        "properties": {
+          "key": {
+            "type": "string"
+          },
+          "domain": {
+            "type": "string"
+          },
+          "status": {
+            "type": "string",
+            "enum": [
+              "valid",
+              "invalid",
+              "error"
+            ]
+          },
+          "reason": {
+            "type": "string",
+            "enum": [
+              "permit-not-found",
+              "permit-not-valid",
+              "invalid-domain",
+              "invalid-request",
+              "server-error"
+            ]
+          },
+          "code": {
+            "type": "string",
+            "enum": [
+              "KEY_NOT_FOUND",
+              "KEY_DELETED",
+              "DOMAIN_MISMATCH",
+              "DOMAIN_TAKEN",
+              "PERMIT_EXPIRED",
+              "PERMIT_REVOKED",
+              "INVALID_DOMAIN",
+              "INVALID_REQUEST",
+              "REQUEST_TOO_LARGE",
+              "UNAUTHORIZED",
+              "FORBIDDEN",
+              "RATE_LIMITED",
+              "CLIENT_BANNED",
+              "NOT_FOUND",
+              "REVISION_MISMATCH",
+              "READ_ONLY",
+              "SERVER_ERROR"
+            ]
+          },
+          "message": {
+            "type": "string"
+          },
+          "warnings": {
+            "type": "array",
+            "items": {
+              "type": "string",
+              "enum": [
+                "expires-soon",
+                "trial"
+              ]
+            }
+          },
+          "serverTime": {
+            "type": "string",
+            "format": "date-time"
+          },
+          "permit": {
+            "$ref": "#/components/schemas/Permit"
+          }
+        }
+      },
+      "BatchCheckResponseV2": {
+        "type": "object",
+        "required": [
+          "results"
+        ],
+        "properties": {
+          "results": {
+            "type": "array",
+            "items": {
+              "$ref": "#/components/schemas/BatchCheckResultV2"
+            }
+          }
+        }
+      },
+      "PermitList": {
+        "type": "object",
+        "required": [
+          "permits"
+        ],
+        "properties": {
+          "permits": {
+            "type": "array",
+            "items": {
+              "$ref": "#/components/schemas/Permit"
+            }
+          },
+          "next": {
+            "type": "string",
+            "description": "Cursor of the next page, missing on the last page"
+          }
+        }
+      },
+      "PermitCreate": {
+        "type": "object",
+        "required": [
+          "domain"
+        ],
+        "properties": {
+          "domain": {
+            "type": "string"
+          },
+          "contact": {
+            "type": "string"
+          },
+          "entity": {
+            "type": "string"
+          },
+          "type": {
+            "type": "string",
+            "enum": [
+              "trial",
+              "standard"
+            ],
+            "description": "Trial permits expire in 14 days, standard in a year"
+          },
+          "attributes": {
+            "type": "object",
+            "description": "Unknown attributes are ignored, missing get defaults",
+            "additionalProperties": {
+              "type": "integer"
+            }
+          }
+        }
+      },
+      "PermitPatch": {
+        "type": "object",
+        "description": "Only fields present are changed, attributes are merged",
+        "properties": {
+          "domain": {
+            "type": "string"
+          },
+          "contact": {
+            "type": "string"
+          },
+          "entity": {
+            "type": "string"
+          },
+          "plan": {
+            "type": "string",
+            "enum": [
+              "trial",
+              "standard",
+              "unlimited"
+            ]
+          },
+          "attributes": {
+            "type": "object",
+            "additionalProperties": {
+              "type": "integer"
+            }
+          }
+        }
+      },
+      "PermitExtend": {
+        "type": "object",
+        "description": "Either exact expiration time or number of months from now",
+        "properties": {
+          "expires": {
+            "type": "string",
+            "format": "date-time"
+          },
+          "months": {
+            "type": "integer"
+          }
+        }
+      },
+      "LoginRequest": {
+        "type": "object",
+        "required": [
+          "username",
+          "password"
+        ],
+        "properties": {
+          "username": {
+            "type": "string"
+          },
+          "password": {
+            "type": "string"
+          }
+        }
+      },
+      "RefreshRequest": {
+        "type": "object",
+        "required": [
+          "refreshToken"
+        ],
+        "properties": {
+          "refreshToken": {
+            "type": "string",
+            "description": "Single-use token from previous login or refresh"
+          }
+        }
+      },
+      "TokenResponse": {
+        "type": "object",
+        "required": [
+          "accessToken",
+          "tokenType",
+          "expiresIn",
+          "refreshToken",
+          "roles"
+        ],
+        "properties": {
+          "accessToken": {
+            "type": "string"
+          },
+          "tokenType": {
+            "type": "string",
+            "enum": [
+              "Bearer"
+            ]
+          },
+          "expiresIn": {
+            "type": "integer",
+            "description": "Seconds until access token expires"
+          },
+          "refreshToken": {
+            "type": "string"
+          },
+          "roles": {
+            "type": "array",
+            "items": {
+              "type": "string",
+              "enum": [
+                "admin",
+                "issuer",
+                "reader"
+              ]
+            }
+          }
+        }
+      },
+      "AuditRecord": {
+        "type": "object",
+        "required": [
+          "seq",
+          "time",
+          "actor",
+          "action",
+          "key",
+          "prevHash",
+          "hash"
+        ],
+        "properties": {
+          "seq": {
+            "type": "integer"
+          },
+          "time": {
+            "type": "string",
+            "format": "date-time"
+          },
+          "actor": {
+            "type": "string"
+          },
+          "ip": {
+            "type": "string"
+          },
+          "action": {
+            "type": "string"
+          },
+          "key": {
+            "type": "string"
+          },
+          "before": {
+            "$ref": "#/components/schemas/Permit"
+          },
+          "after": {
+            "$ref": "#/components/schemas/Permit"
+          },
+          "prevHash": {
+            "type": "string"
+          },
+          "hash": {
+            "type": "string"
+          }
+        }
+      },
+      "AuditVerification": {
+        "type": "object",
+        "required": [
+          "valid",
+          "verified"
+        ],
+        "properties": {
+          "valid": {
+            "type": "boolean"
+          },
+          "verified": {
+            "type": "integer",
+            "description": "Number of verified records"
+          },
+          "error": {
+            "type": "string"
+          }
+        }
+      },
+      "Revision": {
+        "type": "object",
+        "required": [
+          "number",
+          "time",
+          "actor",
+          "action",
+          "permit"
+        ],
+        "properties": {
+          "number": {
+            "type": "integer"
+          },
+          "time": {
+            "type": "string",
+            "format": "date-time"
+          },
+          "actor": {
+            "type": "string"
+          },
+          "action": {
+            "type": "string"
+          },
+          "permit": {
+            "allOf": [
+              {
+                "$ref": "#/components/schemas/Permit"
+              }
+            ],
+            "nullable": true,
+            "description": "State after the change, null when permit was deleted"
+          }
+        }
+      },
+      "Trashed": {
+        "type": "object",
+        "required": [
+          "permit",
+          "deleted",
+          "actor"
+        ],
+        "properties": {
+          "permit": {
+            "$ref": "#/components/schemas/Permit"
+          },
+          "deleted": {
+            "type": "string",
+            "format": "date-time"
+          },
+          "actor": {
+            "type": "string"
+          }
+        }
+      },
+      "Record": {
+        "type": "object",
+        "required": [
+          "key"
+        ],
+        "properties": {
+          "key": {
+            "type": "string"
+          },
+          "permit": {
+            "$ref": "#/components/schemas/Permit"
+          },
+          "trashed": {
+            "$ref": "#/components/schemas/Trashed"
+          },
+          "history": {
+            "type": "array",
+            "items": {
+              "$ref": "#/components/schemas/Revision"
+            }
+          }
+        }
+      },
+      "Changes": {
+        "type": "object",
+        "required": [
+          "head",
+          "changes"
+        ],
+        "properties": {
+          "head": {
+            "type": "integer",
+            "description": "Sequence of the latest change"
+          },
+          "changes": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "required": [
+                "seq",
+                "record"
+              ],
+              "properties": {
+                "seq": {
+                  "type": "integer"
+                },
+                "record": {
+                  "$ref": "#/components/schemas/Record"
+                }
+              }
+            }
+          }
+        }
+      },
+      "ReplicaStatus": {
+        "type": "object",
+        "required": [
+          "primary",
+          "cursor",
+          "head",
+          "lag",
+          "lastSync"
+        ],
+        "properties": {
+          "primary": {
+            "type": "string"
+          },
+          "cursor": {
+            "type": "integer"
+          },
+          "head": {
+            "type": "integer"
+          },
+          "lag": {
+            "type": "integer"
+          },
+          "lastSync": {
+            "type": "string",
+            "format": "date-time"
+          },
+          "lastError": {
+            "type": "string"
+          }
+        }
+      }
+    },
+    "responses": {
+      "BadRequest": {
+        "description": "Invalid request",
+        "content": {
+          "application/json": {
+            "schema": {
+              "$ref": "#/components/schemas/Error"
+            }
+          }
+        }
+      },
+      "Unauthorized": {
+        "description": "Missing or invalid bearer token",
+        "content": {
+          "application/json": {
+            "schema": {
+              "$ref": "#/components/schemas/Error"
+            }
+          }
+        }
+      },
+      "Forbidden": {
+        "description": "Token does not grant the required scope",
+        "content": {
+          "application/json": {
+            "schema": {
+              "$ref": "#/components/schemas/Error"
+            }
+          }
+        }
+      },
+      "NotFound": {
+        "description": "Permit not found",
+        "content": {
+          "application/json": {
+            "schema": {
+              "$ref": "#/components/schemas/Error"
+            }
+          }
+        }
+      },
+      "Gone": {
+        "description": "Permit deleted",
+        "content": {
+          "application/json": {
+            "schema": {
+              "$ref": "#/components/schemas/Error"
+            }
+          }
+        }
+      },
+      "ReadOnly": {
+        "description": "Replicas do not accept changes",
+        "content": {
+          "application/json": {
+            "schema": {
+              "$ref": "#/components/schemas/Error"
+            }
+          }
+        }
+      },
+      "Conflict": {
+        "description": "Domain already has an active permit",
+        "content": {
+          "application/json": {
+            "schema": {
+              "$ref": "#/components/schemas/Error"
+            }
+          }
+        }
+      },
+      "PreconditionFailed": {
+        "description": "Permit was modified since the revision in If-Match",
+        "content": {
+          "application/json": {
+            "schema": {
+              "$ref": "#/components/schemas/Error"
+            }
+          }
+        }
+      },
+      "TooManyRequests": {
+        "description": "Rate limit exceeded",
+        "headers": {
+          "Retry-After": {
+            "description": "Seconds until the limit resets",
+            "schema": {
+              "type": "integer"
+            }
+          }
+        },
+        "content": {
+          "application/json": {
+            "schema": {
+              "$ref": "#/components/schemas/Error"
+            }
+          }
+        }
+      },
+      "ServerError": {
+        "description": "Unexpected error",
+        "content": {
+          "application/json": {
+            "schema": {
+              "$ref": "#/components/schemas/Error"
+            }
+          }
+        }
+      }
+    }
+  }
+}
+`
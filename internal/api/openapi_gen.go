@@ -0,0 +1,41 @@
+//go:build ignore
+// +build ignore
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// Compiles openapi.json into openapi_doc.go as openAPIDocument, run with go generate
+//
+// Document is kept as a raw string so that changes to it show up in diffs of the generated file.
+func main() {
+	doc, err := ioutil.ReadFile("openapi.json")
+	if err != nil {
+		fail(err)
+	}
+
+	if bytes.ContainsRune(doc, '`') {
+		fail(fmt.Errorf("openapi.json can not contain backticks"))
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("// Code generated by openapi_gen.go from openapi.json; DO NOT EDIT.\n\n")
+	buf.WriteString("package api\n\n")
+	buf.WriteString("const openAPIDocument = `")
+	buf.Write(doc)
+	buf.WriteString("`\n")
+
+	if err = ioutil.WriteFile("openapi_doc.go", buf.Bytes(), 0644); err != nil {
+		fail(err)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "could not generate OpenAPI document: "+err.Error())
+	os.Exit(1)
+}
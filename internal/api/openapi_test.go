@@ -0,0 +1,370 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/crusttech/permit/internal/audit"
+	"github.com/crusttech/permit/internal/auth"
+	"github.com/crusttech/permit/internal/guard"
+	"github.com/crusttech/permit/internal/metrics"
+	"github.com/crusttech/permit/internal/openapi"
+	"github.com/crusttech/permit/internal/ratelimit"
+	"github.com/crusttech/permit/internal/replica"
+	"github.com/crusttech/permit/internal/store/fs"
+	"github.com/crusttech/permit/internal/users"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+// Contract tests
+//
+// Requests go through the real router and handlers, every response is
+// validated against the OpenAPI document. Tests fail when a response is not
+// documented, when a documented operation is not exercised or when a route
+// is missing from the document.
+
+type (
+	contract struct {
+		t       *testing.T
+		spec    *openapi.Spec
+		router  *gin.Engine
+		tokens  map[string]string
+		covered map[openapi.Operation]bool
+		metrics *metrics.Registry
+	}
+)
+
+const (
+	testSecret   = "contract-test-secret"
+	testPassword = "correct horse battery"
+)
+
+var routeParam = regexp.MustCompile(`:([a-zA-Z]+)`)
+
+func assert(t *testing.T, ok bool, format string, args ...interface{}) bool {
+	if !ok {
+		t.Fatalf(format, args...)
+	}
+	return ok
+}
+
+func newContract(t *testing.T, dir string, primary string, covered map[openapi.Operation]bool) *contract {
+	// Compiled in document must be generated from the current openapi.json
+	doc, err := ioutil.ReadFile("openapi.json")
+	assert(t, err == nil, "could not read document: %v", err)
+	assert(t, string(doc) == openAPIDocument, "openapi.json changed, run go generate")
+
+	spec, err := openapi.Parse(doc)
+	assert(t, err == nil, "invalid OpenAPI document: %v", err)
+	spec.Strict = true
+
+	backend, err := fs.NewPermitStorage(mkdir(t, dir, "store"))
+	assert(t, err == nil, "could not create storage: %v", err)
+
+	auditLog, err := audit.NewLog(filepath.Join(dir, "audit", "audit.log"), "", nil)
+	assert(t, err == nil, "could not create audit log: %v", err)
+
+	uu, err := users.NewStore(mkdir(t, dir, "users"))
+	assert(t, err == nil, "could not create user store: %v", err)
+	assert(t, uu.Add("admin", testPassword, []string{"admin"}) == nil, "could not add user")
+
+	bans, err := guard.NewStore(mkdir(t, dir, "bans"))
+	assert(t, err == nil, "could not create ban store: %v", err)
+
+	verifier, err := auth.NewVerifier(map[string][]byte{"test": []byte(testSecret)}, "")
+	assert(t, err == nil, "could not create verifier: %v", err)
+
+	signer, err := auth.NewSigner("test", []byte(testSecret))
+	assert(t, err == nil, "could not create signer: %v", err)
+
+	verifier.Audience, verifier.Issuer = "permit", "test"
+	signer.Audience, signer.Issuer = "permit", "test"
+
+	var (
+		storage = audit.Storage(backend, auditLog)
+		g       = guard.New(bans, guard.Policy{Threshold: 1000, Window: time.Hour, BanDuration: time.Minute, MaxDuration: time.Hour, Forget: time.Hour})
+
+		rr = routes{
+			storage:       storage,
+			auditLog:      auditLog,
+			authenticated: authMiddleware(verifier),
+			uniqueDomain:  true,
+			primary:       primary,
+			authLogin:     endpointAuthLogin(uu, signer, time.Hour, ratelimit.New(2, time.Hour), g),
+			authRefresh:   endpointAuthRefresh(uu, signer, time.Hour, g),
+			authLimits:    []gin.HandlerFunc{banMiddleware(g)},
+			checkLimits:   []gin.HandlerFunc{banMiddleware(g)},
+			checkGuard:    g,
+			keyLimiter:    ratelimit.New(1000, time.Hour),
+			callerLimiter: ratelimit.New(1000, time.Hour),
+			batchMax:      3,
+		}
+	)
+
+	if primary != "" {
+		rr.replicaStatus = endpointReplicationStatus(replica.New(primary, "", storage, filepath.Join(dir, "replica.json"), time.Minute))
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	reg := metrics.NewRegistry()
+	router.Use(requestLogMiddleware(zap.NewNop(), nil), metricsMiddleware(newAPIMetrics(reg)))
+	rr.register(router)
+
+	c := &contract{t: t, spec: spec, router: router, tokens: map[string]string{}, covered: covered, metrics: reg}
+	for _, scope := range []string{auth.ScopeAdmin, auth.ScopeRead, auth.ScopeCheck, auth.ScopeReplicate} {
+		c.tokens[scope], _, err = signer.Sign("contract", []string{scope}, nil)
+		assert(t, err == nil, "could not sign token: %v", err)
+	}
+
+	return c
+}
+
+// do sends request and validates response against the document
+func (c *contract) do(method, path, scope string, body interface{}, header ...string) *httptest.ResponseRecorder {
+	var data []byte
+	switch b := body.(type) {
+	case nil:
+	case string:
+		data = []byte(b)
+	default:
+		data, _ = json.Marshal(b)
+	}
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	if scope != "" {
+		req.Header.Set("Authorization", "Bearer "+c.tokens[scope])
+	}
+
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+
+	rec := httptest.NewRecorder()
+	c.router.ServeHTTP(rec, req)
+
+	op, err := c.spec.ValidateResponse(method, documentedPath(c.spec, method, req.URL.Path), rec.Code, rec.Header().Get("Content-Type"), rec.Body.Bytes())
+	assert(c.t, err == nil, "%s %s: response does not match the document: %v\n%s", method, path, err, rec.Body.String())
+
+	c.covered[op] = true
+	return rec
+}
+
+// expect sends request and checks the status
+func (c *contract) expect(status int, method, path, scope string, body interface{}, header ...string) *httptest.ResponseRecorder {
+	rec := c.do(method, path, scope, body, header...)
+	assert(c.t, rec.Code == status, "%s %s: expecting status %d, got %d: %s", method, path, status, rec.Code, rec.Body.String())
+	return rec
+}
+
+// checkRoutes verifies that every registered route is documented
+func (c *contract) checkRoutes() {
+	for _, r := range c.router.Routes() {
+		if r.Path == "/" && r.Method != http.MethodGet {
+			// Catch all path answers any method, only GET is documented
+			continue
+		}
+
+		path := routeParam.ReplaceAllString(r.Path, "{$1}")
+		_, ok := c.spec.Find(r.Method, documentedPath(c.spec, r.Method, path))
+		assert(c.t, ok, "route %s %s is not documented", r.Method, r.Path)
+	}
+}
+
+// documentedPath maps versioned aliases to documented paths
+//
+// Paths under /v1 and paths under /v2 that do not differ from v1 are documented without the prefix.
+func documentedPath(spec *openapi.Spec, method, path string) string {
+	if _, ok := spec.Find(method, path); ok {
+		return path
+	}
+
+	for _, prefix := range []string{"/v1/", "/v2/"} {
+		if strings.HasPrefix(path, prefix) {
+			return path[len(prefix)-1:]
+		}
+	}
+
+	return path
+}
+
+func TestContract(t *testing.T) {
+	dir, err := ioutil.TempDir("", "permit-contract")
+	assert(t, err == nil, "could not create temp dir: %v", err)
+	defer os.RemoveAll(dir)
+
+	var (
+		covered = map[openapi.Operation]bool{}
+		c       = newContract(t, filepath.Join(dir, "primary"), "", covered)
+
+		admin, read, check, replicate = auth.ScopeAdmin, auth.ScopeRead, auth.ScopeCheck, auth.ScopeReplicate
+
+		p, q = permit.Permit{}, permit.Permit{}
+		rec  *httptest.ResponseRecorder
+	)
+
+	c.checkRoutes()
+
+	c.expect(http.StatusOK, "GET", "/", "", nil)
+
+	rec = c.expect(http.StatusOK, "GET", "/openapi.json", "", nil)
+	assert(t, rec.Body.String() == openAPIDocument, "expecting document to be served")
+
+	// Issuing
+	rec = c.expect(http.StatusOK, "POST", "/key", admin, map[string]interface{}{"domain": "example.tld", "contact": "admin@example.tld", "entity": "Example"})
+	assert(t, json.Unmarshal(rec.Body.Bytes(), &p) == nil && len(p.Key) == permit.KeyLength, "expecting permit in response")
+
+	c.expect(http.StatusOK, "POST", "/v1/key", admin, map[string]interface{}{"domain": "trial.tld", "type": "trial"})
+	c.expect(http.StatusBadRequest, "POST", "/key", admin, map[string]interface{}{"domain": "not a domain"})
+	c.expect(http.StatusUnauthorized, "POST", "/key", "", map[string]interface{}{"domain": "example.tld"})
+	c.expect(http.StatusForbidden, "POST", "/key", read, map[string]interface{}{"domain": "example.tld"})
+
+	// Reading
+	c.expect(http.StatusOK, "GET", "/key", read, nil)
+	rec = c.expect(http.StatusOK, "GET", "/v2/key?limit=1&sort=-issued", read, nil)
+	assert(t, strings.Contains(rec.Body.String(), `"next"`), "expecting next page cursor")
+	c.expect(http.StatusBadRequest, "GET", "/key?valid=maybe", read, nil)
+
+	c.expect(http.StatusOK, "GET", "/key/"+p.Key, read, nil)
+	c.expect(http.StatusNotModified, "GET", "/key/"+p.Key, read, nil, "If-None-Match", etag(&p))
+	c.expect(http.StatusNotFound, "GET", "/key/unknown", read, nil)
+
+	// Changes
+	c.expect(http.StatusOK, "PATCH", "/key/"+p.Key, admin, map[string]interface{}{"contact": "billing@example.tld", "attributes": map[string]int{"system.max-users": 10}})
+	c.expect(http.StatusBadRequest, "PATCH", "/key/"+p.Key, admin, map[string]interface{}{})
+	c.expect(http.StatusBadRequest, "PATCH", "/key/"+p.Key, admin, map[string]interface{}{"plan": "gold"})
+	c.expect(http.StatusPreconditionFailed, "PATCH", "/key/"+p.Key, admin, map[string]interface{}{"entity": "Other"}, "If-Match", `"1"`)
+	c.expect(http.StatusNotFound, "PATCH", "/key/unknown", admin, map[string]interface{}{"entity": "Other"})
+
+	c.expect(http.StatusOK, "POST", "/key/"+p.Key+"/revoke", admin, nil)
+	c.expect(http.StatusForbidden, "POST", "/key/"+p.Key+"/revoke", read, nil)
+
+	// Checks of revoked permit
+	c.expect(http.StatusUnauthorized, "POST", "/check", "", map[string]string{"key": p.Key, "domain": p.Domain})
+	rec = c.expect(http.StatusUnauthorized, "POST", "/v2/check", "", map[string]string{"key": p.Key, "domain": p.Domain})
+	assert(t, strings.Contains(rec.Body.String(), permit.CodePermitRevoked), "expecting revoked code: %s", rec.Body.String())
+	assert(t, rec.Header().Get(permit.VersionHeader) == "2", "expecting version header")
+
+	// Domain of the revoked permit is taken by another one
+	rec = c.expect(http.StatusOK, "POST", "/key", admin, map[string]interface{}{"domain": "example.tld"})
+	assert(t, json.Unmarshal(rec.Body.Bytes(), &q) == nil, "expecting permit in response")
+	c.expect(http.StatusConflict, "POST", "/key", admin, map[string]interface{}{"domain": "example.tld"})
+	c.expect(http.StatusConflict, "POST", "/key/"+p.Key+"/enable", admin, nil)
+	c.expect(http.StatusOK, "POST", "/key/"+q.Key+"/revoke", admin, nil)
+
+	c.expect(http.StatusOK, "POST", "/key/"+p.Key+"/enable", admin, nil)
+	c.expect(http.StatusConflict, "POST", "/key/"+q.Key+"/enable", admin, nil)
+	c.expect(http.StatusOK, "POST", "/key/"+p.Key+"/extend", admin, map[string]int{"months": 12})
+	c.expect(http.StatusOK, "POST", "/key/"+p.Key+"/extend", admin, map[string]time.Time{"expires": time.Now().AddDate(0, 0, 10)})
+	c.expect(http.StatusBadRequest, "POST", "/key/"+p.Key+"/extend", admin, map[string]int{})
+
+	// Checks
+	c.expect(http.StatusOK, "POST", "/check", "", map[string]string{"key": p.Key, "domain": p.Domain})
+	c.expect(http.StatusOK, "POST", "/v1/check", "", map[string]string{"key": p.Key, "domain": p.Domain})
+	c.expect(http.StatusUnauthorized, "POST", "/check", "", map[string]string{"key": "unknown", "domain": p.Domain})
+	c.expect(http.StatusBadRequest, "POST", "/check", "", map[string]string{"key": p.Key, "domain": "not a domain"})
+	c.expect(http.StatusBadRequest, "POST", "/check", "", "{")
+
+	rec = c.expect(http.StatusOK, "POST", "/v2/check", "", map[string]string{"key": p.Key, "domain": p.Domain})
+	assert(t, strings.Contains(rec.Body.String(), permit.WarningExpiresSoon), "expecting expiry warning: %s", rec.Body.String())
+	c.expect(http.StatusUnauthorized, "POST", "/v2/check", "", map[string]string{"key": p.Key, "domain": "other.tld"})
+	c.expect(http.StatusBadRequest, "POST", "/v2/check", "", map[string]string{"key": p.Key, "domain": "not a domain"})
+	c.expect(http.StatusBadRequest, "POST", "/v2/check", "", "{")
+
+	batch := map[string]interface{}{"checks": []map[string]string{
+		{"key": p.Key, "domain": p.Domain},
+		{"key": "unknown", "domain": p.Domain},
+	}}
+	c.expect(http.StatusOK, "POST", "/check/batch", check, batch)
+	c.expect(http.StatusOK, "POST", "/v2/check/batch", check, batch)
+	c.expect(http.StatusBadRequest, "POST", "/check/batch", check, map[string]interface{}{"checks": []string{}})
+	c.expect(http.StatusRequestEntityTooLarge, "POST", "/v2/check/batch", check, map[string]interface{}{"checks": make([]map[string]string, 4)})
+	c.expect(http.StatusUnauthorized, "POST", "/check/batch", "", batch)
+	c.expect(http.StatusForbidden, "POST", "/v2/check/batch", read, batch)
+
+	// Authentication
+	rec = c.expect(http.StatusOK, "POST", "/auth/login", "", map[string]string{"username": "admin", "password": testPassword})
+	tokens := tokenResponse{}
+	assert(t, json.Unmarshal(rec.Body.Bytes(), &tokens) == nil, "could not decode tokens")
+	c.expect(http.StatusUnauthorized, "POST", "/auth/login", "", map[string]string{"username": "admin", "password": "wrong password"})
+	c.expect(http.StatusBadRequest, "POST", "/auth/login", "", "{")
+
+	// User name is locked out after the second failure, even with the right password
+	c.expect(http.StatusUnauthorized, "POST", "/auth/login", "", map[string]string{"username": "Admin", "password": "wrong password"})
+	rec = c.expect(http.StatusTooManyRequests, "POST", "/auth/login", "", map[string]string{"username": "admin", "password": testPassword})
+	assert(t, rec.Header().Get("Retry-After") != "", "expecting Retry-After header on lockout")
+	c.expect(http.StatusOK, "POST", "/auth/refresh", "", map[string]string{"refreshToken": tokens.RefreshToken})
+	c.expect(http.StatusUnauthorized, "POST", "/v1/auth/refresh", "", map[string]string{"refreshToken": tokens.RefreshToken})
+
+	// Audit
+	c.expect(http.StatusOK, "GET", "/audit?key="+p.Key, admin, nil)
+	c.expect(http.StatusOK, "GET", "/audit?key=unknown", admin, nil)
+	c.expect(http.StatusBadRequest, "GET", "/audit?since=yesterday", admin, nil)
+	c.expect(http.StatusForbidden, "GET", "/audit", read, nil)
+	c.expect(http.StatusOK, "GET", "/audit/verify", admin, nil)
+
+	// Deletion
+	c.expect(http.StatusNoContent, "DELETE", "/key/"+p.Key, admin, nil)
+	c.expect(http.StatusGone, "GET", "/key/"+p.Key, read, nil)
+	c.expect(http.StatusGone, "POST", "/check", "", map[string]string{"key": p.Key, "domain": p.Domain})
+	rec = c.expect(http.StatusGone, "POST", "/v2/check", "", map[string]string{"key": p.Key, "domain": p.Domain})
+	assert(t, strings.Contains(rec.Body.String(), permit.CodeKeyDeleted), "expecting deleted code: %s", rec.Body.String())
+
+	// Deleted key is not revealed with another domain
+	rec = c.expect(http.StatusUnauthorized, "POST", "/v2/check", "", map[string]string{"key": p.Key, "domain": "other.tld"})
+	assert(t, strings.Contains(rec.Body.String(), permit.CodeKeyNotFound), "expecting not found code: %s", rec.Body.String())
+
+	// Replication, primary
+	c.expect(http.StatusOK, "GET", "/replication/changes?since=0", replicate, nil)
+	c.expect(http.StatusBadRequest, "GET", "/replication/changes?since=first", replicate, nil)
+	c.expect(http.StatusForbidden, "GET", "/replication/changes", read, nil)
+	rec = c.expect(http.StatusOK, "GET", "/replication/snapshot", replicate, nil)
+	assert(t, strings.Count(rec.Body.String(), "\n") == 5, "expecting head, three records and trailer in snapshot: %s", rec.Body.String())
+	assert(t, strings.HasSuffix(rec.Body.String(), `{"end":true,"count":3}`+"\n"), "expecting trailer with record count: %s", rec.Body.String())
+
+	// Replica
+	r := newContract(t, filepath.Join(dir, "replica"), "http://primary.example.tld", covered)
+	r.checkRoutes()
+	r.expect(http.StatusOK, "GET", "/replication/status", read, nil)
+	r.expect(http.StatusMethodNotAllowed, "POST", "/key", admin, map[string]interface{}{"domain": "example.tld"})
+
+	for _, op := range c.spec.Operations() {
+		assert(t, covered[op], "operation %s not covered by contract tests", op)
+	}
+
+	// Metrics collected along the way, undocumented paths are not labeled with their path
+	c.router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/no/such/path", nil))
+
+	var buf bytes.Buffer
+	assert(t, c.metrics.Write(&buf) == nil, "could not write metrics")
+	for _, line := range []string{
+		`permit_checks_total{code="OK"} `,
+		`permit_checks_total{code="KEY_NOT_FOUND"} `,
+		`permit_permits_issued_total{plan="standard"} `,
+		`permit_http_request_duration_seconds_count{method="GET",route="/key/:key",status="200"} `,
+		`permit_http_request_duration_seconds_count{method="GET",route="unmatched",status="404"} 1`,
+	} {
+		assert(t, strings.Contains(buf.String(), line), "expecting %q in metrics:\n%s", line, buf.String())
+	}
+
+	assert(t, !strings.Contains(buf.String(), p.Key), "expecting no permit keys in metrics")
+}
+
+func mkdir(t *testing.T, dir, name string) string {
+	path := filepath.Join(dir, name)
+	assert(t, os.MkdirAll(path, 0755) == nil, "could not create %s", path)
+	return path
+}
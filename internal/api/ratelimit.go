@@ -0,0 +1,68 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/internal/ratelimit"
+	"github.com/crusttech/permit/internal/realip"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+const (
+	// Gin context keys
+	rateLimitExemptKey = "rateLimitExempt"
+	rateLimitStatusKey = "rateLimitStatus"
+)
+
+// rateLimitMiddleware limits requests per client IP, allowlisted clients are not limited at all
+func rateLimitMiddleware(l *ratelimit.Limiter, allow realip.Networks) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ip := context.ClientIP(c.Request.Context())
+
+		if allow.Contains(ip) {
+			c.Set(rateLimitExemptKey, true)
+			return
+		}
+
+		rateLimited(c, l, "ip:"+ip)
+	}
+}
+
+// rateLimited counts request and responds with 429 Too Many Requests when over the limit
+//
+// Key is prefixed with the kind of limit (ip, key, caller), refused requests
+// are counted by it. X-RateLimit-* headers describe the most restrictive of the limits applied to the request.
+func rateLimited(c *gin.Context, l *ratelimit.Limiter, key string) bool {
+	if l == nil || c.GetBool(rateLimitExemptKey) {
+		return false
+	}
+
+	var (
+		now = time.Now()
+		st  = l.Allow(key, now)
+	)
+
+	if prev, has := c.Get(rateLimitStatusKey); !has || !st.Allowed || st.Remaining < prev.(ratelimit.Status).Remaining {
+		c.Set(rateLimitStatusKey, st)
+		c.Header("X-RateLimit-Limit", strconv.Itoa(st.Limit))
+		c.Header("X-RateLimit-Remaining", strconv.Itoa(st.Remaining))
+		c.Header("X-RateLimit-Reset", strconv.FormatInt(st.Reset.Unix(), 10))
+	}
+
+	if st.Allowed {
+		return false
+	}
+
+	countThrottled(c, strings.SplitN(key, ":", 2)[0])
+
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(st.RetryAfter(now).Seconds()))))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, newJsonError(c, permit.CodeRateLimited, "rate limit exceeded"))
+	return true
+}
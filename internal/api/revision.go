@@ -0,0 +1,89 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/internal/store"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+// Optimistic concurrency
+//
+// Permit's revision is sent as ETag. Clients send it back in If-Match and
+// the store refuses to modify the permit when it has changed in the
+// meantime; that is reported with 412 Precondition Failed.
+
+func etag(p *permit.Permit) string {
+	return strconv.Quote(strconv.FormatUint(p.Revision, 10))
+}
+
+// ifMatchMiddleware makes all store mutations of the request conditional on If-Match
+//
+// Only a single strong entity tag (or "*") is supported.
+func ifMatchMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var header = strings.TrimSpace(c.GetHeader("If-Match"))
+
+		if header == "" || header == "*" {
+			return
+		}
+
+		if strings.Contains(header, ",") {
+			c.AbortWithStatusJSON(http.StatusBadRequest, newJsonError(c, permit.CodeInvalidRequest, "If-Match with multiple entity tags is not supported"))
+			return
+		}
+
+		tag, err := strconv.Unquote(header)
+		if err != nil {
+			// Weak or malformed tags never match
+			c.AbortWithStatusJSON(http.StatusPreconditionFailed, newJsonError(c, permit.CodeRevisionMismatch, store.RevisionMismatch))
+			return
+		}
+
+		rev, err := strconv.ParseUint(tag, 10, 64)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusPreconditionFailed, newJsonError(c, permit.CodeRevisionMismatch, store.RevisionMismatch))
+			return
+		}
+
+		c.Request = c.Request.WithContext(context.WithIfRevision(c.Request.Context(), rev))
+	}
+}
+
+// storeErrorStatus maps errors returned by the store to HTTP status and error codes
+func storeErrorStatus(err error) (int, string) {
+	switch err {
+	case permit.PermitNotFound:
+		return http.StatusNotFound, permit.CodeKeyNotFound
+	case store.RevisionNotFound:
+		return http.StatusNotFound, permit.CodeNotFound
+	case permit.PermitDeleted:
+		return http.StatusGone, permit.CodeKeyDeleted
+	case permit.DomainTaken:
+		return http.StatusConflict, permit.CodeDomainTaken
+	case store.RevisionMismatch:
+		return http.StatusPreconditionFailed, permit.CodeRevisionMismatch
+	default:
+		return http.StatusInternalServerError, permit.CodeServerError
+	}
+}
+
+// storeError responds with status matching the store error
+//
+// Unexpected errors are logged and wrapped with msg.
+func storeError(ctx *gin.Context, err error, msg string) {
+	status, code := storeErrorStatus(err)
+	if status == http.StatusInternalServerError {
+		context.Log(ctx.Request.Context()).With(zap.Error(err)).Error(msg)
+		err = errors.Wrap(err, msg)
+	}
+
+	ctx.JSON(status, newJsonError(ctx, code, err))
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/crusttech/permit/internal/auth"
+	"github.com/crusttech/permit/internal/guard"
+	"github.com/crusttech/permit/internal/ratelimit"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+type (
+	// routes holds handlers and limits shared by all API versions
+	routes struct {
+		storage  permitKeeper
+		auditLog auditLog
+
+		authenticated gin.HandlerFunc
+		uniqueDomain  bool
+
+		// Primary's address and replication status on replicas, empty on primary
+		primary       string
+		replicaStatus gin.HandlerFunc
+
+		// Nil when token signing is not configured
+		authLogin   gin.HandlerFunc
+		authRefresh gin.HandlerFunc
+		authLimits  []gin.HandlerFunc
+
+		checkLimits   []gin.HandlerFunc
+		checkGuard    *guard.Guard
+		keyLimiter    *ratelimit.Limiter
+		callerLimiter *ratelimit.Limiter
+		batchMax      int
+	}
+)
+
+// register mounts all API versions and the OpenAPI document
+//
+// Unversioned paths are kept as aliases of v1.
+func (r routes) register(router *gin.Engine) {
+	r.mount(&router.RouterGroup, 1)
+	r.mount(router.Group("/v1"), 1)
+	r.mount(router.Group("/v2"), 2)
+
+	router.GET("/openapi.json", endpointOpenAPI())
+
+	// Catch all path
+	router.Any("/", func(ctx *gin.Context) {
+		ctx.Header("Content-Type", "text/html; charset=utf-8")
+		ctx.String(
+			http.StatusOK,
+			`<html><body style="text-align: center; margin: 50px;"><h1>Crust subscription server</h1></body></html>`,
+		)
+	})
+
+	router.NoRoute(func(ctx *gin.Context) {
+		// Arbitrary paths would make arbitrary metric labels
+		ctx.Set(unmatchedKey, true)
+		ctx.JSON(http.StatusNotFound, newJsonError(ctx, permit.CodeNotFound, "no such endpoint"))
+	})
+}
+
+// mount registers all routes of the API version under base path
+func (r routes) mount(base *gin.RouterGroup, version int) {
+	g := base.Group("/key")
+	g.Use(r.authenticated, ifMatchMiddleware())
+	if r.primary != "" {
+		g.Use(readOnlyMiddleware(r.primary))
+	}
+	if r.uniqueDomain {
+		g.Use(uniqueDomainMiddleware())
+	}
+	g.GET("", requireScope(auth.ScopeRead), endpointKeyList(r.storage))
+	g.POST("", requireScope(auth.ScopeIssue), endpointKeyCreate(r.storage))
+	g.GET("/:key", requireScope(auth.ScopeRead), endpointKeyRead(r.storage))
+	g.PATCH("/:key", requireScope(auth.ScopeAdmin), endpointKeyUpdate(r.storage))
+	g.DELETE("/:key", requireScope(auth.ScopeAdmin), endpointKeyDelete(r.storage))
+	g.POST("/:key/revoke", requireScope(auth.ScopeAdmin), endpointKeyRevoke(r.storage))
+	g.POST("/:key/enable", requireScope(auth.ScopeAdmin), endpointKeyEnable(r.storage))
+	g.POST("/:key/extend", requireScope(auth.ScopeAdmin), endpointKeyExtend(r.storage))
+
+	if r.authLogin != nil {
+		g = base.Group("/auth")
+		g.Use(r.authLimits...)
+		g.POST("/login", r.authLogin)
+		g.POST("/refresh", r.authRefresh)
+	}
+
+	g = base.Group("/audit")
+	g.Use(r.authenticated, requireScope(auth.ScopeAdmin))
+	g.GET("", endpointAuditList(r.auditLog))
+	g.GET("/verify", endpointAuditVerify(r.auditLog))
+
+	g = base.Group("/replication")
+	g.Use(r.authenticated)
+	if r.replicaStatus != nil {
+		g.GET("/status", requireScope(auth.ScopeRead), r.replicaStatus)
+	} else {
+		g.GET("/changes", requireScope(auth.ScopeReplicate), endpointReplicationChanges(r.storage))
+		g.GET("/snapshot", requireScope(auth.ScopeReplicate), endpointReplicationSnapshot(r.storage))
+	}
+
+	g = base.Group("/check")
+	g.Use(r.checkLimits...)
+	g.POST("", endpointKeyCheck(r.storage, r.keyLimiter, r.checkGuard, version))
+
+	// Batch check for authenticated partners, limited per caller
+	base.POST("/check/batch", r.authenticated, requireScope(auth.ScopeCheck), endpointKeyCheckBatch(r.storage, r.callerLimiter, r.batchMax, version))
+}
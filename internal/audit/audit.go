@@ -0,0 +1,484 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/crusttech/permit/internal/envelope"
+	"github.com/crusttech/permit/internal/lockfile"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+type (
+	// Log is an append-only, hash-chained audit log stored as JSON lines
+	//
+	// Each record holds the hash of its predecessor and its own hash over
+	// both, so any modification, removal or reordering of the records
+	// breaks the chain and is reported by Verify.
+	//
+	// Chain alone does not reveal records removed from the end of the log,
+	// so the head (last record's seq and hash) is also kept in an anchor
+	// file. Verify reports log that ends before the anchored head; anchor
+	// should be kept away from the log (another volume or host) so that it
+	// can not be rewritten together with it.
+	//
+	// Records hold permits (keys, contacts) and are sealed with the store's
+	// keyring when encryption is enabled. Hashes are calculated over the
+	// plaintext records, so re-encryption does not break the chain.
+	Log struct {
+		path    string
+		anchor  string
+		keyring *envelope.Keyring
+
+		// End of the log as of the last append, guarded by the log lock
+		mux  sync.Mutex
+		tail tail
+	}
+
+	Record struct {
+		Seq    uint64    `json:"seq"`
+		Time   time.Time `json:"time"`
+		Actor  string    `json:"actor"`
+		IP     string    `json:"ip,omitempty"`
+		Action string    `json:"action"`
+		Key    string    `json:"key"`
+
+		Before *permit.Permit `json:"before,omitempty"`
+		After  *permit.Permit `json:"after,omitempty"`
+
+		PrevHash string `json:"prevHash"`
+		Hash     string `json:"hash"`
+	}
+
+	// tail remembers the last record, so appends do not have to read the log
+	tail struct {
+		size int64
+		seq  uint64
+		hash string
+	}
+
+	// head of the log as stored in the anchor file
+	head struct {
+		Seq  uint64 `json:"seq"`
+		Hash string `json:"hash"`
+	}
+
+	Filter struct {
+		Key    string
+		Actor  string
+		Action string
+		Since  *time.Time
+		Until  *time.Time
+	}
+)
+
+const (
+	lockTimeout = 10 * time.Second
+
+	// Max size of a single record (line) in the log
+	maxRecordSize = 1 << 20
+
+	// Size of chunks the log is read backwards in, looking for the last record
+	tailChunkSize = 64 * 1024
+)
+
+var (
+	// Hash of the (nonexistent) record before the first one
+	genesisHash = hex.EncodeToString(make([]byte, sha256.Size))
+)
+
+// NewLog opens audit log at path, records are sealed with keyring unless it is nil
+//
+// Head of the log is anchored in a file at anchor, path with ".head" suffix when empty.
+func NewLog(path, anchor string, keyring *envelope.Keyring) (*Log, error) {
+	if anchor == "" {
+		anchor = path + ".head"
+	}
+
+	for _, dir := range []string{filepath.Dir(path), filepath.Dir(anchor)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, errors.Wrap(err, "could not create audit log directory")
+		}
+	}
+
+	return &Log{path: path, anchor: anchor, keyring: keyring}, nil
+}
+
+// Append chains and writes record to the end of the log
+//
+// Seq, PrevHash and Hash are set by the log.
+func (l *Log) Append(r Record) (err error) {
+	var (
+		t   tail
+		f   *os.File
+		enc []byte
+	)
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	// Serializes appends from all processes that share the log (api, cli)
+	unlock, err := lockfile.Acquire(l.path+".lock", lockTimeout)
+	if err != nil {
+		return errors.Wrap(err, "could not lock audit log")
+	}
+
+	defer unlock()
+
+	if t, err = l.last(); err != nil {
+		return err
+	}
+
+	r.Seq, r.PrevHash = 1, genesisHash
+	if t.seq > 0 {
+		r.Seq, r.PrevHash = t.seq+1, t.hash
+	}
+
+	if r.Hash, err = hash(r); err != nil {
+		return err
+	}
+
+	if enc, err = l.encode(r, l.keyring.Active()); err != nil {
+		return err
+	}
+
+	if f, err = os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err != nil {
+		return errors.Wrap(err, "could not open audit log")
+	}
+
+	defer f.Close()
+
+	if _, err = f.Write(enc); err != nil {
+		l.tail = tail{}
+		return errors.Wrap(err, "could not write audit record")
+	}
+
+	if err = f.Sync(); err != nil {
+		l.tail = tail{}
+		return errors.Wrap(err, "could not sync audit log")
+	}
+
+	l.tail = tail{size: t.size + int64(len(enc)), seq: r.Seq, hash: r.Hash}
+	return l.writeHead(head{Seq: r.Seq, Hash: r.Hash})
+}
+
+// Reencrypt rewrites the log with all records sealed with the given master key
+//
+// Empty key ID means the active key. Returns number of records that were
+// not sealed with the key before.
+func (l *Log) Reencrypt(keyID string) (n int, err error) {
+	if l.keyring == nil {
+		return 0, errors.New("audit log is not encrypted, no master keys configured")
+	}
+
+	if keyID == "" {
+		keyID = l.keyring.Active()
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	unlock, err := lockfile.Acquire(l.path+".lock", lockTimeout)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not lock audit log")
+	}
+
+	defer unlock()
+
+	// Tail is re-read on the next append
+	l.tail = tail{}
+
+	tmp, err := os.OpenFile(l.path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not create audit log")
+	}
+
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	w := bufio.NewWriter(tmp)
+	err = l.walkLines(func(line []byte, r Record) error {
+		if kid, sealed := envelope.KeyID(line); !sealed || kid != keyID {
+			n++
+		}
+
+		enc, err := l.encode(r, keyID)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(enc)
+		return errors.Wrap(err, "could not write audit record")
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	if err = w.Flush(); err != nil {
+		return 0, errors.Wrap(err, "could not write audit log")
+	}
+
+	if err = tmp.Sync(); err != nil {
+		return 0, errors.Wrap(err, "could not sync audit log")
+	}
+
+	return n, errors.Wrap(os.Rename(tmp.Name(), l.path), "could not replace audit log")
+}
+
+// Query returns records matching the filter, oldest first
+func (l *Log) Query(f Filter) (rr []Record, err error) {
+	rr = make([]Record, 0)
+	err = l.walk(func(r Record) error {
+		if f.Match(r) {
+			rr = append(rr, r)
+		}
+
+		return nil
+	})
+
+	return
+}
+
+// Verify walks the log and checks the hash chain and that the log reaches the anchored head
+//
+// Returns number of verified records and the first inconsistency found.
+// Log without anchor (written before anchors were introduced) is only checked for the chain.
+func (l *Log) Verify() (n uint64, err error) {
+	var prev = Record{Hash: genesisHash}
+
+	// Read before the log; records appended in the meantime only move the end past it
+	anchored, err := l.readHead()
+	if err != nil {
+		return 0, err
+	}
+
+	err = l.walk(func(r Record) error {
+		if r.Seq != prev.Seq+1 {
+			return errors.Errorf("record %d: expecting sequence number %d", r.Seq, prev.Seq+1)
+		}
+
+		if r.PrevHash != prev.Hash {
+			return errors.Errorf("record %d: broken chain, previous hash does not match", r.Seq)
+		}
+
+		if h, err := hash(r); err != nil {
+			return err
+		} else if h != r.Hash {
+			return errors.Errorf("record %d: hash mismatch, record was modified", r.Seq)
+		}
+
+		if anchored != nil && r.Seq == anchored.Seq && r.Hash != anchored.Hash {
+			return errors.Errorf("record %d: hash does not match the anchored head, log was rewritten", r.Seq)
+		}
+
+		prev = r
+		n++
+		return nil
+	})
+
+	if err == nil && anchored != nil && prev.Seq < anchored.Seq {
+		err = errors.Errorf("log ends at record %d, anchored head is record %d, records were removed", prev.Seq, anchored.Seq)
+	}
+
+	return
+}
+
+func (f Filter) Match(r Record) bool {
+	switch {
+	case f.Key != "" && f.Key != r.Key,
+		f.Actor != "" && f.Actor != r.Actor,
+		f.Action != "" && f.Action != r.Action,
+		f.Since != nil && r.Time.Before(*f.Since),
+		f.Until != nil && !r.Time.Before(*f.Until):
+		return false
+	}
+
+	return true
+}
+
+func (l *Log) walk(fn func(Record) error) error {
+	return l.walkLines(func(_ []byte, r Record) error {
+		return fn(r)
+	})
+}
+
+// walkLines passes each line of the log as stored and its decoded record to fn
+func (l *Log) walkLines(fn func([]byte, Record) error) error {
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "could not open audit log")
+	}
+
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), maxRecordSize)
+
+	for line := 1; s.Scan(); line++ {
+		r, err := l.decode(s.Bytes())
+		if err != nil {
+			return errors.Wrapf(err, "could not decode audit record on line %d", line)
+		}
+
+		if err = fn(s.Bytes(), r); err != nil {
+			return err
+		}
+	}
+
+	return errors.Wrap(s.Err(), "could not read audit log")
+}
+
+// last returns the end of the log, zero tail when log is empty
+//
+// Remembered tail is used unless the log changed size since (appended by
+// another process), then the last record is read from the end of the file.
+func (l *Log) last() (tail, error) {
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return tail{}, nil
+	} else if err != nil {
+		return tail{}, errors.Wrap(err, "could not open audit log")
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return tail{}, errors.Wrap(err, "could not open audit log")
+	}
+
+	if fi.Size() == 0 {
+		return tail{}, nil
+	} else if fi.Size() == l.tail.size {
+		return l.tail, nil
+	}
+
+	line, err := lastLine(f, fi.Size())
+	if err != nil {
+		return tail{}, err
+	}
+
+	r, err := l.decode(line)
+	if err != nil {
+		return tail{}, errors.Wrap(err, "could not decode last audit record")
+	}
+
+	return tail{size: fi.Size(), seq: r.Seq, hash: r.Hash}, nil
+}
+
+// readHead returns head stored in the anchor file, nil when there is none
+func (l *Log) readHead() (*head, error) {
+	data, err := ioutil.ReadFile(l.anchor)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "could not read audit log anchor")
+	}
+
+	h := &head{}
+	return h, errors.Wrap(json.Unmarshal(data, h), "could not decode audit log anchor")
+}
+
+// writeHead replaces head in the anchor file, called under the log lock
+func (l *Log) writeHead(h head) error {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return errors.Wrap(err, "could not encode audit log anchor")
+	}
+
+	tmp := l.anchor + ".tmp"
+	if err = ioutil.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return errors.Wrap(err, "could not write audit log anchor")
+	}
+
+	return errors.Wrap(os.Rename(tmp, l.anchor), "could not write audit log anchor")
+}
+
+// lastLine reads file backwards until it finds the start of the last line
+func lastLine(f io.ReaderAt, size int64) ([]byte, error) {
+	var (
+		// Trailing newline is not part of the record
+		end = size - 1
+		buf []byte
+	)
+
+	for start := end; start > 0; {
+		n := int64(tailChunkSize)
+		if n > start {
+			n = start
+		}
+
+		start -= n
+		chunk := make([]byte, n)
+		if _, err := f.ReadAt(chunk, start); err != nil {
+			return nil, errors.Wrap(err, "could not read audit log")
+		}
+
+		buf = append(chunk, buf...)
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			return buf[i+1 : end-start], nil
+		}
+
+		if end-start > maxRecordSize {
+			return nil, errors.New("last audit record too large")
+		}
+	}
+
+	return buf[:end], nil
+}
+
+// encode returns record as a line of the log, sealed with the master key when log is encrypted
+func (l *Log) encode(r Record, keyID string) ([]byte, error) {
+	enc, err := json.Marshal(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not encode audit record")
+	}
+
+	if l.keyring != nil {
+		if enc, err = l.keyring.SealWith(keyID, enc); err != nil {
+			return nil, errors.Wrap(err, "could not encrypt audit record")
+		}
+
+		// Sealed payload is a single line of JSON
+		enc = bytes.TrimRight(enc, "\n")
+	}
+
+	return append(enc, '\n'), nil
+}
+
+// decode opens (when sealed) and decodes a line of the log
+func (l *Log) decode(line []byte) (r Record, err error) {
+	if line, err = l.keyring.Open(line); err != nil {
+		return
+	}
+
+	err = json.Unmarshal(line, &r)
+	return
+}
+
+// hash calculates record's hash over all fields except the hash itself
+func hash(r Record) (string, error) {
+	r.Hash = ""
+
+	enc, err := json.Marshal(r)
+	if err != nil {
+		return "", errors.Wrap(err, "could not encode audit record")
+	}
+
+	sum := sha256.Sum256(enc)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,204 @@
+package audit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/internal/envelope"
+	"github.com/crusttech/permit/internal/store"
+	"github.com/crusttech/permit/internal/store/fs"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+func assert(t *testing.T, ok bool, format string, args ...interface{}) bool {
+	if !ok {
+		t.Fatalf(format, args...)
+	}
+	return ok
+}
+
+func TestAuditedStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "permit-audit-")
+	assert(t, err == nil, "could not create temp dir: %v", err)
+	defer os.RemoveAll(dir)
+
+	fsStorage, err := fs.NewPermitStorage(dir)
+	assert(t, err == nil, "could not create storage: %v", err)
+
+	log, err := NewLog(filepath.Join(dir, "audit", "audit.log"), "", nil)
+	assert(t, err == nil, "could not create audit log: %v", err)
+
+	var (
+		s   = Storage(fsStorage, log)
+		ctx = context.WithClientIP(context.WithActor(context.Background(), "tester"), "127.0.0.1")
+		p   = permit.Permit{Key: "key-1", Domain: "example.tld", Valid: true, Issued: time.Now()}
+	)
+
+	assert(t, s.Create(ctx, p) == nil, "could not create permit")
+	assert(t, s.Revoke(ctx, p.Key) == nil, "could not revoke permit")
+	assert(t, s.Revoke(ctx, "unknown") != nil, "expecting error on unknown key")
+	assert(t, s.Delete(ctx, p.Key) == nil, "could not delete permit")
+
+	rr, err := log.Query(Filter{Key: p.Key})
+	assert(t, err == nil, "unexpected error: %v", err)
+	assert(t, len(rr) == 3, "expecting 3 audit records, got %d", len(rr))
+	assert(t, rr[0].Before == nil && rr[0].After != nil, "expecting only after state on create")
+	assert(t, rr[1].Action == store.ActionRevoke && rr[1].Before.Valid && !rr[1].After.Valid, "expecting revoke to be recorded")
+	assert(t, rr[2].After == nil, "expecting no after state on delete")
+	assert(t, rr[1].Actor == "tester" && rr[1].IP == "127.0.0.1", "expecting actor and ip to be recorded")
+
+	n, err := log.Verify()
+	assert(t, err == nil, "unexpected verification error: %v", err)
+	assert(t, n == 3, "expecting 3 verified records, got %d", n)
+
+	// Tamper with the log
+	raw, _ := ioutil.ReadFile(log.path)
+	raw = bytes.Replace(raw, []byte(`"actor":"tester"`), []byte(`"actor":"someone"`), 1)
+	assert(t, ioutil.WriteFile(log.path, raw, 0600) == nil, "could not modify log")
+
+	n, err = log.Verify()
+	assert(t, err != nil, "expecting verification to fail on modified log")
+	assert(t, n == 0, "expecting first record to fail verification, got %d verified", n)
+}
+
+func TestAuditedCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "permit-audit-")
+	assert(t, err == nil, "could not create temp dir: %v", err)
+	defer os.RemoveAll(dir)
+
+	fsStorage, err := fs.NewPermitStorage(dir)
+	assert(t, err == nil, "could not create storage: %v", err)
+
+	log, err := NewLog(filepath.Join(dir, "audit", "audit.log"), "", nil)
+	assert(t, err == nil, "could not create audit log: %v", err)
+
+	var (
+		s   = Storage(fsStorage, log)
+		ctx = context.WithActor(context.Background(), "tester")
+	)
+
+	for _, key := range []string{"key-1", "key-2"} {
+		assert(t, fsStorage.Create(ctx, permit.Permit{Key: key, Domain: "example.tld", Valid: true, Issued: time.Now()}) == nil, "could not create permit")
+	}
+
+	_, err = s.Check(ctx, store.CheckOptions{Repair: true, UniqueDomain: true})
+	assert(t, err == nil, "unexpected error: %v", err)
+
+	rr, err := log.Query(Filter{Action: store.ActionRepair})
+	assert(t, err == nil, "unexpected error: %v", err)
+	assert(t, len(rr) == 1, "expecting 1 repair record, got %d", len(rr))
+	assert(t, rr[0].Before.Valid && !rr[0].After.Valid && rr[0].Actor == "tester", "expecting revoke of duplicate to be recorded, got %+v", rr[0])
+}
+
+func TestAppendChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "permit-audit-")
+	assert(t, err == nil, "could not create temp dir: %v", err)
+	defer os.RemoveAll(dir)
+
+	var (
+		path = filepath.Join(dir, "audit.log")
+
+		// Two processes (api and cli) appending to the same log
+		api, _ = NewLog(path, "", nil)
+		cli, _ = NewLog(path, "", nil)
+
+		// Larger than a chunk the log is read backwards in
+		big = permit.Permit{Key: "key-1", Entity: string(bytes.Repeat([]byte("x"), tailChunkSize*2))}
+	)
+
+	for i, l := range []*Log{api, api, cli, api, cli, cli, api} {
+		r := Record{Action: store.ActionUpdate, Key: "key-1"}
+		if i == 3 {
+			r.After = &big
+		}
+
+		assert(t, l.Append(r) == nil, "could not append record %d", i)
+	}
+
+	n, err := api.Verify()
+	assert(t, err == nil, "unexpected verification error: %v", err)
+	assert(t, n == 7, "expecting 7 verified records, got %d", n)
+}
+
+func TestAnchoredHead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "permit-audit-")
+	assert(t, err == nil, "could not create temp dir: %v", err)
+	defer os.RemoveAll(dir)
+
+	var (
+		path   = filepath.Join(dir, "audit.log")
+		anchor = filepath.Join(dir, "elsewhere", "audit.head")
+	)
+
+	log, _ := NewLog(path, anchor, nil)
+	for i := 0; i < 3; i++ {
+		assert(t, log.Append(Record{Action: store.ActionUpdate, Key: "key-1"}) == nil, "could not append record %d", i)
+	}
+
+	raw, _ := ioutil.ReadFile(path)
+	lines := bytes.SplitAfter(raw, []byte("\n"))
+
+	// Dropping the last record leaves a valid chain
+	assert(t, ioutil.WriteFile(path, bytes.Join(lines[:2], nil), 0600) == nil, "could not truncate log")
+
+	n, err := log.Verify()
+	assert(t, err != nil && strings.Contains(err.Error(), "records were removed"), "expecting truncation to be reported, got %v", err)
+	assert(t, n == 2, "expecting 2 verified records, got %d", n)
+
+	// Log that predates anchors is checked for the chain only
+	assert(t, os.Remove(anchor) == nil, "could not remove anchor")
+
+	n, err = log.Verify()
+	assert(t, err == nil && n == 2, "expecting 2 verified records without anchor, got %d (%v)", n, err)
+}
+
+func TestEncryptedLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "permit-audit-")
+	assert(t, err == nil, "could not create temp dir: %v", err)
+	defer os.RemoveAll(dir)
+
+	var (
+		path = filepath.Join(dir, "audit.log")
+		keys = map[string][]byte{
+			"k1": []byte("0123456789abcdef0123456789abcdef"),
+			"k2": []byte("abcdefghijklmnopqrstuvwxyzabcdef"),
+		}
+		p = permit.Permit{Key: "secret-key", Contact: "admin@example.tld"}
+	)
+
+	k1, _ := envelope.NewKeyring("k1", keys)
+	log, _ := NewLog(path, "", k1)
+
+	// Records written before encryption was enabled are kept as they are
+	plain, _ := NewLog(path, "", nil)
+	assert(t, plain.Append(Record{Action: store.ActionCreate, Key: "plain-key"}) == nil, "could not append plaintext record")
+
+	assert(t, log.Append(Record{Action: store.ActionCreate, Key: p.Key, After: &p}) == nil, "could not append record")
+	assert(t, log.Append(Record{Action: store.ActionRevoke, Key: p.Key, Before: &p, After: &p}) == nil, "could not append record")
+
+	raw, _ := ioutil.ReadFile(path)
+	assert(t, !bytes.Contains(raw, []byte(p.Key)) && !bytes.Contains(raw, []byte(p.Contact)), "expecting sealed records:\n%s", raw)
+
+	rr, err := log.Query(Filter{Key: p.Key})
+	assert(t, err == nil && len(rr) == 2 && rr[0].After.Contact == p.Contact, "expecting 2 decrypted records, got %v (%v)", rr, err)
+
+	n, err := log.Reencrypt("k2")
+	assert(t, err == nil && n == 3, "expecting 3 re-encrypted records, got %d (%v)", n, err)
+
+	// Old master key is retired
+	k2, _ := envelope.NewKeyring("k2", map[string][]byte{"k2": keys["k2"]})
+	log, _ = NewLog(path, "", k2)
+
+	v, err := log.Verify()
+	assert(t, err == nil && v == 3, "expecting 3 verified records after re-encryption, got %d (%v)", v, err)
+	assert(t, log.Append(Record{Action: store.ActionDelete, Key: p.Key}) == nil, "could not append after re-encryption")
+
+	_, err = plain.Query(Filter{})
+	assert(t, err != nil, "expecting error reading sealed records without keys")
+}
@@ -0,0 +1,159 @@
+package audit
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/internal/store"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+type (
+	// storage decorates permit store and appends an audit record for each mutation
+	storage struct {
+		store.Storage
+		log *Log
+	}
+)
+
+// Storage wraps permit store so that all mutations are logged
+func Storage(s store.Storage, log *Log) *storage {
+	return &storage{Storage: s, log: log}
+}
+
+func (s storage) Create(ctx context.Context, p permit.Permit) error {
+	return s.audit(ctx, store.ActionCreate, p.Key, func() error {
+		return s.Storage.Create(ctx, p)
+	})
+}
+
+func (s storage) Update(ctx context.Context, key string, p store.Patch) error {
+	return s.audit(ctx, store.ActionUpdate, key, func() error {
+		return s.Storage.Update(ctx, key, p)
+	})
+}
+
+func (s storage) Revoke(ctx context.Context, key string) error {
+	return s.audit(ctx, store.ActionRevoke, key, func() error {
+		return s.Storage.Revoke(ctx, key)
+	})
+}
+
+func (s storage) Enable(ctx context.Context, key string) error {
+	return s.audit(ctx, store.ActionEnable, key, func() error {
+		return s.Storage.Enable(ctx, key)
+	})
+}
+
+func (s storage) Extend(ctx context.Context, key string, t *time.Time) error {
+	return s.audit(ctx, store.ActionExtend, key, func() error {
+		return s.Storage.Extend(ctx, key, t)
+	})
+}
+
+func (s storage) Delete(ctx context.Context, key string) error {
+	return s.audit(ctx, store.ActionDelete, key, func() error {
+		return s.Storage.Delete(ctx, key)
+	})
+}
+
+func (s storage) Rollback(ctx context.Context, key string, number int) error {
+	return s.audit(ctx, store.ActionRollback, key, func() error {
+		return s.Storage.Rollback(ctx, key, number)
+	})
+}
+
+func (s storage) Restore(ctx context.Context, key string) error {
+	return s.audit(ctx, store.ActionRestore, key, func() error {
+		return s.Storage.Restore(ctx, key)
+	})
+}
+
+// Purge logs one record for each of the purged permits
+func (s storage) Purge(ctx context.Context, before time.Time) ([]string, error) {
+	kk, err := s.Storage.Purge(ctx, before)
+
+	for _, key := range kk {
+		r := Record{
+			Time:   time.Now().UTC().Truncate(time.Second),
+			Actor:  context.Actor(ctx),
+			IP:     context.ClientIP(ctx),
+			Action: store.ActionPurge,
+			Key:    key,
+		}
+
+		if aErr := s.log.Append(r); aErr != nil {
+			return kk, errors.Wrap(aErr, "permit purged but could not be audited")
+		}
+	}
+
+	return kk, err
+}
+
+// Check logs one record for each of the permits modified by the repair
+func (s storage) Check(ctx context.Context, opt store.CheckOptions) ([]store.Problem, error) {
+	pp, err := s.Storage.Check(ctx, opt)
+
+	for _, p := range pp {
+		if !p.Repaired || p.After == nil {
+			continue
+		}
+
+		r := Record{
+			Time:   time.Now().UTC().Truncate(time.Second),
+			Actor:  context.Actor(ctx),
+			IP:     context.ClientIP(ctx),
+			Action: store.ActionRepair,
+			Key:    p.Key,
+			Before: p.Before,
+			After:  p.After,
+		}
+
+		if aErr := s.log.Append(r); aErr != nil {
+			return pp, errors.Wrap(aErr, "permit repaired but could not be audited")
+		}
+	}
+
+	return pp, err
+}
+
+func (s storage) Import(ctx context.Context, r store.Record) error {
+	return s.audit(ctx, store.ActionImport, r.Key, func() error {
+		return s.Storage.Import(ctx, r)
+	})
+}
+
+// audit runs the mutation and logs permit state before and after it
+func (s storage) audit(ctx context.Context, action, key string, mutate func() error) (err error) {
+	var r = Record{
+		Time:   time.Now().UTC().Truncate(time.Second),
+		Actor:  context.Actor(ctx),
+		IP:     context.ClientIP(ctx),
+		Action: action,
+		Key:    key,
+	}
+
+	if r.Before, err = s.state(key); err != nil {
+		return
+	}
+
+	if err = mutate(); err != nil {
+		return
+	}
+
+	if r.After, err = s.state(key); err != nil {
+		return errors.Wrap(err, "permit modified but could not be audited")
+	}
+
+	return errors.Wrap(s.log.Append(r), "permit modified but could not be audited")
+}
+
+func (s storage) state(key string) (*permit.Permit, error) {
+	if p, err := s.Storage.Get(key); err == permit.PermitNotFound || err == permit.PermitDeleted {
+		return nil, nil
+	} else {
+		return p, err
+	}
+}
@@ -0,0 +1,249 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+// Token verification
+//
+// Tokens are verified with one of the configured keys: HMAC secrets or RSA/EC
+// public keys from a JWKS file, each with its own key ID. Token's "kid"
+// header selects the key; tokens without it are tried with all keys of the
+// matching type. Secrets are rotated by adding a new key, reissuing tokens and
+// removing the old key. JWKS file is re-read when it changes.
+
+type (
+	Verifier struct {
+		// Required values of aud and iss claims, tokens are rejected when they are not set
+		Audience string
+		Issuer   string
+
+		// Allowed clock skew when checking exp and nbf
+		Leeway time.Duration
+
+		secrets map[string][]byte
+		jwks    *jwksFile
+	}
+
+	Claims struct {
+		Subject string
+		Scopes  []string
+		Expires time.Time
+	}
+)
+
+// Scopes required by the API routes
+const (
+	ScopeCheck     = "permit:check"
+	ScopeRead      = "permit:read"
+	ScopeIssue     = "permit:issue"
+	ScopeAdmin     = "permit:admin"
+	ScopeReplicate = "permit:replicate"
+)
+
+var (
+	NoKeys       = errors.New("no token verification keys configured")
+	UnknownKey   = errors.New("token signed with unknown key")
+	InvalidToken = errors.New("invalid token")
+	MissingScope = errors.New("token is missing required scope")
+)
+
+// NewVerifier verifies tokens with the given HMAC secrets and keys from the JWKS file
+//
+// JWKS file is optional.
+func NewVerifier(secrets map[string][]byte, jwksPath string) (*Verifier, error) {
+	v := &Verifier{secrets: secrets}
+
+	if jwksPath != "" {
+		v.jwks = &jwksFile{path: jwksPath}
+		if err := v.jwks.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(v.keys()) == 0 {
+		return nil, NoKeys
+	}
+
+	return v, nil
+}
+
+// ParseSecrets reads HMAC secrets, comma separated "<key ID>:<secret>" definitions
+func ParseSecrets(defs string, secrets map[string][]byte) error {
+	for _, def := range strings.Split(defs, ",") {
+		if def = strings.TrimSpace(def); def == "" {
+			continue
+		}
+
+		parts := strings.SplitN(def, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return errors.New("invalid secret definition, expecting <key ID>:<secret>")
+		}
+
+		secrets[parts[0]] = []byte(parts[1])
+	}
+
+	return nil
+}
+
+// Verify checks token's signature and claims
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	var (
+		claims   = jwt.MapClaims{}
+		p        = &jwt.Parser{UseJSONNumber: true}
+		now      = time.Now()
+		verified bool
+	)
+
+	t, parts, err := p.ParseUnverified(token, claims)
+	if err != nil {
+		return nil, errors.Wrap(InvalidToken, err.Error())
+	}
+
+	kid, _ := t.Header["kid"].(string)
+	keys := v.keys()
+
+	if kid != "" {
+		key, has := keys[kid]
+		if !has {
+			return nil, errors.Wrapf(UnknownKey, "key ID %q", kid)
+		}
+
+		keys = map[string]interface{}{kid: key}
+	}
+
+	for _, key := range keys {
+		if !compatible(t.Method, key) {
+			continue
+		}
+
+		if t.Method.Verify(parts[0]+"."+parts[1], parts[2], key) == nil {
+			verified = true
+			break
+		}
+	}
+
+	if !verified {
+		return nil, errors.Wrap(InvalidToken, "signature verification failed")
+	}
+
+	c := &Claims{}
+	c.Subject, _ = claims["sub"].(string)
+
+	exp, ok := numericDate(claims["exp"])
+	if !ok {
+		return nil, errors.Wrap(InvalidToken, "missing exp claim")
+	} else if now.After(exp.Add(v.Leeway)) {
+		return nil, errors.Wrap(InvalidToken, "token expired")
+	}
+
+	c.Expires = exp
+
+	if nbf, ok := numericDate(claims["nbf"]); ok && now.Add(v.Leeway).Before(nbf) {
+		return nil, errors.Wrap(InvalidToken, "token not valid yet")
+	}
+
+	if v.Audience == "" || !contains(stringList(claims["aud"]), v.Audience) {
+		return nil, errors.Wrap(InvalidToken, "invalid aud claim")
+	}
+
+	if iss, _ := claims["iss"].(string); v.Issuer == "" || iss != v.Issuer {
+		return nil, errors.Wrap(InvalidToken, "invalid iss claim")
+	}
+
+	// OAuth 2.0 style space separated "scope" or a list in "scp"
+	if scope, ok := claims["scope"].(string); ok {
+		c.Scopes = strings.Fields(scope)
+	} else {
+		c.Scopes = stringList(claims["scp"])
+	}
+
+	return c, nil
+}
+
+// HasScope checks if claims grant the scope, admin scope grants all
+func (c Claims) HasScope(scope string) bool {
+	return contains(c.Scopes, scope) || contains(c.Scopes, ScopeAdmin)
+}
+
+// keys returns all verification keys by ID
+func (v *Verifier) keys() map[string]interface{} {
+	kk := map[string]interface{}{}
+
+	if v.jwks != nil {
+		for id, key := range v.jwks.keys() {
+			kk[id] = key
+		}
+	}
+
+	for id, secret := range v.secrets {
+		kk[id] = secret
+	}
+
+	return kk
+}
+
+// compatible checks that the key can be used with the signing method
+//
+// Prevents HMAC verification with public key as the secret and keeps "none" out.
+func compatible(m jwt.SigningMethod, key interface{}) bool {
+	switch m.(type) {
+	case *jwt.SigningMethodHMAC:
+		_, ok := key.([]byte)
+		return ok
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		_, ok := key.(*rsa.PublicKey)
+		return ok
+	case *jwt.SigningMethodECDSA:
+		_, ok := key.(*ecdsa.PublicKey)
+		return ok
+	default:
+		return false
+	}
+}
+
+func numericDate(v interface{}) (time.Time, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		if f, err := n.Float64(); err == nil {
+			return time.Unix(int64(f), 0), true
+		}
+	case float64:
+		return time.Unix(int64(n), 0), true
+	}
+
+	return time.Time{}, false
+}
+
+// stringList reads claim that can be a single string or a list of strings
+func stringList(v interface{}) (ss []string) {
+	switch l := v.(type) {
+	case string:
+		return []string{l}
+	case []interface{}:
+		for _, s := range l {
+			if s, ok := s.(string); ok {
+				ss = append(ss, s)
+			}
+		}
+	}
+
+	return
+}
+
+func contains(ss []string, s string) bool {
+	for _, i := range ss {
+		if i == s {
+			return true
+		}
+	}
+
+	return false
+}
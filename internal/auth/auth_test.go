@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func assert(t *testing.T, ok bool, format string, args ...interface{}) bool {
+	if !ok {
+		t.Fatalf(format, args...)
+	}
+	return ok
+}
+
+func sign(t *testing.T, m jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	tok := jwt.NewWithClaims(m, claims)
+	if kid != "" {
+		tok.Header["kid"] = kid
+	}
+
+	s, err := tok.SignedString(key)
+	assert(t, err == nil, "could not sign token: %v", err)
+	return s
+}
+
+func TestVerifySecrets(t *testing.T) {
+	secrets := map[string][]byte{}
+	assert(t, ParseSecrets("old:first-secret, new:second-secret", secrets) == nil, "could not parse secrets")
+
+	v, err := NewVerifier(secrets, "")
+	assert(t, err == nil, "could not create verifier: %v", err)
+
+	v.Audience, v.Issuer = "permit", "crust"
+
+	var (
+		exp    = time.Now().Add(time.Hour).Unix()
+		claims = jwt.MapClaims{"sub": "alice", "exp": exp, "aud": []string{"other", "permit"}, "iss": "crust", "scope": "permit:read permit:issue"}
+	)
+
+	c, err := v.Verify(sign(t, jwt.SigningMethodHS256, "new", []byte("second-secret"), claims))
+	assert(t, err == nil && c.Subject == "alice", "expecting valid token, got %v", err)
+	assert(t, c.HasScope(ScopeIssue) && !c.HasScope(ScopeAdmin), "unexpected scopes: %v", c.Scopes)
+
+	// Tokens without key ID are tried with all secrets
+	_, err = v.Verify(sign(t, jwt.SigningMethodHS256, "", []byte("first-secret"), claims))
+	assert(t, err == nil, "expecting token without key ID to be verified, got %v", err)
+
+	_, err = v.Verify(sign(t, jwt.SigningMethodHS256, "old", []byte("second-secret"), claims))
+	assert(t, err != nil, "expecting token signed with a different key to fail")
+
+	_, err = v.Verify(sign(t, jwt.SigningMethodHS256, "gone", []byte("second-secret"), claims))
+	assert(t, err != nil, "expecting unknown key ID to fail")
+
+	for name, override := range map[string]jwt.MapClaims{
+		"missing exp": {"exp": nil},
+		"expired":     {"exp": time.Now().Add(-time.Hour).Unix()},
+		"audience":    {"aud": "other"},
+		"missing aud": {"aud": nil},
+		"issuer":      {"iss": "someone"},
+		"missing iss": {"iss": nil},
+	} {
+		cc := jwt.MapClaims{}
+		for k, v := range claims {
+			cc[k] = v
+		}
+
+		for k, v := range override {
+			if v == nil {
+				delete(cc, k)
+			} else {
+				cc[k] = v
+			}
+		}
+
+		_, err = v.Verify(sign(t, jwt.SigningMethodHS256, "new", []byte("second-secret"), cc))
+		assert(t, err != nil, "expecting %s to fail", name)
+	}
+
+	_, err = NewVerifier(map[string][]byte{}, "")
+	assert(t, err == NoKeys, "expecting error without keys, got %v", err)
+}
+
+func TestVerifyJWKS(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert(t, err == nil, "could not generate key: %v", err)
+
+	f, err := ioutil.TempFile("", "permit-jwks-")
+	assert(t, err == nil, "could not create JWKS file: %v", err)
+	defer os.Remove(f.Name())
+
+	fmt.Fprintf(f, `{"keys":[{"kty":"RSA","kid":"rsa-1","use":"sig","n":%q,"e":%q}]}`,
+		base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	)
+	f.Close()
+
+	v, err := NewVerifier(nil, f.Name())
+	assert(t, err == nil, "could not create verifier: %v", err)
+
+	v.Audience, v.Issuer = "permit", "crust"
+
+	claims := jwt.MapClaims{"sub": "replica", "exp": time.Now().Add(time.Hour).Unix(), "aud": "permit", "iss": "crust", "scp": []string{ScopeReplicate}}
+
+	c, err := v.Verify(sign(t, jwt.SigningMethodRS256, "rsa-1", key, claims))
+	assert(t, err == nil && c.HasScope(ScopeReplicate), "expecting valid RSA token, got %v", err)
+
+	// Public key must not be usable as HMAC secret
+	pub, _ := v.jwks.keys()["rsa-1"].(*rsa.PublicKey)
+	assert(t, pub != nil, "expecting RSA key in the set")
+	_, err = v.Verify(sign(t, jwt.SigningMethodHS256, "rsa-1", pub.N.Bytes(), claims))
+	assert(t, err != nil, "expecting HMAC token verified with RSA key to fail")
+}
+
+func TestSigner(t *testing.T) {
+	s, err := NewSigner("login", []byte("login-secret"))
+	assert(t, err == nil, "could not create signer: %v", err)
+	s.Audience, s.Issuer = "permit", "crust"
+
+	v, err := NewVerifier(map[string][]byte{"login": []byte("login-secret")}, "")
+	assert(t, err == nil, "could not create verifier: %v", err)
+
+	// Without audience and issuer no token is accepted
+	token, _, err := s.Sign("alice", []string{ScopeRead}, nil)
+	assert(t, err == nil, "could not sign token: %v", err)
+	_, err = v.Verify(token)
+	assert(t, err != nil, "expecting token to fail without configured audience and issuer")
+
+	v.Audience, v.Issuer = "permit", "crust"
+
+	token, exp, err := s.Sign("alice", []string{ScopeRead}, map[string]interface{}{"roles": []string{"reader"}})
+	assert(t, err == nil && exp.After(time.Now()), "could not sign token: %v", err)
+
+	c, err := v.Verify(token)
+	assert(t, err == nil && c.Subject == "alice" && c.HasScope(ScopeRead) && !c.HasScope(ScopeIssue), "unexpected claims: %+v (%v)", c, err)
+}
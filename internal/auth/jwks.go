@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// jwksFile holds public keys from a JSON Web Key Set file (RFC 7517)
+	jwksFile struct {
+		path string
+
+		mux      sync.Mutex
+		set      map[string]interface{}
+		modified time.Time
+		checked  time.Time
+	}
+
+	jwk struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+
+		// RSA
+		N string `json:"n"`
+		E string `json:"e"`
+
+		// EC
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+
+		// Symmetric
+		K string `json:"k"`
+	}
+)
+
+// How often JWKS file is checked for changes
+const jwksCheckInterval = 10 * time.Second
+
+// keys returns current keys, reloading the file when it has changed
+//
+// Keys from the last successful load are kept when the file can not be read.
+func (f *jwksFile) keys() map[string]interface{} {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if time.Since(f.checked) > jwksCheckInterval {
+		f.checked = time.Now()
+
+		if fi, err := os.Stat(f.path); err == nil && !fi.ModTime().Equal(f.modified) {
+			f.reload()
+		}
+	}
+
+	return f.set
+}
+
+func (f *jwksFile) load() error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.checked = time.Now()
+	return f.reload()
+}
+
+func (f *jwksFile) reload() error {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return errors.Wrap(err, "could not read JWKS file")
+	}
+
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return errors.Wrap(err, "could not read JWKS file")
+	}
+
+	set, err := ParseJWKS(data)
+	if err != nil {
+		return err
+	}
+
+	f.set, f.modified = set, fi.ModTime()
+	return nil
+}
+
+// ParseJWKS decodes signature verification keys from JWKS document
+//
+// Keys without ID and keys not meant for signatures are skipped.
+func ParseJWKS(data []byte) (map[string]interface{}, error) {
+	var (
+		doc = struct {
+			Keys []jwk `json:"keys"`
+		}{}
+
+		set = map[string]interface{}{}
+	)
+
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, errors.Wrap(err, "could not decode JWKS")
+	}
+
+	for _, k := range doc.Keys {
+		if k.Kid == "" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+
+		key, err := k.decode()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid key %q", k.Kid)
+		}
+
+		set[k.Kid] = key
+	}
+
+	return set, nil
+}
+
+func (k jwk) decode() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.Errorf("unsupported curve %q", k.Crv)
+		}
+
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(k.K)
+
+	default:
+		return nil, errors.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeInt(v string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decode key parameter")
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
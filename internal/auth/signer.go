@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+type (
+	// Signer issues HMAC signed access tokens, verifiable by Verifier with the same secret
+	Signer struct {
+		keyID  string
+		secret []byte
+
+		Audience string
+		Issuer   string
+		TTL      time.Duration
+	}
+)
+
+// NewSigner signs tokens with the secret, key ID is set as token's kid header
+func NewSigner(keyID string, secret []byte) (*Signer, error) {
+	if len(secret) == 0 {
+		return nil, errors.Errorf("missing secret for signing key %q", keyID)
+	}
+
+	return &Signer{keyID: keyID, secret: secret, TTL: 15 * time.Minute}, nil
+}
+
+// Sign issues token for the subject with scopes and extra claims
+func (s Signer) Sign(subject string, scopes []string, extra map[string]interface{}) (string, time.Time, error) {
+	var (
+		now    = time.Now()
+		exp    = now.Add(s.TTL)
+		claims = jwt.MapClaims{}
+	)
+
+	for k, v := range extra {
+		claims[k] = v
+	}
+
+	claims["sub"] = subject
+	claims["scp"] = scopes
+	claims["iat"] = now.Unix()
+	claims["exp"] = exp.Unix()
+
+	if s.Audience != "" {
+		claims["aud"] = s.Audience
+	}
+
+	if s.Issuer != "" {
+		claims["iss"] = s.Issuer
+	}
+
+	t := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	t.Header["kid"] = s.keyID
+
+	signed, err := t.SignedString(s.secret)
+	return signed, exp, errors.Wrap(err, "could not sign token")
+}
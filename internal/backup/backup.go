@@ -0,0 +1,429 @@
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/internal/envelope"
+	"github.com/crusttech/permit/internal/store"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+// Backup archive is a gzipped tarball with two entries:
+//  - manifest.json with counts and checksums
+//  - records.jsonl with one store.Record per line
+//
+// When store encryption is enabled, each record is sealed with the keyring,
+// the same way store files are; manifest holds no permit data.
+
+type (
+	Manifest struct {
+		Version   int               `json:"version"`
+		Created   time.Time         `json:"created"`
+		Counts    store.Counts      `json:"counts"`
+		Checksums map[string]string `json:"checksums"`
+
+		// Master key records are sealed with, empty when they are not encrypted
+		KeyID string `json:"keyId,omitempty"`
+	}
+
+	// Report describes what restore did (or would do on dry run)
+	Report struct {
+		Manifest  Manifest `json:"manifest"`
+		Created   []string `json:"created"`
+		Replaced  []string `json:"replaced"`
+		Unchanged []string `json:"unchanged"`
+	}
+
+	source interface {
+		List(q store.Query) ([]*permit.Permit, string, error)
+		Trash() ([]store.Trashed, error)
+		History(key string) ([]store.Revision, error)
+		Snapshot(fn func() error) error
+	}
+
+	target interface {
+		Get(key string) (*permit.Permit, error)
+		Trash() ([]store.Trashed, error)
+		History(key string) ([]store.Revision, error)
+		Import(ctx context.Context, r store.Record) error
+	}
+
+	// recordWriter writes records (sealed when keyring is set) and checksums them
+	recordWriter struct {
+		buf     *bufio.Writer
+		hash    hash.Hash
+		keyring *envelope.Keyring
+		keyID   string
+	}
+)
+
+const (
+	formatVersion = 1
+
+	manifestFilename = "manifest.json"
+	recordsFilename  = "records.jsonl"
+
+	// Max size of a single record (line) in the archive
+	maxRecordSize = 16 << 20
+)
+
+// Create writes consistent snapshot of the store to a compressed archive
+//
+// Store is only locked for writing while records are exported to a temporary
+// file; reads are served as usual the whole time.
+// Records are sealed with keyring's active key unless keyring is nil.
+func Create(s source, w io.Writer, keyring *envelope.Keyring) (m *Manifest, err error) {
+	var (
+		tmp *os.File
+		sum string
+	)
+
+	if tmp, err = ioutil.TempFile("", "permit-backup-"); err != nil {
+		return nil, errors.Wrap(err, "could not create temporary file")
+	}
+
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	m = &Manifest{
+		Version:   formatVersion,
+		Created:   time.Now().UTC().Truncate(time.Second),
+		Checksums: map[string]string{},
+		KeyID:     keyring.Active(),
+	}
+
+	err = s.Snapshot(func() error {
+		w := newRecordWriter(tmp, keyring, m.KeyID)
+
+		err := store.Export(s, func(r store.Record) error {
+			m.Counts.Add(r)
+			return w.write(r)
+		})
+
+		if err != nil {
+			return err
+		}
+
+		sum, err = w.flush()
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	m.Checksums[recordsFilename] = sum
+
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.Wrap(err, "could not rewind temporary file")
+	}
+
+	return m, writeArchive(w, m, tmp)
+}
+
+// Reencrypt rewrites the archive with all records sealed with the given master key
+//
+// Empty key ID means the active key. Archive is verified first and replaced
+// only when the new one is completely written. Returns number of records.
+func Reencrypt(path string, keyring *envelope.Keyring, keyID string) (n int, err error) {
+	var (
+		m   *Manifest
+		tmp *os.File
+		out *os.File
+		sum string
+	)
+
+	if keyring == nil {
+		return 0, errors.New("no master keys configured")
+	}
+
+	if keyID == "" {
+		keyID = keyring.Active()
+	}
+
+	if m, err = read(path, keyring, nil); err != nil {
+		return 0, err
+	}
+
+	if tmp, err = ioutil.TempFile("", "permit-backup-"); err != nil {
+		return 0, errors.Wrap(err, "could not create temporary file")
+	}
+
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	w := newRecordWriter(tmp, keyring, keyID)
+	_, err = read(path, keyring, func(r store.Record) error {
+		n++
+		return w.write(r)
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	if sum, err = w.flush(); err != nil {
+		return 0, err
+	}
+
+	m.Checksums[recordsFilename], m.KeyID = sum, keyID
+
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return 0, errors.Wrap(err, "could not rewind temporary file")
+	}
+
+	// Next to the archive, so it can be renamed over it
+	if out, err = os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+		return 0, errors.Wrap(err, "could not create archive")
+	}
+
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	if err = writeArchive(out, m, tmp); err != nil {
+		return 0, err
+	}
+
+	if err = out.Sync(); err != nil {
+		return 0, errors.Wrap(err, "could not sync archive")
+	}
+
+	return n, errors.Wrap(os.Rename(out.Name(), path), "could not replace archive")
+}
+
+// Restore validates the archive and loads all records into the store
+//
+// Existing permits with keys from the archive are replaced, others are kept.
+// On dry run, archive is only validated and compared with the store.
+func Restore(ctx context.Context, s target, path string, keyring *envelope.Keyring, dryRun bool) (rpt *Report, err error) {
+	var m *Manifest
+
+	// First pass, validate the whole archive before touching the store
+	if m, err = read(path, keyring, nil); err != nil {
+		return nil, err
+	}
+
+	rpt = &Report{
+		Manifest:  *m,
+		Created:   []string{},
+		Replaced:  []string{},
+		Unchanged: []string{},
+	}
+
+	_, err = read(path, keyring, func(r store.Record) error {
+		cur, err := store.Fetch(s, r.Key)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case cur == nil:
+			rpt.Created = append(rpt.Created, r.Key)
+		case reflect.DeepEqual(normalize(*cur), normalize(r)):
+			rpt.Unchanged = append(rpt.Unchanged, r.Key)
+			return nil
+		default:
+			rpt.Replaced = append(rpt.Replaced, r.Key)
+		}
+
+		if dryRun {
+			return nil
+		}
+
+		return errors.Wrapf(s.Import(ctx, r), "could not import %s", r.Key)
+	})
+
+	return rpt, err
+}
+
+// Verify reads the whole archive and checks it against its manifest
+//
+// Keyring is needed to verify archives with sealed records.
+func Verify(path string, keyring *envelope.Keyring) (*Manifest, error) {
+	return read(path, keyring, nil)
+}
+
+func writeArchive(w io.Writer, m *Manifest, records *os.File) error {
+	var (
+		gz = gzip.NewWriter(w)
+		tw = tar.NewWriter(gz)
+	)
+
+	enc, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "could not encode manifest")
+	}
+
+	fi, err := records.Stat()
+	if err != nil {
+		return errors.Wrap(err, "could not stat records")
+	}
+
+	hdr := &tar.Header{Name: manifestFilename, Mode: 0600, Size: int64(len(enc)), ModTime: m.Created}
+	if err = tw.WriteHeader(hdr); err != nil {
+		return errors.Wrap(err, "could not write archive")
+	}
+
+	if _, err = tw.Write(enc); err != nil {
+		return errors.Wrap(err, "could not write archive")
+	}
+
+	hdr = &tar.Header{Name: recordsFilename, Mode: 0600, Size: fi.Size(), ModTime: m.Created}
+	if err = tw.WriteHeader(hdr); err != nil {
+		return errors.Wrap(err, "could not write archive")
+	}
+
+	if _, err = io.Copy(tw, records); err != nil {
+		return errors.Wrap(err, "could not write archive")
+	}
+
+	if err = tw.Close(); err != nil {
+		return errors.Wrap(err, "could not write archive")
+	}
+
+	return errors.Wrap(gz.Close(), "could not write archive")
+}
+
+// read walks the archive, verifies it and passes each record to fn
+//
+// Records are passed on as they are read; callers that must not act on
+// an invalid archive should call read without fn first.
+func read(path string, keyring *envelope.Keyring, fn func(store.Record) error) (m *Manifest, err error) {
+	var (
+		f      *os.File
+		gz     *gzip.Reader
+		hdr    *tar.Header
+		counts store.Counts
+		sum    string
+	)
+
+	if f, err = os.Open(path); err != nil {
+		return nil, errors.Wrap(err, "could not open archive")
+	}
+
+	defer f.Close()
+
+	if gz, err = gzip.NewReader(f); err != nil {
+		return nil, errors.Wrap(err, "could not decompress archive")
+	}
+
+	tr := tar.NewReader(gz)
+
+	if hdr, err = tr.Next(); err != nil || hdr.Name != manifestFilename {
+		return nil, errors.New("invalid archive, expecting manifest as the first entry")
+	}
+
+	m = &Manifest{}
+	if err = json.NewDecoder(tr).Decode(m); err != nil {
+		return nil, errors.Wrap(err, "could not decode manifest")
+	}
+
+	if m.Version != formatVersion {
+		return nil, errors.Errorf("unsupported archive version %d", m.Version)
+	}
+
+	if hdr, err = tr.Next(); err != nil || hdr.Name != recordsFilename {
+		return nil, errors.New("invalid archive, expecting records as the second entry")
+	}
+
+	h := sha256.New()
+	s := bufio.NewScanner(io.TeeReader(tr, h))
+	s.Buffer(make([]byte, 64*1024), maxRecordSize)
+
+	for line := 1; s.Scan(); line++ {
+		var (
+			r   = store.Record{}
+			raw []byte
+		)
+
+		if raw, err = keyring.Open(s.Bytes()); err != nil {
+			return nil, errors.Wrapf(err, "could not decrypt record on line %d", line)
+		}
+
+		if err = json.Unmarshal(raw, &r); err != nil {
+			return nil, errors.Wrapf(err, "could not decode record on line %d", line)
+		}
+
+		if r.Key == "" || (r.Permit == nil) == (r.Trashed == nil) {
+			return nil, errors.Errorf("invalid record on line %d", line)
+		}
+
+		counts.Add(r)
+
+		if fn != nil {
+			if err = fn(r); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err = s.Err(); err != nil {
+		return nil, errors.Wrap(err, "could not read records")
+	}
+
+	if sum = hex.EncodeToString(h.Sum(nil)); sum != m.Checksums[recordsFilename] {
+		return nil, errors.New("records checksum does not match manifest")
+	}
+
+	if counts != m.Counts {
+		return nil, errors.Errorf("record counts %+v do not match manifest %+v", counts, m.Counts)
+	}
+
+	return m, nil
+}
+
+func newRecordWriter(w io.Writer, keyring *envelope.Keyring, keyID string) *recordWriter {
+	h := sha256.New()
+	return &recordWriter{buf: bufio.NewWriter(io.MultiWriter(w, h)), hash: h, keyring: keyring, keyID: keyID}
+}
+
+func (w *recordWriter) write(r store.Record) error {
+	enc, err := json.Marshal(r)
+	if err != nil {
+		return errors.Wrap(err, "could not encode record")
+	}
+
+	if w.keyring != nil {
+		if enc, err = w.keyring.SealWith(w.keyID, enc); err != nil {
+			return errors.Wrapf(err, "could not encrypt %s", r.Key)
+		}
+
+		// Sealed payload is a single line of JSON
+		enc = bytes.TrimRight(enc, "\n")
+	}
+
+	_, err = w.buf.Write(append(enc, '\n'))
+	return errors.Wrap(err, "could not write records")
+}
+
+// flush writes buffered records and returns checksum of all of them
+func (w *recordWriter) flush() (string, error) {
+	if err := w.buf.Flush(); err != nil {
+		return "", errors.Wrap(err, "could not write records")
+	}
+
+	return hex.EncodeToString(w.hash.Sum(nil)), nil
+}
+
+// normalize passes record through JSON so that records read from the store
+// and from the archive can be compared
+func normalize(r store.Record) (n store.Record) {
+	enc, _ := json.Marshal(r)
+	json.Unmarshal(enc, &n)
+	return
+}
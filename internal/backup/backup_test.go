@@ -0,0 +1,150 @@
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/internal/envelope"
+	"github.com/crusttech/permit/internal/store"
+	"github.com/crusttech/permit/internal/store/fs"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+func assert(t *testing.T, ok bool, format string, args ...interface{}) bool {
+	if !ok {
+		t.Fatalf(format, args...)
+	}
+	return ok
+}
+
+func TestCreateRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "permit-backup-")
+	assert(t, err == nil, "could not create temp dir: %v", err)
+	defer os.RemoveAll(dir)
+
+	var (
+		ctx     = context.Background()
+		archive = filepath.Join(dir, "backup.tar.gz")
+	)
+
+	assert(t, os.Mkdir(filepath.Join(dir, "src"), 0755) == nil, "could not create source dir")
+	assert(t, os.Mkdir(filepath.Join(dir, "dst"), 0755) == nil, "could not create target dir")
+
+	src, err := fs.NewPermitStorage(filepath.Join(dir, "src"))
+	assert(t, err == nil, "could not create source storage: %v", err)
+
+	for _, key := range []string{"key-1", "key-2", "key-3"} {
+		p := permit.Permit{Key: key, Domain: "example.tld", Valid: true, Issued: time.Now().Truncate(time.Second)}
+		assert(t, src.Create(ctx, p) == nil, "could not create permit")
+	}
+
+	assert(t, src.Revoke(ctx, "key-2") == nil, "could not revoke permit")
+	assert(t, src.Delete(ctx, "key-3") == nil, "could not delete permit")
+
+	f, err := os.Create(archive)
+	assert(t, err == nil, "could not create archive: %v", err)
+
+	m, err := Create(src, f, nil)
+	f.Close()
+	assert(t, err == nil, "could not create backup: %v", err)
+	assert(t, m.Counts == store.Counts{Permits: 2, Trashed: 1, Revisions: 5}, "unexpected counts: %+v", m.Counts)
+
+	_, err = Verify(archive, nil)
+	assert(t, err == nil, "unexpected verification error: %v", err)
+
+	dst, err := fs.NewPermitStorage(filepath.Join(dir, "dst"))
+	assert(t, err == nil, "could not create target storage: %v", err)
+
+	rpt, err := Restore(ctx, dst, archive, nil, true)
+	assert(t, err == nil, "unexpected dry run error: %v", err)
+	assert(t, len(rpt.Created) == 3, "expecting 3 permits to be created on dry run")
+
+	_, err = dst.Get("key-1")
+	assert(t, err == permit.PermitNotFound, "not expecting dry run to change the store")
+
+	rpt, err = Restore(ctx, dst, archive, nil, false)
+	assert(t, err == nil, "unexpected restore error: %v", err)
+	assert(t, len(rpt.Created) == 3, "expecting 3 permits to be created")
+
+	p, err := dst.Get("key-2")
+	assert(t, err == nil && !p.Valid, "expecting revoked permit to be restored")
+
+	_, err = dst.Get("key-3")
+	assert(t, err == permit.PermitDeleted, "expecting deleted permit to be restored to trash")
+
+	rr, err := dst.History("key-2")
+	assert(t, err == nil && len(rr) == 2, "expecting history to be restored")
+
+	rpt, err = Restore(ctx, dst, archive, nil, false)
+	assert(t, err == nil && len(rpt.Unchanged) == 3, "expecting all permits to be unchanged on second restore")
+
+	// Corrupt the archive
+	raw, _ := ioutil.ReadFile(archive)
+	raw[len(raw)/2] ^= 0xff
+	assert(t, ioutil.WriteFile(archive, raw, 0600) == nil, "could not modify archive")
+
+	_, err = Verify(archive, nil)
+	assert(t, err != nil, "expecting verification of corrupted archive to fail")
+}
+
+func TestEncryptedArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "permit-backup-")
+	assert(t, err == nil, "could not create temp dir: %v", err)
+	defer os.RemoveAll(dir)
+
+	var (
+		ctx     = context.Background()
+		archive = filepath.Join(dir, "backup.tar.gz")
+		keys    = map[string][]byte{
+			"k1": []byte("0123456789abcdef0123456789abcdef"),
+			"k2": []byte("abcdefghijklmnopqrstuvwxyzabcdef"),
+		}
+		p = permit.Permit{Key: "secret-key", Domain: "example.tld", Contact: "admin@example.tld", Valid: true, Issued: time.Now().Truncate(time.Second)}
+	)
+
+	k1, _ := envelope.NewKeyring("k1", keys)
+	k2, _ := envelope.NewKeyring("k2", map[string][]byte{"k2": keys["k2"]})
+
+	src, err := fs.NewPermitStorage(dir)
+	assert(t, err == nil, "could not create source storage: %v", err)
+	assert(t, src.Create(ctx, p) == nil, "could not create permit")
+
+	f, err := os.Create(archive)
+	assert(t, err == nil, "could not create archive: %v", err)
+
+	m, err := Create(src, f, k1)
+	f.Close()
+	assert(t, err == nil && m.KeyID == "k1", "could not create backup: %v", err)
+
+	assert(t, !bytes.Contains(untar(t, archive), []byte(p.Key)), "expecting sealed records in archive")
+
+	_, err = Verify(archive, nil)
+	assert(t, err != nil, "expecting verification without keys to fail")
+
+	n, err := Reencrypt(archive, k1, "k2")
+	assert(t, err == nil && n == 1, "expecting 1 re-encrypted record, got %d (%v)", n, err)
+
+	// Old master key is retired
+	m, err = Verify(archive, k2)
+	assert(t, err == nil && m.KeyID == "k2" && m.Counts.Permits == 1, "unexpected verification result %+v (%v)", m, err)
+}
+
+// untar returns uncompressed content of the archive
+func untar(t *testing.T, path string) []byte {
+	f, err := os.Open(path)
+	assert(t, err == nil, "could not open archive: %v", err)
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	assert(t, err == nil, "could not decompress archive: %v", err)
+
+	raw, err := ioutil.ReadAll(gz)
+	assert(t, err == nil, "could not read archive: %v", err)
+	return raw
+}
@@ -8,8 +8,12 @@ import (
 )
 
 type (
-	loggerKey    struct{}
-	requestIdKey struct{}
+	loggerKey       struct{}
+	requestIdKey    struct{}
+	actorKey        struct{}
+	clientIPKey     struct{}
+	revisionKey     struct{}
+	uniqueDomainKey struct{}
 
 	Context = context.Context
 )
@@ -30,6 +34,24 @@ func WithRequestId(ctx Context, requestId string) Context {
 	return context.WithValue(ctx, requestIdKey{}, requestId)
 }
 
+func WithActor(ctx Context, actor string) Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+func WithClientIP(ctx Context, ip string) Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+// WithIfRevision makes store mutations conditional, they fail unless permit is at the given revision
+func WithIfRevision(ctx Context, revision uint64) Context {
+	return context.WithValue(ctx, revisionKey{}, revision)
+}
+
+// WithUniqueDomain makes store mutations fail when they would leave domain with more than one valid permit
+func WithUniqueDomain(ctx Context) Context {
+	return context.WithValue(ctx, uniqueDomainKey{}, true)
+}
+
 func WithTimeout(parent Context, timeout time.Duration) (Context, context.CancelFunc) {
 	return context.WithTimeout(parent, timeout)
 }
@@ -53,3 +75,45 @@ func RequestId(ctx Context) string {
 
 	return ""
 }
+
+func Actor(ctx Context) string {
+	if ctx == nil {
+		return ""
+	}
+
+	if actor, ok := ctx.Value(actorKey{}).(string); ok {
+		return actor
+	}
+
+	return ""
+}
+
+func ClientIP(ctx Context) string {
+	if ctx == nil {
+		return ""
+	}
+
+	if ip, ok := ctx.Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+
+	return ""
+}
+
+func IfRevision(ctx Context) (uint64, bool) {
+	if ctx == nil {
+		return 0, false
+	}
+
+	revision, ok := ctx.Value(revisionKey{}).(uint64)
+	return revision, ok
+}
+
+func UniqueDomain(ctx Context) bool {
+	if ctx == nil {
+		return false
+	}
+
+	unique, _ := ctx.Value(uniqueDomainKey{}).(bool)
+	return unique
+}
@@ -0,0 +1,285 @@
+package envelope
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Envelope encryption
+//
+// Each payload is encrypted with its own random data key (AES-256-GCM) and
+// the data key is encrypted with one of the master keys. Sealed payload
+// records the ID of the master key, so master keys can be rotated by adding
+// a new key, making it active and re-sealing existing payloads.
+
+type (
+	Keyring struct {
+		keys   map[string][]byte
+		active string
+	}
+
+	sealed struct {
+		Enc   string `json:"enc"`
+		KeyID string `json:"kid"`
+
+		// Data key, encrypted with master key
+		DEK []byte `json:"dek"`
+
+		// Payload, encrypted with data key
+		Data []byte `json:"data"`
+	}
+)
+
+const (
+	algorithm = "AES-256-GCM"
+	keySize   = 32
+)
+
+var (
+	UnknownKey = errors.New("unknown master key")
+	NoKeys     = errors.New("payload is encrypted but no master keys are configured")
+)
+
+// NewKeyring creates keyring with the given master keys
+//
+// Active key is used for sealing; all keys can be used for opening.
+func NewKeyring(active string, keys map[string][]byte) (*Keyring, error) {
+	for id, key := range keys {
+		if id == "" || strings.ContainsAny(id, ": \t") {
+			return nil, errors.Errorf("invalid master key ID %q", id)
+		}
+
+		if len(key) != keySize {
+			return nil, errors.Errorf("master key %q must be %d bytes long", id, keySize)
+		}
+	}
+
+	if _, has := keys[active]; !has {
+		return nil, errors.Wrapf(UnknownKey, "active key %q", active)
+	}
+
+	return &Keyring{keys: keys, active: active}, nil
+}
+
+// ParseKeys reads master keys, one "<key ID>:<base64 encoded key>" per line or comma separated
+//
+// Empty lines and lines starting with # are ignored. Returns ID of the first key.
+func ParseKeys(r io.Reader, keys map[string][]byte) (first string, err error) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		for _, def := range strings.Split(s.Text(), ",") {
+			if def = strings.TrimSpace(def); def == "" || strings.HasPrefix(def, "#") {
+				continue
+			}
+
+			parts := strings.SplitN(def, ":", 2)
+			if len(parts) != 2 {
+				return "", errors.New("invalid master key definition, expecting <key ID>:<base64 encoded key>")
+			}
+
+			if keys[parts[0]], err = base64.StdEncoding.DecodeString(parts[1]); err != nil {
+				return "", errors.Wrapf(err, "could not decode master key %q", parts[0])
+			}
+
+			if first == "" {
+				first = parts[0]
+			}
+		}
+	}
+
+	return first, errors.Wrap(s.Err(), "could not read master keys")
+}
+
+// LoadKeyring builds keyring from a list of key definitions and a key file
+//
+// Returns nil keyring (no encryption) when there are no keys.
+func LoadKeyring(active, defs, file string) (*Keyring, error) {
+	var (
+		keys     = map[string][]byte{}
+		first, f string
+		err      error
+	)
+
+	if first, err = ParseKeys(strings.NewReader(defs), keys); err != nil {
+		return nil, err
+	}
+
+	if file != "" {
+		fh, err := os.Open(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not open master key file")
+		}
+
+		defer fh.Close()
+
+		if f, err = ParseKeys(fh, keys); err != nil {
+			return nil, err
+		}
+
+		if first == "" {
+			first = f
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	if active == "" {
+		active = first
+	}
+
+	return NewKeyring(active, keys)
+}
+
+// Active returns ID of the master key used for sealing
+func (k *Keyring) Active() string {
+	if k == nil {
+		return ""
+	}
+
+	return k.active
+}
+
+// Seal encrypts payload with the active master key
+//
+// Nil keyring returns payload as-is.
+func (k *Keyring) Seal(payload []byte) ([]byte, error) {
+	if k == nil {
+		return payload, nil
+	}
+
+	return k.SealWith(k.active, payload)
+}
+
+// SealWith encrypts payload with a specific master key
+func (k *Keyring) SealWith(keyID string, payload []byte) (_ []byte, err error) {
+	var (
+		s   = sealed{Enc: algorithm, KeyID: keyID}
+		dek = make([]byte, keySize)
+	)
+
+	if k == nil {
+		return nil, NoKeys
+	}
+
+	master, has := k.keys[keyID]
+	if !has {
+		return nil, errors.Wrapf(UnknownKey, "key %q", keyID)
+	}
+
+	if _, err = rand.Read(dek); err != nil {
+		return nil, errors.Wrap(err, "could not generate data key")
+	}
+
+	if s.Data, err = seal(dek, payload, nil); err != nil {
+		return nil, err
+	}
+
+	// Key ID is authenticated together with the wrapped data key so it can not be swapped
+	if s.DEK, err = seal(master, dek, []byte(keyID)); err != nil {
+		return nil, err
+	}
+
+	enc, err := json.Marshal(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not encode envelope")
+	}
+
+	return append(enc, '\n'), nil
+}
+
+// Open decrypts sealed payload
+//
+// Payloads that are not sealed (written before encryption was enabled) are returned as-is.
+func (k *Keyring) Open(data []byte) ([]byte, error) {
+	s, ok := unwrap(data)
+	if !ok {
+		return data, nil
+	}
+
+	if k == nil {
+		return nil, NoKeys
+	}
+
+	master, has := k.keys[s.KeyID]
+	if !has {
+		return nil, errors.Wrapf(UnknownKey, "key %q", s.KeyID)
+	}
+
+	dek, err := open(master, s.DEK, []byte(s.KeyID))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decrypt data key")
+	}
+
+	payload, err := open(dek, s.Data, nil)
+	return payload, errors.Wrap(err, "could not decrypt payload")
+}
+
+// KeyID returns ID of the master key the payload was sealed with
+//
+// Returns false if payload is not sealed.
+func KeyID(data []byte) (string, bool) {
+	s, ok := unwrap(data)
+	return s.KeyID, ok
+}
+
+func unwrap(data []byte) (s sealed, ok bool) {
+	if !bytes.Contains(data, []byte(`"enc"`)) {
+		// Fast path for plaintext payloads
+		return
+	}
+
+	if json.Unmarshal(data, &s) != nil || s.Enc != algorithm {
+		return sealed{}, false
+	}
+
+	return s, true
+}
+
+func seal(key, plaintext, additional []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "could not generate nonce")
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+func open(key, ciphertext, additional []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	ns := aead.NonceSize()
+	return aead.Open(nil, ciphertext[:ns], ciphertext[ns:], additional)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create cipher")
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,64 @@
+package envelope
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func assert(t *testing.T, ok bool, format string, args ...interface{}) bool {
+	if !ok {
+		t.Fatalf(format, args...)
+	}
+	return ok
+}
+
+func TestSealOpen(t *testing.T) {
+	var (
+		payload = []byte(`{"key":"secret"}`)
+		keys    = map[string][]byte{}
+	)
+
+	first, err := ParseKeys(strings.NewReader(
+		"# master keys\n"+
+			"k1:MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE=\n"+
+			"k2:YWJjZGVmZ2hpamtsbW5vcHFyc3R1dnd4eXphYmNkZWY=\n",
+	), keys)
+	assert(t, err == nil, "could not parse keys: %v", err)
+	assert(t, first == "k1", "expecting k1 as the first key, got %q", first)
+
+	kr, err := NewKeyring("k1", keys)
+	assert(t, err == nil, "could not create keyring: %v", err)
+
+	sealed, err := kr.Seal(payload)
+	assert(t, err == nil, "could not seal: %v", err)
+	assert(t, !bytes.Contains(sealed, []byte("secret")), "expecting sealed payload not to contain plaintext")
+
+	kid, ok := KeyID(sealed)
+	assert(t, ok && kid == "k1", "expecting payload sealed with k1, got %q", kid)
+
+	opened, err := kr.Open(sealed)
+	assert(t, err == nil && bytes.Equal(opened, payload), "could not open sealed payload: %v", err)
+
+	opened, err = kr.Open(payload)
+	assert(t, err == nil && bytes.Equal(opened, payload), "expecting plaintext to be returned as-is")
+
+	_, err = (*Keyring)(nil).Open(sealed)
+	assert(t, err == NoKeys, "expecting error when opening without keys")
+
+	resealed, err := kr.SealWith("k2", opened)
+	assert(t, err == nil, "could not seal with k2: %v", err)
+
+	// Keyring without the old key can still open records re-sealed with the new one
+	kr2, err := NewKeyring("k2", map[string][]byte{"k2": keys["k2"]})
+	assert(t, err == nil, "could not create keyring: %v", err)
+
+	_, err = kr2.Open(sealed)
+	assert(t, err != nil, "expecting error when opening with unknown key")
+
+	opened, err = kr2.Open(resealed)
+	assert(t, err == nil && bytes.Equal(opened, payload), "could not open re-sealed payload: %v", err)
+
+	_, err = NewKeyring("k1", map[string][]byte{"k1": []byte("short")})
+	assert(t, err != nil, "expecting error on invalid key size")
+}
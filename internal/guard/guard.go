@@ -0,0 +1,216 @@
+package guard
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Brute-force protection
+//
+// Failed permit checks are counted per client IP and per domain within a
+// window. IP that crosses the threshold is banned; each repeated ban (before
+// the previous offence is forgotten) doubles the duration, up to the max.
+// Domain crossing its threshold is only reported, banning the domain would
+// lock out its owner.
+
+type (
+	Policy struct {
+		// Failures per IP within window that trigger a ban, 0 disables bans
+		Threshold int
+		Window    time.Duration
+
+		// Duration of the first ban and the upper limit for escalation
+		BanDuration time.Duration
+		MaxDuration time.Duration
+
+		// Ban level resets after this long without a new ban
+		Forget time.Duration
+
+		// Failures per domain within window that are reported, 0 disables
+		DomainThreshold int
+	}
+
+	Guard struct {
+		policy Policy
+		store  *Store
+
+		mux      sync.Mutex
+		ips      map[string]*counter
+		domains  map[string]*counter
+		swept    time.Time
+		bans     map[string]Ban
+		modified time.Time
+		checked  time.Time
+
+		triggered uint64
+	}
+
+	// Event describes what the failure triggered
+	Event struct {
+		// New ban of the client IP
+		Ban *Ban
+
+		// Domain crossed its threshold with this failure
+		DomainAlert bool
+		Failures    int
+	}
+
+	counter struct {
+		start time.Time
+		count int
+	}
+)
+
+// How often ban file is checked for changes made by other processes
+const reloadInterval = time.Second
+
+// New creates guard that keeps bans in the store
+func New(store *Store, p Policy) *Guard {
+	return &Guard{
+		policy:  p,
+		store:   store,
+		ips:     map[string]*counter{},
+		domains: map[string]*counter{},
+		bans:    map[string]Ban{},
+	}
+}
+
+// Banned returns active ban of the IP
+func (g *Guard) Banned(ip string, now time.Time) (*Ban, bool) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	g.reload(now)
+
+	if b, has := g.bans[ip]; has && b.Active(now) {
+		return &b, true
+	}
+
+	return nil, false
+}
+
+// Fail counts failed check and bans the IP when it crosses the threshold
+func (g *Guard) Fail(ip, domain string, now time.Time) (e Event, err error) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	g.sweep(now)
+
+	if g.policy.DomainThreshold > 0 && domain != "" {
+		c := g.count(g.domains, strings.ToLower(domain), now)
+		e.DomainAlert = c.count == g.policy.DomainThreshold
+	}
+
+	if g.policy.Threshold <= 0 {
+		return
+	}
+
+	c := g.count(g.ips, ip, now)
+	e.Failures = c.count
+
+	if c.count < g.policy.Threshold {
+		return
+	}
+
+	// Counting starts over after the ban
+	delete(g.ips, ip)
+
+	err = g.store.update(func(bb map[string]Ban) error {
+		prune(bb, now, g.policy.Forget)
+
+		b := Ban{IP: ip, Level: 1, Since: now}
+
+		if prev, has := bb[ip]; has && now.Sub(prev.Until) < g.policy.Forget {
+			b.Level = prev.Level + 1
+		}
+
+		b.Until = now.Add(g.duration(b.Level))
+		b.Reason = fmt.Sprintf("%d failed checks within %s", c.count, g.policy.Window)
+
+		bb[ip], g.bans[ip] = b, b
+		e.Ban = &b
+		return nil
+	})
+
+	if err == nil {
+		g.triggered++
+	}
+
+	return
+}
+
+// Triggered returns number of bans triggered by this guard
+func (g *Guard) Triggered() uint64 {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	return g.triggered
+}
+
+// duration of the ban on the given level
+func (g *Guard) duration(level int) time.Duration {
+	d := g.policy.BanDuration
+	for i := 1; i < level && d < g.policy.MaxDuration; i++ {
+		d *= 2
+	}
+
+	if g.policy.MaxDuration > 0 && d > g.policy.MaxDuration {
+		d = g.policy.MaxDuration
+	}
+
+	return d
+}
+
+func (g *Guard) count(cc map[string]*counter, key string, now time.Time) *counter {
+	c, has := cc[key]
+	if !has || !now.Before(c.start.Add(g.policy.Window)) {
+		c = &counter{start: now}
+		cc[key] = c
+	}
+
+	c.count++
+	return c
+}
+
+// sweep drops expired counters, at most once per window
+func (g *Guard) sweep(now time.Time) {
+	if now.Sub(g.swept) < g.policy.Window {
+		return
+	}
+
+	g.swept = now
+
+	for _, cc := range []map[string]*counter{g.ips, g.domains} {
+		for key, c := range cc {
+			if !now.Before(c.start.Add(g.policy.Window)) {
+				delete(cc, key)
+			}
+		}
+	}
+}
+
+// reload picks up bans changed by other processes (lifted with CLI...)
+//
+// Bans from the last successful read are kept when the file can not be read.
+func (g *Guard) reload(now time.Time) {
+	if now.Sub(g.checked) < reloadInterval {
+		return
+	}
+
+	g.checked = now
+
+	fi, err := os.Stat(g.store.file())
+	if os.IsNotExist(err) {
+		g.bans = map[string]Ban{}
+		return
+	} else if err != nil || fi.ModTime().Equal(g.modified) {
+		return
+	}
+
+	if bb, err := g.store.read(); err == nil {
+		g.bans, g.modified = bb, fi.ModTime()
+	}
+}
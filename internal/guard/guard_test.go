@@ -0,0 +1,90 @@
+package guard
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func assert(t *testing.T, ok bool, format string, args ...interface{}) bool {
+	if !ok {
+		t.Fatalf(format, args...)
+	}
+	return ok
+}
+
+func TestEscalatingBans(t *testing.T) {
+	dir, err := ioutil.TempDir("", "permit-guard-")
+	assert(t, err == nil, "could not create temp dir: %v", err)
+	defer os.RemoveAll(dir)
+
+	store, err := NewStore(dir)
+	assert(t, err == nil, "could not create store: %v", err)
+
+	var (
+		now = time.Now()
+		g   = New(store, Policy{
+			Threshold:       3,
+			Window:          time.Minute,
+			BanDuration:     time.Minute,
+			MaxDuration:     3 * time.Minute,
+			Forget:          time.Hour,
+			DomainThreshold: 4,
+		})
+
+		fail = func(ip string) Event {
+			e, err := g.Fail(ip, "example.tld", now)
+			assert(t, err == nil, "could not count failure: %v", err)
+			return e
+		}
+	)
+
+	fail("192.0.2.1")
+	fail("192.0.2.1")
+	e := fail("192.0.2.1")
+	assert(t, e.Ban != nil && e.Ban.Level == 1 && e.Ban.Until.Equal(now.Add(time.Minute)), "expecting first ban, got %+v", e.Ban)
+
+	_, banned := g.Banned("192.0.2.1", now)
+	assert(t, banned, "expecting IP to be banned")
+
+	_, banned = g.Banned("192.0.2.2", now)
+	assert(t, !banned, "expecting other IPs not to be banned")
+
+	e = fail("192.0.2.2")
+	assert(t, e.DomainAlert, "expecting domain alert on 4th failure for the domain")
+
+	// Repeated offences double the ban, up to the max
+	for _, expected := range []time.Duration{2 * time.Minute, 3 * time.Minute} {
+		now = now.Add(5 * time.Minute)
+		fail("192.0.2.1")
+		fail("192.0.2.1")
+		e = fail("192.0.2.1")
+		assert(t, e.Ban != nil && e.Ban.Until.Sub(now) == expected, "expecting %v ban, got %+v", expected, e.Ban)
+	}
+
+	assert(t, g.Triggered() == 3, "expecting 3 triggered bans, got %d", g.Triggered())
+
+	bb, err := store.List(now, false)
+	assert(t, err == nil && len(bb) == 1 && bb[0].Level == 3, "unexpected bans: %+v (%v)", bb, err)
+
+	// Lifting with another process is picked up
+	assert(t, store.Lift("192.0.2.1") == nil, "could not lift ban")
+	_, banned = g.Banned("192.0.2.1", now.Add(2*reloadInterval))
+	assert(t, !banned, "expecting lifted ban to be picked up")
+
+	assert(t, store.Lift("192.0.2.1") == BanNotFound, "expecting unknown ban")
+
+	// Forgotten bans are dropped with the next ban
+	fail("192.0.2.1")
+	fail("192.0.2.1")
+	fail("192.0.2.1")
+
+	now = now.Add(2 * time.Hour)
+	fail("192.0.2.3")
+	fail("192.0.2.3")
+	fail("192.0.2.3")
+
+	bb, err = store.List(now, true)
+	assert(t, err == nil && len(bb) == 1 && bb[0].IP == "192.0.2.3", "expecting forgotten ban to be pruned, got %+v (%v)", bb, err)
+}
@@ -0,0 +1,162 @@
+package guard
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/crusttech/permit/internal/lockfile"
+)
+
+type (
+	// Store keeps bans in a file shared by API and CLI
+	Store struct {
+		path string
+	}
+
+	Ban struct {
+		IP     string    `json:"ip"`
+		Level  int       `json:"level"`
+		Since  time.Time `json:"since"`
+		Until  time.Time `json:"until"`
+		Reason string    `json:"reason"`
+	}
+)
+
+const (
+	bansFile = "bans.json"
+	lockFile = "bans.lock"
+
+	lockTimeout = 5 * time.Second
+)
+
+var (
+	BanNotFound = errors.New("ban not found")
+)
+
+// NewStore keeps bans in the directory
+func NewStore(path string) (*Store, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, errors.Wrap(err, "could not create bans directory")
+	}
+
+	return &Store{path: path}, nil
+}
+
+// Active reports if ban is in force
+func (b Ban) Active(now time.Time) bool {
+	return now.Before(b.Until)
+}
+
+// List returns bans sorted by expiration, expired ones (kept for escalation) only when all is set
+func (s Store) List(now time.Time, all bool) ([]Ban, error) {
+	bb, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+
+	ll := make([]Ban, 0, len(bb))
+	for _, b := range bb {
+		if all || b.Active(now) {
+			ll = append(ll, b)
+		}
+	}
+
+	sort.Slice(ll, func(i, j int) bool { return ll[i].Until.Before(ll[j].Until) })
+	return ll, nil
+}
+
+// Lift removes ban, including its history
+func (s Store) Lift(ip string) error {
+	return s.update(func(bb map[string]Ban) error {
+		if _, has := bb[ip]; !has {
+			return BanNotFound
+		}
+
+		delete(bb, ip)
+		return nil
+	})
+}
+
+// prune drops bans that ended more than forget ago, their level would not be escalated anymore
+func prune(bb map[string]Ban, now time.Time, forget time.Duration) {
+	for ip, b := range bb {
+		if now.Sub(b.Until) >= forget {
+			delete(bb, ip)
+		}
+	}
+}
+
+// update changes bans under lock shared by all processes
+func (s Store) update(fn func(map[string]Ban) error) error {
+	release, err := lockfile.Acquire(filepath.Join(s.path, lockFile), lockTimeout)
+	if err != nil {
+		return errors.Wrap(err, "could not lock bans")
+	}
+
+	defer release()
+
+	bb, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	if err = fn(bb); err != nil {
+		return err
+	}
+
+	return s.write(bb)
+}
+
+func (s Store) read() (map[string]Ban, error) {
+	var bb = map[string]Ban{}
+
+	data, err := ioutil.ReadFile(s.file())
+	if os.IsNotExist(err) {
+		return bb, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "could not read bans")
+	}
+
+	return bb, errors.Wrap(json.Unmarshal(data, &bb), "could not decode bans")
+}
+
+func (s Store) write(bb map[string]Ban) error {
+	data, err := json.MarshalIndent(bb, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "could not encode bans")
+	}
+
+	f, err := ioutil.TempFile(s.path, bansFile)
+	if err != nil {
+		return errors.Wrap(err, "could not write bans")
+	}
+
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), s.file())
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, "could not write bans")
+	}
+
+	return nil
+}
+
+func (s Store) file() string {
+	return filepath.Join(s.path, bansFile)
+}
@@ -0,0 +1,70 @@
+package lockfile
+
+import (
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Lock files older than this are considered abandoned
+//
+// Holder refreshes lock's modification time so long-running
+// operations (backups...) do not lose it.
+const staleAge = time.Minute
+
+var (
+	Timeout = errors.New("timeout while waiting for lock")
+)
+
+// Acquire creates lock file, waiting up to timeout for other holders to release it
+//
+// Works across processes that share the filesystem (api server and cli).
+func Acquire(path string, timeout time.Duration) (release func(), err error) {
+	var deadline = time.Now().Add(timeout)
+
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			f.Close()
+			return hold(path), nil
+		} else if !os.IsExist(err) {
+			return nil, errors.Wrap(err, "could not create lock file")
+		}
+
+		if fi, err := os.Stat(path); err == nil && time.Since(fi.ModTime()) > staleAge {
+			os.Remove(path)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, Timeout
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// hold keeps lock fresh until released
+func hold(path string) (release func()) {
+	var done = make(chan struct{})
+
+	go func() {
+		t := time.NewTicker(staleAge / 3)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-t.C:
+				os.Chtimes(path, now, now)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		os.Remove(path)
+	}
+}
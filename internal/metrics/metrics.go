@@ -0,0 +1,285 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics in Prometheus text exposition format
+//
+// Counters and histograms are kept in memory and reset when the process
+// restarts, Prometheus handles that. Gauges (and counters kept elsewhere)
+// are read with callbacks when metrics are scraped.
+
+type (
+	Registry struct {
+		mux        sync.Mutex
+		collectors []collector
+	}
+
+	// Sample is a value of callback metric, label values are in the order of metric's labels
+	Sample struct {
+		Labels []string
+		Value  float64
+	}
+
+	Counter struct {
+		desc
+
+		mux    sync.Mutex
+		values map[string]float64
+	}
+
+	Histogram struct {
+		desc
+		buckets []float64
+
+		mux    sync.Mutex
+		values map[string]*histogram
+	}
+
+	collector interface {
+		write(w *bufio.Writer)
+	}
+
+	desc struct {
+		name   string
+		help   string
+		kind   string
+		labels []string
+	}
+
+	histogram struct {
+		counts []uint64
+		sum    float64
+		count  uint64
+	}
+
+	callback struct {
+		desc
+		fn func() []Sample
+	}
+)
+
+const (
+	// Content type of the exposition format
+	ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+	// Separates label values in series keys
+	labelSep = "\xff"
+)
+
+// DefaultBuckets suit request latencies, in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Counter registers counter with the label names
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	c := &Counter{desc: desc{name, help, "counter", labels}, values: map[string]float64{}}
+	r.register(c)
+	return c
+}
+
+// Histogram registers histogram with upper bounds of buckets (without +Inf)
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{desc: desc{name, help, "histogram", labels}, buckets: buckets, values: map[string]*histogram{}}
+	r.register(h)
+	return h
+}
+
+// GaugeFunc registers gauge that is read with fn on every scrape
+func (r *Registry) GaugeFunc(name, help string, fn func() []Sample, labels ...string) {
+	r.register(&callback{desc: desc{name, help, "gauge", labels}, fn: fn})
+}
+
+// CounterFunc registers counter kept outside the registry
+func (r *Registry) CounterFunc(name, help string, fn func() float64) {
+	r.register(&callback{desc: desc{name, help, "counter", nil}, fn: func() []Sample {
+		return []Sample{{Value: fn()}}
+	}})
+}
+
+// Write sends all metrics to w
+func (r *Registry) Write(w io.Writer) error {
+	r.mux.Lock()
+	cc := make([]collector, len(r.collectors))
+	copy(cc, r.collectors)
+	r.mux.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, c := range cc {
+		c.write(bw)
+	}
+
+	return bw.Flush()
+}
+
+// Handler serves metrics to Prometheus
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		r.Write(w)
+	})
+}
+
+func (r *Registry) register(c collector) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.collectors = append(r.collectors, c)
+}
+
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+func (c *Counter) Add(v float64, labels ...string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.values[key(labels)] += v
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.header(w)
+	for _, k := range sortedKeys(c.values) {
+		c.sample(w, "", split(k), "", "", c.values[k])
+	}
+}
+
+func (h *Histogram) Observe(v float64, labels ...string) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	k := key(labels)
+	s, ok := h.values[k]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[k] = s
+	}
+
+	for i, b := range h.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+
+	s.sum += v
+	s.count++
+}
+
+// ObserveSince observes seconds elapsed since start
+func (h *Histogram) ObserveSince(start time.Time, labels ...string) {
+	h.Observe(time.Since(start).Seconds(), labels...)
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	h.header(w)
+
+	kk := make([]string, 0, len(h.values))
+	for k := range h.values {
+		kk = append(kk, k)
+	}
+
+	sort.Strings(kk)
+
+	for _, k := range kk {
+		var (
+			s  = h.values[k]
+			lv = split(k)
+		)
+
+		for i, b := range h.buckets {
+			h.sample(w, "_bucket", lv, "le", formatFloat(b), float64(s.counts[i]))
+		}
+
+		h.sample(w, "_bucket", lv, "le", "+Inf", float64(s.count))
+		h.sample(w, "_sum", lv, "", "", s.sum)
+		h.sample(w, "_count", lv, "", "", float64(s.count))
+	}
+}
+
+func (c *callback) write(w *bufio.Writer) {
+	c.header(w)
+	for _, s := range c.fn() {
+		c.sample(w, "", s.Labels, "", "", s.Value)
+	}
+}
+
+func (d desc) header(w *bufio.Writer) {
+	w.WriteString("# HELP " + d.name + " " + strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help) + "\n")
+	w.WriteString("# TYPE " + d.name + " " + d.kind + "\n")
+}
+
+// sample writes one line, extra label (le of histogram buckets) is added when set
+func (d desc) sample(w *bufio.Writer, suffix string, values []string, extra, extraValue string, v float64) {
+	w.WriteString(d.name + suffix)
+
+	pairs := make([]string, 0, len(d.labels)+1)
+	for i, l := range d.labels {
+		if i < len(values) {
+			pairs = append(pairs, l+`="`+escape(values[i])+`"`)
+		}
+	}
+
+	if extra != "" {
+		pairs = append(pairs, extra+`="`+extraValue+`"`)
+	}
+
+	if len(pairs) > 0 {
+		w.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+
+	w.WriteString(" " + formatFloat(v) + "\n")
+}
+
+func escape(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+func key(labels []string) string {
+	return strings.Join(labels, labelSep)
+}
+
+func split(k string) []string {
+	return strings.Split(k, labelSep)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	kk := make([]string, 0, len(m))
+	for k := range m {
+		kk = append(kk, k)
+	}
+
+	sort.Strings(kk)
+	return kk
+}
@@ -0,0 +1,146 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/crusttech/permit/internal/store"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+type (
+	mockStorage struct {
+		store.Storage
+
+		permits []*permit.Permit
+		err     error
+		lists   int
+	}
+)
+
+func (s *mockStorage) List(q store.Query) ([]*permit.Permit, string, error) {
+	s.lists++
+	return s.permits, "", s.err
+}
+
+func (s mockStorage) Get(key string) (*permit.Permit, error) {
+	return nil, s.err
+}
+
+func assert(t *testing.T, ok bool, format string, args ...interface{}) bool {
+	if !ok {
+		t.Fatalf(format, args...)
+	}
+	return ok
+}
+
+func write(t *testing.T, r *Registry) string {
+	var buf bytes.Buffer
+	assert(t, r.Write(&buf) == nil, "could not write metrics")
+	return buf.String()
+}
+
+func TestWrite(t *testing.T) {
+	r := NewRegistry()
+
+	c := r.Counter("test_total", "Test counter.", "code")
+	c.Inc("OK")
+	c.Add(2, "OK")
+	c.Inc(`a"b`)
+	c.Inc("")
+
+	h := r.Histogram("test_seconds", "Test histogram.", []float64{.1, 1})
+	h.Observe(.05)
+	h.Observe(.5)
+	h.Observe(5)
+
+	r.CounterFunc("test_func_total", "Test counter func.", func() float64 { return 7 })
+
+	expected := strings.Join([]string{
+		`# HELP test_total Test counter.`,
+		`# TYPE test_total counter`,
+		`test_total{code=""} 1`,
+		`test_total{code="OK"} 3`,
+		`test_total{code="a\"b"} 1`,
+		`# HELP test_seconds Test histogram.`,
+		`# TYPE test_seconds histogram`,
+		`test_seconds_bucket{le="0.1"} 1`,
+		`test_seconds_bucket{le="1"} 2`,
+		`test_seconds_bucket{le="+Inf"} 3`,
+		`test_seconds_sum 5.55`,
+		`test_seconds_count 3`,
+		`# HELP test_func_total Test counter func.`,
+		`# TYPE test_func_total counter`,
+		`test_func_total 7`,
+		``,
+	}, "\n")
+
+	out := write(t, r)
+	assert(t, out == expected, "unexpected output:\n%s\nexpecting:\n%s", out, expected)
+}
+
+func TestPermits(t *testing.T) {
+	var (
+		r    = NewRegistry()
+		s    = &mockStorage{}
+		soon = time.Now().Add(24 * time.Hour)
+		late = time.Now().Add(365 * 24 * time.Hour)
+		past = time.Now().Add(-time.Hour)
+	)
+
+	s.permits = []*permit.Permit{
+		{Valid: true},
+		{Valid: true, Expires: &soon},
+		{Valid: true, Expires: &late},
+		{Valid: true, Expires: &past},
+		{Valid: false, Expires: &soon},
+	}
+
+	Permits(r, s)
+
+	out := write(t, r)
+	for _, line := range []string{
+		`permit_permits{state="active"} 3`,
+		`permit_permits{state="expired"} 1`,
+		`permit_permits{state="revoked"} 1`,
+		`permit_permits_expiring_soon 1`,
+	} {
+		assert(t, strings.Contains(out, line+"\n"), "expecting %q in:\n%s", line, out)
+	}
+
+	assert(t, s.lists == 1, "expecting permits to be listed once per scrape, got %d", s.lists)
+
+	defer func(ttl time.Duration) { permitCountsTTL = ttl }(permitCountsTTL)
+	permitCountsTTL = 0
+
+	s.err = errors.New("store down")
+	out = write(t, r)
+	assert(t, !strings.Contains(out, "permit_permits{"), "expecting no samples when listing fails:\n%s", out)
+}
+
+func TestStorage(t *testing.T) {
+	var (
+		r = NewRegistry()
+		m = &mockStorage{err: permit.PermitNotFound}
+		s = Storage(m, r)
+	)
+
+	s.Get("missing")
+	m.err = errors.Wrap(errors.New("disk full"), "could not read")
+	s.Get("broken")
+	s.List(store.Query{})
+
+	out := write(t, r)
+	for _, line := range []string{
+		`permit_storage_operation_duration_seconds_count{operation="get"} 2`,
+		`permit_storage_operation_duration_seconds_count{operation="list"} 1`,
+		`permit_storage_errors_total{operation="get"} 1`,
+		`permit_storage_errors_total{operation="list"} 1`,
+	} {
+		assert(t, strings.Contains(out, line+"\n"), "expecting %q in:\n%s", line, out)
+	}
+}
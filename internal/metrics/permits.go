@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/crusttech/permit/internal/store"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+type (
+	permitLister interface {
+		List(q store.Query) ([]*permit.Permit, string, error)
+	}
+
+	permitCounts struct {
+		active, expired, revoked, expiringSoon float64
+	}
+)
+
+// Permits are listed at most once per this long, so that gauges of one scrape share the counts
+var permitCountsTTL = time.Second
+
+// Permits registers gauges with number of permits by state
+//
+// Permits are counted once per scrape; nothing is reported when listing fails
+// so that Prometheus sees the gap instead of zeros.
+func Permits(r *Registry, s permitLister) {
+	var (
+		mux     sync.Mutex
+		last    time.Time
+		cached  permitCounts
+		counted bool
+	)
+
+	var counts = func() (permitCounts, bool) {
+		mux.Lock()
+		defer mux.Unlock()
+
+		if time.Since(last) >= permitCountsTTL {
+			cached, counted = countPermits(s)
+			last = time.Now()
+		}
+
+		return cached, counted
+	}
+
+	r.GaugeFunc("permit_permits", "Number of permits by state.", func() []Sample {
+		c, ok := counts()
+		if !ok {
+			return nil
+		}
+
+		return []Sample{
+			{Labels: []string{"active"}, Value: c.active},
+			{Labels: []string{"expired"}, Value: c.expired},
+			{Labels: []string{"revoked"}, Value: c.revoked},
+		}
+	}, "state")
+
+	r.GaugeFunc("permit_permits_expiring_soon", "Number of active permits expiring within 30 days.", func() []Sample {
+		c, ok := counts()
+		if !ok {
+			return nil
+		}
+
+		return []Sample{{Value: c.expiringSoon}}
+	})
+}
+
+func countPermits(s permitLister) (c permitCounts, ok bool) {
+	pp, _, err := s.List(store.Query{})
+	if err != nil {
+		return c, false
+	}
+
+	now := time.Now()
+	for _, p := range pp {
+		switch {
+		case !p.Valid:
+			c.revoked++
+		case p.Expires != nil && p.Expires.Before(now):
+			c.expired++
+		default:
+			c.active++
+			if p.Expires != nil && p.Expires.Sub(now) < permit.ExpiresSoon {
+				c.expiringSoon++
+			}
+		}
+	}
+
+	return c, true
+}
@@ -0,0 +1,148 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/internal/store"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+type (
+	// storage decorates permit store and measures duration and errors of its operations
+	storage struct {
+		store.Storage
+
+		duration *Histogram
+		errors   *Counter
+	}
+)
+
+// StorageBuckets suit storage operations, in seconds
+var StorageBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+// Storage wraps permit store so that its operations are measured
+//
+// Watch is not measured, it streams events until its context is done.
+func Storage(s store.Storage, r *Registry) *storage {
+	return &storage{
+		Storage: s,
+		duration: r.Histogram(
+			"permit_storage_operation_duration_seconds",
+			"Duration of permit store operations.",
+			StorageBuckets,
+			"operation",
+		),
+		errors: r.Counter(
+			"permit_storage_errors_total",
+			"Failed permit store operations, not counting expected errors like missing permits.",
+			"operation",
+		),
+	}
+}
+
+func (s storage) List(q store.Query) (pp []*permit.Permit, cursor string, err error) {
+	defer s.observe("list", time.Now(), &err)
+	return s.Storage.List(q)
+}
+
+func (s storage) Get(key string) (p *permit.Permit, err error) {
+	defer s.observe("get", time.Now(), &err)
+	return s.Storage.Get(key)
+}
+
+func (s storage) FindByDomain(domain string) (pp []*permit.Permit, err error) {
+	defer s.observe("find_by_domain", time.Now(), &err)
+	return s.Storage.FindByDomain(domain)
+}
+
+func (s storage) Create(ctx context.Context, p permit.Permit) (err error) {
+	defer s.observe("create", time.Now(), &err)
+	return s.Storage.Create(ctx, p)
+}
+
+func (s storage) Update(ctx context.Context, key string, p store.Patch) (err error) {
+	defer s.observe("update", time.Now(), &err)
+	return s.Storage.Update(ctx, key, p)
+}
+
+func (s storage) Revoke(ctx context.Context, key string) (err error) {
+	defer s.observe("revoke", time.Now(), &err)
+	return s.Storage.Revoke(ctx, key)
+}
+
+func (s storage) Enable(ctx context.Context, key string) (err error) {
+	defer s.observe("enable", time.Now(), &err)
+	return s.Storage.Enable(ctx, key)
+}
+
+func (s storage) Extend(ctx context.Context, key string, t *time.Time) (err error) {
+	defer s.observe("extend", time.Now(), &err)
+	return s.Storage.Extend(ctx, key, t)
+}
+
+func (s storage) Delete(ctx context.Context, key string) (err error) {
+	defer s.observe("delete", time.Now(), &err)
+	return s.Storage.Delete(ctx, key)
+}
+
+func (s storage) History(key string) (rr []store.Revision, err error) {
+	defer s.observe("history", time.Now(), &err)
+	return s.Storage.History(key)
+}
+
+func (s storage) Rollback(ctx context.Context, key string, number int) (err error) {
+	defer s.observe("rollback", time.Now(), &err)
+	return s.Storage.Rollback(ctx, key, number)
+}
+
+func (s storage) Trash() (tt []store.Trashed, err error) {
+	defer s.observe("trash", time.Now(), &err)
+	return s.Storage.Trash()
+}
+
+func (s storage) Restore(ctx context.Context, key string) (err error) {
+	defer s.observe("restore", time.Now(), &err)
+	return s.Storage.Restore(ctx, key)
+}
+
+func (s storage) Purge(ctx context.Context, before time.Time) (kk []string, err error) {
+	defer s.observe("purge", time.Now(), &err)
+	return s.Storage.Purge(ctx, before)
+}
+
+func (s storage) Import(ctx context.Context, r store.Record) (err error) {
+	defer s.observe("import", time.Now(), &err)
+	return s.Storage.Import(ctx, r)
+}
+
+func (s storage) Generation() (gen uint64, err error) {
+	defer s.observe("generation", time.Now(), &err)
+	return s.Storage.Generation()
+}
+
+func (s storage) Events(since uint64, limit int) (ee []store.Event, last uint64, err error) {
+	defer s.observe("events", time.Now(), &err)
+	return s.Storage.Events(since, limit)
+}
+
+func (s storage) observe(operation string, start time.Time, err *error) {
+	s.duration.ObserveSince(start, operation)
+
+	if *err != nil && !expected(*err) {
+		s.errors.Inc(operation)
+	}
+}
+
+// expected errors are answers to the caller, not failures of the store
+func expected(err error) bool {
+	switch errors.Cause(err) {
+	case permit.PermitNotFound, permit.PermitDeleted, permit.DomainTaken,
+		store.RevisionNotFound, store.RevisionMismatch, store.EmptyPatch, store.InvalidCursor, store.EventsCompacted:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,258 @@
+package migrate
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/internal/store"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+// Migration copies records from one store to another while the source is
+// in use. Every copied record is appended (with its checksum) to a state
+// file; records with unchanged checksums are skipped on the next run, so an
+// interrupted migration can be resumed and a final run only picks up
+// records that changed in the meantime.
+
+type (
+	Status string
+
+	// Result of migrating a single record
+	Result struct {
+		Key      string `json:"key"`
+		Status   Status `json:"status"`
+		Checksum string `json:"checksum,omitempty"`
+		Error    string `json:"error,omitempty"`
+	}
+
+	Summary struct {
+		Copied   int `json:"copied"`
+		Skipped  int `json:"skipped"`
+		Failed   int `json:"failed"`
+		Verified int `json:"verified"`
+		Mismatch int `json:"mismatch"`
+
+		Source store.Counts `json:"source"`
+		Target store.Counts `json:"target"`
+	}
+
+	source interface {
+		List(q store.Query) ([]*permit.Permit, string, error)
+		Trash() ([]store.Trashed, error)
+		History(key string) ([]store.Revision, error)
+	}
+
+	target interface {
+		source
+		Get(key string) (*permit.Permit, error)
+		Import(ctx context.Context, r store.Record) error
+	}
+
+	state struct {
+		Key      string `json:"key"`
+		Checksum string `json:"checksum"`
+	}
+
+	stateFile struct {
+		f *os.File
+	}
+)
+
+const (
+	StatusCopied   Status = "copied"
+	StatusSkipped  Status = "skipped"
+	StatusFailed   Status = "failed"
+	StatusVerified Status = "verified"
+	StatusMismatch Status = "mismatch"
+)
+
+// Run copies all records from source to target and verifies them
+//
+// Copy failures do not stop the migration; they are reported and counted
+// and Run returns an error at the end. State file is optional.
+func Run(ctx context.Context, from source, to target, statePath string, report func(Result)) (*Summary, error) {
+	var (
+		sum    = &Summary{}
+		copied []state
+	)
+
+	done, err := loadState(statePath)
+	if err != nil {
+		return nil, err
+	}
+
+	sf, err := openState(statePath)
+	if err != nil {
+		return nil, err
+	}
+
+	defer sf.Close()
+
+	err = store.Export(from, func(r store.Record) error {
+		checksum, err := r.Checksum()
+		if err != nil {
+			return err
+		}
+
+		res := Result{Key: r.Key, Checksum: checksum}
+		defer func() { report(res) }()
+
+		copied = append(copied, state{Key: r.Key, Checksum: checksum})
+
+		if done[r.Key] == res.Checksum {
+			res.Status = StatusSkipped
+			sum.Skipped++
+			return nil
+		}
+
+		if err = to.Import(ctx, r); err != nil {
+			res.Status, res.Error = StatusFailed, err.Error()
+			sum.Failed++
+			return nil
+		}
+
+		res.Status = StatusCopied
+		sum.Copied++
+		return sf.append(state{Key: r.Key, Checksum: res.Checksum})
+	})
+
+	if err != nil {
+		return sum, errors.Wrap(err, "could not copy records")
+	}
+
+	if err = verify(from, to, copied, sf, sum, report); err != nil {
+		return sum, err
+	}
+
+	switch {
+	case sum.Failed > 0:
+		return sum, errors.Errorf("%d records could not be copied", sum.Failed)
+	case sum.Mismatch > 0:
+		return sum, errors.Errorf("%d records differ between source and target", sum.Mismatch)
+	case sum.Source != sum.Target:
+		return sum, errors.Errorf("counts differ, source has %+v, target has %+v", sum.Source, sum.Target)
+	}
+
+	return sum, nil
+}
+
+// verify compares checksums of copied records on the target and counts of both stores
+//
+// Mismatched records are cleared from the state file so the next run copies them again.
+func verify(from source, to target, copied []state, sf *stateFile, sum *Summary, report func(Result)) error {
+	err := store.Export(to, func(r store.Record) error {
+		sum.Target.Add(r)
+		return nil
+	})
+
+	if err != nil {
+		return errors.Wrap(err, "could not read target")
+	}
+
+	for _, c := range copied {
+		res := Result{Key: c.Key, Status: StatusVerified}
+
+		r, err := store.Fetch(to, c.Key)
+		if err != nil {
+			return errors.Wrapf(err, "could not read %s from target", c.Key)
+		}
+
+		if r != nil {
+			res.Checksum, err = r.Checksum()
+			if err != nil {
+				return err
+			}
+		}
+
+		if res.Checksum != c.Checksum {
+			res.Status = StatusMismatch
+			sum.Mismatch++
+
+			if err = sf.append(state{Key: c.Key}); err != nil {
+				return err
+			}
+		} else {
+			sum.Verified++
+		}
+
+		report(res)
+	}
+
+	// Source is counted last so that records changed during copy show up as a difference
+	return errors.Wrap(store.Export(from, func(r store.Record) error {
+		sum.Source.Add(r)
+		return nil
+	}), "could not read source")
+}
+
+// loadState reads checksums of records copied by previous runs
+//
+// Later entries for the same key win.
+func loadState(path string) (map[string]string, error) {
+	var done = make(map[string]string)
+
+	if path == "" {
+		return done, nil
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return done, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "could not open state file")
+	}
+
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var st state
+		if err = json.Unmarshal(s.Bytes(), &st); err != nil {
+			// Last line can be cut short by a crash, record is simply copied again
+			continue
+		}
+
+		done[st.Key] = st.Checksum
+	}
+
+	return done, errors.Wrap(s.Err(), "could not read state file")
+}
+
+func openState(path string) (*stateFile, error) {
+	if path == "" {
+		return &stateFile{}, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open state file")
+	}
+
+	return &stateFile{f: f}, nil
+}
+
+func (sf *stateFile) append(st state) error {
+	if sf.f == nil {
+		return nil
+	}
+
+	enc, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+
+	_, err = sf.f.Write(append(enc, '\n'))
+	return errors.Wrap(err, "could not write state file")
+}
+
+func (sf *stateFile) Close() error {
+	if sf.f == nil {
+		return nil
+	}
+
+	return sf.f.Close()
+}
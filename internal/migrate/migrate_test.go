@@ -0,0 +1,79 @@
+package migrate
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/internal/store"
+	"github.com/crusttech/permit/internal/store/fs"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+func assert(t *testing.T, ok bool, format string, args ...interface{}) bool {
+	if !ok {
+		t.Fatalf(format, args...)
+	}
+	return ok
+}
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "permit-migrate-")
+	assert(t, err == nil, "could not create temp dir: %v", err)
+	defer os.RemoveAll(dir)
+
+	var (
+		ctx       = context.Background()
+		statePath = filepath.Join(dir, "state.jsonl")
+		statuses  = map[Status]int{}
+		report    = func(r Result) { statuses[r.Status]++ }
+	)
+
+	assert(t, os.Mkdir(filepath.Join(dir, "src"), 0755) == nil, "could not create source dir")
+	assert(t, os.Mkdir(filepath.Join(dir, "dst"), 0755) == nil, "could not create target dir")
+
+	src, err := fs.NewPermitStorage(filepath.Join(dir, "src"))
+	assert(t, err == nil, "could not create source storage: %v", err)
+
+	dst, err := fs.NewPermitStorage(filepath.Join(dir, "dst"))
+	assert(t, err == nil, "could not create target storage: %v", err)
+
+	for _, key := range []string{"key-1", "key-2", "key-3"} {
+		p := permit.Permit{Key: key, Domain: "example.tld", Valid: true, Issued: time.Now().Truncate(time.Second)}
+		assert(t, src.Create(ctx, p) == nil, "could not create permit")
+	}
+
+	assert(t, src.Delete(ctx, "key-3") == nil, "could not delete permit")
+
+	sum, err := Run(ctx, src, dst, statePath, report)
+	assert(t, err == nil, "unexpected migration error: %v", err)
+	assert(t, sum.Copied == 3 && sum.Verified == 3, "unexpected summary: %+v", sum)
+	assert(t, sum.Target == store.Counts{Permits: 2, Trashed: 1, Revisions: 4}, "unexpected target counts: %+v", sum.Target)
+
+	_, err = dst.Get("key-3")
+	assert(t, err == permit.PermitDeleted, "expecting deleted permit to be migrated to trash")
+
+	// Resume after a change on the source, only the changed record is copied
+	assert(t, src.Revoke(ctx, "key-2") == nil, "could not revoke permit")
+
+	statuses = map[Status]int{}
+	sum, err = Run(ctx, src, dst, statePath, report)
+	assert(t, err == nil, "unexpected migration error: %v", err)
+	assert(t, sum.Copied == 1 && sum.Skipped == 2, "unexpected summary: %+v", sum)
+	assert(t, statuses[StatusCopied] == 1 && statuses[StatusVerified] == 3, "unexpected report: %+v", statuses)
+
+	p, err := dst.Get("key-2")
+	assert(t, err == nil && !p.Valid, "expecting revoked permit on target")
+
+	// Change behind migration's back is caught by verification
+	assert(t, dst.Enable(ctx, "key-2") == nil, "could not enable permit")
+
+	sum, err = Run(ctx, src, dst, statePath, report)
+	assert(t, err != nil && sum.Mismatch == 1, "expecting mismatch, got %v (%+v)", err, sum)
+
+	sum, err = Run(ctx, src, dst, statePath, report)
+	assert(t, err == nil && sum.Copied == 1, "expecting mismatched record to be copied again, got %v (%+v)", err, sum)
+}
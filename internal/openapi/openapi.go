@@ -0,0 +1,285 @@
+package openapi
+
+import (
+	"encoding/json"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Validation of responses against OpenAPI 3 document
+//
+// Only the parts of the specification that the permit API uses are
+// supported: paths with templated segments, responses by status code (or
+// "default"), media types and schemas with type, nullable, enum, format
+// date-time, properties, required, additionalProperties, items, allOf and
+// local $ref. Other keywords are ignored.
+
+type (
+	Spec struct {
+		// Strict spec refuses properties missing from schemas that list
+		// properties, unless additionalProperties allows them
+		Strict bool
+
+		doc   map[string]interface{}
+		paths []path
+	}
+
+	// Operation identifies documented endpoint, path is the template from the document
+	Operation struct {
+		Method string
+		Path   string
+	}
+
+	path struct {
+		template string
+		segments []string
+		item     map[string]interface{}
+	}
+)
+
+var (
+	methods = []string{"get", "put", "post", "delete", "options", "head", "patch"}
+
+	OperationNotFound = errors.New("operation not documented")
+)
+
+// Parse reads OpenAPI 3 document and verifies that all its references resolve
+func Parse(data []byte) (*Spec, error) {
+	s := &Spec{}
+
+	if err := json.Unmarshal(data, &s.doc); err != nil {
+		return nil, errors.Wrap(err, "could not decode document")
+	}
+
+	if v, _ := s.doc["openapi"].(string); !strings.HasPrefix(v, "3.") {
+		return nil, errors.Errorf("unsupported openapi version %q", v)
+	}
+
+	pp, ok := s.doc["paths"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("document has no paths")
+	}
+
+	for template, item := range pp {
+		i, ok := item.(map[string]interface{})
+		if !ok || !strings.HasPrefix(template, "/") {
+			return nil, errors.Errorf("invalid path %q", template)
+		}
+
+		s.paths = append(s.paths, path{template: template, segments: split(template), item: i})
+	}
+
+	sort.Slice(s.paths, func(i, j int) bool {
+		return s.paths[i].template < s.paths[j].template
+	})
+
+	if err := s.checkRefs(s.doc, "#"); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Operations returns all documented operations, sorted by path and method
+func (s *Spec) Operations() []Operation {
+	oo := make([]Operation, 0)
+	for _, p := range s.paths {
+		for _, m := range methods {
+			if _, has := p.item[m]; has {
+				oo = append(oo, Operation{Method: strings.ToUpper(m), Path: p.template})
+			}
+		}
+	}
+
+	return oo
+}
+
+// Find returns documented operation that serves the request path
+//
+// When more templates match, the one with more literal segments is used.
+func (s *Spec) Find(method, urlPath string) (Operation, bool) {
+	var (
+		segments = split(urlPath)
+		best     = -1
+		found    Operation
+	)
+
+	for _, p := range s.paths {
+		if _, has := p.item[strings.ToLower(method)]; !has {
+			continue
+		}
+
+		if literal, ok := p.match(segments); ok && literal > best {
+			best, found = literal, Operation{Method: strings.ToUpper(method), Path: p.template}
+		}
+	}
+
+	return found, best >= 0
+}
+
+// ValidateResponse checks that the response is documented for the operation and that body matches its schema
+func (s *Spec) ValidateResponse(method, urlPath string, status int, contentType string, body []byte) (Operation, error) {
+	op, ok := s.Find(method, urlPath)
+	if !ok {
+		return op, errors.Wrapf(OperationNotFound, "%s %s", method, urlPath)
+	}
+
+	var (
+		operation = s.operation(op)
+		rr, _     = operation["responses"].(map[string]interface{})
+		response  interface{}
+	)
+
+	if response, ok = rr[strconv.Itoa(status)]; !ok {
+		if response, ok = rr["default"]; !ok {
+			return op, errors.Errorf("%s %s: status %d not documented", op.Method, op.Path, status)
+		}
+	}
+
+	rsp, _ := s.resolve(response).(map[string]interface{})
+	content, _ := rsp["content"].(map[string]interface{})
+
+	if len(content) == 0 {
+		if len(body) > 0 {
+			return op, errors.Errorf("%s %s: status %d documented without content", op.Method, op.Path, status)
+		}
+
+		return op, nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	media, ok := content[mediaType].(map[string]interface{})
+	if !ok {
+		return op, errors.Errorf("%s %s: content type %q not documented for status %d", op.Method, op.Path, contentType, status)
+	}
+
+	if mediaType != "application/json" || media["schema"] == nil {
+		return op, nil
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return op, errors.Wrapf(err, "%s %s: could not decode response", op.Method, op.Path)
+	}
+
+	if err := s.validate(media["schema"], value, "$"); err != nil {
+		return op, errors.Wrapf(err, "%s %s: status %d", op.Method, op.Path, status)
+	}
+
+	return op, nil
+}
+
+func (o Operation) String() string {
+	return o.Method + " " + o.Path
+}
+
+func (s *Spec) operation(op Operation) map[string]interface{} {
+	for _, p := range s.paths {
+		if p.template == op.Path {
+			o, _ := p.item[strings.ToLower(op.Method)].(map[string]interface{})
+			return o
+		}
+	}
+
+	return nil
+}
+
+// resolve follows local references
+func (s *Spec) resolve(v interface{}) interface{} {
+	for i := 0; i < 32; i++ {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return v
+		}
+
+		ref, ok := m["$ref"].(string)
+		if !ok {
+			return v
+		}
+
+		v, _ = s.lookup(ref)
+	}
+
+	return nil
+}
+
+// lookup finds value by local reference, like #/components/schemas/Permit
+func (s *Spec) lookup(ref string) (interface{}, bool) {
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, false
+	}
+
+	var v interface{} = s.doc
+	for _, name := range strings.Split(ref[2:], "/") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		name = strings.Replace(strings.Replace(name, "~1", "/", -1), "~0", "~", -1)
+		if v, ok = m[name]; !ok {
+			return nil, false
+		}
+	}
+
+	return v, true
+}
+
+func (s *Spec) checkRefs(v interface{}, at string) error {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		if ref, ok := val["$ref"].(string); ok {
+			if _, found := s.lookup(ref); !found {
+				return errors.Errorf("unresolved reference %q at %s", ref, at)
+			}
+		}
+
+		for k, c := range val {
+			if err := s.checkRefs(c, at+"/"+k); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i, c := range val {
+			if err := s.checkRefs(c, at+"/"+strconv.Itoa(i)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// match returns number of literal segments when path matches
+func (p path) match(segments []string) (int, bool) {
+	if len(segments) != len(p.segments) {
+		return 0, false
+	}
+
+	literal := 0
+	for i, s := range p.segments {
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			if segments[i] == "" {
+				return 0, false
+			}
+
+			continue
+		}
+
+		if s != segments[i] {
+			return 0, false
+		}
+
+		literal++
+	}
+
+	return literal, true
+}
+
+func split(p string) []string {
+	return strings.Split(strings.Trim(p, "/"), "/")
+}
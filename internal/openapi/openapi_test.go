@@ -0,0 +1,135 @@
+package openapi
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+const testDocument = `{
+	"openapi": "3.0.2",
+	"info": {"title": "test", "version": "1"},
+	"paths": {
+		"/item/{id}": {
+			"get": {
+				"responses": {
+					"200": {"description": "item", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Item"}}}},
+					"204": {"description": "empty"},
+					"default": {"$ref": "#/components/responses/Error"}
+				}
+			}
+		},
+		"/item/new": {
+			"get": {
+				"responses": {
+					"200": {"description": "list", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Item"}}}}}
+				}
+			}
+		}
+	},
+	"components": {
+		"schemas": {
+			"Item": {
+				"type": "object",
+				"required": ["id"],
+				"properties": {
+					"id": {"type": "integer"},
+					"state": {"type": "string", "enum": ["on", "off"]},
+					"created": {"type": "string", "format": "date-time"},
+					"note": {"type": "string", "nullable": true},
+					"tags": {"type": "object", "additionalProperties": {"type": "boolean"}}
+				}
+			}
+		},
+		"responses": {
+			"Error": {"description": "error", "content": {"application/json": {"schema": {"type": "object", "properties": {"error": {"type": "string"}}}}}}
+		}
+	}
+}`
+
+func assert(t *testing.T, ok bool, format string, args ...interface{}) bool {
+	if !ok {
+		t.Fatalf(format, args...)
+	}
+	return ok
+}
+
+func TestParse(t *testing.T) {
+	s, err := Parse([]byte(testDocument))
+	assert(t, err == nil, "unexpected error: %v", err)
+	assert(t, len(s.Operations()) == 2, "expecting 2 operations, got %v", s.Operations())
+
+	_, err = Parse([]byte(strings.Replace(testDocument, "#/components/schemas/Item", "#/components/schemas/Missing", 1)))
+	assert(t, err != nil && strings.Contains(err.Error(), "unresolved reference"), "expecting unresolved reference error, got %v", err)
+
+	_, err = Parse([]byte(`{"openapi": "2.0", "paths": {}}`))
+	assert(t, err != nil, "expecting error for unsupported version")
+}
+
+func TestFind(t *testing.T) {
+	s, _ := Parse([]byte(testDocument))
+
+	op, ok := s.Find("GET", "/item/new")
+	assert(t, ok && op.Path == "/item/new", "expecting literal path to win, got %v", op)
+
+	op, ok = s.Find("GET", "/item/42")
+	assert(t, ok && op.Path == "/item/{id}", "expecting templated path, got %v", op)
+
+	_, ok = s.Find("POST", "/item/42")
+	assert(t, !ok, "expecting undocumented method not to match")
+
+	_, ok = s.Find("GET", "/item/42/more")
+	assert(t, !ok, "expecting longer path not to match")
+}
+
+func TestValidateResponse(t *testing.T) {
+	s, _ := Parse([]byte(testDocument))
+
+	tests := []struct {
+		path   string
+		status int
+		ctype  string
+		body   string
+		err    string
+	}{
+		{"/item/1", 200, "application/json; charset=utf-8", `{"id": 1, "state": "on", "created": "2019-03-01T10:00:00.5Z", "note": null, "tags": {"a": true}}`, ""},
+		{"/item/1", 204, "", ``, ""},
+		{"/item/1", 404, "application/json", `{"error": "not found"}`, ""},
+		{"/item/new", 200, "application/json", `[{"id": 1}, {"id": 2}]`, ""},
+		{"/item/1", 200, "application/json", `{"state": "on"}`, "missing required property"},
+		{"/item/1", 200, "application/json", `{"id": 1.5}`, "expecting integer"},
+		{"/item/1", 200, "application/json", `{"id": 1, "state": "maybe"}`, "is not one of"},
+		{"/item/1", 200, "application/json", `{"id": 1, "created": "yesterday"}`, "is not a date-time"},
+		{"/item/1", 200, "application/json", `{"id": 1, "tags": {"a": 1}}`, "expecting boolean"},
+		{"/item/1", 200, "application/json", `{"id": null}`, "null is not allowed"},
+		{"/item/1", 200, "text/plain", `hello`, "content type"},
+		{"/item/1", 204, "", `{}`, "without content"},
+		{"/item/new", 404, "application/json", `{}`, "not documented"},
+		{"/other", 200, "application/json", `{}`, OperationNotFound.Error()},
+	}
+
+	for _, test := range tests {
+		_, err := s.ValidateResponse("GET", test.path, test.status, test.ctype, []byte(test.body))
+		if test.err == "" {
+			assert(t, err == nil, "%s %d: unexpected error: %v", test.path, test.status, err)
+		} else {
+			assert(t, err != nil && strings.Contains(err.Error(), test.err), "%s %d: expecting error %q, got %v", test.path, test.status, test.err, err)
+		}
+	}
+
+	_, err := s.ValidateResponse("GET", "/other", 200, "", nil)
+	assert(t, errors.Cause(err) == OperationNotFound, "expecting OperationNotFound, got %v", err)
+}
+
+func TestStrict(t *testing.T) {
+	s, _ := Parse([]byte(testDocument))
+	body := []byte(`{"id": 1, "extra": true}`)
+
+	_, err := s.ValidateResponse("GET", "/item/1", 200, "application/json", body)
+	assert(t, err == nil, "unexpected error: %v", err)
+
+	s.Strict = true
+	_, err = s.ValidateResponse("GET", "/item/1", 200, "application/json", body)
+	assert(t, err != nil && strings.Contains(err.Error(), `property "extra" not documented`), "expecting undocumented property error, got %v", err)
+}
@@ -0,0 +1,149 @@
+package openapi
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// validate checks decoded JSON value against the schema, at is the location for error messages
+func (s *Spec) validate(schema, value interface{}, at string) error {
+	sch, ok := s.resolve(schema).(map[string]interface{})
+	if !ok {
+		return errors.Errorf("%s: invalid schema", at)
+	}
+
+	if value == nil {
+		if nullable, _ := sch["nullable"].(bool); nullable || sch["type"] == nil {
+			return nil
+		}
+
+		return errors.Errorf("%s: null is not allowed", at)
+	}
+
+	if all, ok := sch["allOf"].([]interface{}); ok {
+		for _, a := range all {
+			if err := s.validate(a, value, at); err != nil {
+				return err
+			}
+		}
+	}
+
+	if enum, ok := sch["enum"].([]interface{}); ok && !contains(enum, value) {
+		return errors.Errorf("%s: %v is not one of %v", at, value, enum)
+	}
+
+	switch typ, _ := sch["type"].(string); typ {
+	case "":
+		return nil
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return errors.Errorf("%s: expecting string, got %T", at, value)
+		}
+
+		if sch["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, str); err != nil {
+				return errors.Errorf("%s: %q is not a date-time", at, str)
+			}
+		}
+	case "integer":
+		if n, ok := value.(float64); !ok || n != math.Trunc(n) {
+			return errors.Errorf("%s: expecting integer, got %v", at, value)
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return errors.Errorf("%s: expecting number, got %T", at, value)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return errors.Errorf("%s: expecting boolean, got %T", at, value)
+		}
+	case "array":
+		aa, ok := value.([]interface{})
+		if !ok {
+			return errors.Errorf("%s: expecting array, got %T", at, value)
+		}
+
+		if items := sch["items"]; items != nil {
+			for i, a := range aa {
+				if err := s.validate(items, a, at+"["+strconv.Itoa(i)+"]"); err != nil {
+					return err
+				}
+			}
+		}
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return errors.Errorf("%s: expecting object, got %T", at, value)
+		}
+
+		return s.validateObject(sch, obj, at)
+	default:
+		return errors.Errorf("%s: unsupported schema type %q", at, typ)
+	}
+
+	return nil
+}
+
+func (s *Spec) validateObject(sch map[string]interface{}, obj map[string]interface{}, at string) error {
+	props, _ := sch["properties"].(map[string]interface{})
+
+	if required, ok := sch["required"].([]interface{}); ok {
+		for _, r := range required {
+			if name, _ := r.(string); name != "" {
+				if _, has := obj[name]; !has {
+					return errors.Errorf("%s: missing required property %q", at, name)
+				}
+			}
+		}
+	}
+
+	// Sorted, so the first error is always the same
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		if p, has := props[name]; has {
+			if err := s.validate(p, obj[name], at+"."+name); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		switch additional := sch["additionalProperties"].(type) {
+		case nil:
+			if s.Strict && props != nil {
+				return errors.Errorf("%s: property %q not documented", at, name)
+			}
+		case bool:
+			if !additional {
+				return errors.Errorf("%s: property %q not documented", at, name)
+			}
+		case map[string]interface{}:
+			if err := s.validate(additional, obj[name], at+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func contains(enum []interface{}, value interface{}) bool {
+	for _, e := range enum {
+		if e == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,109 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Fixed window rate limiter
+//
+// Each key (client IP, permit key...) gets limit requests per window; the
+// window starts with key's first request.
+
+type (
+	Limiter struct {
+		limit  int
+		window time.Duration
+
+		mux     sync.Mutex
+		windows map[string]*window
+		swept   time.Time
+	}
+
+	window struct {
+		start time.Time
+		count int
+	}
+
+	Status struct {
+		Allowed   bool
+		Limit     int
+		Remaining int
+
+		// When the current window ends
+		Reset time.Time
+	}
+)
+
+// New creates limiter allowing limit requests per window, nil when limit is 0 (unlimited)
+func New(limit int, w time.Duration) *Limiter {
+	if limit <= 0 || w <= 0 {
+		return nil
+	}
+
+	return &Limiter{limit: limit, window: w, windows: map[string]*window{}}
+}
+
+// Allow counts request for the key
+//
+// Refused requests are not counted.
+func (l *Limiter) Allow(key string, now time.Time) Status {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.sweep(now)
+
+	w, has := l.windows[key]
+	if !has || !now.Before(w.start.Add(l.window)) {
+		w = &window{start: now}
+		l.windows[key] = w
+	}
+
+	st := Status{Limit: l.limit, Reset: w.start.Add(l.window)}
+
+	if w.count < l.limit {
+		w.count++
+		st.Allowed = true
+	}
+
+	st.Remaining = l.limit - w.count
+	return st
+}
+
+// Peek returns status of the key without counting a request
+func (l *Limiter) Peek(key string, now time.Time) Status {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	st := Status{Allowed: true, Limit: l.limit, Remaining: l.limit, Reset: now.Add(l.window)}
+
+	if w, has := l.windows[key]; has && now.Before(w.start.Add(l.window)) {
+		st.Allowed, st.Remaining, st.Reset = w.count < l.limit, l.limit-w.count, w.start.Add(l.window)
+	}
+
+	return st
+}
+
+// RetryAfter is time left until the window resets
+func (s Status) RetryAfter(now time.Time) time.Duration {
+	if d := s.Reset.Sub(now); d > 0 {
+		return d
+	}
+
+	return 0
+}
+
+// sweep drops expired windows, at most once per window length
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < l.window {
+		return
+	}
+
+	l.swept = now
+
+	for key, w := range l.windows {
+		if !now.Before(w.start.Add(l.window)) {
+			delete(l.windows, key)
+		}
+	}
+}
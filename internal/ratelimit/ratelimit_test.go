@@ -0,0 +1,55 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func assert(t *testing.T, ok bool, format string, args ...interface{}) bool {
+	if !ok {
+		t.Fatalf(format, args...)
+	}
+	return ok
+}
+
+func TestAllow(t *testing.T) {
+	var (
+		l   = New(2, time.Minute)
+		now = time.Now()
+	)
+
+	assert(t, New(0, time.Minute) == nil, "expecting no limiter for zero limit")
+
+	st := l.Allow("a", now)
+	assert(t, st.Allowed && st.Remaining == 1 && st.Reset.Equal(now.Add(time.Minute)), "unexpected status: %+v", st)
+
+	l.Allow("a", now.Add(time.Second))
+	st = l.Allow("a", now.Add(2*time.Second))
+	assert(t, !st.Allowed && st.Remaining == 0, "expecting third request to be refused: %+v", st)
+	assert(t, st.RetryAfter(now.Add(2*time.Second)) == 58*time.Second, "unexpected retry after %v", st.RetryAfter(now.Add(2*time.Second)))
+
+	st = l.Allow("b", now.Add(2*time.Second))
+	assert(t, st.Allowed, "expecting other keys to have their own limit")
+
+	st = l.Allow("a", now.Add(time.Minute))
+	assert(t, st.Allowed && st.Remaining == 1, "expecting new window after reset: %+v", st)
+}
+
+func TestPeek(t *testing.T) {
+	var (
+		l   = New(2, time.Minute)
+		now = time.Now()
+	)
+
+	st := l.Peek("a", now)
+	assert(t, st.Allowed && st.Remaining == 2, "expecting unknown key to be allowed: %+v", st)
+
+	l.Allow("a", now)
+	l.Allow("a", now)
+
+	st = l.Peek("a", now.Add(time.Second))
+	assert(t, !st.Allowed && st.Remaining == 0 && st.Reset.Equal(now.Add(time.Minute)), "expecting exhausted key to be refused: %+v", st)
+
+	st = l.Allow("a", now.Add(time.Minute))
+	assert(t, st.Allowed && st.Remaining == 1, "expecting peek not to count requests: %+v", st)
+}
@@ -0,0 +1,104 @@
+package realip
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Client IP resolution
+//
+// X-Forwarded-For and X-Real-IP are only honoured when the request comes
+// from a trusted proxy. Forwarded addresses are walked from the nearest hop
+// back, skipping trusted proxies; the first untrusted one is the client.
+
+type (
+	Networks []*net.IPNet
+)
+
+// ParseNetworks reads comma separated IP addresses and CIDR ranges
+func ParseNetworks(list string) (nn Networks, err error) {
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip == nil {
+				return nil, errors.Errorf("invalid IP address %q", s)
+			} else if ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid network %q", s)
+		}
+
+		nn = append(nn, n)
+	}
+
+	return
+}
+
+// Contains checks if IP address is in any of the networks
+func (nn Networks) Contains(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+
+	for _, n := range nn {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ClientIP returns address of the client, looking behind trusted proxies
+func ClientIP(r *http.Request, trusted Networks) string {
+	ip := remoteIP(r)
+	if !trusted.Contains(ip) {
+		return ip
+	}
+
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				// Garbage in the header, stop at the last proxy we trust
+				break
+			}
+
+			ip = hop
+			if !trusted.Contains(hop) {
+				break
+			}
+		}
+
+		return ip
+	}
+
+	if real := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(real) != nil {
+		return real
+	}
+
+	return ip
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
+	if err != nil {
+		return strings.TrimSpace(r.RemoteAddr)
+	}
+
+	return host
+}
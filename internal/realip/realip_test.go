@@ -0,0 +1,42 @@
+package realip
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func assert(t *testing.T, ok bool, format string, args ...interface{}) bool {
+	if !ok {
+		t.Fatalf(format, args...)
+	}
+	return ok
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ParseNetworks("10.0.0.0/8, 192.168.1.1")
+	assert(t, err == nil, "could not parse networks: %v", err)
+
+	_, err = ParseNetworks("10.0.0.300")
+	assert(t, err != nil, "expecting invalid address to fail")
+
+	for _, c := range []struct {
+		remote, xff, expected string
+	}{
+		// Headers from untrusted clients are ignored
+		{"203.0.113.5:1234", "198.51.100.1", "203.0.113.5"},
+		{"10.1.2.3:1234", "", "10.1.2.3"},
+		{"10.1.2.3:1234", "198.51.100.1", "198.51.100.1"},
+		// Spoofed address in front of a real client is ignored
+		{"10.1.2.3:1234", "1.2.3.4, 198.51.100.1, 192.168.1.1", "198.51.100.1"},
+		{"10.1.2.3:1234", "garbage, 10.0.0.2", "10.0.0.2"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		if c.xff != "" {
+			r.Header.Set("X-Forwarded-For", c.xff)
+		}
+
+		ip := ClientIP(r, trusted)
+		assert(t, ip == c.expected, "expecting %s for %s (%s), got %s", c.expected, c.remote, c.xff, ip)
+	}
+}
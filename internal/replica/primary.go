@@ -0,0 +1,115 @@
+package replica
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"math"
+
+	"github.com/pkg/errors"
+
+	"github.com/crusttech/permit/internal/store"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+type (
+	// Change carries the current state of a changed permit
+	//
+	// Record holds only the key when the permit was purged.
+	Change struct {
+		Seq    uint64       `json:"seq"`
+		Record store.Record `json:"record"`
+	}
+
+	// Changes is a batch of changes, sent by primary
+	Changes struct {
+		Head    uint64   `json:"head"`
+		Changes []Change `json:"changes"`
+	}
+
+	// Snapshot header, first line of the snapshot stream, followed by one store.Record per line
+	snapshotHeader struct {
+		Head uint64 `json:"head"`
+	}
+
+	// Snapshot trailer, last line of the snapshot stream
+	//
+	// Stream without it (or with a different number of records) was cut short.
+	snapshotTrailer struct {
+		End   bool `json:"end"`
+		Count int  `json:"count"`
+	}
+
+	source interface {
+		List(q store.Query) ([]*permit.Permit, string, error)
+		Get(key string) (*permit.Permit, error)
+		Trash() ([]store.Trashed, error)
+		History(key string) ([]store.Revision, error)
+		Events(since uint64, limit int) ([]store.Event, uint64, error)
+	}
+)
+
+// ChangesSince collects changes after the given sequence
+//
+// Changes carry the state of the permit at the time of the call, not at the
+// time of the event, so applying them in order always converges to the
+// primary's state.
+func ChangesSince(s source, since uint64, limit int) (*Changes, error) {
+	ee, head, err := s.Events(since, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read events")
+	}
+
+	cc := &Changes{Head: head, Changes: make([]Change, 0, len(ee))}
+	for _, e := range ee {
+		r, err := store.Fetch(s, e.Key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not fetch %s", e.Key)
+		}
+
+		if r == nil {
+			r = &store.Record{Key: e.Key}
+		}
+
+		cc.Changes = append(cc.Changes, Change{Seq: e.Seq, Record: *r})
+	}
+
+	return cc, nil
+}
+
+// WriteSnapshot streams all records, preceded by the sequence of the latest change and followed by their count
+//
+// Store is not locked; changes made while the snapshot is written come after
+// the sequence in the header and are picked up by the replica afterwards.
+func WriteSnapshot(s source, w io.Writer) error {
+	// Nothing comes after the largest sequence, only head is read
+	_, head, err := s.Events(math.MaxUint64, 0)
+	if err != nil {
+		return errors.Wrap(err, "could not read events")
+	}
+
+	var (
+		bw  = bufio.NewWriter(w)
+		enc = json.NewEncoder(bw)
+	)
+
+	if err = enc.Encode(snapshotHeader{Head: head}); err != nil {
+		return err
+	}
+
+	var count int
+	err = store.Export(s, func(r store.Record) error {
+		count++
+		return enc.Encode(r)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if err = enc.Encode(snapshotTrailer{End: true, Count: count}); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
@@ -0,0 +1,354 @@
+package replica
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/internal/store"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+// Replication
+//
+// Replica pulls changes from the primary's /replication endpoints and imports
+// them into its local store. First sync loads a full snapshot, and so does a
+// sync after the primary changed, compacted changes the replica did not pull
+// yet or lost changes the replica already has. Snapshot ends with a trailer
+// holding the record count; local permits are removed and the cursor moved only
+// when it is complete. Sequence of the last applied change is kept in a
+// state file so replication resumes where it stopped.
+
+type (
+	Replica struct {
+		primary  string
+		token    string
+		target   target
+		state    string
+		interval time.Duration
+		client   *http.Client
+
+		mux    sync.RWMutex
+		status Status
+	}
+
+	Status struct {
+		Primary string `json:"primary"`
+
+		// Sequence of the last applied change and of the latest change on primary
+		Cursor uint64 `json:"cursor"`
+		Head   uint64 `json:"head"`
+		Lag    uint64 `json:"lag"`
+
+		LastSync  time.Time `json:"lastSync"`
+		LastError string    `json:"lastError,omitempty"`
+	}
+
+	state struct {
+		Primary string `json:"primary"`
+		Cursor  uint64 `json:"cursor"`
+	}
+
+	target interface {
+		List(q store.Query) ([]*permit.Permit, string, error)
+		Trash() ([]store.Trashed, error)
+		History(key string) ([]store.Revision, error)
+		Import(ctx context.Context, r store.Record) error
+	}
+)
+
+const (
+	batchSize = 500
+
+	// Replica makes all changes under this actor
+	actor = "replica"
+)
+
+func New(primary, token string, t target, statePath string, interval time.Duration) *Replica {
+	return &Replica{
+		primary:  strings.TrimSuffix(primary, "/"),
+		token:    token,
+		target:   t,
+		state:    statePath,
+		interval: interval,
+		client:   &http.Client{Timeout: time.Minute},
+		status:   Status{Primary: primary},
+	}
+}
+
+// Run syncs with primary every interval until ctx is done
+//
+// Sync errors are kept in status and logged; replication is retried on the next tick.
+func (r *Replica) Run(ctx context.Context) {
+	var log = context.Log(ctx)
+
+	for {
+		if err := r.Sync(ctx); err != nil {
+			log.Error("replication failed: " + err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.interval):
+		}
+	}
+}
+
+// Sync applies all changes made on primary since the last sync
+func (r *Replica) Sync(ctx context.Context) (err error) {
+	ctx = context.WithActor(ctx, actor)
+
+	defer func() {
+		r.mux.Lock()
+		defer r.mux.Unlock()
+
+		if err != nil {
+			r.status.LastError = err.Error()
+		} else {
+			r.status.LastError = ""
+			r.status.LastSync = time.Now()
+		}
+	}()
+
+	st, err := r.loadState()
+	if err != nil {
+		return err
+	}
+
+	if st.Primary != r.primary {
+		if st, err = r.resync(ctx); err != nil {
+			return err
+		}
+	}
+
+	for {
+		var cc = &Changes{}
+		err = r.get(ctx, "/replication/changes?since="+strconv.FormatUint(st.Cursor, 10)+"&limit="+strconv.Itoa(batchSize), func(rsp *http.Response) error {
+			return json.NewDecoder(rsp.Body).Decode(cc)
+		})
+
+		if err != nil && errors.Cause(err) != permit.CursorExpired {
+			return err
+		}
+
+		if err != nil || cc.Head < st.Cursor {
+			// Primary compacted its journal past our cursor or it
+			// lost changes we already have (restored from backup)
+			if st, err = r.resync(ctx); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		for _, c := range cc.Changes {
+			if err = r.target.Import(ctx, c.Record); err != nil {
+				return errors.Wrapf(err, "could not apply change %d", c.Seq)
+			}
+
+			st.Cursor = c.Seq
+		}
+
+		if len(cc.Changes) > 0 {
+			if err = r.saveState(st); err != nil {
+				return err
+			}
+		}
+
+		r.progress(st.Cursor, cc.Head)
+
+		if len(cc.Changes) == 0 || st.Cursor >= cc.Head {
+			return nil
+		}
+	}
+}
+
+func (r *Replica) Status() Status {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	return r.status
+}
+
+// resync loads primary's snapshot and starts following changes from where it was taken
+func (r *Replica) resync(ctx context.Context) (st state, err error) {
+	if st.Cursor, err = r.bootstrap(ctx); err != nil {
+		return st, errors.Wrap(err, "could not load snapshot")
+	}
+
+	st.Primary = r.primary
+	return st, r.saveState(st)
+}
+
+// bootstrap replaces local store content with primary's snapshot, returns sequence the snapshot was taken at
+func (r *Replica) bootstrap(ctx context.Context) (head uint64, err error) {
+	var seen = map[string]bool{}
+
+	err = r.get(ctx, "/replication/snapshot", func(rsp *http.Response) error {
+		var (
+			s       = bufio.NewScanner(rsp.Body)
+			hdr     = snapshotHeader{}
+			trailer *snapshotTrailer
+			count   int
+		)
+
+		s.Buffer(nil, 16*1024*1024)
+
+		if !s.Scan() {
+			return errors.New("empty snapshot")
+		}
+
+		if err := json.Unmarshal(s.Bytes(), &hdr); err != nil {
+			return errors.Wrap(err, "could not decode snapshot header")
+		}
+
+		for s.Scan() {
+			var (
+				rec store.Record
+				end snapshotTrailer
+			)
+
+			if err := json.Unmarshal(s.Bytes(), &end); err != nil {
+				return errors.Wrap(err, "could not decode snapshot record")
+			} else if end.End {
+				trailer = &end
+				break
+			}
+
+			if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+				return errors.Wrap(err, "could not decode snapshot record")
+			}
+
+			if err := r.target.Import(ctx, rec); err != nil {
+				return errors.Wrapf(err, "could not import %s", rec.Key)
+			}
+
+			seen[rec.Key] = true
+			count++
+		}
+
+		if err := s.Err(); err != nil {
+			return errors.Wrap(err, "could not read snapshot")
+		}
+
+		// Records of a cut stream are imported, but nothing is removed and cursor stays where it was
+		if trailer == nil {
+			return errors.New("incomplete snapshot, trailer is missing")
+		} else if trailer.Count != count {
+			return errors.Errorf("incomplete snapshot, expecting %d records, got %d", trailer.Count, count)
+		} else if s.Scan() {
+			return errors.New("unexpected data after snapshot trailer")
+		}
+
+		head = hdr.Head
+		return nil
+	})
+
+	if err != nil {
+		return
+	}
+
+	// Remove whatever the primary does not have
+	var stale []string
+	err = store.Export(r.target, func(rec store.Record) error {
+		if !seen[rec.Key] {
+			stale = append(stale, rec.Key)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, errors.Wrap(err, "could not list local permits")
+	}
+
+	for _, key := range stale {
+		if err = r.target.Import(ctx, store.Record{Key: key}); err != nil {
+			return 0, errors.Wrapf(err, "could not remove %s", key)
+		}
+	}
+
+	return
+}
+
+func (r *Replica) progress(cursor, head uint64) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.status.Cursor, r.status.Head, r.status.Lag = cursor, head, 0
+	if head > cursor {
+		r.status.Lag = head - cursor
+	}
+}
+
+func (r *Replica) get(ctx context.Context, path string, fn func(*http.Response) error) error {
+	u, err := url.Parse(r.primary + path)
+	if err != nil {
+		return errors.Wrap(err, "invalid primary URL")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+
+	rsp, err := r.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "could not reach primary")
+	}
+
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode == http.StatusGone {
+		return permit.CursorExpired
+	} else if rsp.StatusCode != http.StatusOK {
+		return errors.Errorf("primary responded with %s", rsp.Status)
+	}
+
+	return fn(rsp)
+}
+
+func (r *Replica) loadState() (st state, err error) {
+	data, err := ioutil.ReadFile(r.state)
+	if os.IsNotExist(err) {
+		return st, nil
+	} else if err != nil {
+		return st, errors.Wrap(err, "could not read replication state")
+	}
+
+	return st, errors.Wrap(json.Unmarshal(data, &st), "could not decode replication state")
+}
+
+func (r *Replica) saveState(st state) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(r.state), 0755); err != nil {
+		return errors.Wrap(err, "could not create replication state directory")
+	}
+
+	tmp := r.state + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Wrap(err, "could not write replication state")
+	}
+
+	return errors.Wrap(os.Rename(tmp, r.state), "could not write replication state")
+}
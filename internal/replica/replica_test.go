@@ -0,0 +1,171 @@
+package replica
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/internal/store/fs"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+func assert(t *testing.T, ok bool, format string, args ...interface{}) bool {
+	if !ok {
+		t.Fatalf(format, args...)
+	}
+	return ok
+}
+
+func TestSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "permit-replica-")
+	assert(t, err == nil, "could not create temp dir: %v", err)
+	defer os.RemoveAll(dir)
+
+	var ctx = context.Background()
+
+	assert(t, os.Mkdir(filepath.Join(dir, "primary"), 0755) == nil, "could not create primary dir")
+	assert(t, os.Mkdir(filepath.Join(dir, "replica"), 0755) == nil, "could not create replica dir")
+
+	primary, err := fs.NewPermitStorage(filepath.Join(dir, "primary"))
+	assert(t, err == nil, "could not create primary storage: %v", err)
+
+	local, err := fs.NewPermitStorage(filepath.Join(dir, "replica"))
+	assert(t, err == nil, "could not create replica storage: %v", err)
+
+	// Permit that only the replica has, removed on bootstrap
+	assert(t, local.Create(ctx, permit.Permit{Key: "stale", Domain: "stale.tld"}) == nil, "could not create permit")
+
+	for _, key := range []string{"key-1", "key-2"} {
+		assert(t, primary.Create(ctx, permit.Permit{Key: key, Domain: "example.tld", Valid: true}) == nil, "could not create permit")
+	}
+
+	assert(t, primary.Delete(ctx, "key-2") == nil, "could not delete permit")
+
+	var expired bool
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/replication/changes", func(w http.ResponseWriter, r *http.Request) {
+		if expired {
+			expired = false
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+
+		since, _ := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+		cc, err := ChangesSince(primary, since, 1)
+		assert(t, err == nil, "could not collect changes: %v", err)
+		json.NewEncoder(w).Encode(cc)
+	})
+
+	mux.HandleFunc("/replication/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		assert(t, WriteSnapshot(primary, w) == nil, "could not write snapshot")
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	r := New(srv.URL, "", local, filepath.Join(dir, "replica.json"), time.Second)
+
+	assert(t, r.Sync(ctx) == nil, "could not sync: %v", r.Status().LastError)
+
+	_, err = local.Get("key-1")
+	assert(t, err == nil, "expecting key-1 to be replicated, got %v", err)
+
+	_, err = local.Get("key-2")
+	assert(t, err == permit.PermitDeleted, "expecting key-2 to be replicated to trash, got %v", err)
+
+	_, err = local.Get("stale")
+	assert(t, err == permit.PermitNotFound, "expecting permit unknown to primary to be removed, got %v", err)
+
+	// Changes after bootstrap are pulled in batches (of one)
+	assert(t, primary.Revoke(ctx, "key-1") == nil, "could not revoke permit")
+	assert(t, primary.Create(ctx, permit.Permit{Key: "key-3", Domain: "example.tld", Valid: true}) == nil, "could not create permit")
+	_, err = primary.Purge(ctx, time.Now().Add(time.Second))
+	assert(t, err == nil, "could not purge trash: %v", err)
+
+	assert(t, r.Sync(ctx) == nil, "could not sync: %v", r.Status().LastError)
+
+	p, err := local.Get("key-1")
+	assert(t, err == nil && !p.Valid, "expecting revoke to be replicated")
+
+	_, err = local.Get("key-3")
+	assert(t, err == nil, "expecting key-3 to be replicated, got %v", err)
+
+	_, err = local.Get("key-2")
+	assert(t, err == permit.PermitNotFound, "expecting purge to be replicated, got %v", err)
+
+	st := r.Status()
+	assert(t, st.Lag == 0 && st.Cursor == st.Head && st.Head == 6, "expecting replica to catch up, got %+v", st)
+
+	// Resumes from saved cursor
+	r = New(srv.URL, "", local, filepath.Join(dir, "replica.json"), time.Second)
+	assert(t, r.Sync(ctx) == nil, "could not sync: %v", r.Status().LastError)
+	assert(t, r.Status().Cursor == 6, "expecting replica to resume from saved cursor")
+
+	// Loads the snapshot again when primary compacted changes after the cursor
+	expired = true
+	assert(t, primary.Create(ctx, permit.Permit{Key: "key-4", Domain: "example.tld", Valid: true}) == nil, "could not create permit")
+	assert(t, r.Sync(ctx) == nil, "could not sync: %v", r.Status().LastError)
+
+	_, err = local.Get("key-4")
+	assert(t, err == nil, "expecting key-4 to be replicated from snapshot, got %v", err)
+	assert(t, r.Status().Cursor == 7, "expecting cursor at snapshot head, got %d", r.Status().Cursor)
+
+	// Loads the snapshot again when primary is behind the cursor
+	data, _ := json.Marshal(state{Primary: srv.URL, Cursor: 100})
+	assert(t, ioutil.WriteFile(filepath.Join(dir, "replica.json"), data, 0600) == nil, "could not write state")
+	assert(t, r.Sync(ctx) == nil, "could not sync: %v", r.Status().LastError)
+	assert(t, r.Status().Cursor == 7, "expecting cursor at snapshot head, got %d", r.Status().Cursor)
+}
+
+func TestTruncatedSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "permit-replica-")
+	assert(t, err == nil, "could not create temp dir: %v", err)
+	defer os.RemoveAll(dir)
+
+	var ctx = context.Background()
+
+	assert(t, os.Mkdir(filepath.Join(dir, "primary"), 0755) == nil, "could not create primary dir")
+	assert(t, os.Mkdir(filepath.Join(dir, "replica"), 0755) == nil, "could not create replica dir")
+
+	primary, _ := fs.NewPermitStorage(filepath.Join(dir, "primary"))
+	local, _ := fs.NewPermitStorage(filepath.Join(dir, "replica"))
+
+	assert(t, local.Create(ctx, permit.Permit{Key: "stale", Domain: "stale.tld"}) == nil, "could not create permit")
+
+	for _, key := range []string{"key-1", "key-2"} {
+		assert(t, primary.Create(ctx, permit.Permit{Key: key, Domain: "example.tld", Valid: true}) == nil, "could not create permit")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/replication/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		assert(t, WriteSnapshot(primary, &buf) == nil, "could not write snapshot")
+
+		// Connection dropped on a line boundary, just before the trailer
+		lines := bytes.SplitAfter(buf.Bytes(), []byte("\n"))
+		w.Write(bytes.Join(lines[:len(lines)-2], nil))
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	var statePath = filepath.Join(dir, "replica.json")
+
+	r := New(srv.URL, "", local, statePath, time.Second)
+	assert(t, r.Sync(ctx) != nil, "expecting truncated snapshot to fail sync")
+
+	_, err = local.Get("stale")
+	assert(t, err == nil, "expecting local permits to be kept after truncated snapshot, got %v", err)
+
+	_, err = os.Stat(statePath)
+	assert(t, os.IsNotExist(err), "expecting no state to be saved after truncated snapshot")
+}
@@ -0,0 +1,236 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/internal/store"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+type (
+	// storage decorates permit store with a read-through cache for Get
+	//
+	// Found, not found and deleted lookups are cached. Entries expire after
+	// ttl and the least recently used entries are evicted when the cache is
+	// full. Mutations made through the decorator invalidate their key; all
+	// other changes (from other processes) are picked up by comparing
+	// store generation, which is read at most once per refresh interval.
+	storage struct {
+		store.Storage
+
+		size    int
+		ttl     time.Duration
+		refresh time.Duration
+
+		mux     sync.Mutex
+		gen     uint64
+		lru     *list.List
+		entries map[string]*list.Element
+
+		// Generation as last read from the store and when
+		genMux  sync.Mutex
+		genLast uint64
+		genRead time.Time
+	}
+
+	entry struct {
+		key     string
+		permit  *permit.Permit
+		err     error
+		expires time.Time
+	}
+)
+
+// Storage wraps permit store with a cache of up to size entries
+//
+// Changes made by other processes are seen within refresh interval (0
+// checks store generation on every lookup).
+func Storage(s store.Storage, size int, ttl, refresh time.Duration) *storage {
+	return &storage{
+		Storage: s,
+		size:    size,
+		ttl:     ttl,
+		refresh: refresh,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (s *storage) Get(key string) (*permit.Permit, error) {
+	gen, err := s.generation()
+	if err != nil {
+		// Can not tell if cached entries are still valid
+		return s.Storage.Get(key)
+	}
+
+	if e, ok := s.lookup(gen, key); ok {
+		return clone(e.permit), e.err
+	}
+
+	p, err := s.Storage.Get(key)
+	switch err {
+	case nil, permit.PermitNotFound, permit.PermitDeleted:
+		s.store(gen, &entry{key: key, permit: clone(p), err: err})
+	}
+
+	return p, err
+}
+
+func (s *storage) Create(ctx context.Context, p permit.Permit) error {
+	defer s.invalidate(p.Key)
+	return s.Storage.Create(ctx, p)
+}
+
+func (s *storage) Update(ctx context.Context, key string, p store.Patch) error {
+	defer s.invalidate(key)
+	return s.Storage.Update(ctx, key, p)
+}
+
+func (s *storage) Revoke(ctx context.Context, key string) error {
+	defer s.invalidate(key)
+	return s.Storage.Revoke(ctx, key)
+}
+
+func (s *storage) Enable(ctx context.Context, key string) error {
+	defer s.invalidate(key)
+	return s.Storage.Enable(ctx, key)
+}
+
+func (s *storage) Extend(ctx context.Context, key string, t *time.Time) error {
+	defer s.invalidate(key)
+	return s.Storage.Extend(ctx, key, t)
+}
+
+func (s *storage) Delete(ctx context.Context, key string) error {
+	defer s.invalidate(key)
+	return s.Storage.Delete(ctx, key)
+}
+
+func (s *storage) Rollback(ctx context.Context, key string, number int) error {
+	defer s.invalidate(key)
+	return s.Storage.Rollback(ctx, key, number)
+}
+
+func (s *storage) Restore(ctx context.Context, key string) error {
+	defer s.invalidate(key)
+	return s.Storage.Restore(ctx, key)
+}
+
+func (s *storage) Purge(ctx context.Context, before time.Time) ([]string, error) {
+	kk, err := s.Storage.Purge(ctx, before)
+	for _, k := range kk {
+		s.invalidate(k)
+	}
+
+	return kk, err
+}
+
+func (s *storage) Import(ctx context.Context, r store.Record) error {
+	defer s.invalidate(r.Key)
+	return s.Storage.Import(ctx, r)
+}
+
+// generation returns store generation, read again when refresh interval passed
+func (s *storage) generation() (uint64, error) {
+	s.genMux.Lock()
+	defer s.genMux.Unlock()
+
+	if s.refresh > 0 && time.Since(s.genRead) < s.refresh {
+		return s.genLast, nil
+	}
+
+	gen, err := s.Storage.Generation()
+	if err != nil {
+		return 0, err
+	}
+
+	s.genLast, s.genRead = gen, time.Now()
+	return gen, nil
+}
+
+// lookup returns fresh cache entry; entries of older generations are dropped
+func (s *storage) lookup(gen uint64, key string) (*entry, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if gen != s.gen {
+		s.lru.Init()
+		s.entries = make(map[string]*list.Element)
+		s.gen = gen
+		return nil, false
+	}
+
+	el, has := s.entries[key]
+	if !has {
+		return nil, false
+	}
+
+	e := el.Value.(*entry)
+	if time.Now().After(e.expires) {
+		s.remove(el)
+		return nil, false
+	}
+
+	s.lru.MoveToFront(el)
+	return e, true
+}
+
+func (s *storage) store(gen uint64, e *entry) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if gen != s.gen || s.size <= 0 {
+		return
+	}
+
+	if el, has := s.entries[e.key]; has {
+		s.remove(el)
+	}
+
+	e.expires = time.Now().Add(s.ttl)
+	s.entries[e.key] = s.lru.PushFront(e)
+
+	for s.lru.Len() > s.size {
+		s.remove(s.lru.Back())
+	}
+}
+
+func (s *storage) invalidate(key string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if el, has := s.entries[key]; has {
+		s.remove(el)
+	}
+}
+
+func (s *storage) remove(el *list.Element) {
+	delete(s.entries, el.Value.(*entry).key)
+	s.lru.Remove(el)
+}
+
+// clone copies permit so callers can not modify cached values
+func clone(p *permit.Permit) *permit.Permit {
+	if p == nil {
+		return nil
+	}
+
+	c := *p
+
+	if p.Expires != nil {
+		t := *p.Expires
+		c.Expires = &t
+	}
+
+	if p.Attributes != nil {
+		c.Attributes = make(map[string]int, len(p.Attributes))
+		for k, v := range p.Attributes {
+			c.Attributes[k] = v
+		}
+	}
+
+	return &c
+}
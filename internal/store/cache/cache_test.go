@@ -0,0 +1,111 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/internal/store"
+	"github.com/crusttech/permit/internal/store/fs"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+func assert(t *testing.T, ok bool, format string, args ...interface{}) bool {
+	if !ok {
+		t.Fatalf(format, args...)
+	}
+	return ok
+}
+
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "permit-cache-")
+	assert(t, err == nil, "could not create temp dir: %v", err)
+	defer os.RemoveAll(dir)
+
+	var ctx = context.Background()
+
+	backend, err := fs.NewPermitStorage(dir)
+	assert(t, err == nil, "could not create storage: %v", err)
+
+	// Another process working on the same directory
+	other, err := fs.NewPermitStorage(dir)
+	assert(t, err == nil, "could not create storage: %v", err)
+
+	s := Storage(backend, 2, time.Minute, 0)
+
+	_, err = s.Get("key-1")
+	assert(t, err == permit.PermitNotFound, "expecting not found, got %v", err)
+	assert(t, s.lru.Len() == 1, "expecting negative lookup to be cached")
+
+	assert(t, other.Create(ctx, permit.Permit{Key: "key-1", Domain: "example.tld", Valid: true}) == nil, "could not create permit")
+
+	p, err := s.Get("key-1")
+	assert(t, err == nil && p.Valid, "expecting permit created by other process, got %v", err)
+
+	p.Valid = false
+	p, _ = s.Get("key-1")
+	assert(t, p.Valid, "expecting cached permit not to be modified by callers")
+
+	assert(t, s.Revoke(ctx, "key-1") == nil, "could not revoke permit")
+	p, _ = s.Get("key-1")
+	assert(t, !p.Valid, "expecting revoke to invalidate cache")
+
+	assert(t, other.Delete(ctx, "key-1") == nil, "could not delete permit")
+	_, err = s.Get("key-1")
+	assert(t, err == permit.PermitDeleted, "expecting deleted permit, got %v", err)
+
+	for _, k := range []string{"key-2", "key-3", "key-4"} {
+		s.Get(k)
+	}
+
+	assert(t, s.lru.Len() == 2, "expecting cache to be bounded, got %d entries", s.lru.Len())
+	_, cached := s.entries["key-2"]
+	assert(t, !cached, "expecting least recently used entry to be evicted")
+}
+
+type countingStorage struct {
+	store.Storage
+	generations int
+}
+
+func (s *countingStorage) Generation() (uint64, error) {
+	s.generations++
+	return s.Storage.Generation()
+}
+
+func TestCacheRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "permit-cache-")
+	assert(t, err == nil, "could not create temp dir: %v", err)
+	defer os.RemoveAll(dir)
+
+	var ctx = context.Background()
+
+	backend, err := fs.NewPermitStorage(dir)
+	assert(t, err == nil, "could not create storage: %v", err)
+
+	other, err := fs.NewPermitStorage(dir)
+	assert(t, err == nil, "could not create storage: %v", err)
+
+	var (
+		c = &countingStorage{Storage: backend}
+		s = Storage(c, 10, time.Minute, 50*time.Millisecond)
+	)
+
+	assert(t, other.Create(ctx, permit.Permit{Key: "key-1", Domain: "example.tld", Valid: true}) == nil, "could not create permit")
+
+	for i := 0; i < 100; i++ {
+		s.Get("key-1")
+	}
+
+	assert(t, c.generations == 1, "expecting generation to be read once within refresh interval, got %d", c.generations)
+
+	assert(t, other.Revoke(ctx, "key-1") == nil, "could not revoke permit")
+	p, _ := s.Get("key-1")
+	assert(t, p.Valid, "expecting change from other process not to be seen within refresh interval")
+
+	time.Sleep(60 * time.Millisecond)
+	p, _ = s.Get("key-1")
+	assert(t, !p.Valid, "expecting change from other process to be seen after refresh interval")
+}
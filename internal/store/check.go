@@ -0,0 +1,44 @@
+package store
+
+import (
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+type (
+	// CheckOptions control what the integrity check looks for and what it fixes
+	CheckOptions struct {
+		// Fix problems that can be fixed automatically
+		Repair bool
+
+		// Several active permits sharing a domain are a problem (see PERMIT_UNIQUE_DOMAIN)
+		UniqueDomain bool
+	}
+
+	// Problem found by the storage integrity check
+	Problem struct {
+		Kind    string `json:"kind"`
+		Path    string `json:"path"`
+		Key     string `json:"key,omitempty"`
+		Message string `json:"message"`
+
+		// Problem was fixed (only when check was asked to repair)
+		Repaired bool `json:"repaired"`
+
+		// Permit state around the repair, so that callers can audit it
+		Before *permit.Permit `json:"-"`
+		After  *permit.Permit `json:"-"`
+	}
+)
+
+// Kinds of problems
+const (
+	ProblemInvalidFile     = "invalid-file"
+	ProblemFilename        = "filename-mismatch"
+	ProblemKeyLength       = "key-length"
+	ProblemInvalidDomain   = "invalid-domain"
+	ProblemDuplicateDomain = "duplicate-domain"
+	ProblemTemporaryFile   = "temporary-file"
+	ProblemUndecryptable   = "undecryptable"
+	ProblemDomainIndex     = "domain-index"
+	ProblemSummary         = "shard-summary"
+)
@@ -0,0 +1,34 @@
+package dsn
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/crusttech/permit/internal/envelope"
+	"github.com/crusttech/permit/internal/store"
+	"github.com/crusttech/permit/internal/store/fs"
+)
+
+// Open creates storage from a data source name
+//
+// Supported backends:
+//   - fs:/path/to/dir (or fs:///path/to/dir), file per permit
+func Open(dsn string, keyring *envelope.Keyring) (store.Storage, error) {
+	parts := strings.SplitN(dsn, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, errors.Errorf("invalid storage DSN %q, expecting <backend>:<location>", dsn)
+	}
+
+	switch parts[0] {
+	case "fs":
+		s, err := fs.NewEncryptedPermitStorage(strings.TrimPrefix(parts[1], "//"), keyring)
+		if err != nil {
+			return nil, err
+		}
+
+		return s, nil
+	default:
+		return nil, errors.Errorf("unsupported storage backend %q", parts[0])
+	}
+}
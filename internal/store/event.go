@@ -0,0 +1,47 @@
+package store
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// Event describes a change of a single permit
+	//
+	// Events carry no permit data; consumers that need the new state read it
+	// from the store.
+	Event struct {
+		Seq    uint64    `json:"seq"`
+		Time   time.Time `json:"time"`
+		Type   string    `json:"type"`
+		Key    string    `json:"key"`
+		Actor  string    `json:"actor,omitempty"`
+		Action string    `json:"action"`
+	}
+)
+
+// Event types
+const (
+	EventCreated = "created"
+	EventUpdated = "updated"
+	EventRevoked = "revoked"
+	EventDeleted = "deleted"
+)
+
+// EventsCompacted is returned for cursors older than the oldest event kept in the journal
+var EventsCompacted = errors.New("events after the cursor were compacted away")
+
+// EventType returns type of the event emitted for the action
+func EventType(action string) string {
+	switch action {
+	case ActionCreate, ActionRestore:
+		return EventCreated
+	case ActionRevoke:
+		return EventRevoked
+	case ActionDelete, ActionPurge:
+		return EventDeleted
+	default:
+		return EventUpdated
+	}
+}
@@ -0,0 +1,135 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+type (
+	// Record holds everything a store knows about one permit key
+	//
+	// Used to move permits between stores (backups, migrations) without
+	// losing trash state or history.
+	Record struct {
+		Key     string         `json:"key"`
+		Permit  *permit.Permit `json:"permit,omitempty"`
+		Trashed *Trashed       `json:"trashed,omitempty"`
+		History []Revision     `json:"history,omitempty"`
+	}
+
+	// Counts of records, permits and revisions
+	Counts struct {
+		Permits   int `json:"permits"`
+		Trashed   int `json:"trashed"`
+		Revisions int `json:"revisions"`
+	}
+
+	exporter interface {
+		List(q Query) ([]*permit.Permit, string, error)
+		Trash() ([]Trashed, error)
+		History(key string) ([]Revision, error)
+	}
+
+	fetcher interface {
+		Get(key string) (*permit.Permit, error)
+		Trash() ([]Trashed, error)
+		History(key string) ([]Revision, error)
+	}
+)
+
+// Export walks all live and trashed permits and their history
+//
+// Live permits are passed to fn first, followed by trashed ones.
+func Export(s exporter, fn func(Record) error) error {
+	ll, _, err := s.List(Query{})
+	if err != nil {
+		return errors.Wrap(err, "could not list permits")
+	}
+
+	tt, err := s.Trash()
+	if err != nil {
+		return errors.Wrap(err, "could not list trash")
+	}
+
+	var rr = make([]Record, 0, len(ll)+len(tt))
+
+	for _, l := range ll {
+		rr = append(rr, Record{Key: l.Key, Permit: l})
+	}
+
+	for i := range tt {
+		rr = append(rr, Record{Key: tt[i].Permit.Key, Trashed: &tt[i]})
+	}
+
+	for _, r := range rr {
+		if r.History, err = s.History(r.Key); err != nil && err != permit.PermitNotFound {
+			return errors.Wrapf(err, "could not read history of %s", r.Key)
+		}
+
+		if err = fn(r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Fetch loads record of a single key, returns nil when store knows nothing about it
+func Fetch(s fetcher, key string) (*Record, error) {
+	var r = &Record{Key: key}
+
+	p, err := s.Get(key)
+	switch err {
+	case nil:
+		r.Permit = p
+	case permit.PermitDeleted:
+		tt, err := s.Trash()
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range tt {
+			if tt[i].Permit.Key == key {
+				r.Trashed = &tt[i]
+			}
+		}
+	case permit.PermitNotFound:
+		return nil, nil
+	default:
+		return nil, err
+	}
+
+	if r.History, err = s.History(key); err != nil && err != permit.PermitNotFound {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Checksum returns hex encoded SHA-256 of the record
+func (r Record) Checksum() (string, error) {
+	enc, err := json.Marshal(r)
+	if err != nil {
+		return "", errors.Wrap(err, "could not encode record")
+	}
+
+	sum := sha256.Sum256(enc)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (c *Counts) Add(r Record) {
+	if r.Permit != nil {
+		c.Permits++
+	}
+
+	if r.Trashed != nil {
+		c.Trashed++
+	}
+
+	c.Revisions += len(r.History)
+}
@@ -0,0 +1,399 @@
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/internal/envelope"
+	"github.com/crusttech/permit/internal/store"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+// Integrity check
+//
+// Files that can not be decoded are moved to lost+found/ on repair (never
+// deleted), misnamed permit files are renamed, invalid domains are normalized
+// where possible and, when domains are unique and several active permits share
+// one, all but the paid or longest valid one are revoked. Problems that need a
+// human (wrong key length, undecryptable files) are only reported. Domain index
+// and shard summaries are rebuilt after repairs.
+//
+// Repaired permits are returned with their state before and after the repair
+// so that the audit decorator can log them.
+
+const lostFoundDir = "lost+found"
+
+func (s fs) Check(ctx context.Context, opt store.CheckOptions) ([]store.Problem, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+
+	pp, ll, err := s.checkFiles(opt.Repair)
+	unlock()
+
+	if err != nil {
+		return pp, err
+	}
+
+	pp = append(pp, s.checkPermits(ctx, ll, opt)...)
+	pp = append(pp, s.checkIndex(ll)...)
+
+	if opt.Repair && len(pp) > 0 {
+		if err = s.rebuildIndex(); err != nil {
+			return pp, err
+		}
+
+		for i := range pp {
+			if pp[i].Kind == store.ProblemDomainIndex || pp[i].Kind == store.ProblemSummary {
+				pp[i].Repaired = true
+			}
+		}
+	}
+
+	return pp, nil
+}
+
+// checkFiles looks for leftover, undecodable and misnamed files, store must be locked
+//
+// Returns all decodable live permits.
+func (s fs) checkFiles(repair bool) (pp []store.Problem, ll []*permit.Permit, err error) {
+	var (
+		check = func(dir string, match func(string) bool, fn func(path, name string) *store.Problem) error {
+			ff, err := ioutil.ReadDir(dir)
+			if os.IsNotExist(err) {
+				return nil
+			} else if err != nil {
+				return errors.Wrap(err, "could not read directory")
+			}
+
+			for _, f := range ff {
+				path := filepath.Join(dir, f.Name())
+
+				switch {
+				case f.IsDir():
+					continue
+				case isTempFilename(f.Name()):
+					p := store.Problem{Kind: store.ProblemTemporaryFile, Path: path, Message: "leftover of an interrupted write"}
+					if repair {
+						p.Repaired = os.Remove(path) == nil
+					}
+
+					pp = append(pp, p)
+				case match(f.Name()):
+					if p := fn(path, f.Name()); p != nil {
+						pp = append(pp, *p)
+					}
+				}
+			}
+
+			return nil
+		}
+	)
+
+	var checkPermit = func(path, name string) *store.Problem {
+		l := &permit.Permit{}
+		if p := s.checkDecode(path, l, repair); p != nil {
+			return p
+		}
+
+		if fp := s.hash(l.Key); fp != name {
+			p := &store.Problem{Kind: store.ProblemFilename, Path: path, Key: l.Key, Message: "file name does not match hash of the key"}
+
+			if s.permitExists(fp) {
+				// Permit with the right name wins
+				p.Message += ", permit file with the right name exists"
+				if repair {
+					p.Repaired = s.quarantine(path) == nil
+				}
+
+				return p
+			}
+
+			if repair {
+				if p.Repaired = os.MkdirAll(s.shardDir(fp[:shardPrefixLen]), 0755) == nil; p.Repaired {
+					p.Repaired = os.Rename(path, s.permitPath(fp)) == nil
+				}
+			}
+
+			ll = append(ll, l)
+			return p
+		}
+
+		ll = append(ll, l)
+		return nil
+	}
+
+	shards, err := s.shards()
+	if err != nil {
+		return
+	}
+
+	for _, shard := range shards {
+		if err = check(s.shardDir(shard), isPermitFilename, checkPermit); err != nil {
+			return
+		}
+	}
+
+	err = check(s.filepath(trashDir), isPermitFilename, func(path, name string) *store.Problem {
+		t := &store.Trashed{}
+		if p := s.checkDecode(path, t, repair); p != nil {
+			return p
+		}
+
+		if s.hash(t.Permit.Key) != name {
+			p := &store.Problem{Kind: store.ProblemFilename, Path: path, Key: t.Permit.Key, Message: "trash file name does not match hash of the key"}
+			if repair && !s.trashed(s.hash(t.Permit.Key)) {
+				p.Repaired = os.Rename(path, s.trashPath(s.hash(t.Permit.Key))) == nil
+			}
+
+			return p
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return
+	}
+
+	hh, err := ioutil.ReadDir(s.filepath(historyDir))
+	if os.IsNotExist(err) {
+		return pp, ll, nil
+	} else if err != nil {
+		return pp, ll, errors.Wrap(err, "could not read history directory")
+	}
+
+	for _, h := range hh {
+		err = check(s.historyDir(h.Name()), isRevisionFilename, func(path, name string) *store.Problem {
+			return s.checkDecode(path, &store.Revision{}, repair)
+		})
+
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// checkDecode reports (and on repair quarantines) file that can not be decoded
+func (s fs) checkDecode(path string, v interface{}, repair bool) *store.Problem {
+	err := s.readFile(path, v)
+	if err == nil {
+		return nil
+	}
+
+	switch errors.Cause(err) {
+	case envelope.NoKeys, envelope.UnknownKey:
+		// Data is probably fine, keys are missing
+		return &store.Problem{Kind: store.ProblemUndecryptable, Path: path, Message: err.Error()}
+	}
+
+	p := &store.Problem{Kind: store.ProblemInvalidFile, Path: path, Message: err.Error()}
+	if repair {
+		p.Repaired = s.quarantine(path) == nil
+	}
+
+	return p
+}
+
+// checkPermits validates keys and domains of live permits
+func (s fs) checkPermits(ctx context.Context, ll []*permit.Permit, opt store.CheckOptions) (pp []store.Problem) {
+	var domains = map[string][]*permit.Permit{}
+
+	for _, l := range ll {
+		path := s.permitPath(s.hash(l.Key))
+
+		if len(l.Key) != permit.KeyLength {
+			pp = append(pp, store.Problem{
+				Kind:    store.ProblemKeyLength,
+				Path:    path,
+				Key:     l.Key,
+				Message: fmt.Sprintf("key is %d characters long, expecting %d", len(l.Key), permit.KeyLength),
+			})
+		}
+
+		if !permit.ValidateDomain(l.Domain) {
+			p := store.Problem{Kind: store.ProblemInvalidDomain, Path: path, Key: l.Key, Message: fmt.Sprintf("invalid domain %q", l.Domain)}
+
+			domain := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(l.Domain), "."))
+			if opt.Repair && permit.ValidateDomain(domain) {
+				s.repair(ctx, l, &p, func(p *permit.Permit) error {
+					p.Domain = domain
+					return nil
+				})
+			}
+
+			pp = append(pp, p)
+		}
+
+		if opt.UniqueDomain && l.IsValid() {
+			domains[strings.ToLower(l.Domain)] = append(domains[strings.ToLower(l.Domain)], l)
+		}
+	}
+
+	for domain, dd := range domains {
+		if len(dd) < 2 {
+			continue
+		}
+
+		sort.Slice(dd, func(i, j int) bool { return outranks(dd[i], dd[j]) })
+
+		for _, l := range dd[1:] {
+			p := store.Problem{
+				Kind:    store.ProblemDuplicateDomain,
+				Path:    s.permitPath(s.hash(l.Key)),
+				Key:     l.Key,
+				Message: fmt.Sprintf("domain %s has another active permit %s that is kept", domain, dd[0].Key),
+			}
+
+			if opt.Repair {
+				s.repair(ctx, l, &p, func(p *permit.Permit) error {
+					p.Valid = false
+					return nil
+				})
+			}
+
+			pp = append(pp, p)
+		}
+	}
+
+	return
+}
+
+// outranks tells if permit a should be kept over permit b sharing its domain
+//
+// Paid plans win over trials, then the permit that is valid longer and then the newer one.
+func outranks(a, b *permit.Permit) bool {
+	if aPaid, bPaid := a.Plan != permit.PlanTrial, b.Plan != permit.PlanTrial; aPaid != bPaid {
+		return aPaid
+	}
+
+	switch {
+	case a.Expires == nil && b.Expires != nil:
+		return true
+	case a.Expires != nil && b.Expires == nil:
+		return false
+	case a.Expires != nil && !a.Expires.Equal(*b.Expires):
+		return a.Expires.After(*b.Expires)
+	}
+
+	return a.Issued.After(b.Issued)
+}
+
+// repair modifies the permit and records its state before and after on the problem
+//
+// Permit l is replaced with its current state in the store.
+func (s fs) repair(ctx context.Context, l *permit.Permit, p *store.Problem, fn func(*permit.Permit) error) {
+	before := *l
+
+	if p.Repaired = s.update(ctx, l.Key, store.ActionRepair, fn) == nil; !p.Repaired {
+		return
+	}
+
+	if cur, err := s.read(s.hash(l.Key)); err == nil {
+		*l = *cur
+	}
+
+	after := *l
+	p.Before, p.After = &before, &after
+}
+
+// checkIndex looks for live permits missing from the domain index and for shard summaries that do not match permit files
+func (s fs) checkIndex(ll []*permit.Permit) (pp []store.Problem) {
+	var files = map[string]map[string]*permit.Permit{}
+
+	for _, l := range ll {
+		fp := s.hash(l.Key)
+
+		if files[fp[:shardPrefixLen]] == nil {
+			files[fp[:shardPrefixLen]] = map[string]*permit.Permit{}
+		}
+
+		files[fp[:shardPrefixLen]][fp] = l
+
+		marker := s.domainDir(l.Domain) + string(os.PathSeparator) + fp
+		if _, err := os.Stat(marker); err != nil {
+			pp = append(pp, store.Problem{Kind: store.ProblemDomainIndex, Path: marker, Key: l.Key, Message: "permit is missing from domain index"})
+		}
+	}
+
+	shards, _ := s.shards()
+	for _, shard := range shards {
+		path := s.shardDir(shard) + string(os.PathSeparator) + summaryFile
+
+		sum, err := s.readSummary(shard)
+		if err != nil {
+			pp = append(pp, store.Problem{Kind: store.ProblemSummary, Path: path, Message: err.Error()})
+		} else if !reflect.DeepEqual(normalize(sum), normalize(files[shard])) {
+			pp = append(pp, store.Problem{Kind: store.ProblemSummary, Path: path, Message: "shard summary does not match permit files"})
+		}
+	}
+
+	return
+}
+
+// rebuildIndex drops domain index (with any stale markers) and builds it and shard summaries again
+func (s fs) rebuildIndex() error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	shards, err := s.shards()
+	if err != nil {
+		return err
+	}
+
+	for _, shard := range shards {
+		if err = s.rebuildSummary(shard); err != nil {
+			return err
+		}
+	}
+
+	if err = os.RemoveAll(s.filepath(domainIndexDir)); err != nil {
+		return errors.Wrap(err, "could not remove domain index")
+	}
+
+	return s.reindex()
+}
+
+// normalize passes permits through JSON so that decoded and in-memory values can be compared
+func normalize(pp map[string]*permit.Permit) (n map[string]*permit.Permit) {
+	n = map[string]*permit.Permit{}
+	if len(pp) == 0 {
+		return
+	}
+
+	enc, _ := json.Marshal(pp)
+	json.Unmarshal(enc, &n)
+	return
+}
+
+// quarantine moves file to lost+found
+func (s fs) quarantine(path string) error {
+	if err := os.MkdirAll(s.filepath(lostFoundDir), 0755); err != nil {
+		return errors.Wrap(err, "could not create lost+found directory")
+	}
+
+	rel, err := filepath.Rel(s.path, path)
+	if err != nil {
+		return err
+	}
+
+	name := strings.Replace(rel, string(os.PathSeparator), "-", -1) + "." + time.Now().Format("20060102T150405")
+	return os.Rename(path, s.filepath(lostFoundDir)+string(os.PathSeparator)+name)
+}
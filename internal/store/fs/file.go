@@ -0,0 +1,118 @@
+package fs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Files are written to a temporary file in the same directory first and then
+// renamed (or linked) into place, so readers never see a half-written file.
+// Leftovers of interrupted writes have tmpMarker in their name.
+const tmpMarker = ".tmp-"
+
+// encode marshals value and seals it when store is encrypted
+func (s fs) encode(v interface{}) ([]byte, error) {
+	enc, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.keyring.Seal(append(enc, '\n'))
+}
+
+// decode opens sealed data (if needed) and unmarshals it
+func (s fs) decode(data []byte, v interface{}) error {
+	data, err := s.keyring.Open(data)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// readFile reads and decodes file
+//
+// Errors from the filesystem are returned as-is so callers can check them with os.IsNotExist.
+func (s fs) readFile(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return errors.Wrap(s.decode(data, v), "could not decode file")
+}
+
+// writeFile encodes value and atomically replaces the file
+func (s fs) writeFile(path string, v interface{}) error {
+	data, err := s.encode(v)
+	if err != nil {
+		return errors.Wrap(err, "could not encode file")
+	}
+
+	return replaceFile(path, data)
+}
+
+// createFile encodes value and atomically creates a new file
+//
+// Fails with an error that satisfies os.IsExist when the file already exists.
+func (s fs) createFile(path string, v interface{}) error {
+	data, err := s.encode(v)
+	if err != nil {
+		return errors.Wrap(err, "could not encode file")
+	}
+
+	tmp, err := writeTemp(path, data)
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp)
+
+	// Unlike rename, link does not replace existing files
+	return os.Link(tmp, path)
+}
+
+func replaceFile(path string, data []byte) error {
+	tmp, err := writeTemp(path, data)
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "could not replace file")
+	}
+
+	return nil
+}
+
+func writeTemp(path string, data []byte) (string, error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+tmpMarker)
+	if err != nil {
+		return "", errors.Wrap(err, "could not create temporary file")
+	}
+
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		return "", errors.Wrap(err, "could not write temporary file")
+	}
+
+	return f.Name(), nil
+}
+
+func isTempFilename(name string) bool {
+	return strings.Contains(name, tmpMarker)
+}
@@ -3,87 +3,283 @@ package fs
 import (
 	"crypto/md5"
 	"encoding/hex"
-	"encoding/json"
 	"io/ioutil"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
 
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/internal/envelope"
+	"github.com/crusttech/permit/internal/lockfile"
+	"github.com/crusttech/permit/internal/store"
 	"github.com/crusttech/permit/pkg/permit"
 )
 
 type (
 	fs struct {
 		path string
+
+		// Master keys for encryption at rest, nil when store is not encrypted
+		keyring *envelope.Keyring
 	}
 )
 
+const (
+	writeLockFile    = "write.lock"
+	writeLockTimeout = 30 * time.Second
+
+	// Counter that is incremented after every write, see Generation()
+	generationFile = "generation"
+)
+
 func NewPermitStorage(path string) (*fs, error) {
-	return &fs{path: path}, nil
+	return NewEncryptedPermitStorage(path, nil)
+}
+
+// NewEncryptedPermitStorage creates storage that seals all files it writes with the keyring
+//
+// Files written before encryption was enabled are still readable.
+func NewEncryptedPermitStorage(path string, keyring *envelope.Keyring) (*fs, error) {
+	s := &fs{path: path, keyring: keyring}
+
+	if err := s.upgrade(); err != nil {
+		return nil, errors.Wrap(err, "could not upgrade storage layout")
+	}
+
+	if !s.exists(domainIndexDir) {
+		if err := s.reindex(); err != nil {
+			return nil, errors.Wrap(err, "could not build domain index")
+		}
+	}
+
+	return s, nil
 }
 
-func (s fs) List(query string) (ll []*permit.Permit, err error) {
-	var ff []os.FileInfo
+// Snapshot runs fn while writes are blocked so that all reads inside see a consistent state
+//
+// Reads from other goroutines and processes are not affected.
+func (s fs) Snapshot(fn func() error) error {
+	unlock, err := s.acquire()
+	if err != nil {
+		return err
+	}
 
-	if ff, err = ioutil.ReadDir(s.path); err != nil {
+	defer unlock()
+
+	return fn()
+}
+
+func (s fs) List(q store.Query) (ll []*permit.Permit, next string, err error) {
+	if err = q.Validate(); err != nil {
+		return
+	}
+
+	all, err := s.listSummary()
+	if err != nil {
 		return
 	}
 
 	ll = make([]*permit.Permit, 0)
-	for _, f := range ff {
-		if l, err := s.read(f.Name()); err != nil {
-			return nil, err
-		} else {
+	for _, l := range all {
+		if q.Match(l) {
 			ll = append(ll, l)
 		}
 	}
 
-	return
+	return store.Paginate(ll, q)
 }
 
 func (s fs) Get(key string) (*permit.Permit, error) {
-	return s.read(s.hash(key))
+	fp := s.hash(key)
+
+	p, err := s.read(fp)
+	if err == permit.PermitNotFound && s.trashed(fp) {
+		return nil, permit.PermitDeleted
+	}
+
+	return p, err
 }
 
-func (s fs) Create(p permit.Permit) error {
+func (s fs) Create(ctx context.Context, p permit.Permit) error {
 	fp := s.hash(p.Key)
 
-	if s.exists(fp) {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	if s.permitExists(fp) || s.trashed(fp) {
 		return errors.New("permit already exists")
 	}
 
-	return s.write(fp, p)
+	if err = s.checkDomain(ctx, fp, nil, &p); err != nil {
+		return err
+	}
+
+	p.Revision = 1
+
+	if err = s.write(fp, p); err != nil {
+		return err
+	}
+
+	if err = s.indexDomain(p.Domain, fp); err != nil {
+		return err
+	}
+
+	return s.record(ctx, p.Key, store.ActionCreate, &p)
+}
+
+// Update changes permit's descriptive fields and moves it in domain index when domain changes
+func (s fs) Update(ctx context.Context, key string, patch store.Patch) error {
+	fp := s.hash(key)
+
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	l, err := s.read(fp)
+	if err != nil {
+		return err
+	} else if err = checkRevision(ctx, l); err != nil {
+		return err
+	}
+
+	before := *l
+	patch.Apply(l)
+
+	if err = s.checkDomain(ctx, fp, &before, l); err != nil {
+		return err
+	}
+
+	l.Revision++
+
+	if err = s.write(fp, *l); err != nil {
+		return err
+	}
+
+	if !strings.EqualFold(before.Domain, l.Domain) {
+		if err = s.unindexDomain(before.Domain, fp); err != nil {
+			return err
+		}
+
+		if err = s.indexDomain(l.Domain, fp); err != nil {
+			return err
+		}
+	}
+
+	return s.record(ctx, key, store.ActionUpdate, l)
 }
 
-func (s fs) Extend(key string, t *time.Time) error {
-	return s.update(s.hash(key), func(permit *permit.Permit) error {
+func (s fs) Extend(ctx context.Context, key string, t *time.Time) error {
+	return s.update(ctx, key, store.ActionExtend, func(permit *permit.Permit) error {
 		permit.Expires = t
 		return nil
 	})
 }
 
-func (s fs) Revoke(key string) error {
-	return s.update(s.hash(key), func(permit *permit.Permit) error {
+func (s fs) Revoke(ctx context.Context, key string) error {
+	return s.update(ctx, key, store.ActionRevoke, func(permit *permit.Permit) error {
 		permit.Valid = false
 		return nil
 	})
 }
 
-func (s fs) Enable(key string) error {
-	return s.update(s.hash(key), func(permit *permit.Permit) error {
+func (s fs) Enable(ctx context.Context, key string) error {
+	return s.update(ctx, key, store.ActionEnable, func(permit *permit.Permit) error {
 		permit.Valid = true
 		return nil
 	})
 }
 
-func (s fs) Delete(key string) error {
-	fp := s.filepath(s.hash(key))
-	if !s.exists(fp) {
-		return permit.PermitNotFound
+// Delete moves permit to trash
+func (s fs) Delete(ctx context.Context, key string) error {
+	fp := s.hash(key)
+
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	l, err := s.read(fp)
+	if err != nil {
+		return err
+	}
+
+	if err = checkRevision(ctx, l); err != nil {
+		return err
+	}
+
+	l.Revision++
+
+	if err = s.trash(ctx, fp, *l); err != nil {
+		return err
+	}
+
+	if err = s.remove(fp); err != nil {
+		return err
+	}
+
+	if err = s.unindexDomain(l.Domain, fp); err != nil {
+		return err
+	}
+
+	return s.record(ctx, key, store.ActionDelete, nil)
+}
+
+// Generation returns counter that changes whenever any process writes to the store
+func (s fs) Generation() (uint64, error) {
+	data, err := ioutil.ReadFile(s.filepath(generationFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, errors.Wrap(err, "could not read generation")
+	}
+
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// lock blocks mutations from all processes that share the store
+//
+// Unlocking bumps the generation so caches (in this or other processes) can
+// tell that something changed.
+func (s fs) lock() (unlock func(), err error) {
+	release, err := s.acquire()
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		defer release()
+
+		if gen, err := s.Generation(); err == nil {
+			// Failing here only delays cache invalidation until entries expire
+			replaceFile(s.filepath(generationFile), []byte(strconv.FormatUint(gen+1, 10)+"\n"))
+		}
+	}, nil
+}
+
+func (s fs) acquire() (unlock func(), err error) {
+	unlock, err = lockfile.Acquire(s.filepath(writeLockFile), writeLockTimeout)
+	return unlock, errors.Wrap(err, "could not lock storage")
+}
+
+func isPermitFilename(name string) bool {
+	if len(name) != md5.Size*2 {
+		return false
 	}
 
-	return errors.Wrap(os.Remove(fp), "could not remove permit file")
+	_, err := hex.DecodeString(name)
+	return err == nil
 }
 
 func (s fs) hash(key string) string {
@@ -97,53 +293,88 @@ func (s fs) exists(filename string) bool {
 	return err == nil
 }
 
-func (s fs) update(fp string, cb func(*permit.Permit) error) error {
-	if l, err := s.read(fp); err != nil || l == nil {
+func (s fs) update(ctx context.Context, key, action string, cb func(*permit.Permit) error) error {
+	fp := s.hash(key)
+
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	l, err := s.read(fp)
+	if err != nil || l == nil {
 		return permit.PermitNotFound
-	} else if err = cb(l); err != nil {
+	} else if err = checkRevision(ctx, l); err != nil {
+		return err
+	}
+
+	before := *l
+	if err = cb(l); err != nil {
 		return errors.New("could not update permit")
-	} else if err = s.write(fp, *l); err != nil {
+	} else if err = s.checkDomain(ctx, fp, &before, l); err != nil {
 		return err
 	}
 
+	l.Revision++
+
+	if err = s.write(fp, *l); err != nil {
+		return err
+	}
+
+	return s.record(ctx, key, action, l)
+}
+
+// checkRevision fails when mutation is conditional (see context.WithIfRevision)
+// and permit has been modified since the caller read it
+func checkRevision(ctx context.Context, p *permit.Permit) error {
+	if rev, ok := context.IfRevision(ctx); ok && p.Revision != rev {
+		return store.RevisionMismatch
+	}
+
 	return nil
 }
 
-func (s fs) read(filename string) (l *permit.Permit, err error) {
-	var f *os.File
+func (s fs) permitExists(fp string) bool {
+	_, err := os.Stat(s.permitPath(fp))
+	return err == nil
+}
+
+func (s fs) read(fp string) (l *permit.Permit, err error) {
 	l = &permit.Permit{}
 
-	if f, err = os.Open(s.filepath(filename)); err != nil {
+	if err = s.readFile(s.permitPath(fp), l); err != nil {
 		if os.IsNotExist(err) {
 			return nil, permit.PermitNotFound
 		}
-		err = errors.Wrap(err, "could not read permit file")
-		return
-	}
-
-	defer f.Close()
 
-	if err = json.NewDecoder(f).Decode(&l); err != nil {
-		err = errors.Wrap(err, "could not decode permit file")
+		return nil, errors.Wrap(err, "could not read permit file")
 	}
 
 	return
 }
 
-func (s fs) write(filename string, l permit.Permit) (err error) {
-	var f *os.File
+// write stores permit file and updates shard summary, store must be locked
+func (s fs) write(fp string, l permit.Permit) error {
+	if err := os.MkdirAll(s.shardDir(fp[:shardPrefixLen]), 0755); err != nil {
+		return errors.Wrap(err, "could not create shard directory")
+	}
 
-	if f, err = os.Create(s.filepath(filename)); err != nil {
-		return errors.Wrap(err, "could not create permit file")
+	if err := s.writeFile(s.permitPath(fp), l); err != nil {
+		return errors.Wrap(err, "could not write permit file")
 	}
 
-	defer f.Close()
+	return s.summarize(fp, &l)
+}
 
-	if err = json.NewEncoder(f).Encode(l); err != nil {
-		err = errors.Wrap(err, "could not encode permit file")
+// remove deletes permit file and its shard summary entry, store must be locked
+func (s fs) remove(fp string) error {
+	if err := os.Remove(s.permitPath(fp)); err != nil {
+		return errors.Wrap(err, "could not remove permit file")
 	}
 
-	return
+	return s.summarize(fp, nil)
 }
 
 func (s fs) filepath(filename string) string {
@@ -0,0 +1,499 @@
+package fs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/internal/envelope"
+	"github.com/crusttech/permit/internal/store"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+func assert(t *testing.T, ok bool, format string, args ...interface{}) bool {
+	if !ok {
+		t.Fatalf(format, args...)
+	}
+	return ok
+}
+
+func makeTestStorage(t *testing.T) (*fs, func()) {
+	dir, err := ioutil.TempDir("", "permit-fs-")
+	assert(t, err == nil, "could not create temp dir: %v", err)
+
+	s, err := NewPermitStorage(dir)
+	assert(t, err == nil, "could not create storage: %v", err)
+
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func makeTestPermit(key, domain string) permit.Permit {
+	return permit.Permit{
+		Version: 1,
+		Key:     key,
+		Domain:  domain,
+		Valid:   true,
+		Issued:  time.Now().Truncate(time.Second),
+	}
+}
+
+func TestFindByDomain(t *testing.T) {
+	s, cleanup := makeTestStorage(t)
+	defer cleanup()
+
+	assert(t, s.Create(context.Background(), makeTestPermit("key-1", "example.tld")) == nil, "could not create permit")
+	assert(t, s.Create(context.Background(), makeTestPermit("key-2", "example.tld")) == nil, "could not create permit")
+	assert(t, s.Create(context.Background(), makeTestPermit("key-3", "other.tld")) == nil, "could not create permit")
+
+	ll, err := s.FindByDomain("EXAMPLE.tld")
+	assert(t, err == nil, "unexpected error: %v", err)
+	assert(t, len(ll) == 2, "expecting 2 permits, got %d", len(ll))
+
+	ll, _, err = s.List(store.Query{})
+	assert(t, err == nil, "unexpected error: %v", err)
+	assert(t, len(ll) == 3, "expecting index to be skipped when listing, got %d permits", len(ll))
+
+	assert(t, s.Delete(context.Background(), "key-1") == nil, "could not delete permit")
+
+	ll, err = s.FindByDomain("example.tld")
+	assert(t, err == nil, "unexpected error: %v", err)
+	assert(t, len(ll) == 1 && ll[0].Key == "key-2", "expecting only key-2 after delete")
+
+	ll, err = s.FindByDomain("unknown.tld")
+	assert(t, err == nil, "unexpected error: %v", err)
+	assert(t, len(ll) == 0, "expecting no permits for unknown domain")
+}
+
+func TestUniqueDomain(t *testing.T) {
+	s, cleanup := makeTestStorage(t)
+	defer cleanup()
+
+	var (
+		ctx    = context.WithUniqueDomain(context.Background())
+		domain = "example.tld"
+	)
+
+	assert(t, s.Create(ctx, makeTestPermit("key-1", domain)) == nil, "could not create permit")
+
+	err := s.Create(ctx, makeTestPermit("key-2", "EXAMPLE.tld"))
+	assert(t, err == permit.DomainTaken, "expecting domain taken on create, got %v", err)
+	assert(t, s.Create(context.Background(), makeTestPermit("key-2", "other.tld")) == nil, "could not create permit")
+
+	err = s.Update(ctx, "key-2", store.Patch{Domain: &domain})
+	assert(t, err == permit.DomainTaken, "expecting domain taken on update, got %v", err)
+	assert(t, s.Update(ctx, "key-1", store.Patch{Domain: &domain}) == nil, "expecting permit to keep its own domain")
+
+	// Without the option store accepts the second permit, all reactivations must then be refused
+	assert(t, s.Update(context.Background(), "key-2", store.Patch{Domain: &domain}) == nil, "could not update permit")
+	assert(t, s.Revoke(ctx, "key-2") == nil, "could not revoke permit")
+
+	err = s.Enable(ctx, "key-2")
+	assert(t, err == permit.DomainTaken, "expecting domain taken on enable, got %v", err)
+
+	assert(t, s.Rollback(ctx, "key-2", 2) == permit.DomainTaken, "expecting domain taken on rollback")
+	assert(t, s.Enable(context.Background(), "key-2") == nil, "could not enable permit")
+	assert(t, s.Delete(ctx, "key-2") == nil, "could not delete permit")
+	assert(t, s.Restore(ctx, "key-2") == permit.DomainTaken, "expecting domain taken on restore")
+
+	assert(t, s.Revoke(ctx, "key-1") == nil, "could not revoke permit")
+	assert(t, s.Restore(ctx, "key-2") == nil, "expecting restore once domain is free")
+	assert(t, s.Extend(ctx, "key-1", nil) == nil, "expecting extend of revoked permit to pass")
+	assert(t, s.Enable(ctx, "key-1") == permit.DomainTaken, "expecting domain taken on enable")
+}
+
+func TestReindex(t *testing.T) {
+	s, cleanup := makeTestStorage(t)
+	defer cleanup()
+
+	assert(t, s.Create(context.Background(), makeTestPermit("key-1", "example.tld")) == nil, "could not create permit")
+
+	// Simulate store created before domain index existed
+	assert(t, os.RemoveAll(s.filepath(domainIndexDir)) == nil, "could not remove index")
+
+	s, err := NewPermitStorage(s.path)
+	assert(t, err == nil, "could not reopen storage: %v", err)
+
+	ll, err := s.FindByDomain("example.tld")
+	assert(t, err == nil, "unexpected error: %v", err)
+	assert(t, len(ll) == 1, "expecting rebuilt index to find permit, got %d", len(ll))
+}
+
+func TestHistoryRollback(t *testing.T) {
+	s, cleanup := makeTestStorage(t)
+	defer cleanup()
+
+	ctx := context.WithActor(context.Background(), "tester")
+
+	assert(t, s.Create(ctx, makeTestPermit("key-1", "example.tld")) == nil, "could not create permit")
+	assert(t, s.Revoke(ctx, "key-1") == nil, "could not revoke permit")
+	assert(t, s.Delete(ctx, "key-1") == nil, "could not delete permit")
+
+	rr, err := s.History("key-1")
+	assert(t, err == nil, "unexpected error: %v", err)
+	assert(t, len(rr) == 3, "expecting 3 revisions, got %d", len(rr))
+	assert(t, rr[1].Number == 2 && rr[1].Action == store.ActionRevoke, "expecting revoke as 2nd revision")
+	assert(t, rr[1].Actor == "tester", "expecting actor to be recorded")
+	assert(t, rr[2].Permit == nil, "expecting no permit state after delete")
+
+	assert(t, s.Rollback(ctx, "key-1", 3) != nil, "expecting error when rolling back to deleted state")
+	assert(t, s.Rollback(ctx, "key-1", 9) == store.RevisionNotFound, "expecting revision not found error")
+	assert(t, s.Rollback(ctx, "key-1", 1) == nil, "could not rollback permit")
+
+	p, err := s.Get("key-1")
+	assert(t, err == nil, "unexpected error: %v", err)
+	assert(t, p.Valid, "expecting permit to be restored as valid")
+
+	ll, err := s.FindByDomain("example.tld")
+	assert(t, err == nil && len(ll) == 1, "expecting restored permit to be indexed")
+
+	rr, _ = s.History("key-1")
+	assert(t, len(rr) == 4 && rr[3].Action == store.ActionRollback, "expecting rollback to be recorded")
+}
+
+func TestTrash(t *testing.T) {
+	s, cleanup := makeTestStorage(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	assert(t, s.Create(ctx, makeTestPermit("key-1", "example.tld")) == nil, "could not create permit")
+	assert(t, s.Delete(ctx, "key-1") == nil, "could not delete permit")
+
+	_, err := s.Get("key-1")
+	assert(t, err == permit.PermitDeleted, "expecting deleted permit error, got %v", err)
+
+	_, err = s.Get("key-2")
+	assert(t, err == permit.PermitNotFound, "expecting permit not found error, got %v", err)
+
+	tt, err := s.Trash()
+	assert(t, err == nil, "unexpected error: %v", err)
+	assert(t, len(tt) == 1 && tt[0].Permit.Key == "key-1", "expecting deleted permit in trash")
+
+	assert(t, s.Create(ctx, makeTestPermit("key-1", "example.tld")) != nil, "expecting error when creating permit with trashed key")
+	assert(t, s.Restore(ctx, "key-1") == nil, "could not restore permit")
+
+	p, err := s.Get("key-1")
+	assert(t, err == nil && p.Domain == "example.tld", "expecting restored permit, got %v", err)
+
+	assert(t, s.Delete(ctx, "key-1") == nil, "could not delete permit")
+
+	kk, err := s.Purge(ctx, time.Now().AddDate(0, 0, -1))
+	assert(t, err == nil && len(kk) == 0, "not expecting recently deleted permit to be purged")
+
+	kk, err = s.Purge(ctx, time.Now().Add(time.Second))
+	assert(t, err == nil && len(kk) == 1, "expecting permit to be purged")
+
+	_, err = s.Get("key-1")
+	assert(t, err == permit.PermitNotFound, "expecting purged permit to be gone, got %v", err)
+
+	_, err = s.History("key-1")
+	assert(t, err == permit.PermitNotFound, "expecting history to be purged")
+}
+
+func TestEncryption(t *testing.T) {
+	s, cleanup := makeTestStorage(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	assert(t, s.Create(ctx, makeTestPermit("key-1", "example.tld")) == nil, "could not create permit")
+
+	keyring, err := envelope.NewKeyring("k1", map[string][]byte{"k1": []byte("0123456789abcdef0123456789abcdef")})
+	assert(t, err == nil, "could not create keyring: %v", err)
+
+	s, err = NewEncryptedPermitStorage(s.path, keyring)
+	assert(t, err == nil, "could not reopen storage: %v", err)
+
+	p, err := s.Get("key-1")
+	assert(t, err == nil && p.Domain == "example.tld", "expecting plaintext permit to be readable, got %v", err)
+
+	n, err := s.Reencrypt("")
+	assert(t, err == nil, "could not re-encrypt: %v", err)
+	assert(t, n == 4, "expecting permit, shard summary, revision and journal event to be re-encrypted, got %d", n)
+
+	raw, _ := ioutil.ReadFile(s.permitPath(s.hash("key-1")))
+	assert(t, !strings.Contains(string(raw), "example.tld"), "expecting permit file to be encrypted")
+
+	raw, _ = ioutil.ReadFile(s.shardDir(s.hash("key-1")[:shardPrefixLen]) + "/" + summaryFile)
+	assert(t, !strings.Contains(string(raw), "example.tld"), "expecting shard summary to be encrypted")
+
+	assert(t, s.Revoke(ctx, "key-1") == nil, "could not revoke permit")
+	raw, _ = ioutil.ReadFile(s.filepath(journalFile))
+	assert(t, !strings.Contains(string(raw), "key-1"), "expecting keys in journal to be encrypted")
+
+	ee, _, err := s.Events(0, 0)
+	assert(t, err == nil && len(ee) == 2 && ee[1].Key == "key-1", "expecting events with decrypted keys, got %+v (%v)", ee, err)
+
+	n, err = s.Reencrypt("")
+	assert(t, err == nil && n == 0, "expecting nothing to re-encrypt on second run")
+
+	p, err = s.Get("key-1")
+	assert(t, err == nil && p.Domain == "example.tld", "could not read encrypted permit: %v", err)
+
+	rr, err := s.History("key-1")
+	assert(t, err == nil && len(rr) == 2, "could not read encrypted history: %v", err)
+
+	s, err = NewPermitStorage(s.path)
+	assert(t, err == nil, "could not reopen storage: %v", err)
+
+	_, err = s.Get("key-1")
+	assert(t, err != nil, "expecting error when reading encrypted permit without keys")
+}
+
+func TestConditionalUpdate(t *testing.T) {
+	s, cleanup := makeTestStorage(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	assert(t, s.Create(ctx, makeTestPermit("key-1", "example.tld")) == nil, "could not create permit")
+
+	p, err := s.Get("key-1")
+	assert(t, err == nil && p.Revision == 1, "expecting new permit at revision 1")
+
+	assert(t, s.Revoke(context.WithIfRevision(ctx, 1), "key-1") == nil, "could not revoke permit at current revision")
+
+	err = s.Enable(context.WithIfRevision(ctx, 1), "key-1")
+	assert(t, err == store.RevisionMismatch, "expecting revision mismatch, got %v", err)
+
+	p, _ = s.Get("key-1")
+	assert(t, p.Revision == 2 && !p.Valid, "expecting stale update not to change permit")
+
+	assert(t, s.Delete(context.WithIfRevision(ctx, 2), "key-1") == nil, "could not delete permit at current revision")
+	assert(t, s.Rollback(ctx, "key-1", 1) == nil, "could not roll back permit")
+
+	p, _ = s.Get("key-1")
+	assert(t, p.Revision == 4 && p.Valid, "expecting rollback to continue from latest revision, got %d", p.Revision)
+}
+
+func TestUpdate(t *testing.T) {
+	s, cleanup := makeTestStorage(t)
+	defer cleanup()
+
+	var (
+		ctx     = context.Background()
+		domain  = "example.net"
+		contact = "new@example.net"
+	)
+
+	assert(t, s.Create(ctx, makeTestPermit("key-1", "example.tld")) == nil, "could not create permit")
+	assert(t, s.Update(ctx, "key-1", store.Patch{Domain: &domain, Contact: &contact, Attributes: map[string]int{"x": 2}}) == nil, "could not update permit")
+
+	p, err := s.Get("key-1")
+	assert(t, err == nil && p.Domain == domain && p.Contact == contact && p.Revision == 2, "unexpected permit after update: %+v", p)
+	assert(t, p.Attributes["x"] == 2, "expecting attributes to be merged: %v", p.Attributes)
+
+	ll, _ := s.FindByDomain("example.tld")
+	assert(t, len(ll) == 0, "expecting permit to be removed from old domain index")
+
+	ll, _ = s.FindByDomain(domain)
+	assert(t, len(ll) == 1, "expecting permit in new domain index")
+
+	err = s.Update(ctx, "key-2", store.Patch{Contact: &contact})
+	assert(t, err == permit.PermitNotFound, "expecting not found error, got %v", err)
+}
+
+func TestWatch(t *testing.T) {
+	s, cleanup := makeTestStorage(t)
+	defer cleanup()
+
+	assert(t, s.Create(context.Background(), makeTestPermit("key-0", "example.tld")) == nil, "could not create permit")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ch := s.Watch(ctx)
+
+	// Changes made by another process
+	other, err := NewPermitStorage(s.path)
+	assert(t, err == nil, "could not reopen storage: %v", err)
+
+	assert(t, other.Create(ctx, makeTestPermit("key-1", "example.tld")) == nil, "could not create permit")
+	assert(t, other.Revoke(ctx, "key-1") == nil, "could not revoke permit")
+	assert(t, other.Extend(ctx, "key-1", nil) == nil, "could not extend permit")
+	assert(t, other.Delete(ctx, "key-1") == nil, "could not delete permit")
+
+	for i, typ := range []string{store.EventCreated, store.EventRevoked, store.EventUpdated, store.EventDeleted} {
+		e, ok := <-ch
+		assert(t, ok, "expecting event %d", i)
+		assert(t, e.Type == typ && e.Key == "key-1", "expecting %s event for key-1, got %+v", typ, e)
+		assert(t, e.Seq == uint64(i+2), "expecting sequence %d, got %d", i+2, e.Seq)
+	}
+
+	cancel()
+	_, ok := <-ch
+	assert(t, !ok, "expecting channel to be closed")
+}
+
+func TestCheck(t *testing.T) {
+	s, cleanup := makeTestStorage(t)
+	defer cleanup()
+
+	var (
+		ctx   = context.Background()
+		key   = strings.Repeat("k", permit.KeyLength)
+		older = makeTestPermit(strings.Repeat("o", permit.KeyLength), "example.tld")
+		kinds = func(pp []store.Problem) map[string]int {
+			kk := map[string]int{}
+			for _, p := range pp {
+				kk[p.Kind]++
+			}
+			return kk
+		}
+	)
+
+	// Older paid permit outranks newer trial
+	older.Issued, older.Plan = older.Issued.Add(-time.Hour), permit.PlanStandard
+	newer := makeTestPermit(key, "example.tld")
+	newer.Plan = permit.PlanTrial
+
+	assert(t, s.Create(ctx, newer) == nil, "could not create permit")
+	assert(t, s.Create(ctx, older) == nil, "could not create permit")
+	assert(t, s.Create(ctx, makeTestPermit("short", " Other.tld ")) == nil, "could not create permit")
+
+	// Damage the store by hand
+	for _, k := range []string{"broken", "misnamed"} {
+		assert(t, os.MkdirAll(s.shardDir(s.hash(k)[:shardPrefixLen]), 0755) == nil, "could not create shard")
+	}
+
+	assert(t, ioutil.WriteFile(s.permitPath(s.hash("broken")), []byte("{not json"), 0644) == nil, "could not write file")
+	assert(t, ioutil.WriteFile(s.permitPath(s.hash(key))+tmpMarker+"1", nil, 0644) == nil, "could not write file")
+	assert(t, os.Rename(s.permitPath(s.hash("short")), s.permitPath(s.hash("misnamed"))) == nil, "could not rename file")
+
+	pp, err := s.Check(ctx, store.CheckOptions{})
+	assert(t, err == nil, "unexpected error: %v", err)
+	assert(t, kinds(pp)[store.ProblemDuplicateDomain] == 0, "expecting shared domain to be fine without unique domains, got %+v", pp)
+
+	pp, err = s.Check(ctx, store.CheckOptions{UniqueDomain: true})
+	assert(t, err == nil, "unexpected error: %v", err)
+
+	kk := kinds(pp)
+	assert(t, kk[store.ProblemInvalidFile] == 1, "expecting invalid file, got %+v", pp)
+	assert(t, kk[store.ProblemTemporaryFile] == 1, "expecting temporary file, got %+v", pp)
+	assert(t, kk[store.ProblemFilename] == 1, "expecting misnamed file, got %+v", pp)
+	assert(t, kk[store.ProblemKeyLength] == 1, "expecting wrong key length, got %+v", pp)
+	assert(t, kk[store.ProblemInvalidDomain] == 1, "expecting invalid domain, got %+v", pp)
+	assert(t, kk[store.ProblemDuplicateDomain] == 1, "expecting duplicate domain, got %+v", pp)
+
+	pp, err = s.Check(ctx, store.CheckOptions{Repair: true, UniqueDomain: true})
+	assert(t, err == nil, "unexpected error: %v", err)
+
+	for _, p := range pp {
+		assert(t, p.Repaired || p.Kind == store.ProblemKeyLength, "expecting %s to be repaired", p.Kind)
+
+		if p.Kind == store.ProblemDuplicateDomain {
+			assert(t, p.Before.Valid && !p.After.Valid, "expecting repaired permit state to be returned, got %+v", p)
+		}
+	}
+
+	pp, err = s.Check(ctx, store.CheckOptions{UniqueDomain: true})
+	assert(t, err == nil, "unexpected error: %v", err)
+	assert(t, len(pp) == 1 && pp[0].Kind == store.ProblemKeyLength, "expecting only key length problem to remain, got %+v", pp)
+
+	p, err := s.Get(key)
+	assert(t, err == nil && !p.Valid, "expecting trial duplicate to be revoked")
+
+	p, err = s.Get(older.Key)
+	assert(t, err == nil && p.Valid, "expecting paid permit to be kept")
+
+	ll, err := s.FindByDomain("other.tld")
+	assert(t, err == nil && len(ll) == 1, "expecting normalized domain to be indexed")
+}
+
+func TestUpgradeLayout(t *testing.T) {
+	s, cleanup := makeTestStorage(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	assert(t, s.Create(ctx, makeTestPermit("key-1", "example.tld")) == nil, "could not create permit")
+
+	// Simulate store with flat layout
+	fp := s.hash("key-2")
+	data, _ := s.encode(makeTestPermit("key-2", "other.tld"))
+	assert(t, ioutil.WriteFile(s.filepath(fp), data, 0644) == nil, "could not write flat permit file")
+
+	s, err := NewPermitStorage(s.path)
+	assert(t, err == nil, "could not reopen storage: %v", err)
+	assert(t, !s.exists(fp) && s.permitExists(fp), "expecting permit file to be moved to its shard")
+
+	ll, _, err := s.List(store.Query{})
+	assert(t, err == nil && len(ll) == 2, "expecting 2 permits, got %d (%v)", len(ll), err)
+
+	pp, err := s.Check(ctx, store.CheckOptions{})
+	assert(t, err == nil && len(pp) == 2, "expecting only short keys to be reported, got %+v", pp)
+}
+
+func TestEvents(t *testing.T) {
+	s, cleanup := makeTestStorage(t)
+	defer cleanup()
+
+	// Journal large enough to be bisected
+	var buf []byte
+	for i := 1; i <= 2000; i++ {
+		buf = append(buf, fmt.Sprintf(`{"seq":%d,"type":"updated","key":"key-%d","action":"extend"}`+"\n", i, i)...)
+	}
+
+	assert(t, ioutil.WriteFile(s.filepath(journalFile), buf, 0600) == nil, "could not write journal")
+
+	for _, since := range []uint64{0, 1, 999, 1500, 1995} {
+		ee, head, err := s.Events(since, 10)
+		assert(t, err == nil, "unexpected error: %v", err)
+		assert(t, head == 2000, "expecting head 2000, got %d", head)
+		assert(t, len(ee) == 10 || since == 1995 && len(ee) == 5, "unexpected number of events after %d: %d", since, len(ee))
+		assert(t, ee[0].Seq == since+1, "expecting first event after %d, got %d", since, ee[0].Seq)
+	}
+
+	assert(t, s.Create(context.Background(), makeTestPermit("key-1", "example.tld")) == nil, "could not create permit")
+
+	ee, head, err := s.Events(2000, 0)
+	assert(t, err == nil && head == 2001 && len(ee) == 1 && ee[0].Type == store.EventCreated, "expecting create event to be appended")
+}
+
+func TestJournalCompaction(t *testing.T) {
+	s, cleanup := makeTestStorage(t)
+	defer cleanup()
+
+	defer func(max int64) { journalMaxSize = max }(journalMaxSize)
+	journalMaxSize = 4096
+
+	var ctx = context.Background()
+
+	assert(t, s.Create(ctx, makeTestPermit("key-1", "example.tld")) == nil, "could not create permit")
+
+	wctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	ch := s.Watch(wctx)
+
+	for i := 0; i < 100; i++ {
+		assert(t, s.Extend(ctx, "key-1", nil) == nil, "could not extend permit")
+	}
+
+	assert(t, s.journalSize() <= journalMaxSize, "expecting journal to be compacted, size %d", s.journalSize())
+
+	low, err := s.lowWater()
+	assert(t, err == nil && low > 1, "expecting low-water mark, got %d (%v)", low, err)
+
+	_, _, err = s.Events(0, 0)
+	assert(t, errors.Cause(err) == store.EventsCompacted, "expecting compacted events error, got %v", err)
+
+	ee, head, err := s.Events(low, 0)
+	assert(t, err == nil && head == 101 && len(ee) > 0 && ee[0].Seq == low+1, "expecting events after low-water mark, got %d events (%v)", len(ee), err)
+
+	// Watcher keeps up by sequence after the journal was compacted under it
+	for e := range ch {
+		if e.Seq == head {
+			break
+		}
+	}
+
+	assert(t, s.Extend(ctx, "key-1", nil) == nil, "could not extend permit")
+	e := <-ch
+	assert(t, e.Seq == head+1, "expecting next event after compaction, got %d", e.Seq)
+}
@@ -0,0 +1,241 @@
+package fs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/internal/store"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+// Revision history
+//
+// Every mutation stores a snapshot of the permit under history/<permit hash>/
+// in a file named by the zero-padded revision number. History is kept after
+// the permit is deleted so it can be rolled back.
+
+const (
+	historyDir = "history"
+
+	revisionFilenameFormat = "%08d.json"
+)
+
+func (s fs) History(key string) (rr []store.Revision, err error) {
+	if rr, err = s.revisions(s.hash(key)); err == nil && len(rr) == 0 {
+		return nil, permit.PermitNotFound
+	}
+
+	return
+}
+
+// Rollback restores permit to the state recorded in the revision
+//
+// Rollback itself is recorded as a new revision.
+func (s fs) Rollback(ctx context.Context, key string, number int) error {
+	var (
+		fp  = s.hash(key)
+		rev *store.Revision
+	)
+
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	rr, err := s.revisions(fp)
+	if err != nil {
+		return err
+	}
+
+	for i := range rr {
+		if rr[i].Number == number {
+			rev = &rr[i]
+		}
+	}
+
+	if rev == nil {
+		return store.RevisionNotFound
+	} else if rev.Permit == nil {
+		return errors.Errorf("revision %d holds a deleted permit", number)
+	}
+
+	cur, err := s.read(fp)
+	if err != nil && err != permit.PermitNotFound {
+		return err
+	}
+
+	// Rolled back permit continues from the latest revision, be it live or trashed
+	latest := cur
+	if latest == nil {
+		if t, err := s.readTrashed(fp); err == nil {
+			latest = &t.Permit
+		} else if err != permit.PermitNotFound {
+			return err
+		}
+	}
+
+	if latest == nil {
+		latest = &permit.Permit{}
+	}
+
+	if err = checkRevision(ctx, latest); err != nil {
+		return err
+	}
+
+	p := *rev.Permit
+	p.Revision = latest.Revision + 1
+
+	if err = s.checkDomain(ctx, fp, cur, &p); err != nil {
+		return err
+	}
+
+	if err = s.write(fp, p); err != nil {
+		return err
+	}
+
+	if s.trashed(fp) {
+		// Rolling back a deleted permit restores it
+		if err = os.Remove(s.trashPath(fp)); err != nil {
+			return errors.Wrap(err, "could not remove permit from trash")
+		}
+	}
+
+	if cur != nil && !strings.EqualFold(cur.Domain, p.Domain) {
+		if err = s.unindexDomain(cur.Domain, fp); err != nil {
+			return err
+		}
+	}
+
+	if err = s.indexDomain(p.Domain, fp); err != nil {
+		return err
+	}
+
+	return s.record(ctx, key, store.ActionRollback, &p)
+}
+
+// record stores new revision of the permit and adds the change to the journal
+func (s fs) record(ctx context.Context, key, action string, p *permit.Permit) error {
+	var dir = s.historyDir(s.hash(key))
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "could not create history directory")
+	}
+
+	n, err := s.lastRevision(dir)
+	if err != nil {
+		return err
+	}
+
+	rev := store.Revision{
+		Time:   time.Now().Truncate(time.Second),
+		Actor:  context.Actor(ctx),
+		Action: action,
+		Permit: p,
+	}
+
+	for {
+		n++
+		rev.Number = n
+
+		// Exclusive create so that concurrent writers never share a revision number
+		err = s.createFile(dir+string(os.PathSeparator)+fmt.Sprintf(revisionFilenameFormat, n), rev)
+		if os.IsExist(err) {
+			continue
+		} else if err != nil {
+			return errors.Wrap(err, "could not create revision file")
+		}
+
+		return s.journal(ctx, action, key)
+	}
+}
+
+// replaceHistory overwrites all revisions of the permit
+func (s fs) replaceHistory(fp string, rr []store.Revision) error {
+	var dir = s.historyDir(fp)
+
+	if err := os.RemoveAll(dir); err != nil {
+		return errors.Wrap(err, "could not remove history directory")
+	}
+
+	if len(rr) == 0 {
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "could not create history directory")
+	}
+
+	for _, rev := range rr {
+		if err := s.writeFile(dir+string(os.PathSeparator)+fmt.Sprintf(revisionFilenameFormat, rev.Number), rev); err != nil {
+			return errors.Wrap(err, "could not write revision file")
+		}
+	}
+
+	return nil
+}
+
+func (s fs) revisions(fp string) (rr []store.Revision, err error) {
+	var (
+		dir = s.historyDir(fp)
+		ff  []os.FileInfo
+	)
+
+	if ff, err = ioutil.ReadDir(dir); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, errors.Wrap(err, "could not read history directory")
+	}
+
+	rr = make([]store.Revision, 0, len(ff))
+	for _, fi := range ff {
+		if !isRevisionFilename(fi.Name()) {
+			continue
+		}
+
+		rev := store.Revision{}
+		if err = s.readFile(dir+string(os.PathSeparator)+fi.Name(), &rev); err != nil {
+			return nil, errors.Wrap(err, "could not read revision file")
+		}
+
+		rr = append(rr, rev)
+	}
+
+	return
+}
+
+func (s fs) lastRevision(dir string) (int, error) {
+	ff, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not read history directory")
+	}
+
+	// ReadDir sorts by filename, zero-padded numbers keep the last one at the end
+	for i := len(ff) - 1; i >= 0; i-- {
+		if isRevisionFilename(ff[i].Name()) {
+			return strconv.Atoi(strings.TrimSuffix(ff[i].Name(), ".json"))
+		}
+	}
+
+	return 0, nil
+}
+
+func isRevisionFilename(name string) bool {
+	var n int
+	_, err := fmt.Sscanf(name, revisionFilenameFormat, &n)
+	return err == nil && fmt.Sprintf(revisionFilenameFormat, n) == name
+}
+
+func (s fs) historyDir(fp string) string {
+	return s.filepath(historyDir) + string(os.PathSeparator) + fp
+}
@@ -0,0 +1,85 @@
+package fs
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/internal/store"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+// Import writes record as-is, replacing whatever the store holds under its key
+//
+// Unlike mutations, import does not record a new revision; history
+// is taken from the record.
+func (s fs) Import(ctx context.Context, r store.Record) error {
+	if err := validateRecord(r); err != nil {
+		return err
+	}
+
+	fp := s.hash(r.Key)
+
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	cur, err := s.read(fp)
+	if err != nil && err != permit.PermitNotFound {
+		return err
+	}
+
+	if cur != nil {
+		if err = s.unindexDomain(cur.Domain, fp); err != nil {
+			return err
+		}
+
+		if err = s.remove(fp); err != nil {
+			return err
+		}
+	}
+
+	if err = os.Remove(s.trashPath(fp)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "could not remove permit from trash")
+	}
+
+	if r.Permit != nil {
+		if err = s.write(fp, *r.Permit); err != nil {
+			return err
+		}
+
+		if err = s.indexDomain(r.Permit.Domain, fp); err != nil {
+			return err
+		}
+	}
+
+	if r.Trashed != nil {
+		if err = s.writeTrashed(fp, *r.Trashed); err != nil {
+			return err
+		}
+	}
+
+	if err = s.replaceHistory(fp, r.History); err != nil {
+		return err
+	}
+
+	return s.journal(ctx, store.ActionImport, r.Key)
+}
+
+func validateRecord(r store.Record) error {
+	switch {
+	case r.Key == "":
+		return errors.New("record without key")
+	case r.Permit != nil && r.Trashed != nil:
+		return errors.Errorf("record %s is both live and trashed", r.Key)
+	case r.Permit != nil && r.Permit.Key != r.Key,
+		r.Trashed != nil && r.Trashed.Permit.Key != r.Key:
+		return errors.Errorf("record %s holds permit with a different key", r.Key)
+	}
+
+	return nil
+}
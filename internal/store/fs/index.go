@@ -0,0 +1,132 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/internal/store"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+// Domain index
+//
+// Each indexed domain gets its own directory under domains/ (named by the hash
+// of the lowercased domain) with one empty marker file per permit that uses it.
+// Markers are named by the permit's file hash, so the index never holds raw keys
+// and it can be updated by several processes without read-modify-write races.
+
+const domainIndexDir = "domains"
+
+func (s fs) FindByDomain(domain string) (ll []*permit.Permit, err error) {
+	var ff []os.FileInfo
+
+	if ff, err = ioutil.ReadDir(s.domainDir(domain)); err != nil {
+		if os.IsNotExist(err) {
+			return []*permit.Permit{}, nil
+		}
+
+		return nil, errors.Wrap(err, "could not read domain index")
+	}
+
+	ll = make([]*permit.Permit, 0, len(ff))
+	for _, f := range ff {
+		l, err := s.read(f.Name())
+		if err == permit.PermitNotFound {
+			// Stale marker, permit was removed behind our back
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if !strings.EqualFold(l.Domain, domain) {
+			// Stale marker, permit file was modified by hand
+			continue
+		}
+
+		ll = append(ll, l)
+	}
+
+	return
+}
+
+// checkDomain fails with permit.DomainTaken when mutation is limited to unique domains
+// (see context.WithUniqueDomain) and it makes permit valid on a domain that already has a valid permit
+//
+// Before is the permit as it was prior to the mutation, nil when it was not in the store.
+// Must be called under lock so that no other process can take the domain in the meantime.
+func (s fs) checkDomain(ctx context.Context, fp string, before, after *permit.Permit) error {
+	if !context.UniqueDomain(ctx) || !after.IsValid() {
+		return nil
+	}
+
+	if before != nil && before.IsValid() && strings.EqualFold(before.Domain, after.Domain) {
+		// Permit already held the domain
+		return nil
+	}
+
+	ll, err := s.FindByDomain(after.Domain)
+	if err != nil {
+		return err
+	}
+
+	for _, l := range ll {
+		if s.hash(l.Key) != fp && l.IsValid() {
+			return permit.DomainTaken
+		}
+	}
+
+	return nil
+}
+
+func (s fs) indexDomain(domain, fp string) error {
+	dir := s.domainDir(domain)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "could not create domain index")
+	}
+
+	if err := ioutil.WriteFile(dir+string(os.PathSeparator)+fp, nil, 0644); err != nil {
+		return errors.Wrap(err, "could not update domain index")
+	}
+
+	return nil
+}
+
+func (s fs) unindexDomain(domain, fp string) error {
+	err := os.Remove(s.domainDir(domain) + string(os.PathSeparator) + fp)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "could not update domain index")
+	}
+
+	return nil
+}
+
+// reindex rebuilds domain index from scratch
+//
+// Used on stores that were created before the index existed.
+func (s fs) reindex() error {
+	ll, _, err := s.List(store.Query{})
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(s.filepath(domainIndexDir), 0755); err != nil {
+		return errors.Wrap(err, "could not create domain index")
+	}
+
+	for _, l := range ll {
+		if err = s.indexDomain(l.Domain, s.hash(l.Key)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s fs) domainDir(domain string) string {
+	return s.filepath(domainIndexDir) + string(os.PathSeparator) + s.hash(strings.ToLower(domain))
+}
@@ -0,0 +1,509 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/internal/envelope"
+	"github.com/crusttech/permit/internal/store"
+)
+
+// Change journal
+//
+// Every mutation appends an event to changes.log (one JSON object per line,
+// written under the write lock). Watchers in any process remember how far
+// they have read and poll the file size for new events.
+//
+// Permit keys are sealed with the keyring when the store is encrypted. When
+// the journal grows over journalMaxSize, its older half is dropped and the
+// sequence of the last dropped event is kept as the low-water mark; reading
+// events after an older sequence fails with store.EventsCompacted.
+
+type (
+	// journalEntry is an event as written to the journal
+	journalEntry struct {
+		Seq  uint64    `json:"seq"`
+		Time time.Time `json:"time"`
+		Type string    `json:"type"`
+
+		// Plaintext key in unencrypted stores, sealed key otherwise
+		Key       string `json:"key,omitempty"`
+		SealedKey []byte `json:"sealedKey,omitempty"`
+
+		Actor  string `json:"actor,omitempty"`
+		Action string `json:"action"`
+	}
+)
+
+const (
+	journalFile = "changes.log"
+
+	// Sequence of the last event dropped from the journal
+	journalLowWaterFile = "changes.low"
+
+	watchInterval = 250 * time.Millisecond
+
+	// How much of the journal's tail is read when looking for the last event
+	journalTailSize = 64 * 1024
+)
+
+var (
+	// Journal is compacted to half when it grows over this size
+	journalMaxSize int64 = 32 << 20
+
+	errGarbage = errors.New("not a journal entry")
+)
+
+// Watch emits events of all changes made after the call, until ctx is done
+//
+// Channel is closed when ctx is done. Watchers resume after compaction by
+// sequence; events compacted away before they were read are skipped.
+func (s fs) Watch(ctx context.Context) <-chan store.Event {
+	var (
+		ch      = make(chan store.Event)
+		offset  = s.journalSize()
+		last, _ = s.lastSeq()
+	)
+
+	go func() {
+		defer close(ch)
+
+		t := time.NewTicker(watchInterval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+
+			size := s.journalSize()
+			if size < offset {
+				// Compacted, find where we stopped in the new journal
+				var err error
+				if offset, err = s.seek(last); err != nil {
+					continue
+				}
+			}
+
+			if size <= offset {
+				continue
+			}
+
+			ee, next, err := s.events(offset)
+			if err != nil {
+				// Retried on next tick
+				continue
+			}
+
+			offset = next
+
+			for _, e := range ee {
+				if e.Seq <= last {
+					continue
+				}
+
+				select {
+				case ch <- e:
+					last = e.Seq
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return ch
+}
+
+func (s fs) Events(since uint64, limit int) (ee []store.Event, head uint64, err error) {
+	low, err := s.lowWater()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if since < low {
+		return nil, 0, errors.Wrapf(store.EventsCompacted, "oldest available event follows %d", low)
+	}
+
+	if head, err = s.lastSeq(); err != nil || head == 0 {
+		return nil, head, err
+	}
+
+	offset, err := s.seek(since)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	all, _, err := s.events(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ee = make([]store.Event, 0)
+	for _, e := range all {
+		if e.Seq > since && (limit <= 0 || len(ee) < limit) {
+			ee = append(ee, e)
+		}
+	}
+
+	return ee, head, nil
+}
+
+// seek finds offset of a line at or before the first event with sequence after since
+//
+// Sequences grow with the offset, so the journal can be bisected.
+func (s fs) seek(since uint64) (int64, error) {
+	f, err := os.Open(s.filepath(journalFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, errors.Wrap(err, "could not open journal")
+	}
+
+	defer f.Close()
+
+	var (
+		lo, hi = int64(0), s.journalSize()
+		buf    = make([]byte, 4096)
+	)
+
+	for hi-lo > journalTailSize {
+		mid := lo + (hi-lo)/2
+
+		n, err := f.ReadAt(buf, mid)
+		if err != nil && err != io.EOF {
+			return 0, errors.Wrap(err, "could not read journal")
+		}
+
+		// Decode the first complete line after mid
+		var (
+			chunk = buf[:n]
+			start = bytes.IndexByte(chunk, '\n') + 1
+			end   = bytes.IndexByte(chunk[start:], '\n')
+			e     journalEntry
+		)
+
+		if start == 0 || end < 0 || json.Unmarshal(chunk[start:start+end], &e) != nil || e.Seq > since {
+			hi = mid
+		} else {
+			lo = mid + int64(start)
+		}
+	}
+
+	return lo, nil
+}
+
+// journal appends event for action on the permit, store must be locked
+func (s fs) journal(ctx context.Context, action, key string) error {
+	last, complete, err := s.lastEntry()
+	if err != nil {
+		return err
+	}
+
+	low, err := s.lowWater()
+	if err != nil {
+		return err
+	}
+
+	e := store.Event{
+		Seq:    low,
+		Time:   time.Now(),
+		Type:   store.EventType(action),
+		Key:    key,
+		Actor:  context.Actor(ctx),
+		Action: action,
+	}
+
+	if last != nil && last.Seq > e.Seq {
+		e.Seq = last.Seq
+	}
+
+	e.Seq++
+
+	enc, err := s.encodeEvent(e, s.keyring.Active())
+	if err != nil {
+		return err
+	}
+
+	if !complete {
+		// Terminate line left by an interrupted write
+		enc = append([]byte{'\n'}, enc...)
+	}
+
+	f, err := os.OpenFile(s.filepath(journalFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrap(err, "could not open journal")
+	}
+
+	if _, err = f.Write(enc); err != nil {
+		f.Close()
+		return errors.Wrap(err, "could not write journal")
+	}
+
+	if err = f.Close(); err != nil {
+		return errors.Wrap(err, "could not write journal")
+	}
+
+	if s.journalSize() > journalMaxSize {
+		return s.compactJournal()
+	}
+
+	return nil
+}
+
+// compactJournal drops the older half of the journal, store must be locked
+//
+// Low-water mark is written first, so readers never miss that events are gone.
+func (s fs) compactJournal() error {
+	data, err := ioutil.ReadFile(s.filepath(journalFile))
+	if err != nil {
+		return errors.Wrap(err, "could not read journal")
+	}
+
+	// Cut at the first line boundary after the middle
+	cut := bytes.IndexByte(data[len(data)/2:], '\n')
+	if cut < 0 {
+		return nil
+	}
+
+	cut += len(data)/2 + 1
+
+	var (
+		low   uint64
+		lines = bytes.Split(bytes.TrimSuffix(data[:cut], []byte("\n")), []byte("\n"))
+	)
+
+	for i := len(lines) - 1; i >= 0 && low == 0; i-- {
+		e := journalEntry{}
+		if json.Unmarshal(lines[i], &e) == nil {
+			low = e.Seq
+		}
+	}
+
+	err = replaceFile(s.filepath(journalLowWaterFile), []byte(strconv.FormatUint(low, 10)+"\n"))
+	if err != nil {
+		return errors.Wrap(err, "could not write journal low-water mark")
+	}
+
+	return errors.Wrap(replaceFile(s.filepath(journalFile), data[cut:]), "could not compact journal")
+}
+
+// reencryptJournal seals keys of all events with the master key, store must be locked
+//
+// Returns number of re-sealed events.
+func (s fs) reencryptJournal(keyID string) (n int, err error) {
+	data, err := ioutil.ReadFile(s.filepath(journalFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, errors.Wrap(err, "could not read journal")
+	}
+
+	var buf bytes.Buffer
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		e := journalEntry{}
+		if json.Unmarshal(line, &e) != nil {
+			// Garbage left by an interrupted write is dropped
+			continue
+		}
+
+		if kid, sealed := envelope.KeyID(e.SealedKey); sealed && kid == keyID {
+			buf.Write(line)
+			continue
+		}
+
+		ev, err := s.decodeEvent(line)
+		if err != nil {
+			return 0, err
+		}
+
+		enc, err := s.encodeEvent(ev, keyID)
+		if err != nil {
+			return 0, err
+		}
+
+		buf.Write(enc)
+		n++
+	}
+
+	if n == 0 {
+		return 0, nil
+	}
+
+	return n, errors.Wrap(replaceFile(s.filepath(journalFile), buf.Bytes()), "could not write journal")
+}
+
+// events reads complete events written after offset, returns offset of the first unread byte
+func (s fs) events(offset int64) (ee []store.Event, next int64, err error) {
+	f, err := os.Open(s.filepath(journalFile))
+	if os.IsNotExist(err) {
+		return nil, offset, nil
+	} else if err != nil {
+		return nil, offset, errors.Wrap(err, "could not open journal")
+	}
+
+	defer f.Close()
+
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return nil, offset, errors.Wrap(err, "could not read journal")
+	}
+
+	var buf bytes.Buffer
+	if _, err = buf.ReadFrom(f); err != nil {
+		return nil, offset, errors.Wrap(err, "could not read journal")
+	}
+
+	data := buf.Bytes()
+
+	// Line without newline at the end is still being written
+	i := bytes.LastIndexByte(data, '\n')
+	if i < 0 {
+		return nil, offset, nil
+	}
+
+	data = data[:i+1]
+
+	for _, line := range bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n")) {
+		e, err := s.decodeEvent(line)
+		if err == errGarbage {
+			// Left by an interrupted write
+			continue
+		} else if err != nil {
+			return nil, offset, err
+		}
+
+		ee = append(ee, e)
+	}
+
+	return ee, offset + int64(len(data)), nil
+}
+
+// lastSeq returns sequence of the latest event, low-water mark when journal is empty
+func (s fs) lastSeq() (uint64, error) {
+	last, _, err := s.lastEntry()
+	if err != nil {
+		return 0, err
+	}
+
+	if last != nil {
+		return last.Seq, nil
+	}
+
+	return s.lowWater()
+}
+
+// lastEntry returns the last entry in the journal (nil when there is none)
+// and whether the journal ends with a complete line
+func (s fs) lastEntry() (*journalEntry, bool, error) {
+	f, err := os.Open(s.filepath(journalFile))
+	if os.IsNotExist(err) {
+		return nil, true, nil
+	} else if err != nil {
+		return nil, false, errors.Wrap(err, "could not open journal")
+	}
+
+	defer f.Close()
+
+	var (
+		offset = s.journalSize() - journalTailSize
+		buf    = make([]byte, journalTailSize)
+	)
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	n, err := f.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return nil, false, errors.Wrap(err, "could not read journal")
+	}
+
+	buf = buf[:n]
+	complete := n == 0 || buf[n-1] == '\n'
+
+	lines := bytes.Split(buf, []byte("\n"))
+	for i := len(lines) - 1; i >= 0; i-- {
+		e := &journalEntry{}
+		if json.Unmarshal(lines[i], e) == nil {
+			return e, complete, nil
+		}
+	}
+
+	return nil, complete, nil
+}
+
+// lowWater returns sequence of the last event dropped from the journal, 0 if none was
+func (s fs) lowWater() (uint64, error) {
+	data, err := ioutil.ReadFile(s.filepath(journalLowWaterFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, errors.Wrap(err, "could not read journal low-water mark")
+	}
+
+	low, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	return low, errors.Wrap(err, "could not read journal low-water mark")
+}
+
+func (s fs) journalSize() int64 {
+	fi, err := os.Stat(s.filepath(journalFile))
+	if err != nil {
+		return 0
+	}
+
+	return fi.Size()
+}
+
+// encodeEvent returns event as a line of the journal, with key sealed when store is encrypted
+func (s fs) encodeEvent(e store.Event, keyID string) ([]byte, error) {
+	var (
+		err error
+		je  = journalEntry{Seq: e.Seq, Time: e.Time, Type: e.Type, Key: e.Key, Actor: e.Actor, Action: e.Action}
+	)
+
+	if s.keyring != nil {
+		if je.SealedKey, err = s.keyring.SealWith(keyID, []byte(e.Key)); err != nil {
+			return nil, errors.Wrap(err, "could not encrypt event")
+		}
+
+		je.Key = ""
+	}
+
+	enc, err := json.Marshal(je)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not encode event")
+	}
+
+	return append(enc, '\n'), nil
+}
+
+// decodeEvent decodes a line of the journal, errGarbage for lines that are not events
+func (s fs) decodeEvent(line []byte) (store.Event, error) {
+	var je journalEntry
+	if json.Unmarshal(line, &je) != nil {
+		return store.Event{}, errGarbage
+	}
+
+	e := store.Event{Seq: je.Seq, Time: je.Time, Type: je.Type, Key: je.Key, Actor: je.Actor, Action: je.Action}
+	if je.SealedKey != nil {
+		key, err := s.keyring.Open(je.SealedKey)
+		if err != nil {
+			return e, errors.Wrapf(err, "could not decrypt event %d", je.Seq)
+		}
+
+		e.Key = string(key)
+	}
+
+	return e, nil
+}
@@ -0,0 +1,127 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/crusttech/permit/internal/envelope"
+)
+
+// Reencrypt seals all permit, trash and revision files and keys in the change journal with the given master key
+//
+// Empty key ID means the active key. Files already sealed with the key are
+// skipped, so an interrupted run can simply be repeated.
+// Returns number of re-encrypted files.
+func (s fs) Reencrypt(keyID string) (n int, err error) {
+	if s.keyring == nil {
+		return 0, errors.New("storage is not encrypted, no master keys configured")
+	}
+
+	if keyID == "" {
+		keyID = s.keyring.Active()
+	}
+
+	unlock, err := s.lock()
+	if err != nil {
+		return
+	}
+
+	defer unlock()
+
+	err = s.walkData(func(path string) error {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.Wrap(err, "could not read file")
+		}
+
+		if kid, sealed := envelope.KeyID(data); sealed && kid == keyID {
+			return nil
+		}
+
+		if data, err = s.keyring.Open(data); err != nil {
+			return errors.Wrapf(err, "could not decrypt %s", path)
+		}
+
+		if data, err = s.keyring.SealWith(keyID, data); err != nil {
+			return err
+		}
+
+		if err = replaceFile(path, data); err != nil {
+			return err
+		}
+
+		n++
+		return nil
+	})
+
+	if err != nil {
+		return
+	}
+
+	j, err := s.reencryptJournal(keyID)
+	return n + j, err
+}
+
+// walkData calls fn with path of every permit, shard summary, trash and revision file
+func (s fs) walkData(fn func(path string) error) error {
+	var (
+		sep = string(os.PathSeparator)
+
+		files = func(dir string, match func(string) bool) error {
+			ff, err := ioutil.ReadDir(dir)
+			if os.IsNotExist(err) {
+				return nil
+			} else if err != nil {
+				return errors.Wrap(err, "could not read directory")
+			}
+
+			for _, f := range ff {
+				if f.IsDir() || !match(f.Name()) {
+					continue
+				}
+
+				if err = fn(dir + sep + f.Name()); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}
+	)
+
+	shards, err := s.shards()
+	if err != nil {
+		return err
+	}
+
+	for _, shard := range shards {
+		err = files(s.shardDir(shard), func(name string) bool {
+			return isPermitFilename(name) || name == summaryFile
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := files(s.filepath(trashDir), isPermitFilename); err != nil {
+		return err
+	}
+
+	hh, err := ioutil.ReadDir(s.filepath(historyDir))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "could not read history directory")
+	}
+
+	for _, h := range hh {
+		if err = files(s.historyDir(h.Name()), isRevisionFilename); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,234 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+// Sharded layout
+//
+// Permit files live under permits/<first two characters of the hash>/ so that
+// no directory grows too large. Each shard keeps a summary index with copies
+// of all its permits; List reads summaries instead of opening every permit
+// file. Summaries are updated under the write lock together with the permit
+// files and are rebuilt from the files when missing.
+//
+// Stores with the old flat layout (permit files in the root) are upgraded
+// when opened.
+
+const (
+	permitsDir = "permits"
+
+	shardPrefixLen = 2
+	summaryFile    = "index"
+)
+
+// listSummary returns all live permits, read from shard summaries
+func (s fs) listSummary() ([]*permit.Permit, error) {
+	shards, err := s.shards()
+	if err != nil {
+		return nil, err
+	}
+
+	ll := make([]*permit.Permit, 0)
+	for _, shard := range shards {
+		sum, err := s.readSummary(shard)
+		if os.IsNotExist(errors.Cause(err)) {
+			// Summary is rebuilt on the next write or reopen, read files meanwhile
+			sum, err = s.scanShard(shard)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, l := range sum {
+			ll = append(ll, l)
+		}
+	}
+
+	return ll, nil
+}
+
+// summarize updates permit's entry in the shard summary, nil permit removes it
+//
+// Store must be locked.
+func (s fs) summarize(fp string, p *permit.Permit) error {
+	var shard = fp[:shardPrefixLen]
+
+	sum, err := s.readSummary(shard)
+	if os.IsNotExist(errors.Cause(err)) {
+		sum, err = s.scanShard(shard)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if p == nil {
+		delete(sum, fp)
+	} else {
+		sum[fp] = p
+	}
+
+	return s.writeSummary(shard, sum)
+}
+
+// rebuildSummary replaces shard summary with permits read from the shard's files
+//
+// Store must be locked.
+func (s fs) rebuildSummary(shard string) error {
+	sum, err := s.scanShard(shard)
+	if err != nil {
+		return err
+	}
+
+	return s.writeSummary(shard, sum)
+}
+
+func (s fs) readSummary(shard string) (map[string]*permit.Permit, error) {
+	sum := map[string]*permit.Permit{}
+	if err := s.readFile(s.shardDir(shard)+string(os.PathSeparator)+summaryFile, &sum); err != nil {
+		return nil, errors.Wrap(err, "could not read shard summary")
+	}
+
+	return sum, nil
+}
+
+func (s fs) writeSummary(shard string, sum map[string]*permit.Permit) error {
+	return errors.Wrap(s.writeFile(s.shardDir(shard)+string(os.PathSeparator)+summaryFile, sum), "could not write shard summary")
+}
+
+// scanShard reads all permit files of the shard
+func (s fs) scanShard(shard string) (map[string]*permit.Permit, error) {
+	ff, err := ioutil.ReadDir(s.shardDir(shard))
+	if os.IsNotExist(err) {
+		return map[string]*permit.Permit{}, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "could not read shard directory")
+	}
+
+	sum := make(map[string]*permit.Permit, len(ff))
+	for _, f := range ff {
+		if f.IsDir() || !isPermitFilename(f.Name()) {
+			continue
+		}
+
+		if sum[f.Name()], err = s.read(f.Name()); err != nil {
+			return nil, err
+		}
+	}
+
+	return sum, nil
+}
+
+// shards returns names of existing shard directories
+func (s fs) shards() ([]string, error) {
+	ff, err := ioutil.ReadDir(s.filepath(permitsDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "could not read permits directory")
+	}
+
+	shards := make([]string, 0, len(ff))
+	for _, f := range ff {
+		if f.IsDir() && len(f.Name()) == shardPrefixLen {
+			shards = append(shards, f.Name())
+		}
+	}
+
+	return shards, nil
+}
+
+// upgrade moves permit files from the flat layout into shards and builds missing summaries
+func (s fs) upgrade() error {
+	if ok, err := s.upgraded(); err != nil || ok {
+		return err
+	}
+
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	ff, err := ioutil.ReadDir(s.path)
+	if err != nil {
+		return errors.Wrap(err, "could not read storage directory")
+	}
+
+	for _, f := range ff {
+		if f.IsDir() || !isPermitFilename(f.Name()) {
+			continue
+		}
+
+		if err = os.MkdirAll(s.shardDir(f.Name()[:shardPrefixLen]), 0755); err != nil {
+			return errors.Wrap(err, "could not create shard directory")
+		}
+
+		if err = os.Rename(s.filepath(f.Name()), s.permitPath(f.Name())); err != nil {
+			return errors.Wrap(err, "could not move permit file")
+		}
+
+		// Written by older code, that might not have maintained the domain index
+		if l, err := s.read(f.Name()); err == nil {
+			if err = s.indexDomain(l.Domain, f.Name()); err != nil {
+				return err
+			}
+		}
+	}
+
+	shards, err := s.shards()
+	if err != nil {
+		return err
+	}
+
+	for _, shard := range shards {
+		if err = s.rebuildSummary(shard); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// upgraded checks that there are no flat permit files and that all shards have summaries
+func (s fs) upgraded() (bool, error) {
+	ff, err := ioutil.ReadDir(s.path)
+	if err != nil {
+		return false, errors.Wrap(err, "could not read storage directory")
+	}
+
+	for _, f := range ff {
+		if !f.IsDir() && isPermitFilename(f.Name()) {
+			return false, nil
+		}
+	}
+
+	shards, err := s.shards()
+	if err != nil {
+		return false, err
+	}
+
+	for _, shard := range shards {
+		if _, err = os.Stat(s.shardDir(shard) + string(os.PathSeparator) + summaryFile); os.IsNotExist(err) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func (s fs) permitPath(fp string) string {
+	return s.shardDir(fp[:shardPrefixLen]) + string(os.PathSeparator) + fp
+}
+
+func (s fs) shardDir(shard string) string {
+	return s.filepath(permitsDir) + string(os.PathSeparator) + shard
+}
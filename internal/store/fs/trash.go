@@ -0,0 +1,171 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/internal/store"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+// Trash
+//
+// Deleted permits are moved to trash/<permit hash> together with the time and
+// the actor of the deletion. They stay there until restored or purged.
+
+const trashDir = "trash"
+
+func (s fs) Trash() (tt []store.Trashed, err error) {
+	var ff []os.FileInfo
+
+	if ff, err = ioutil.ReadDir(s.filepath(trashDir)); err != nil {
+		if os.IsNotExist(err) {
+			return []store.Trashed{}, nil
+		}
+
+		return nil, errors.Wrap(err, "could not read trash directory")
+	}
+
+	tt = make([]store.Trashed, 0, len(ff))
+	for _, f := range ff {
+		if !isPermitFilename(f.Name()) {
+			continue
+		}
+
+		t, err := s.readTrashed(f.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		tt = append(tt, *t)
+	}
+
+	return
+}
+
+// Restore moves deleted permit from trash back to the store
+func (s fs) Restore(ctx context.Context, key string) error {
+	fp := s.hash(key)
+
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	if s.permitExists(fp) {
+		return errors.New("permit already exists")
+	}
+
+	t, err := s.readTrashed(fp)
+	if err != nil {
+		return err
+	}
+
+	if err = checkRevision(ctx, &t.Permit); err != nil {
+		return err
+	} else if err = s.checkDomain(ctx, fp, nil, &t.Permit); err != nil {
+		return err
+	}
+
+	t.Permit.Revision++
+
+	if err = s.write(fp, t.Permit); err != nil {
+		return err
+	}
+
+	if err = os.Remove(s.trashPath(fp)); err != nil {
+		return errors.Wrap(err, "could not remove permit from trash")
+	}
+
+	if err = s.indexDomain(t.Permit.Domain, fp); err != nil {
+		return err
+	}
+
+	return s.record(ctx, key, store.ActionRestore, &t.Permit)
+}
+
+// Purge permanently removes permits deleted before the given time, together with their history
+//
+// Returns keys of the purged permits.
+func (s fs) Purge(ctx context.Context, before time.Time) (kk []string, err error) {
+	var tt []store.Trashed
+
+	unlock, err := s.lock()
+	if err != nil {
+		return
+	}
+
+	defer unlock()
+
+	if tt, err = s.Trash(); err != nil {
+		return
+	}
+
+	kk = make([]string, 0)
+	for _, t := range tt {
+		if !t.Deleted.Before(before) {
+			continue
+		}
+
+		fp := s.hash(t.Permit.Key)
+
+		if err = os.Remove(s.trashPath(fp)); err != nil {
+			return kk, errors.Wrap(err, "could not remove permit from trash")
+		}
+
+		if err = os.RemoveAll(s.historyDir(fp)); err != nil {
+			return kk, errors.Wrap(err, "could not remove permit history")
+		}
+
+		if err = s.journal(ctx, store.ActionPurge, t.Permit.Key); err != nil {
+			return kk, err
+		}
+
+		kk = append(kk, t.Permit.Key)
+	}
+
+	return
+}
+
+// trash moves permit to trash
+func (s fs) trash(ctx context.Context, fp string, p permit.Permit) error {
+	return s.writeTrashed(fp, store.Trashed{
+		Permit:  p,
+		Deleted: time.Now().Truncate(time.Second),
+		Actor:   context.Actor(ctx),
+	})
+}
+
+func (s fs) writeTrashed(fp string, t store.Trashed) error {
+	if err := os.MkdirAll(s.filepath(trashDir), 0755); err != nil {
+		return errors.Wrap(err, "could not create trash directory")
+	}
+
+	return errors.Wrap(s.writeFile(s.trashPath(fp), t), "could not write trash file")
+}
+
+func (s fs) trashed(fp string) bool {
+	_, err := os.Stat(s.trashPath(fp))
+	return err == nil
+}
+
+func (s fs) readTrashed(fp string) (*store.Trashed, error) {
+	t := &store.Trashed{}
+	if err := s.readFile(s.trashPath(fp), t); os.IsNotExist(err) {
+		return nil, permit.PermitNotFound
+	} else if err != nil {
+		return nil, errors.Wrap(err, "could not read trash file")
+	}
+
+	return t, nil
+}
+
+func (s fs) trashPath(fp string) string {
+	return s.filepath(trashDir) + string(os.PathSeparator) + fp
+}
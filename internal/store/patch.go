@@ -0,0 +1,78 @@
+package store
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+type (
+	// Patch describes changes of permit's descriptive fields
+	//
+	// Nil fields are left unchanged. Attributes are merged into existing ones,
+	// validity and expiration are changed with Revoke, Enable and Extend.
+	Patch struct {
+		Domain     *string        `json:"domain,omitempty"`
+		Contact    *string        `json:"contact,omitempty"`
+		Entity     *string        `json:"entity,omitempty"`
+		Plan       *string        `json:"plan,omitempty"`
+		Attributes map[string]int `json:"attributes,omitempty"`
+	}
+)
+
+var (
+	EmptyPatch = errors.New("nothing to update")
+)
+
+// Validate checks patch for empty changes, invalid domain and unknown plan
+func (p Patch) Validate() error {
+	if p.Domain == nil && p.Contact == nil && p.Entity == nil && p.Plan == nil && len(p.Attributes) == 0 {
+		return EmptyPatch
+	}
+
+	if p.Domain != nil && !permit.ValidateDomain(*p.Domain) {
+		return errors.Errorf("invalid domain %q", *p.Domain)
+	}
+
+	if p.Plan != nil {
+		switch *p.Plan {
+		case permit.PlanTrial, permit.PlanStandard, permit.PlanUnlimited:
+		default:
+			return errors.Errorf("unknown plan %q", *p.Plan)
+		}
+	}
+
+	return nil
+}
+
+// Apply changes the permit
+func (p Patch) Apply(l *permit.Permit) {
+	if p.Domain != nil {
+		l.Domain = *p.Domain
+	}
+
+	if p.Contact != nil {
+		l.Contact = *p.Contact
+	}
+
+	if p.Entity != nil {
+		l.Entity = *p.Entity
+	}
+
+	if p.Plan != nil {
+		l.Plan = *p.Plan
+	}
+
+	if len(p.Attributes) > 0 {
+		aa := make(map[string]int, len(l.Attributes)+len(p.Attributes))
+		for name, value := range l.Attributes {
+			aa[name] = value
+		}
+
+		for name, value := range p.Attributes {
+			aa[name] = value
+		}
+
+		l.Attributes = aa
+	}
+}
@@ -0,0 +1,243 @@
+package store
+
+import (
+	"encoding/base64"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+type (
+	// Query filters, sorts and paginates permits
+	//
+	// Empty (zero) filter values are ignored.
+	Query struct {
+		// Matches start of the permit key
+		KeyPrefix string
+
+		// Glob pattern (see path.Match) matched against the domain, case-insensitive
+		Domain string
+
+		// Case-insensitive substrings of entity and contact
+		Entity  string
+		Contact string
+
+		// Matches permit's valid flag; false lists revoked permits
+		Valid *bool
+
+		// Permits without expiration date never expire before and always expire after
+		ExpiresBefore *time.Time
+		ExpiresAfter  *time.Time
+
+		Plan string
+
+		// Sort field, one of SortFields; prefix with "-" for descending order
+		Sort string
+
+		// Max number of permits returned, 0 for all
+		Limit int
+
+		// Opaque cursor, returned by the previous page
+		Cursor string
+	}
+)
+
+const (
+	// Sort value for permits without expiration date, makes them sort last
+	noExpiration = "~"
+
+	sortTimeFormat = "20060102T150405.000000000"
+)
+
+var (
+	SortFields = []string{"key", "domain", "entity", "contact", "plan", "issued", "expires"}
+
+	InvalidCursor = errors.New("invalid cursor")
+)
+
+// Validate checks query for unknown sort fields and malformed patterns and cursors
+func (q Query) Validate() error {
+	if _, err := path.Match(q.Domain, ""); err != nil {
+		return errors.Wrap(err, "invalid domain pattern")
+	}
+
+	if field, _ := q.sortField(); !isSortField(field) {
+		return errors.Errorf("unknown sort field %q", field)
+	}
+
+	if q.Limit < 0 {
+		return errors.New("negative limit")
+	}
+
+	if q.Cursor != "" {
+		if _, _, err := decodeCursor(q.Cursor); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Match checks if permit matches all query filters
+func (q Query) Match(p *permit.Permit) bool {
+	if p == nil {
+		return false
+	}
+
+	if q.KeyPrefix != "" && !strings.HasPrefix(p.Key, q.KeyPrefix) {
+		return false
+	}
+
+	if q.Domain != "" {
+		if ok, _ := path.Match(strings.ToLower(q.Domain), strings.ToLower(p.Domain)); !ok {
+			return false
+		}
+	}
+
+	if q.Entity != "" && !containsFold(p.Entity, q.Entity) {
+		return false
+	}
+
+	if q.Contact != "" && !containsFold(p.Contact, q.Contact) {
+		return false
+	}
+
+	if q.Valid != nil && p.Valid != *q.Valid {
+		return false
+	}
+
+	if q.ExpiresBefore != nil && (p.Expires == nil || !p.Expires.Before(*q.ExpiresBefore)) {
+		return false
+	}
+
+	if q.ExpiresAfter != nil && p.Expires != nil && !p.Expires.After(*q.ExpiresAfter) {
+		return false
+	}
+
+	if q.Plan != "" && p.Plan != q.Plan {
+		return false
+	}
+
+	return true
+}
+
+// Paginate sorts the (already filtered) permits and cuts out the page the query points to
+//
+// Returns cursor for the next page or an empty string when this is the last one.
+func Paginate(ll []*permit.Permit, q Query) (page []*permit.Permit, next string, err error) {
+	if err = q.Validate(); err != nil {
+		return
+	}
+
+	var (
+		field, desc = q.sortField()
+
+		// Compares sort values and falls back to keys to keep the order stable
+		cmp = func(aVal, aKey, bVal, bKey string) int {
+			r := strings.Compare(aVal, bVal)
+			if r == 0 {
+				r = strings.Compare(aKey, bKey)
+			}
+
+			if desc {
+				return -r
+			}
+
+			return r
+		}
+	)
+
+	sort.Slice(ll, func(i, j int) bool {
+		return cmp(sortValue(ll[i], field), ll[i].Key, sortValue(ll[j], field), ll[j].Key) < 0
+	})
+
+	page = ll
+	if q.Cursor != "" {
+		cVal, cKey, _ := decodeCursor(q.Cursor)
+		start := sort.Search(len(ll), func(i int) bool {
+			return cmp(sortValue(ll[i], field), ll[i].Key, cVal, cKey) > 0
+		})
+
+		page = ll[start:]
+	}
+
+	if q.Limit > 0 && len(page) > q.Limit {
+		page = page[:q.Limit]
+		last := page[len(page)-1]
+		next = encodeCursor(sortValue(last, field), last.Key)
+	}
+
+	return
+}
+
+func (q Query) sortField() (field string, desc bool) {
+	field = q.Sort
+	if strings.HasPrefix(field, "-") {
+		field, desc = field[1:], true
+	}
+
+	if field == "" {
+		field = "key"
+	}
+
+	return
+}
+
+func isSortField(field string) bool {
+	for _, f := range SortFields {
+		if f == field {
+			return true
+		}
+	}
+
+	return false
+}
+
+func sortValue(p *permit.Permit, field string) string {
+	switch field {
+	case "domain":
+		return strings.ToLower(p.Domain)
+	case "entity":
+		return strings.ToLower(p.Entity)
+	case "contact":
+		return strings.ToLower(p.Contact)
+	case "plan":
+		return p.Plan
+	case "issued":
+		return p.Issued.UTC().Format(sortTimeFormat)
+	case "expires":
+		if p.Expires == nil {
+			return noExpiration
+		}
+		return p.Expires.UTC().Format(sortTimeFormat)
+	default:
+		return p.Key
+	}
+}
+
+func encodeCursor(value, key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(value + "\x00" + key))
+}
+
+func decodeCursor(cursor string) (value, key string, err error) {
+	var raw []byte
+	if raw, err = base64.RawURLEncoding.DecodeString(cursor); err != nil {
+		return "", "", InvalidCursor
+	}
+
+	parts := strings.SplitN(string(raw), "\x00", 2)
+	if len(parts) != 2 {
+		return "", "", InvalidCursor
+	}
+
+	return parts[0], parts[1], nil
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
@@ -0,0 +1,95 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+func assert(t *testing.T, ok bool, format string, args ...interface{}) bool {
+	if !ok {
+		t.Fatalf(format, args...)
+	}
+	return ok
+}
+
+func TestQueryMatch(t *testing.T) {
+	var (
+		now     = time.Now()
+		later   = now.AddDate(0, 1, 0)
+		revoked = false
+
+		p = &permit.Permit{
+			Key:     "abc123",
+			Domain:  "crm.Example.tld",
+			Entity:  "ACME Inc.",
+			Contact: "admin@acme.tld",
+			Valid:   true,
+			Expires: &later,
+			Plan:    permit.PlanTrial,
+		}
+
+		tests = []struct {
+			q     Query
+			match bool
+		}{
+			{Query{}, true},
+			{Query{KeyPrefix: "abc"}, true},
+			{Query{KeyPrefix: "123"}, false},
+			{Query{Domain: "*.example.tld"}, true},
+			{Query{Domain: "*.other.tld"}, false},
+			{Query{Entity: "acme"}, true},
+			{Query{Contact: "@acme"}, true},
+			{Query{Contact: "@other"}, false},
+			{Query{Valid: &revoked}, false},
+			{Query{ExpiresBefore: &now}, false},
+			{Query{ExpiresAfter: &now}, true},
+			{Query{Plan: permit.PlanStandard}, false},
+		}
+	)
+
+	for i, test := range tests {
+		assert(t, test.q.Match(p) == test.match, "test %d: expecting match to be %v", i, test.match)
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	var (
+		ll = []*permit.Permit{
+			{Key: "c", Domain: "a.tld"},
+			{Key: "a", Domain: "c.tld"},
+			{Key: "d", Domain: "b.tld"},
+			{Key: "b", Domain: "b.tld"},
+		}
+
+		keys = func(ll []*permit.Permit) (s string) {
+			for _, l := range ll {
+				s += l.Key
+			}
+			return
+		}
+
+		q    = Query{Sort: "-domain", Limit: 3}
+		page []*permit.Permit
+		next string
+		err  error
+	)
+
+	page, next, err = Paginate(ll, q)
+	assert(t, err == nil, "unexpected error: %v", err)
+	assert(t, keys(page) == "adb", "unexpected order of the first page: %s", keys(page))
+	assert(t, next != "", "expecting cursor for the next page")
+
+	q.Cursor = next
+	page, next, err = Paginate(ll, q)
+	assert(t, err == nil, "unexpected error: %v", err)
+	assert(t, keys(page) == "c", "unexpected order of the last page: %s", keys(page))
+	assert(t, next == "", "not expecting cursor after the last page")
+
+	_, _, err = Paginate(ll, Query{Sort: "foo"})
+	assert(t, err != nil, "expecting error on unknown sort field")
+
+	_, _, err = Paginate(ll, Query{Cursor: "%%%"})
+	assert(t, err == InvalidCursor, "expecting invalid cursor error")
+}
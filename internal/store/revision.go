@@ -0,0 +1,117 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+type (
+	// Revision is a numbered snapshot of a permit, taken after each mutation
+	Revision struct {
+		Number int       `json:"number"`
+		Time   time.Time `json:"time"`
+		Actor  string    `json:"actor"`
+		Action string    `json:"action"`
+
+		// State of the permit after the mutation, nil when permit was deleted
+		Permit *permit.Permit `json:"permit"`
+	}
+
+	// Trashed is a deleted permit, kept until restored or purged
+	Trashed struct {
+		Permit  permit.Permit `json:"permit"`
+		Deleted time.Time     `json:"deleted"`
+		Actor   string        `json:"actor"`
+	}
+
+	// Change of a single permit field
+	Change struct {
+		Field string `json:"field"`
+		Old   string `json:"old,omitempty"`
+		New   string `json:"new,omitempty"`
+	}
+)
+
+// Mutations, recorded in revisions
+const (
+	ActionCreate   = "create"
+	ActionUpdate   = "update"
+	ActionRevoke   = "revoke"
+	ActionEnable   = "enable"
+	ActionExtend   = "extend"
+	ActionDelete   = "delete"
+	ActionRollback = "rollback"
+	ActionRestore  = "restore"
+	ActionPurge    = "purge"
+	ActionImport   = "import"
+	ActionRepair   = "repair"
+)
+
+var (
+	RevisionNotFound = errors.New("revision not found")
+	RevisionMismatch = errors.New("permit was modified in the meantime, revision does not match")
+)
+
+// Diff lists changed fields between two states of a permit
+//
+// Any of the states can be nil (permit did not exist or was removed).
+func Diff(a, b *permit.Permit) (cc []Change) {
+	var (
+		fa, fb = flatten(a), flatten(b)
+		ff     = make([]string, 0, len(fa)+len(fb))
+	)
+
+	for f := range fa {
+		ff = append(ff, f)
+	}
+
+	for f := range fb {
+		if _, has := fa[f]; !has {
+			ff = append(ff, f)
+		}
+	}
+
+	sort.Strings(ff)
+
+	for _, f := range ff {
+		if fa[f] != fb[f] {
+			cc = append(cc, Change{Field: f, Old: fa[f], New: fb[f]})
+		}
+	}
+
+	return
+}
+
+// flatten converts permit to field-value pairs
+func flatten(p *permit.Permit) map[string]string {
+	var ff = map[string]string{}
+
+	if p == nil {
+		return ff
+	}
+
+	ff["version"] = strconv.FormatUint(uint64(p.Version), 10)
+	ff["key"] = p.Key
+	ff["domain"] = p.Domain
+	ff["valid"] = strconv.FormatBool(p.Valid)
+	ff["contact"] = p.Contact
+	ff["entity"] = p.Entity
+	ff["plan"] = p.Plan
+	ff["issued"] = p.Issued.Format(time.RFC3339)
+
+	if p.Expires != nil {
+		ff["expires"] = p.Expires.Format(time.RFC3339)
+	}
+
+	for name, value := range p.Attributes {
+		ff[fmt.Sprintf("attributes.%s", name)] = strconv.Itoa(value)
+	}
+
+	return ff
+}
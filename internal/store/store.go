@@ -0,0 +1,47 @@
+package store
+
+import (
+	"time"
+
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+type (
+	// Storage is implemented by every permit store backend
+	//
+	// Decorators (audit log...) embed it and override only what they need.
+	// Consumers should keep declaring their own (narrower) interfaces.
+	Storage interface {
+		List(q Query) ([]*permit.Permit, string, error)
+		Get(key string) (*permit.Permit, error)
+		FindByDomain(domain string) ([]*permit.Permit, error)
+		Create(ctx context.Context, p permit.Permit) error
+		Update(ctx context.Context, key string, p Patch) error
+		Revoke(ctx context.Context, key string) error
+		Enable(ctx context.Context, key string) error
+		Extend(ctx context.Context, key string, t *time.Time) error
+		Delete(ctx context.Context, key string) error
+		History(key string) ([]Revision, error)
+		Rollback(ctx context.Context, key string, number int) error
+		Trash() ([]Trashed, error)
+		Restore(ctx context.Context, key string) error
+		Purge(ctx context.Context, before time.Time) ([]string, error)
+		Snapshot(fn func() error) error
+		Import(ctx context.Context, r Record) error
+		Reencrypt(keyID string) (int, error)
+
+		// Generation changes whenever the store is modified, by this or any other process
+		Generation() (uint64, error)
+
+		// Watch emits changes made after the call until ctx is done
+		Watch(ctx context.Context) <-chan Event
+
+		// Events returns up to limit recorded changes with sequence after since
+		// and sequence of the latest change
+		Events(since uint64, limit int) ([]Event, uint64, error)
+
+		// Check looks for damaged or inconsistent data and optionally repairs it
+		Check(ctx context.Context, opt CheckOptions) ([]Problem, error)
+	}
+)
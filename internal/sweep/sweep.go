@@ -0,0 +1,398 @@
+package sweep
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/internal/envelope"
+	"github.com/crusttech/permit/internal/store"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+// Expiry sweeper
+//
+// Trials that expired more than TrialDays ago are archived (full record is
+// appended to an archive file and permit is moved to trash) or deleted
+// (moved to trash). Paid permits that expired more than PaidDays ago are
+// flagged in the report for a follow-up. Permits deleted more than TrashDays
+// ago (by the sweeper or anyone else) are purged from trash.
+//
+// Permits issued before plans were recorded have no plan; those issued for
+// at most trialLength are taken for trials, as that is how trials were issued.
+//
+// Archived records hold full permits and are sealed with the store's keyring
+// when encryption is enabled.
+
+type (
+	Policy struct {
+		// ActionArchive, ActionDelete or ActionNone
+		TrialAction string `json:"trialAction"`
+		TrialDays   int    `json:"trialDays"`
+
+		// Paid permits expired longer than this are flagged, 0 disables flagging
+		PaidDays int `json:"paidDays"`
+
+		// Permits in trash longer than this are purged, 0 disables purging
+		TrashDays int `json:"trashDays"`
+
+		// JSONL file archived records are appended to
+		ArchivePath string `json:"archivePath,omitempty"`
+
+		// Archived records are sealed with the active key when set
+		Keyring *envelope.Keyring `json:"-"`
+	}
+
+	Report struct {
+		Started  time.Time `json:"started"`
+		Finished time.Time `json:"finished"`
+		DryRun   bool      `json:"dryRun"`
+		Policy   Policy    `json:"policy"`
+
+		Archived []Item   `json:"archived"`
+		Deleted  []Item   `json:"deleted"`
+		Flagged  []Item   `json:"flagged"`
+		Purged   []string `json:"purged"`
+		Errors   []string `json:"errors"`
+	}
+
+	Item struct {
+		Key     string    `json:"key"`
+		Domain  string    `json:"domain"`
+		Plan    string    `json:"plan"`
+		Expired time.Time `json:"expired"`
+	}
+
+	target interface {
+		List(q store.Query) ([]*permit.Permit, string, error)
+		Get(key string) (*permit.Permit, error)
+		Trash() ([]store.Trashed, error)
+		History(key string) ([]store.Revision, error)
+		Delete(ctx context.Context, key string) error
+		Purge(ctx context.Context, before time.Time) ([]string, error)
+	}
+)
+
+const (
+	ActionNone    = "none"
+	ActionArchive = "archive"
+	ActionDelete  = "delete"
+
+	// Sweeper makes all changes under this actor
+	actor = "sweeper"
+
+	// Trials were issued for 14 days, counted from midnight after issue by the API
+	trialLength = 15 * 24 * time.Hour
+)
+
+// Validate checks policy values
+func (p Policy) Validate() error {
+	switch p.TrialAction {
+	case ActionNone, ActionDelete:
+	case ActionArchive:
+		if p.ArchivePath == "" {
+			return errors.New("archive path is required to archive trials")
+		}
+	default:
+		return errors.Errorf("unknown trial action %q", p.TrialAction)
+	}
+
+	if p.TrialDays < 0 || p.PaidDays < 0 || p.TrashDays < 0 {
+		return errors.New("number of days can not be negative")
+	}
+
+	return nil
+}
+
+// Run applies policy to all permits that expired before now
+//
+// Failures on single permits are collected in the report and do not stop the run.
+func Run(ctx context.Context, s target, p Policy, now time.Time, dryRun bool) (*Report, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	var (
+		rpt = &Report{
+			Started:  time.Now(),
+			DryRun:   dryRun,
+			Policy:   p,
+			Archived: []Item{},
+			Deleted:  []Item{},
+			Flagged:  []Item{},
+			Purged:   []string{},
+			Errors:   []string{},
+		}
+	)
+
+	ctx = context.WithActor(ctx, actor)
+
+	ll, _, err := s.List(store.Query{ExpiresBefore: &now, Sort: "expires"})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list expired permits")
+	}
+
+	for _, l := range ll {
+		var (
+			plan = planOf(l)
+			item = Item{Key: l.Key, Domain: l.Domain, Plan: plan, Expired: *l.Expires}
+			days = int(now.Sub(*l.Expires).Hours() / 24)
+		)
+
+		switch {
+		case plan == permit.PlanTrial && p.TrialAction != ActionNone && days >= p.TrialDays:
+			if err = sweepTrial(ctx, s, p, l.Key, dryRun); err != nil {
+				rpt.Errors = append(rpt.Errors, errors.Wrapf(err, "could not %s %s", p.TrialAction, l.Key).Error())
+			} else if p.TrialAction == ActionArchive {
+				rpt.Archived = append(rpt.Archived, item)
+			} else {
+				rpt.Deleted = append(rpt.Deleted, item)
+			}
+
+		case plan != permit.PlanTrial && p.PaidDays > 0 && days >= p.PaidDays:
+			rpt.Flagged = append(rpt.Flagged, item)
+		}
+	}
+
+	if p.TrashDays > 0 {
+		kk, err := purge(ctx, s, now.AddDate(0, 0, -p.TrashDays), dryRun)
+		if err != nil {
+			rpt.Errors = append(rpt.Errors, errors.Wrap(err, "could not purge trash").Error())
+		}
+
+		// Keys purged before a failure are reported too
+		rpt.Purged = append(rpt.Purged, kk...)
+	}
+
+	rpt.Finished = time.Now()
+	return rpt, nil
+}
+
+// planOf returns permit's plan, inferred from its length when it has none
+func planOf(l *permit.Permit) string {
+	switch {
+	case l.Plan != "":
+		return l.Plan
+	case l.Expires == nil:
+		return permit.PlanUnlimited
+	case l.Expires.Sub(l.Issued) <= trialLength:
+		return permit.PlanTrial
+	default:
+		return permit.PlanStandard
+	}
+}
+
+// Save writes report as JSON file into the directory
+func (r Report) Save(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", errors.Wrap(err, "could not create report directory")
+	}
+
+	enc, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, "sweep-"+r.Started.Format("20060102T150405")+".json")
+	return path, errors.Wrap(ioutil.WriteFile(path, enc, 0644), "could not write report")
+}
+
+func sweepTrial(ctx context.Context, s target, p Policy, key string, dryRun bool) error {
+	if dryRun {
+		return nil
+	}
+
+	if p.TrialAction == ActionArchive {
+		r, err := store.Fetch(s, key)
+		if err != nil {
+			return err
+		}
+
+		if r != nil {
+			if err = archive(p.ArchivePath, p.Keyring, *r); err != nil {
+				return err
+			}
+		}
+	}
+
+	return s.Delete(ctx, key)
+}
+
+// purge removes permits deleted before the given time, returns their keys
+//
+// Dry run only lists them.
+func purge(ctx context.Context, s target, before time.Time, dryRun bool) (kk []string, err error) {
+	if !dryRun {
+		return s.Purge(ctx, before)
+	}
+
+	tt, err := s.Trash()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range tt {
+		if t.Deleted.Before(before) {
+			kk = append(kk, t.Permit.Key)
+		}
+	}
+
+	return
+}
+
+// archive appends record to the archive file
+func archive(path string, keyring *envelope.Keyring, r store.Record) error {
+	enc, err := encode(r, keyring, keyring.Active())
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.Wrap(err, "could not create archive directory")
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrap(err, "could not open archive")
+	}
+
+	if _, err = f.Write(enc); err != nil {
+		f.Close()
+		return errors.Wrap(err, "could not write archive")
+	}
+
+	return errors.Wrap(f.Close(), "could not write archive")
+}
+
+// ReadArchive calls fn for each of the archived records
+func ReadArchive(path string, keyring *envelope.Keyring, fn func(store.Record) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "could not open archive")
+	}
+
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 16*1024*1024)
+
+	for s.Scan() {
+		var r store.Record
+
+		line, err := keyring.Open(s.Bytes())
+		if err != nil {
+			return errors.Wrap(err, "could not decrypt archived record")
+		}
+
+		if err = json.Unmarshal(line, &r); err != nil {
+			return errors.Wrap(err, "could not decode archived record")
+		}
+
+		if err = fn(r); err != nil {
+			return err
+		}
+	}
+
+	return errors.Wrap(s.Err(), "could not read archive")
+}
+
+// Reencrypt seals all archived records with the given (or active) key, returns number of records re-encrypted
+//
+// Archive is rewritten next to the original and renamed over it, sweeper
+// should not run at the same time.
+func Reencrypt(path string, keyring *envelope.Keyring, keyID string) (n int, err error) {
+	if keyring == nil {
+		return 0, errors.New("no master keys configured")
+	}
+
+	if keyID == "" {
+		keyID = keyring.Active()
+	}
+
+	tmp, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not create archive")
+	}
+
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	w := bufio.NewWriter(tmp)
+	err = ReadArchive(path, keyring, func(r store.Record) error {
+		enc, err := encode(r, keyring, keyID)
+		if err != nil {
+			return err
+		}
+
+		n++
+		_, err = w.Write(enc)
+		return errors.Wrap(err, "could not write archive")
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	if err = w.Flush(); err != nil {
+		return 0, errors.Wrap(err, "could not write archive")
+	}
+
+	if err = tmp.Sync(); err != nil {
+		return 0, errors.Wrap(err, "could not sync archive")
+	}
+
+	return n, errors.Wrap(os.Rename(tmp.Name(), path), "could not replace archive")
+}
+
+// encode encodes record as a line of the archive, sealed when keyring is set
+func encode(r store.Record, keyring *envelope.Keyring, keyID string) ([]byte, error) {
+	enc, err := json.Marshal(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not encode record")
+	}
+
+	if keyring != nil {
+		if enc, err = keyring.SealWith(keyID, enc); err != nil {
+			return nil, errors.Wrap(err, "could not encrypt record")
+		}
+
+		// Sealed payload is a single line of JSON
+		enc = bytes.TrimRight(enc, "\n")
+	}
+
+	return append(enc, '\n'), nil
+}
+
+// Schedule runs sweeper every interval until context is cancelled
+//
+// Reports are saved into reportDir.
+func Schedule(ctx context.Context, s target, p Policy, interval time.Duration, reportDir string) {
+	var log = context.Log(ctx)
+
+	for {
+		if rpt, err := Run(ctx, s, p, time.Now(), false); err != nil {
+			log.Error("sweep failed: " + err.Error())
+		} else if path, err := rpt.Save(reportDir); err != nil {
+			log.Error("could not save sweep report: " + err.Error())
+		} else {
+			log.Info(fmt.Sprintf(
+				"sweep finished, %d archived, %d deleted, %d flagged, %d purged, %d errors, report in %s",
+				len(rpt.Archived), len(rpt.Deleted), len(rpt.Flagged), len(rpt.Purged), len(rpt.Errors), path,
+			))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package sweep
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/crusttech/permit/internal/context"
+	"github.com/crusttech/permit/internal/envelope"
+	"github.com/crusttech/permit/internal/store"
+	"github.com/crusttech/permit/internal/store/fs"
+	"github.com/crusttech/permit/pkg/permit"
+)
+
+func assert(t *testing.T, ok bool, format string, args ...interface{}) bool {
+	if !ok {
+		t.Fatalf(format, args...)
+	}
+	return ok
+}
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "permit-sweep-")
+	assert(t, err == nil, "could not create temp dir: %v", err)
+	defer os.RemoveAll(dir)
+
+	assert(t, os.Mkdir(filepath.Join(dir, "storage"), 0755) == nil, "could not create storage dir")
+
+	s, err := fs.NewPermitStorage(filepath.Join(dir, "storage"))
+	assert(t, err == nil, "could not create storage: %v", err)
+
+	var (
+		ctx    = context.Background()
+		now    = time.Now().Truncate(time.Second)
+		policy = Policy{
+			TrialAction: ActionArchive,
+			TrialDays:   7,
+			PaidDays:    30,
+			ArchivePath: filepath.Join(dir, "archive.jsonl"),
+		}
+		create = func(key, plan string, expired int) {
+			exp := now.AddDate(0, 0, -expired)
+			p := permit.Permit{Key: key, Domain: "example.tld", Plan: plan, Valid: true, Issued: now, Expires: &exp}
+			assert(t, s.Create(ctx, p) == nil, "could not create permit %s", key)
+		}
+	)
+
+	create("trial-old", permit.PlanTrial, 10)
+	create("trial-recent", permit.PlanTrial, 3)
+	create("trial-active", permit.PlanTrial, -5)
+	create("paid-old", permit.PlanStandard, 40)
+	create("paid-recent", permit.PlanStandard, 10)
+
+	// Issued before plans were recorded, 14 day trial and a yearly permit
+	for key, length := range map[string]int{"legacy-trial": 14, "legacy-paid": 365} {
+		exp := now.AddDate(0, 0, -50)
+		p := permit.Permit{Key: key, Domain: "example.tld", Valid: true, Issued: exp.AddDate(0, 0, -length), Expires: &exp}
+		assert(t, s.Create(ctx, p) == nil, "could not create permit %s", key)
+	}
+
+	rpt, err := Run(ctx, s, policy, now, true)
+	assert(t, err == nil, "unexpected sweep error: %v", err)
+	assert(t, len(rpt.Archived) == 2 && rpt.Archived[0].Key == "legacy-trial" && rpt.Archived[1].Key == "trial-old", "unexpected archived list: %+v", rpt.Archived)
+	assert(t, rpt.Archived[0].Plan == permit.PlanTrial, "expecting plan of legacy trial to be inferred, got %q", rpt.Archived[0].Plan)
+	assert(t, len(rpt.Flagged) == 2 && rpt.Flagged[0].Key == "legacy-paid" && rpt.Flagged[1].Key == "paid-old", "unexpected flagged list: %+v", rpt.Flagged)
+
+	_, err = s.Get("trial-old")
+	assert(t, err == nil, "expecting dry run to leave permits untouched, got %v", err)
+
+	rpt, err = Run(ctx, s, policy, now, false)
+	assert(t, err == nil && len(rpt.Errors) == 0, "unexpected sweep error: %v (%v)", err, rpt.Errors)
+
+	_, err = s.Get("trial-old")
+	assert(t, err == permit.PermitDeleted, "expecting archived trial in trash, got %v", err)
+
+	f, err := os.Open(policy.ArchivePath)
+	assert(t, err == nil, "could not open archive: %v", err)
+	defer f.Close()
+
+	lines := 0
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		lines++
+	}
+	assert(t, lines == 2, "expecting two archived records, got %d", lines)
+
+	path, err := rpt.Save(filepath.Join(dir, "reports"))
+	assert(t, err == nil, "could not save report: %v", err)
+	_, err = os.Stat(path)
+	assert(t, err == nil, "expecting report file: %v", err)
+
+	// Second run has nothing left to archive
+	rpt, err = Run(ctx, s, policy, now, false)
+	assert(t, err == nil && len(rpt.Archived) == 0 && len(rpt.Flagged) == 2, "unexpected report: %v (%+v)", err, rpt)
+
+	// Archived trials are purged once they are in trash longer than retention
+	purge := Policy{TrialAction: ActionNone, TrashDays: 1}
+	rpt, err = Run(ctx, s, purge, now.AddDate(0, 0, 2), true)
+	assert(t, err == nil && len(rpt.Purged) == 2, "expecting 2 permits to be purged in dry run, got %v (%v)", rpt.Purged, err)
+
+	rpt, err = Run(ctx, s, purge, now.AddDate(0, 0, 2), false)
+	assert(t, err == nil && len(rpt.Purged) == 2 && len(rpt.Errors) == 0, "expecting 2 purged permits, got %v (%v, %v)", rpt.Purged, err, rpt.Errors)
+
+	_, err = s.Get("trial-old")
+	assert(t, err == permit.PermitNotFound, "expecting purged trial to be gone, got %v", err)
+
+	_, err = Run(ctx, s, Policy{TrialAction: "shred"}, now, false)
+	assert(t, err != nil, "expecting invalid policy to fail")
+}
+
+func TestEncryptedArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "permit-sweep-")
+	assert(t, err == nil, "could not create temp dir: %v", err)
+	defer os.RemoveAll(dir)
+
+	var (
+		path = filepath.Join(dir, "archive.jsonl")
+		keys = map[string][]byte{
+			"k1": []byte("0123456789abcdef0123456789abcdef"),
+			"k2": []byte("abcdefghijklmnopqrstuvwxyzabcdef"),
+		}
+		p = permit.Permit{Key: "secret-key", Contact: "admin@example.tld"}
+	)
+
+	k1, _ := envelope.NewKeyring("k1", keys)
+
+	// Records archived before encryption was enabled are kept as they are
+	assert(t, archive(path, nil, store.Record{Key: "plain-key"}) == nil, "could not archive record")
+	assert(t, archive(path, k1, store.Record{Key: p.Key, Permit: &p}) == nil, "could not archive record")
+
+	raw, _ := ioutil.ReadFile(path)
+	assert(t, !bytes.Contains(raw, []byte(p.Key)) && !bytes.Contains(raw, []byte(p.Contact)), "expecting sealed records:\n%s", raw)
+
+	n, err := Reencrypt(path, k1, "k2")
+	assert(t, err == nil && n == 2, "expecting 2 re-encrypted records, got %d (%v)", n, err)
+
+	// Old master key is retired
+	k2, _ := envelope.NewKeyring("k2", map[string][]byte{"k2": keys["k2"]})
+
+	var rr []store.Record
+	err = ReadArchive(path, k2, func(r store.Record) error {
+		rr = append(rr, r)
+		return nil
+	})
+
+	assert(t, err == nil && len(rr) == 2 && rr[1].Permit.Contact == p.Contact, "expecting 2 decrypted records, got %v (%v)", rr, err)
+	assert(t, ReadArchive(path, nil, func(store.Record) error { return nil }) != nil, "expecting error reading sealed records without keys")
+}
@@ -0,0 +1,383 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/crusttech/permit/internal/lockfile"
+)
+
+// Admin user accounts
+//
+// Users log in with a password (bcrypt hash is stored) and get short-lived
+// access tokens with scopes of their roles, and a refresh token. Refresh
+// tokens are stored hashed, can be used once and are dropped when password
+// changes or user is disabled.
+
+type (
+	Store struct {
+		path string
+	}
+
+	User struct {
+		Name     string    `json:"name"`
+		Hash     string    `json:"hash"`
+		Roles    []string  `json:"roles"`
+		Disabled bool      `json:"disabled"`
+		Created  time.Time `json:"created"`
+		Updated  time.Time `json:"updated"`
+
+		Refresh []refresh `json:"refresh,omitempty"`
+	}
+
+	refresh struct {
+		// SHA-256 of the token
+		Hash    string    `json:"hash"`
+		Expires time.Time `json:"expires"`
+	}
+)
+
+const (
+	usersFile = "users.json"
+	lockFile  = "users.lock"
+
+	lockTimeout = 5 * time.Second
+
+	minPasswordLen = 8
+	refreshLen     = 32
+	bcryptCost     = 12
+)
+
+// Roles and scopes they grant
+var Roles = map[string][]string{
+	"admin":  {"permit:admin"},
+	"issuer": {"permit:issue", "permit:read"},
+	"reader": {"permit:read"},
+}
+
+var (
+	UserNotFound       = errors.New("user not found")
+	UserExists         = errors.New("user already exists")
+	UserDisabled       = errors.New("user disabled")
+	InvalidCredentials = errors.New("invalid username or password")
+	InvalidRefresh     = errors.New("invalid or expired refresh token")
+	WeakPassword       = errors.Errorf("password must be at least %d characters long", minPasswordLen)
+
+	nameCheck = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._@-]{0,63}$`)
+
+	dummyOnce sync.Once
+	dummyHash []byte
+)
+
+// NewStore keeps users in the directory
+func NewStore(path string) (*Store, error) {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, errors.Wrap(err, "could not create users directory")
+	}
+
+	return &Store{path: path}, nil
+}
+
+// Scopes returns all scopes granted by user's roles
+func (u User) Scopes() (ss []string) {
+	var seen = map[string]bool{}
+
+	for _, r := range u.Roles {
+		for _, s := range Roles[r] {
+			if !seen[s] {
+				seen[s] = true
+				ss = append(ss, s)
+			}
+		}
+	}
+
+	sort.Strings(ss)
+	return
+}
+
+// List returns all users, sorted by name
+func (s Store) List() ([]User, error) {
+	uu, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+
+	ll := make([]User, 0, len(uu))
+	for _, u := range uu {
+		u.Refresh = nil
+		ll = append(ll, *u)
+	}
+
+	sort.Slice(ll, func(i, j int) bool { return ll[i].Name < ll[j].Name })
+	return ll, nil
+}
+
+// Add creates new user
+func (s Store) Add(name, password string, roles []string) error {
+	if !nameCheck.MatchString(name) {
+		return errors.Errorf("invalid user name %q", name)
+	}
+
+	if err := validateRoles(roles); err != nil {
+		return err
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	return s.update(func(uu map[string]*User) error {
+		if _, has := uu[name]; has {
+			return UserExists
+		}
+
+		now := time.Now().Truncate(time.Second)
+		uu[name] = &User{Name: name, Hash: hash, Roles: roles, Created: now, Updated: now}
+		return nil
+	})
+}
+
+// Passwd changes user's password and drops all refresh tokens
+func (s Store) Passwd(name, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	return s.modify(name, func(u *User) error {
+		u.Hash, u.Refresh = hash, nil
+		return nil
+	})
+}
+
+// SetDisabled disables or enables user, disabling drops all refresh tokens
+func (s Store) SetDisabled(name string, disabled bool) error {
+	return s.modify(name, func(u *User) error {
+		u.Disabled = disabled
+		if disabled {
+			u.Refresh = nil
+		}
+
+		return nil
+	})
+}
+
+// Login checks credentials and issues refresh token valid for ttl
+func (s Store) Login(name, password string, ttl time.Duration) (*User, string, error) {
+	uu, err := s.read()
+	if err != nil {
+		return nil, "", err
+	}
+
+	u, has := uu[name]
+	if !has {
+		// Same work as for existing users, so response time does not reveal them
+		dummyOnce.Do(func() { dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcryptCost) })
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, "", InvalidCredentials
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(u.Hash), []byte(password)) != nil {
+		return nil, "", InvalidCredentials
+	}
+
+	if u.Disabled {
+		return nil, "", UserDisabled
+	}
+
+	return s.issue(name, "", ttl)
+}
+
+// Refresh exchanges refresh token for a new one
+//
+// Token can be used only once.
+func (s Store) Refresh(token string, ttl time.Duration) (*User, string, error) {
+	uu, err := s.read()
+	if err != nil {
+		return nil, "", err
+	}
+
+	hash := hashToken(token)
+	for name, u := range uu {
+		for _, r := range u.Refresh {
+			if r.Hash == hash {
+				return s.issue(name, hash, ttl)
+			}
+		}
+	}
+
+	return nil, "", InvalidRefresh
+}
+
+// issue adds new refresh token to the user, replacing the used one
+func (s Store) issue(name, used string, ttl time.Duration) (u *User, token string, err error) {
+	if token, err = randomToken(); err != nil {
+		return nil, "", err
+	}
+
+	err = s.modify(name, func(m *User) error {
+		var (
+			now = time.Now()
+			rr  = []refresh{{Hash: hashToken(token), Expires: now.Add(ttl)}}
+			ok  = used == ""
+		)
+
+		if m.Disabled {
+			return UserDisabled
+		}
+
+		for _, r := range m.Refresh {
+			if r.Hash == used {
+				ok = r.Expires.After(now)
+			} else if r.Expires.After(now) {
+				rr = append(rr, r)
+			}
+		}
+
+		if !ok {
+			return InvalidRefresh
+		}
+
+		m.Refresh = rr
+		u = m
+		return nil
+	})
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return u, token, nil
+}
+
+func (s Store) modify(name string, fn func(*User) error) error {
+	return s.update(func(uu map[string]*User) error {
+		u, has := uu[name]
+		if !has {
+			return UserNotFound
+		}
+
+		if err := fn(u); err != nil {
+			return err
+		}
+
+		u.Updated = time.Now().Truncate(time.Second)
+		return nil
+	})
+}
+
+// update changes users under lock shared by all processes
+func (s Store) update(fn func(map[string]*User) error) error {
+	release, err := lockfile.Acquire(filepath.Join(s.path, lockFile), lockTimeout)
+	if err != nil {
+		return errors.Wrap(err, "could not lock users")
+	}
+
+	defer release()
+
+	uu, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	if err = fn(uu); err != nil {
+		return err
+	}
+
+	return s.write(uu)
+}
+
+func (s Store) read() (map[string]*User, error) {
+	var uu = map[string]*User{}
+
+	data, err := ioutil.ReadFile(filepath.Join(s.path, usersFile))
+	if os.IsNotExist(err) {
+		return uu, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "could not read users")
+	}
+
+	return uu, errors.Wrap(json.Unmarshal(data, &uu), "could not decode users")
+}
+
+func (s Store) write(uu map[string]*User) error {
+	data, err := json.MarshalIndent(uu, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "could not encode users")
+	}
+
+	f, err := ioutil.TempFile(s.path, usersFile)
+	if err != nil {
+		return errors.Wrap(err, "could not write users")
+	}
+
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(s.path, usersFile))
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, "could not write users")
+	}
+
+	return nil
+}
+
+func validateRoles(roles []string) error {
+	if len(roles) == 0 {
+		return errors.New("at least one role is required")
+	}
+
+	for _, r := range roles {
+		if _, has := Roles[r]; !has {
+			return errors.Errorf("unknown role %q", r)
+		}
+	}
+
+	return nil
+}
+
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLen {
+		return "", WeakPassword
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	return string(hash), errors.Wrap(err, "could not hash password")
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, refreshLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "could not generate token")
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,57 @@
+package users
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func assert(t *testing.T, ok bool, format string, args ...interface{}) bool {
+	if !ok {
+		t.Fatalf(format, args...)
+	}
+	return ok
+}
+
+func TestLoginRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "permit-users-")
+	assert(t, err == nil, "could not create temp dir: %v", err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewStore(dir)
+	assert(t, err == nil, "could not create store: %v", err)
+
+	assert(t, s.Add("alice", "short", []string{"admin"}) == WeakPassword, "expecting weak password to be refused")
+	assert(t, s.Add("alice", "correct horse", []string{"root"}) != nil, "expecting unknown role to be refused")
+	assert(t, s.Add("alice", "correct horse", []string{"issuer"}) == nil, "could not add user")
+	assert(t, s.Add("alice", "correct horse", []string{"admin"}) == UserExists, "expecting duplicate user to be refused")
+
+	_, _, err = s.Login("alice", "wrong horse", time.Hour)
+	assert(t, err == InvalidCredentials, "expecting invalid credentials, got %v", err)
+
+	_, _, err = s.Login("bob", "correct horse", time.Hour)
+	assert(t, err == InvalidCredentials, "expecting invalid credentials for unknown user, got %v", err)
+
+	u, refresh, err := s.Login("alice", "correct horse", time.Hour)
+	assert(t, err == nil && refresh != "", "could not log in: %v", err)
+	assert(t, len(u.Scopes()) == 2, "unexpected scopes: %v", u.Scopes())
+
+	_, next, err := s.Refresh(refresh, time.Hour)
+	assert(t, err == nil && next != refresh, "could not refresh: %v", err)
+
+	_, _, err = s.Refresh(refresh, time.Hour)
+	assert(t, err == InvalidRefresh, "expecting used refresh token to be refused, got %v", err)
+
+	// Password change revokes all refresh tokens
+	assert(t, s.Passwd("alice", "battery staple") == nil, "could not change password")
+	_, _, err = s.Refresh(next, time.Hour)
+	assert(t, err == InvalidRefresh, "expecting refresh token to be revoked, got %v", err)
+
+	assert(t, s.SetDisabled("alice", true) == nil, "could not disable user")
+	_, _, err = s.Login("alice", "battery staple", time.Hour)
+	assert(t, err == UserDisabled, "expecting disabled user to be refused, got %v", err)
+
+	uu, err := s.List()
+	assert(t, err == nil && len(uu) == 1 && uu[0].Disabled && uu[0].Refresh == nil, "unexpected users: %+v", uu)
+}
@@ -0,0 +1,56 @@
+package permit
+
+import (
+	"time"
+)
+
+type (
+	// CheckResponse is v2 check response envelope
+	CheckResponse struct {
+		Status     string    `json:"status"`
+		Reason     string    `json:"reason,omitempty"`
+		Code       string    `json:"code,omitempty"`
+		Message    string    `json:"message,omitempty"`
+		Warnings   []string  `json:"warnings"`
+		ServerTime time.Time `json:"serverTime"`
+		Permit     *Permit   `json:"permit,omitempty"`
+	}
+)
+
+const (
+	// Response header with API version of the check response
+	VersionHeader = "Permit-Api-Version"
+
+	CheckValid   = "valid"
+	CheckInvalid = "invalid"
+	CheckError   = "error"
+
+	// Reasons of invalid and failed checks
+	ReasonNotFound       = "permit-not-found"
+	ReasonNotValid       = "permit-not-valid"
+	ReasonInvalidDomain  = "invalid-domain"
+	ReasonInvalidRequest = "invalid-request"
+	ReasonServerError    = "server-error"
+
+	// Warnings about valid permits
+	WarningExpiresSoon = "expires-soon"
+	WarningTrial       = "trial"
+
+	// Permits expiring sooner than this get a warning
+	ExpiresSoon = 30 * 24 * time.Hour
+)
+
+// Warnings lists what the permit holder should know about
+func (p Permit) Warnings(now time.Time) []string {
+	ww := []string{}
+
+	if p.Expires != nil && p.Expires.Sub(now) < ExpiresSoon {
+		ww = append(ww, WarningExpiresSoon)
+	}
+
+	if p.Plan == PlanTrial {
+		ww = append(ww, WarningTrial)
+	}
+
+	return ww
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"io/ioutil"
 	"net/http"
 
 	"github.com/pkg/errors"
@@ -16,13 +17,17 @@ type (
 )
 
 const (
-	permitCheckEndpoint = "https://permit.crust.tech/check"
+	permitCheckEndpoint   = "https://permit.crust.tech/check"
+	permitCheckEndpointV2 = "https://permit.crust.tech/v2/check"
+
+	requestIDHeader = "request-id"
 )
 
 func Check(ctx context.Context, p Permit) (*Permit, error) {
 	return CheckWithClient(ctx, http.DefaultClient, p)
 }
 
+// CheckWithClient checks permit with v2 API, falling back to v1 on servers without it
 func CheckWithClient(ctx context.Context, client httpClient, p Permit) (*Permit, error) {
 	if len(p.Key) == 0 {
 		return nil, errors.New("key not set")
@@ -35,36 +40,131 @@ func CheckWithClient(ctx context.Context, client httpClient, p Permit) (*Permit,
 		return nil, errors.Wrap(err, "permit encoding failed")
 	}
 
-	if req, err := http.NewRequest("POST", permitCheckEndpoint, buf); err != nil {
-		return nil, errors.Wrap(err, "unable to create request")
-	} else {
-		return CheckWithRequest(client, req.WithContext(ctx))
+	for _, endpoint := range []string{permitCheckEndpointV2, permitCheckEndpoint} {
+		req, err := http.NewRequest("POST", endpoint, bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to create request")
+		}
+
+		rsp, err := check(client, req.WithContext(ctx))
+		if err == errNoV2 {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		return rsp.permit()
 	}
+
+	return nil, errors.New("subscription key not found")
 }
 
+// CheckWithRequest sends prepared check request, v1 or v2 response is decoded
 func CheckWithRequest(client httpClient, request *http.Request) (p *Permit, err error) {
-	var rsp *http.Response
-	if rsp, err = client.Do(request); err != nil {
+	rsp, err := check(client, request)
+	if err == errNoV2 {
+		return nil, errors.New("subscription key not found")
+	} else if err != nil {
+		return nil, err
+	}
+
+	return rsp.permit()
+}
+
+// errNoV2 is returned when server does not know v2 check endpoint
+var errNoV2 = errors.New("v2 check not supported")
+
+// check sends request and converts v1 responses into v2 envelope
+//
+// Responses with error codes are returned as *Error.
+func check(client httpClient, request *http.Request) (*CheckResponse, error) {
+	rsp, err := client.Do(request)
+	if err != nil {
 		return nil, errors.Wrap(err, "unable to fetch permit")
 	}
 
 	defer rsp.Body.Close()
 
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read response")
+	}
+
+	var requestID = rsp.Header.Get(requestIDHeader)
+
+	if rsp.Header.Get(VersionHeader) == "2" {
+		cr := &CheckResponse{}
+		if err = json.Unmarshal(body, cr); err != nil {
+			return nil, errors.Wrap(err, "unable to decode check response")
+		}
+
+		if cr.Status != CheckValid && cr.Code != "" {
+			return nil, &Error{Code: cr.Code, Message: cr.Message, RequestID: requestID, Status: rsp.StatusCode}
+		}
+
+		return cr, nil
+	}
+
+	if rsp.StatusCode >= http.StatusBadRequest {
+		e := &Error{}
+		if json.Unmarshal(body, e) == nil && e.Code != "" {
+			if e.RequestID == "" {
+				e.RequestID = requestID
+			}
+
+			e.Status = rsp.StatusCode
+			return nil, e
+		}
+	}
+
+	cr := &CheckResponse{Status: CheckInvalid}
+
 	switch rsp.StatusCode {
 	case http.StatusBadRequest:
-		return nil, errors.New("bad request")
+		cr.Reason = ReasonInvalidRequest
 	case http.StatusNotFound:
-		return nil, errors.New("subscription key not found")
+		if request.URL.String() == permitCheckEndpointV2 {
+			return nil, errNoV2
+		}
+
+		cr.Reason = ReasonNotFound
+	case http.StatusGone:
+		cr.Reason = ReasonNotFound
+		cr.Message = "subscription key deleted"
 	case http.StatusInternalServerError:
-		return nil, errors.New("subscription server error")
+		cr.Status, cr.Reason = CheckError, ReasonServerError
 	case http.StatusUnauthorized:
-		return nil, errors.New("subscription key invalid")
+		cr.Reason = ReasonNotValid
+	default:
+		cr.Status, cr.Permit = CheckValid, &Permit{}
+		if err = json.Unmarshal(body, cr.Permit); err != nil {
+			return nil, errors.Wrap(err, "unable to decode response into permit")
+		}
 	}
 
-	p = &Permit{}
-	if err = json.NewDecoder(rsp.Body).Decode(&p); err != nil {
-		return nil, errors.Wrap(err, "unable to decode response into permit")
+	return cr, nil
+}
+
+// permit returns valid permit or error describing why the check failed
+//
+// Used for responses without error codes, from servers that predate them.
+func (r CheckResponse) permit() (*Permit, error) {
+	if r.Status == CheckValid && r.Permit != nil {
+		return r.Permit, nil
+	}
+
+	if r.Message != "" && r.Reason == ReasonNotFound {
+		return nil, errors.New(r.Message)
 	}
 
-	return
+	switch r.Reason {
+	case ReasonInvalidRequest, ReasonInvalidDomain:
+		return nil, errors.New("bad request")
+	case ReasonNotFound:
+		return nil, errors.New("subscription key not found")
+	case ReasonServerError:
+		return nil, errors.New("subscription server error")
+	default:
+		return nil, errors.New("subscription key invalid")
+	}
 }
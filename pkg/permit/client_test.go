@@ -5,8 +5,10 @@ import (
 	"io/ioutil"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin/json"
+	"github.com/pkg/errors"
 
 	"github.com/crusttech/permit/internal/context"
 )
@@ -76,6 +78,9 @@ func TestCheckWithClient(t *testing.T) {
 	p, err = CheckWithClient(context.Background(), makeHttpClientMock(http.StatusNotFound, nil), tp)
 	assert(t, err != nil, "expecting error when not found")
 
+	p, err = CheckWithClient(context.Background(), makeHttpClientMock(http.StatusGone, nil), tp)
+	assert(t, err != nil, "expecting error when deleted")
+
 	p, err = CheckWithClient(context.Background(), makeHttpClientMock(http.StatusInternalServerError, nil), tp)
 	assert(t, err != nil, "expecting error on bad request")
 
@@ -83,3 +88,111 @@ func TestCheckWithClient(t *testing.T) {
 	assert(t, err != nil, "expecting error on bad request")
 
 }
+
+func TestCheckWithClientV2(t *testing.T) {
+	var (
+		key = "teCYbMI8vSvi8hKF3Jb23jyeEmI7xbybWSYJXv8TDBQqIfBhGWYuPguBsfhNGaPU"
+		tp  = Permit{Key: key, Domain: "example.tld"}
+
+		urls []string
+	)
+
+	envelope := func(code int, cr CheckResponse) httpClient {
+		return httpClientMock{
+			do: func(req *http.Request) (*http.Response, error) {
+				urls = append(urls, req.URL.String())
+				j, _ := json.Marshal(cr)
+
+				rsp := &http.Response{StatusCode: code, Body: ioutil.NopCloser(bytes.NewBuffer(j)), Header: make(http.Header)}
+				rsp.Header.Set(VersionHeader, "2")
+				return rsp, nil
+			},
+		}
+	}
+
+	p, err := CheckWithClient(context.Background(), envelope(http.StatusOK, CheckResponse{Status: CheckValid, Permit: &tp}), tp)
+	assert(t, err == nil, "unexpected error: %v", err)
+	assert(t, p != nil && p.Key == key, "expecting permit from envelope")
+	assert(t, len(urls) == 1 && urls[0] == permitCheckEndpointV2, "expecting single v2 request, got %v", urls)
+
+	_, err = CheckWithClient(context.Background(), envelope(http.StatusUnauthorized, CheckResponse{Status: CheckInvalid, Reason: ReasonNotFound}), tp)
+	assert(t, err != nil && err.Error() == "subscription key not found", "expecting not found error, got %v", err)
+
+	// Servers without v2 respond with 404 without version header
+	urls = nil
+	_, err = CheckWithClient(context.Background(), httpClientMock{
+		do: func(req *http.Request) (*http.Response, error) {
+			urls = append(urls, req.URL.String())
+
+			if req.URL.String() == permitCheckEndpointV2 {
+				return makeHttpClientMock(http.StatusNotFound, nil).Do(req)
+			}
+
+			return makeHttpClientMock(http.StatusOK, &tp).Do(req)
+		},
+	}, tp)
+	assert(t, err == nil, "unexpected error: %v", err)
+	assert(t, len(urls) == 2 && urls[1] == permitCheckEndpoint, "expecting fallback to v1, got %v", urls)
+}
+
+func TestWarnings(t *testing.T) {
+	var (
+		now  = time.Now()
+		soon = now.Add(24 * time.Hour)
+		late = now.Add(365 * 24 * time.Hour)
+	)
+
+	ww := Permit{Expires: &late, Plan: PlanStandard}.Warnings(now)
+	assert(t, len(ww) == 0, "expecting no warnings, got %v", ww)
+
+	ww = Permit{Expires: &soon, Plan: PlanTrial}.Warnings(now)
+	assert(t, len(ww) == 2 && ww[0] == WarningExpiresSoon && ww[1] == WarningTrial, "expecting expiry and trial warnings, got %v", ww)
+}
+
+func TestCheckErrorCodes(t *testing.T) {
+	var (
+		key = "teCYbMI8vSvi8hKF3Jb23jyeEmI7xbybWSYJXv8TDBQqIfBhGWYuPguBsfhNGaPU"
+		tp  = Permit{Key: key, Domain: "example.tld"}
+	)
+
+	respond := func(code int, body interface{}, header http.Header) httpClient {
+		return httpClientMock{
+			do: func(req *http.Request) (*http.Response, error) {
+				j, _ := json.Marshal(body)
+				return &http.Response{StatusCode: code, Body: ioutil.NopCloser(bytes.NewBuffer(j)), Header: header}, nil
+			},
+		}
+	}
+
+	_, err := CheckWithClient(context.Background(), respond(
+		http.StatusUnauthorized,
+		Error{Code: CodePermitExpired, Message: "permit expired", RequestID: "req-1"},
+		make(http.Header),
+	), tp)
+
+	e, ok := err.(*Error)
+	assert(t, ok, "expecting *Error, got %T", err)
+	assert(t, e.RequestID == "req-1" && e.Status == http.StatusUnauthorized, "unexpected error details: %+v", e)
+	assert(t, errors.Cause(err) == PermitExpired, "expecting PermitExpired, got %v", errors.Cause(err))
+
+	header := make(http.Header)
+	header.Set(VersionHeader, "2")
+	header.Set(requestIDHeader, "req-2")
+
+	_, err = CheckWithClient(context.Background(), respond(
+		http.StatusTooManyRequests,
+		CheckResponse{Status: CheckInvalid, Code: CodeRateLimited},
+		header,
+	), tp)
+
+	e, ok = err.(*Error)
+	assert(t, ok && e.RequestID == "req-2", "expecting *Error with request ID from header, got %v", err)
+	assert(t, errors.Cause(err) == RateLimited, "expecting RateLimited, got %v", errors.Cause(err))
+
+	err = &Error{Code: "SOMETHING_NEW"}
+	assert(t, errors.Cause(err) == ServerError, "expecting unknown code to be a server error")
+
+	for code, e := range catalog {
+		assert(t, ErrorCode(e) == code, "expecting %s for %v, got %s", code, e, ErrorCode(e))
+	}
+}
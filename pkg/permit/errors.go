@@ -0,0 +1,123 @@
+package permit
+
+import (
+	"github.com/pkg/errors"
+)
+
+type (
+	// Error is an error response of the permit API
+	//
+	// Code is one of the codes from the catalog below, Cause returns the
+	// typed error the code maps to (if any), so errors.Cause can be compared
+	// with PermitExpired, RateLimited and others.
+	Error struct {
+		Code      string `json:"code"`
+		Message   string `json:"message"`
+		RequestID string `json:"requestId,omitempty"`
+
+		// HTTP status the error was received with
+		Status int `json:"-"`
+	}
+)
+
+// Error codes
+//
+// Checks respond with KEY_NOT_FOUND to unknown keys and to keys issued for
+// other domains alike, so guessed keys can not be told apart.
+const (
+	CodeKeyNotFound      = "KEY_NOT_FOUND"
+	CodeKeyDeleted       = "KEY_DELETED"
+	CodeDomainMismatch   = "DOMAIN_MISMATCH"
+	CodeDomainTaken      = "DOMAIN_TAKEN"
+	CodePermitExpired    = "PERMIT_EXPIRED"
+	CodePermitRevoked    = "PERMIT_REVOKED"
+	CodeInvalidDomain    = "INVALID_DOMAIN"
+	CodeInvalidRequest   = "INVALID_REQUEST"
+	CodeRequestTooLarge  = "REQUEST_TOO_LARGE"
+	CodeUnauthorized     = "UNAUTHORIZED"
+	CodeForbidden        = "FORBIDDEN"
+	CodeRateLimited      = "RATE_LIMITED"
+	CodeClientBanned     = "CLIENT_BANNED"
+	CodeNotFound         = "NOT_FOUND"
+	CodeRevisionMismatch = "REVISION_MISMATCH"
+	CodeReadOnly         = "READ_ONLY"
+	CodeCursorExpired    = "CURSOR_EXPIRED"
+	CodeServerError      = "SERVER_ERROR"
+)
+
+var (
+	DomainMismatch   = errors.New("permit not valid for domain")
+	PermitExpired    = errors.New("permit expired")
+	PermitRevoked    = errors.New("permit revoked")
+	InvalidDomain    = errors.New("invalid domain")
+	InvalidRequest   = errors.New("bad request")
+	RequestTooLarge  = errors.New("request too large")
+	Unauthorized     = errors.New("not authenticated")
+	Forbidden        = errors.New("not allowed")
+	RateLimited      = errors.New("rate limit exceeded")
+	ClientBanned     = errors.New("client temporarily banned")
+	NotFound         = errors.New("not found")
+	RevisionMismatch = errors.New("permit was modified in the meantime")
+	ReadOnly         = errors.New("read-only replica")
+	CursorExpired    = errors.New("changes after the cursor were compacted away")
+	ServerError      = errors.New("subscription server error")
+
+	// Catalog maps error codes to typed errors
+	catalog = map[string]error{
+		CodeKeyNotFound:      PermitNotFound,
+		CodeKeyDeleted:       PermitDeleted,
+		CodeDomainMismatch:   DomainMismatch,
+		CodeDomainTaken:      DomainTaken,
+		CodePermitExpired:    PermitExpired,
+		CodePermitRevoked:    PermitRevoked,
+		CodeInvalidDomain:    InvalidDomain,
+		CodeInvalidRequest:   InvalidRequest,
+		CodeRequestTooLarge:  RequestTooLarge,
+		CodeUnauthorized:     Unauthorized,
+		CodeForbidden:        Forbidden,
+		CodeRateLimited:      RateLimited,
+		CodeClientBanned:     ClientBanned,
+		CodeNotFound:         NotFound,
+		CodeRevisionMismatch: RevisionMismatch,
+		CodeReadOnly:         ReadOnly,
+		CodeCursorExpired:    CursorExpired,
+		CodeServerError:      ServerError,
+	}
+)
+
+// CodeError returns typed error for the code, nil for unknown codes
+func CodeError(code string) error {
+	return catalog[code]
+}
+
+// ErrorCode returns code of the typed error (or its cause), empty for unknown errors
+func ErrorCode(err error) string {
+	err = errors.Cause(err)
+
+	for code, e := range catalog {
+		if e == err {
+			return code
+		}
+	}
+
+	return ""
+}
+
+func (e *Error) Error() string {
+	if e.Message != "" {
+		return e.Message
+	}
+
+	return e.Cause().Error()
+}
+
+// Cause returns typed error of the code
+//
+// Codes unknown to this version of the package are treated as server errors.
+func (e *Error) Cause() error {
+	if c := CodeError(e.Code); c != nil {
+		return c
+	}
+
+	return ServerError
+}
@@ -18,17 +18,28 @@ type (
 		Contact    string         `json:"contact"`
 		Entity     string         `json:"entity"`
 		Issued     time.Time      `json:"issued"`
+		Plan       string         `json:"plan,omitempty"`
+
+		// Incremented on every change, used for optimistic concurrency
+		Revision uint64 `json:"revision"`
 	}
 )
 
 const (
 	// KeyLength
 	KeyLength = 64
+
+	// Plans permits are issued under
+	PlanTrial     = "trial"
+	PlanStandard  = "standard"
+	PlanUnlimited = "unlimited"
 )
 
 var (
 	domainCheck       = regexp.MustCompile(`^([a-zA-Z0-9-_]+\.)*[a-zA-Z0-9][a-zA-Z0-9-_]+\.[a-zA-Z]{2,11}?$`)
 	PermitNotFound    = errors.New("permit not found")
+	PermitDeleted     = errors.New("permit deleted")
+	DomainTaken       = errors.New("domain already has an active permit")
 	DefaultAttributes = map[string]int{
 		"system.enabled":                 1,
 		"system.max-users":               -1,
@@ -53,6 +64,17 @@ func ValidateDomain(d string) bool {
 	return domainCheck.MatchString(d)
 }
 
+// FirstValid returns first valid permit from the list or nil if there is none
+func FirstValid(pp []*Permit) *Permit {
+	for _, p := range pp {
+		if p != nil && p.IsValid() {
+			return p
+		}
+	}
+
+	return nil
+}
+
 func (p Permit) IsValid() bool {
 	return p.Valid && !p.Expired() && ValidateDomain(p.Domain)
 }